@@ -0,0 +1,228 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	log "github.com/sirupsen/logrus"
+
+	l "gioui.org/layout"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+	"github.com/iegomez/lds/conf"
+	"github.com/iegomez/lds/lds"
+	xmat "github.com/scartill/giox/material"
+)
+
+var openHooks bool
+
+// cHooks runs the device behaviour script; appliedBehaviour is its configuration, kept to
+// reload the script only when it changes.
+var (
+	cHooks           *conf.Hooks
+	appliedBehaviour conf.Behaviour
+	hooksStop        chan struct{}
+	hookDownlinks    chan *lds.Downlink
+)
+
+// hookDownlinksBuffer is the number of downlinks that may wait for the onDownlink hook.
+const hookDownlinksBuffer = 16
+
+// hookChanges holds the hook results whose settings the next frame applies, as hooks run in
+// the background and config belongs to the UI goroutine.
+var hookChanges struct {
+	sync.Mutex
+	results []*conf.HookResult
+}
+
+var (
+	hooksCheckbox    widget.Bool
+	hooksTimerEdit   widget.Editor
+	openHooksButton  widget.Clickable
+	hooksEditor      widget.Editor
+	clearHooksButton widget.Clickable
+	closeHooksButton widget.Clickable
+)
+
+func behaviourResetGuiValues() {
+	hooksCheckbox.Value = config.Behaviour.Enabled
+	hooksTimerEdit.SetText(strconv.Itoa(config.Behaviour.TimerInterval))
+	hooksEditor.SetText(config.Behaviour.Script)
+}
+
+// behaviourWidgets reads the behaviour widgets into config and returns them for the data tab.
+func behaviourWidgets(th *material.Theme) []l.FlexChild {
+	config.Behaviour.Enabled = hooksCheckbox.Value
+	extractInt(&hooksTimerEdit, &config.Behaviour.TimerInterval, 0)
+	config.Behaviour.Script = hooksEditor.Text()
+
+	for openHooksButton.Clicked() {
+		openHooks = true
+	}
+
+	return []l.FlexChild{
+		xmat.RigidSection(th, "Behaviour"),
+		l.Rigid(func(gtx l.Context) l.Dimensions {
+			return l.Flex{Axis: l.Horizontal}.Layout(gtx,
+				xmat.RigidCheckBox(th, "Use hooks", &hooksCheckbox),
+				xmat.RigidEditor(th, "Timer interval (s)", "0", &hooksTimerEdit),
+				xmat.RigidButton(th, "Open hooks", &openHooksButton),
+			)
+		}),
+	}
+}
+
+// hooksEditorWidgets returns the hooks script editor.
+func hooksEditorWidgets(th *material.Theme) []l.FlexChild {
+	for clearHooksButton.Clicked() {
+		config.Behaviour.Script = conf.DefaultHooksScript
+		hooksEditor.SetText(config.Behaviour.Script)
+	}
+
+	for closeHooksButton.Clicked() {
+		openHooks = false
+	}
+
+	return []l.FlexChild{
+		xmat.RigidSection(th, "JS Hooks"),
+		xmat.RigidLabel(th, `If "Use hooks" is checked, onDownlink(fPort, bytes) is called with every downlink and onTimer()`),
+		xmat.RigidLabel(th, `every timer interval. They may modify the device object and call sendUplink(fPort, bytes, delayMs, confirmed).`),
+		xmat.RigidLabel(th, `Changes are applied on the next join or uplink.`),
+		xmat.RigidEditor(th, "Hooks", "JS", &hooksEditor),
+		xmat.RigidButton(th, "Clear", &clearHooksButton),
+		xmat.RigidButton(th, "Close", &closeHooksButton),
+	}
+}
+
+// setHooks reloads the behaviour script when its configuration changed and restarts the timer.
+func setHooks() {
+	if config.Behaviour == appliedBehaviour && (cHooks != nil || !config.Behaviour.Enabled) {
+		return
+	}
+
+	if hooksStop != nil {
+		close(hooksStop)
+		hooksStop = nil
+	}
+	cHooks = nil
+	hookDownlinks = nil
+	appliedBehaviour = config.Behaviour
+	if !config.Behaviour.Enabled {
+		return
+	}
+
+	hooks, err := config.NewHooks()
+	if err != nil {
+		log.Errorln(err)
+		return
+	}
+	cHooks = hooks
+	hookDownlinks = make(chan *lds.Downlink, hookDownlinksBuffer)
+	hooksStop = make(chan struct{})
+	go runHooks(hooks, time.Duration(config.Behaviour.TimerInterval)*time.Second, hookDownlinks, hooksStop)
+}
+
+// runHooks calls onTimer every interval, if any, and onDownlink with the device downlinks, one
+// at a time until stopped.
+func runHooks(hooks *conf.Hooks, interval time.Duration, downlinks <-chan *lds.Downlink, stop chan struct{}) {
+	var ticks <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+	for {
+		select {
+		case <-ticks:
+			callHook(hooks.OnTimer)
+		case dl := <-downlinks:
+			callHook(func(d *lds.Device) (*conf.HookResult, error) { return hooks.OnDownlink(d, dl) })
+		case <-stop:
+			return
+		}
+	}
+}
+
+// callHook calls a hook with the current device, which may change its counters, so its uplinks
+// wait meanwhile.
+func callHook(hook func(d *lds.Device) (*conf.HookResult, error)) {
+	uplinkMu.Lock()
+	result, err := hook(cDevice)
+	uplinkMu.Unlock()
+	sendHookUplinks(result, err)
+}
+
+// onDeviceDownlink logs the LPP downlinks and passes them to the onDownlink hook.
+func onDeviceDownlink(dl *lds.Downlink) {
+	config.LogLPPDownlink(dl)
+	if downlinks := hookDownlinks; downlinks != nil {
+		select {
+		case downlinks <- dl:
+		default:
+			log.Warnln("onDownlink hook is busy, dropping downlink")
+		}
+	}
+}
+
+// sendHookUplinks has the next frame apply the settings a hook changed and sends the uplinks it
+// requested once their delay elapses.
+func sendHookUplinks(result *conf.HookResult, err error) {
+	if err != nil {
+		log.Errorf("hook error: %s", err)
+		return
+	}
+
+	hookChanges.Lock()
+	hookChanges.results = append(hookChanges.results, result)
+	hookChanges.Unlock()
+	if window != nil {
+		window.Invalidate()
+	}
+
+	for _, u := range result.Uplinks {
+		u := u
+		time.AfterFunc(u.Delay, func() { sendHookUplink(u) })
+	}
+}
+
+func sendHookUplink(u *conf.HookUplink) {
+	if !cNSClient.IsConnected() {
+		if mqttClient == nil || !mqttClient.IsConnected() {
+			log.Errorln("Neither client is connected")
+			return
+		}
+	}
+
+	uplinkMu.Lock()
+	cDevice.Move(time.Now())
+	urx, utx := config.UplinkInfo()
+	ulfc, err := cDevice.UplinkGateways(simGateways(), u.MType(), u.FPort, urx, utx, u.Payload, config.Band.Name, config.DataRate(), nil, lorawan.FCtrl{})
+	uplinkMu.Unlock()
+	if err != nil {
+		log.Errorf("couldn't send hook uplink: %s", err)
+	} else {
+		log.Infof("hook uplink sent, uplink framecounter is now %d", ulfc)
+	}
+}
+
+// applyHookChanges applies the settings hooks changed to config and their widgets. It runs on
+// the UI goroutine before the forms read them back.
+func applyHookChanges() {
+	hookChanges.Lock()
+	results := hookChanges.results
+	hookChanges.results = nil
+	hookChanges.Unlock()
+	if len(results) == 0 {
+		return
+	}
+
+	for _, result := range results {
+		result.Apply(config)
+	}
+	fPortEditor.SetText(strconv.Itoa(config.RawPayload.FPort))
+	mTypeCombo.SelectItem(mTypes[config.Device.MType])
+	bandwidthCombo.SelectItem(strconv.Itoa(config.DR.Bandwidth))
+	spreadFactorCombo.SelectItem(strconv.Itoa(config.DR.SpreadFactor))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strconv"
+
+	l "gioui.org/layout"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+	"github.com/iegomez/lds/conf"
+	xmat "github.com/scartill/giox/material"
+)
+
+// appliedChannel is the configuration of the device's current channel, kept to preserve loss bursts.
+var appliedChannel conf.Channel
+
+var (
+	uplinkLossEdit       widget.Editor
+	downlinkLossEdit     widget.Editor
+	burstStartEdit       widget.Editor
+	burstEndEdit         widget.Editor
+	burstLossEdit        widget.Editor
+	collisionsCheckbox   widget.Bool
+	captureThresholdEdit widget.Editor
+)
+
+func channelResetGuiValues() {
+	c := &config.Channel
+	uplinkLossEdit.SetText(strconv.FormatFloat(c.UplinkLoss, 'f', -1, 64))
+	downlinkLossEdit.SetText(strconv.FormatFloat(c.DownlinkLoss, 'f', -1, 64))
+	burstStartEdit.SetText(strconv.FormatFloat(c.BurstStart, 'f', -1, 64))
+	burstEndEdit.SetText(strconv.FormatFloat(c.BurstEnd, 'f', -1, 64))
+	burstLossEdit.SetText(strconv.FormatFloat(c.BurstLoss, 'f', -1, 64))
+	collisionsCheckbox.Value = c.Collisions
+	captureThresholdEdit.SetText(strconv.FormatFloat(c.CaptureThreshold, 'f', -1, 64))
+}
+
+// channelWidgets reads the channel editors into config and returns them for the gateways tab.
+func channelWidgets(th *material.Theme) []l.FlexChild {
+	c := &config.Channel
+	extractFloat(&uplinkLossEdit, &c.UplinkLoss, 0)
+	extractFloat(&downlinkLossEdit, &c.DownlinkLoss, 0)
+	extractFloat(&burstStartEdit, &c.BurstStart, 0)
+	extractFloat(&burstEndEdit, &c.BurstEnd, 0)
+	extractFloat(&burstLossEdit, &c.BurstLoss, 1)
+	c.Collisions = collisionsCheckbox.Value
+	extractFloat(&captureThresholdEdit, &c.CaptureThreshold, 6)
+
+	return []l.FlexChild{
+		xmat.RigidLabel(th, "Channel impairments (loss probabilities from 0 to 1)"),
+		l.Rigid(func(gtx l.Context) l.Dimensions {
+			return l.Flex{Axis: l.Horizontal}.Layout(gtx,
+				xmat.RigidEditor(th, "Uplink loss", "0", &uplinkLossEdit),
+				xmat.RigidEditor(th, "Downlink loss", "0", &downlinkLossEdit),
+				xmat.RigidEditor(th, "Burst start", "0", &burstStartEdit),
+				xmat.RigidEditor(th, "Burst end", "0", &burstEndEdit),
+				xmat.RigidEditor(th, "Burst loss", "1", &burstLossEdit),
+			)
+		}),
+		l.Rigid(func(gtx l.Context) l.Dimensions {
+			return l.Flex{Axis: l.Horizontal}.Layout(gtx,
+				xmat.RigidCheckBox(th, "Collisions", &collisionsCheckbox),
+				xmat.RigidEditor(th, "Capture threshold (dB)", "6", &captureThresholdEdit),
+			)
+		}),
+	}
+}
+
+// setChannel replaces the device channel when its configuration changed.
+func setChannel() {
+	if config.Channel == appliedChannel && cDevice.Channel != nil {
+		return
+	}
+
+	cDevice.Channel = config.Channel.Build(conf.Air)
+	appliedChannel = config.Channel
+}
@@ -0,0 +1,613 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iegomez/lds/conf"
+	"github.com/iegomez/lds/lds"
+)
+
+// apiServer exposes the simulator over HTTP, driving its devices through a shared fleet.
+type apiServer struct {
+	*fleet
+	token    string
+	devices  map[lorawan.EUI64]*apiDevice
+	watchers map[chan *apiEvent]lorawan.EUI64 //Event streams, for every device when the EUI is zero.
+}
+
+// apiDevice is a device created through the API along with its settings and counters.
+type apiDevice struct {
+	device    *lds.Device
+	conf      conf.Device
+	payload   *conf.Config //Payload configuration, with generators of its own.
+	joined    chan struct{}
+	sending   bool //An uplink is being sent without the lock, so the device may not change meanwhile.
+	uplinks   uint64
+	downlinks uint64
+}
+
+// deviceRequest creates or configures a device. Settings left out keep their value, which is the
+// configured device one for new devices.
+type deviceRequest struct {
+	DevEUI        string `json:"devEUI"`
+	DevAddr       string `json:"devAddr"`
+	JoinEUI       string `json:"joinEUI"`
+	NwkKey        string `json:"nwkKey"`
+	AppKey        string `json:"appKey"`
+	AppSKey       string `json:"appSKey"`
+	NwkSEncKey    string `json:"nwkSEncKey"`
+	SNwkSIntKey   string `json:"sNwkSIntKey"`
+	FNwkSIntKey   string `json:"fNwkSIntKey"`
+	Profile       string `json:"profile"`
+	MACVersion    *int   `json:"macVersion"`
+	SkipFCntCheck *bool  `json:"skipFCntCheck"`
+	UlFcnt        *int   `json:"ulFcnt"`
+	DlFcnt        *int   `json:"dlFcnt"`
+}
+
+// uplinkRequest sends an uplink, with the configured port and payload when not given.
+type uplinkRequest struct {
+	FPort     *int   `json:"fPort"`
+	Payload   string `json:"payload"` //Hex encoded.
+	Confirmed bool   `json:"confirmed"`
+	ADR       bool   `json:"adr"`
+}
+
+// deviceState is the session and counters of a device.
+type deviceState struct {
+	DevEUI      string `json:"devEUI"`
+	DevAddr     string `json:"devAddr"`
+	JoinEUI     string `json:"joinEUI"`
+	Profile     string `json:"profile"`
+	MACVersion  int    `json:"macVersion"`
+	Joined      bool   `json:"joined"`
+	NwkSEncKey  string `json:"nwkSEncKey"`
+	SNwkSIntKey string `json:"sNwkSIntKey"`
+	FNwkSIntKey string `json:"fNwkSIntKey"`
+	AppSKey     string `json:"appSKey"`
+	UlFcnt      uint32 `json:"ulFcnt"`
+	DlFcnt      uint32 `json:"dlFcnt"`
+	DevNonce    int    `json:"devNonce"`
+	JoinNonce   int    `json:"joinNonce"`
+	Uplinks     uint64 `json:"uplinks"`
+	Downlinks   uint64 `json:"downlinks"`
+}
+
+// apiEvent is a join-accept or data downlink received by a device.
+type apiEvent struct {
+	DevEUI      string    `json:"devEUI"`
+	Time        time.Time `json:"time"`
+	MType       string    `json:"mType"`
+	FCnt        uint32    `json:"fCnt"`
+	FPort       *uint8    `json:"fPort,omitempty"`
+	ACK         bool      `json:"ack"`
+	FPending    bool      `json:"fPending"`
+	Payload     string    `json:"payload"` //Hex encoded.
+	MACCommands []string  `json:"macCommands,omitempty"`
+}
+
+func serve(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", ":8090", "address the API listens on")
+	token := fs.String("token", "", "token required as a bearer Authorization header, none when empty")
+	fs.Parse(args)
+
+	f, err := connectFleet()
+	if err != nil {
+		return err
+	}
+	defer f.transport.close()
+
+	s := &apiServer{
+		fleet:    f,
+		token:    *token,
+		devices:  map[lorawan.EUI64]*apiDevice{},
+		watchers: map[chan *apiEvent]lorawan.EUI64{},
+	}
+	f.onJoin = s.onJoin
+
+	//The configured device is available from the start.
+	d, err := newDevice()
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	s.register(d, config.Device)
+	s.Unlock()
+
+	server := &http.Server{Addr: *listen, Handler: s}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		log.Infoln("interrupted")
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	log.Infof("API listening at %s", *listen)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// register adds a device to the API and the fleet.
+func (s *apiServer) register(d *lds.Device, dev conf.Device) *apiDevice {
+	ad := &apiDevice{
+		device:  d,
+		conf:    dev,
+		payload: config.WithGenerators(),
+		joined:  make(chan struct{}, 1),
+	}
+	d.OnDownlink = func(dl *lds.Downlink) {
+		ad.downlinks++
+		config.LogLPPDownlink(dl)
+		s.publish(newDownlinkEvent(d, dl))
+	}
+	s.devices[d.DevEUI] = ad
+	s.add(d)
+	return ad
+}
+
+// onJoin is called by the fleet, with the lock held, once a device joined.
+func (s *apiServer) onJoin(d *lds.Device) {
+	ad, ok := s.devices[d.DevEUI]
+	if !ok {
+		return
+	}
+	ad.conf = withSession(ad.conf, d)
+	select {
+	case ad.joined <- struct{}{}:
+	default:
+	}
+	s.publish(&apiEvent{DevEUI: d.DevEUI.String(), Time: time.Now(), MType: lorawan.JoinAccept.String()})
+}
+
+// publish sends an event to the streams watching its device; slow streams miss events.
+func (s *apiServer) publish(e *apiEvent) {
+	for ch, devEUI := range s.watchers {
+		if devEUI != (lorawan.EUI64{}) && devEUI.String() != e.DevEUI {
+			continue
+		}
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+func newDownlinkEvent(d *lds.Device, dl *lds.Downlink) *apiEvent {
+	e := &apiEvent{
+		DevEUI:   d.DevEUI.String(),
+		Time:     dl.Time,
+		MType:    dl.MType.String(),
+		FCnt:     dl.FCnt,
+		FPort:    dl.FPort,
+		ACK:      dl.ACK,
+		FPending: dl.FPending,
+		Payload:  hex.EncodeToString(dl.Payload),
+	}
+	for _, cmd := range dl.MACCommands {
+		e.MACCommands = append(e.MACCommands, cmd.CID.String())
+	}
+	return e
+}
+
+// ServeHTTP routes the requests under /devices, and /downlinks, checking the token if any.
+func (s *apiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.token != "" && r.Header.Get("Authorization") != "Bearer "+s.token {
+		writeError(w, http.StatusUnauthorized, errors.New("invalid token"))
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "downlinks" && r.Method == http.MethodGet:
+		s.stream(w, r, lorawan.EUI64{})
+		return
+	case parts[0] != "devices" || len(parts) > 3:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	case len(parts) == 1:
+		switch r.Method {
+		case http.MethodGet:
+			s.list(w)
+		case http.MethodPost:
+			s.create(w, r)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		}
+		return
+	}
+
+	devEUI, err := lds.HexToEUI(parts[1])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.Wrap(err, "devEUI error"))
+		return
+	}
+	action := ""
+	if len(parts) == 3 {
+		action = parts[2]
+	}
+
+	if action == "downlinks" && r.Method == http.MethodGet {
+		s.stream(w, r, devEUI)
+		return
+	}
+	if action == "join" && r.Method == http.MethodPost {
+		s.joinDevice(w, r, devEUI)
+		return
+	}
+	if action == "uplink" && r.Method == http.MethodPost {
+		s.uplinkDevice(w, r, devEUI)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	ad, ok := s.devices[devEUI]
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.Errorf("device %s not found", devEUI))
+		return
+	}
+	if ad.sending && r.Method != http.MethodGet {
+		writeError(w, http.StatusConflict, errors.Errorf("device %s is sending an uplink", devEUI))
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, ad.state())
+	case action == "" && r.Method == http.MethodPut:
+		s.configure(w, r, ad)
+	case action == "" && r.Method == http.MethodDelete:
+		s.remove(ad.device)
+		ad.device.OnDownlink = nil
+		delete(s.devices, devEUI)
+		w.WriteHeader(http.StatusNoContent)
+	case action == "reset" && r.Method == http.MethodPost:
+		s.remove(ad.device)
+		if err := ad.device.Reset(); err != nil {
+			writeError(w, http.StatusInternalServerError, errors.Wrap(err, "couldn't reset device"))
+			return
+		}
+		ad.conf = withSession(ad.conf, ad.device)
+		s.add(ad.device)
+		writeJSON(w, http.StatusOK, ad.state())
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+func (s *apiServer) list(w http.ResponseWriter) {
+	s.Lock()
+	defer s.Unlock()
+
+	states := make([]*deviceState, 0, len(s.devices))
+	for _, ad := range s.devices {
+		states = append(states, ad.state())
+	}
+	writeJSON(w, http.StatusOK, states)
+}
+
+func (s *apiServer) create(w http.ResponseWriter, r *http.Request) {
+	var req deviceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errors.Wrap(err, "bad request body"))
+		return
+	}
+	if req.DevEUI == "" {
+		writeError(w, http.StatusBadRequest, errors.New("devEUI is required"))
+		return
+	}
+
+	dev := config.Device
+	req.apply(&dev)
+	d, _, err := config.WithDevice(dev).NewDevice()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := req.setCounters(d); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.devices[d.DevEUI]; ok {
+		writeError(w, http.StatusConflict, errors.Errorf("device %s already exists", d.DevEUI))
+		return
+	}
+	ad := s.register(d, dev)
+	writeJSON(w, http.StatusCreated, ad.state())
+}
+
+func (s *apiServer) configure(w http.ResponseWriter, r *http.Request, ad *apiDevice) {
+	var req deviceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errors.Wrap(err, "bad request body"))
+		return
+	}
+	if req.DevEUI != "" && !strings.EqualFold(req.DevEUI, ad.device.DevEUI.String()) {
+		writeError(w, http.StatusBadRequest, errors.New("devEUI can't be changed"))
+		return
+	}
+
+	dev := withSession(ad.conf, ad.device)
+	req.apply(&dev)
+	s.remove(ad.device)
+	err := config.WithDevice(dev).UpdateDevice(ad.device)
+	if err == nil {
+		ad.conf = dev
+		err = req.setCounters(ad.device)
+	}
+	s.add(ad.device)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, ad.state())
+}
+
+// joinDevice sends a join request and, when asked to, waits for the join-accept without holding
+// the lock, so that it may be processed.
+func (s *apiServer) joinDevice(w http.ResponseWriter, r *http.Request, devEUI lorawan.EUI64) {
+	var wait time.Duration
+	if v := r.URL.Query().Get("wait"); v != "" {
+		var err error
+		if wait, err = time.ParseDuration(v); err != nil {
+			writeError(w, http.StatusBadRequest, errors.Wrap(err, "bad wait"))
+			return
+		}
+	}
+
+	s.Lock()
+	ad, ok := s.devices[devEUI]
+	if !ok {
+		s.Unlock()
+		writeError(w, http.StatusNotFound, errors.Errorf("device %s not found", devEUI))
+		return
+	}
+	if ad.sending {
+		s.Unlock()
+		writeError(w, http.StatusConflict, errors.Errorf("device %s is sending an uplink", devEUI))
+		return
+	}
+	select {
+	case <-ad.joined:
+	default:
+	}
+	err := s.join(ad.device)
+	state := ad.state()
+	s.Unlock()
+
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	if wait == 0 {
+		writeJSON(w, http.StatusAccepted, state)
+		return
+	}
+
+	select {
+	case <-ad.joined:
+	case <-time.After(wait):
+		writeError(w, http.StatusGatewayTimeout, errors.Errorf("no join-accept received after %s", wait))
+		return
+	case <-r.Context().Done():
+		return
+	}
+
+	s.Lock()
+	state = ad.state()
+	s.Unlock()
+	writeJSON(w, http.StatusOK, state)
+}
+
+// uplinkDevice sends an uplink holding only the device lock, so that the rest of the devices
+// aren't held up by it while its downlinks wait.
+func (s *apiServer) uplinkDevice(w http.ResponseWriter, r *http.Request, devEUI lorawan.EUI64) {
+	var req uplinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errors.Wrap(err, "bad request body"))
+		return
+	}
+
+	fPort := config.RawPayload.FPort
+	if req.FPort != nil {
+		fPort = *req.FPort
+	}
+	if fPort < 0 || fPort > 255 {
+		writeError(w, http.StatusBadRequest, errors.New("fPort must be between 0 and 255"))
+		return
+	}
+
+	var payload []byte
+	var err error
+	if req.Payload != "" {
+		payload, err = hex.DecodeString(req.Payload)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errors.Wrap(err, "couldn't decode hex payload"))
+			return
+		}
+	}
+
+	s.Lock()
+	ad, ok := s.devices[devEUI]
+	if !ok {
+		s.Unlock()
+		writeError(w, http.StatusNotFound, errors.Errorf("device %s not found", devEUI))
+		return
+	}
+	if ad.sending {
+		s.Unlock()
+		writeError(w, http.StatusConflict, errors.Errorf("device %s is sending an uplink", devEUI))
+		return
+	}
+	if payload == nil {
+		if payload, err = ad.payload.Payload(ad.device); err != nil {
+			s.Unlock()
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	ad.sending = true
+	mu := s.lockDevice(ad.device)
+	s.Unlock()
+
+	mType := lorawan.UnconfirmedDataUp
+	if req.Confirmed {
+		mType = lorawan.ConfirmedDataUp
+	}
+	fCnt, err := s.uplink(ad.device, mType, uint8(fPort), payload, lorawan.FCtrl{ADR: req.ADR})
+	mu.Unlock()
+
+	s.Lock()
+	ad.sending = false
+	if err == nil {
+		ad.uplinks++
+	}
+	s.Unlock()
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]uint32{"fCnt": fCnt})
+}
+
+// stream writes the downlinks of a device, or of every device when devEUI is zero, as JSON lines
+// until the client goes away.
+func (s *apiServer) stream(w http.ResponseWriter, r *http.Request, devEUI lorawan.EUI64) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming unsupported"))
+		return
+	}
+
+	events := make(chan *apiEvent, 32)
+	s.Lock()
+	s.watchers[events] = devEUI
+	s.Unlock()
+	defer func() {
+		s.Lock()
+		delete(s.watchers, events)
+		s.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case e := <-events:
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// apply overrides the device settings with the ones given.
+func (req *deviceRequest) apply(dev *conf.Device) {
+	set := func(field *string, value string) {
+		if value != "" {
+			*field = value
+		}
+	}
+	set(&dev.DevEUI, req.DevEUI)
+	set(&dev.DevAddress, req.DevAddr)
+	set(&dev.JoinEUI, req.JoinEUI)
+	set(&dev.NwkKey, req.NwkKey)
+	set(&dev.AppKey, req.AppKey)
+	set(&dev.AppSKey, req.AppSKey)
+	set(&dev.NwkSEncKey, req.NwkSEncKey)
+	set(&dev.SNwkSIntKey, req.SNwkSIntKey)
+	set(&dev.FNwkSIntKey, req.FNwkSIntKey)
+	set(&dev.Profile, strings.ToUpper(req.Profile))
+	if req.MACVersion != nil {
+		dev.MACVersion = lorawan.MACVersion(*req.MACVersion)
+	}
+	if req.SkipFCntCheck != nil {
+		dev.SkipFCntCheck = *req.SkipFCntCheck
+	}
+}
+
+// setCounters sets the frame counters given.
+func (req *deviceRequest) setCounters(d *lds.Device) error {
+	if req.UlFcnt == nil && req.DlFcnt == nil {
+		return nil
+	}
+	ulFcnt, dlFcnt := int(d.UlFcnt), int(d.DlFcnt)
+	if req.UlFcnt != nil {
+		ulFcnt = *req.UlFcnt
+	}
+	if req.DlFcnt != nil {
+		dlFcnt = *req.DlFcnt
+	}
+	if err := d.SetValues(ulFcnt, dlFcnt, int(d.DevNonce), int(d.JoinNonce)); err != nil {
+		return errors.Wrap(err, "couldn't set counters")
+	}
+	return nil
+}
+
+func (ad *apiDevice) state() *deviceState {
+	d := ad.device
+	return &deviceState{
+		DevEUI:      d.DevEUI.String(),
+		DevAddr:     lds.DevAddressToHex(d.DevAddr),
+		JoinEUI:     d.JoinEUI.String(),
+		Profile:     d.Profile,
+		MACVersion:  int(d.MACVersion),
+		Joined:      d.Joined,
+		NwkSEncKey:  lds.KeyToHex(d.NwkSEncKey),
+		SNwkSIntKey: lds.KeyToHex(d.SNwkSIntKey),
+		FNwkSIntKey: lds.KeyToHex(d.FNwkSIntKey),
+		AppSKey:     lds.KeyToHex(d.AppSKey),
+		UlFcnt:      d.UlFcnt,
+		DlFcnt:      d.DlFcnt,
+		DevNonce:    int(d.DevNonce),
+		JoinNonce:   int(d.JoinNonce),
+		Uplinks:     ad.uplinks,
+		Downlinks:   ad.downlinks,
+	}
+}
+
+// withSession returns the device settings with the current session of the device.
+func withSession(dev conf.Device, d *lds.Device) conf.Device {
+	c := config.WithDevice(dev)
+	c.SetSession(d)
+	return c.Device
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("API response error: %s", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
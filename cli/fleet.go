@@ -0,0 +1,237 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iegomez/lds/lds"
+)
+
+// joinAcceptWait is how long a device waits for its join-accept before the next device with its
+// root key may join. Join-accepts come at most 6 seconds after the join request.
+const joinAcceptWait = 10 * time.Second
+
+// fleet drives several devices through a single set of gateway connections, routing each
+// downlink to the device it's meant for. Devices are guarded by the fleet mutex, or by their own
+// one while they send without the fleet one.
+type fleet struct {
+	sync.Mutex
+	byAddr    map[lorawan.DevAddr]*lds.Device
+	joining   []*lds.Device //In the order their join requests were sent, one per root key.
+	queued    []*lds.Device //Waiting for the device joining with their root key.
+	timeouts  map[*lds.Device]*time.Timer
+	sending   map[*lds.Device]*sync.Mutex
+	transport *transport
+	gateways  []*lds.Gateway
+
+	onJoinSent func(d *lds.Device, err error) //Called with the lock held once a join request was sent or failed.
+	onJoin     func(d *lds.Device)            //Called with the lock held once a device joined.
+	onError    func(err error)                //Called with every downlink error.
+}
+
+// connectFleet connects the configured gateways.
+func connectFleet() (*fleet, error) {
+	f := &fleet{
+		byAddr:   map[lorawan.DevAddr]*lds.Device{},
+		timeouts: map[*lds.Device]*time.Timer{},
+		sending:  map[*lds.Device]*sync.Mutex{},
+	}
+	var err error
+	f.transport, err = connect(config, *transKind, f.onDownlink)
+	if err != nil {
+		return nil, err
+	}
+	f.gateways = f.transport.gateways()
+	return f, nil
+}
+
+// add makes the device receive its data downlinks once it has a session.
+func (f *fleet) add(d *lds.Device) {
+	if d.Profile == "ABP" || d.Joined {
+		f.byAddr[d.DevAddr] = d
+	}
+}
+
+// remove stops routing downlinks to the device.
+func (f *fleet) remove(d *lds.Device) {
+	for addr, other := range f.byAddr {
+		if other == d {
+			delete(f.byAddr, addr)
+		}
+	}
+	f.joining = without(f.joining, d)
+	f.queued = without(f.queued, d)
+	if t, ok := f.timeouts[d]; ok {
+		t.Stop()
+		delete(f.timeouts, d)
+	}
+}
+
+func without(devices []*lds.Device, d *lds.Device) []*lds.Device {
+	for i, other := range devices {
+		if other == d {
+			return append(devices[:i], devices[i+1:]...)
+		}
+	}
+	return devices
+}
+
+// join sends a join request of the device, or queues it while another device with the same root
+// key waits for its join-accept: their join-accepts validate with either device, as the MIC
+// covers neither the DevEUI nor, for LoRaWAN 1.0, the DevNonce.
+func (f *fleet) join(d *lds.Device) error {
+	f.remove(d)
+	for _, other := range f.joining {
+		if other.NwkKey == d.NwkKey {
+			log.Debugf("device %s join queued behind device %s", d.DevEUI, other.DevEUI)
+			f.queued = append(f.queued, d)
+			return nil
+		}
+	}
+	return f.sendJoin(d)
+}
+
+func (f *fleet) sendJoin(d *lds.Device) error {
+	urx, utx := config.UplinkInfo()
+	err := d.JoinGateways(f.gateways, urx, utx)
+	if f.onJoinSent != nil {
+		f.onJoinSent(d, err)
+	}
+	if err != nil {
+		return errors.Wrap(err, "join error")
+	}
+	f.joining = append(f.joining, d)
+
+	var t *time.Timer
+	t = time.AfterFunc(joinAcceptWait, func() {
+		f.Lock()
+		defer f.Unlock()
+		if f.timeouts[d] != t {
+			return
+		}
+		log.Warnf("device %s got no join-accept", d.DevEUI)
+		f.remove(d)
+		go f.joinNext(d.NwkKey)
+	})
+	f.timeouts[d] = t
+	return nil
+}
+
+// joinNext sends the join request of the first device queued with the given root key.
+func (f *fleet) joinNext(key lorawan.AES128Key) {
+	f.Lock()
+	defer f.Unlock()
+	for _, d := range f.queued {
+		if d.NwkKey != key {
+			continue
+		}
+		f.queued = without(f.queued, d)
+		if err := f.sendJoin(d); err != nil {
+			log.Errorf("device %s: %s", d.DevEUI, err)
+			go f.joinNext(key)
+		}
+		return
+	}
+}
+
+// lockDevice returns the locked mutex of a device, letting it send without the fleet lock while
+// its downlinks wait. The fleet lock must be held.
+func (f *fleet) lockDevice(d *lds.Device) *sync.Mutex {
+	mu, ok := f.sending[d]
+	if !ok {
+		mu = &sync.Mutex{}
+		f.sending[d] = mu
+	}
+	mu.Lock()
+	return mu
+}
+
+// uplink sends a data uplink of the device with the configured rx and tx info.
+func (f *fleet) uplink(d *lds.Device, mType lorawan.MType, fPort uint8, payload []byte, fCtrl lorawan.FCtrl) (uint32, error) {
+	urx, utx := config.UplinkInfo()
+	fCnt, err := d.UplinkGateways(f.gateways, mType, fPort, urx, utx, payload, config.Band.Name, config.DataRate(), nil, fCtrl)
+	if err != nil {
+		return 0, errors.Wrap(err, "couldn't send uplink")
+	}
+	return fCnt, nil
+}
+
+// onDownlink hands data downlinks to the device with their DevAddr, and join-accepts to the
+// device waiting for one whose keys validate it. Devices sharing their root key join one at a
+// time, so a single waiting device validates a join-accept.
+func (f *fleet) onDownlink(payload []byte) error {
+	err := f.route(payload)
+	if err != nil && f.onError != nil {
+		f.onError(err)
+	}
+	return err
+}
+
+func (f *fleet) route(payload []byte) error {
+	phy, ok, err := lds.DownlinkPHYPayload(payload, f.transport.isMQTT())
+	if err != nil || !ok {
+		return err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	if phy.MHDR.MType == lorawan.JoinAccept {
+		d := f.joinAcceptDevice(phy)
+		if d == nil {
+			return errors.Wrap(lds.ErrJoinMIC, "no device waiting for a join-accept validates it")
+		}
+		if _, err := d.ProcessDownlink(payload, d.MACVersion, f.transport.isMQTT()); err != nil {
+			return errors.Wrapf(err, "device %s", d.DevEUI)
+		}
+		if !d.Joined {
+			//The join-accept was lost on the channel.
+			return nil
+		}
+		f.remove(d)
+		f.byAddr[d.DevAddr] = d
+		log.Infof("device %s joined with DevAddr %s", d.DevEUI, d.DevAddr)
+		if f.onJoin != nil {
+			f.onJoin(d)
+		}
+		go f.joinNext(d.NwkKey)
+		return nil
+	}
+
+	macPayload, ok := phy.MACPayload.(*lorawan.MACPayload)
+	if !ok {
+		return nil
+	}
+	d, ok := f.byAddr[macPayload.FHDR.DevAddr]
+	if !ok {
+		log.Debugf("downlink for unknown DevAddr %s ignored", macPayload.FHDR.DevAddr)
+		return nil
+	}
+	if mu, ok := f.sending[d]; ok {
+		mu.Lock()
+		defer mu.Unlock()
+	}
+	if _, err := d.ProcessDownlink(payload, d.MACVersion, f.transport.isMQTT()); err != nil {
+		return errors.Wrapf(err, "device %s", d.DevEUI)
+	}
+	return nil
+}
+
+// joinAcceptDevice returns the joining device whose keys validate a join-accept, if any, without
+// changing the devices.
+func (f *fleet) joinAcceptDevice(phy lorawan.PHYPayload) *lds.Device {
+	phyBytes, err := phy.MarshalBinary()
+	if err != nil {
+		return nil
+	}
+	for _, d := range f.joining {
+		if frame, err := d.DecodeFrame(phyBytes, lds.FrameContext{}); err == nil && frame.MICValid {
+			return d
+		}
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/brocaar/lorawan"
+	"github.com/pkg/errors"
+
+	"github.com/iegomez/lds/conf"
+	"github.com/iegomez/lds/lds"
+)
+
+// sessionFlags override the configured device session for the offline frame commands.
+type sessionFlags struct {
+	devAddr, nwkKey, appSKey, nwkSEncKey, sNwkSIntKey, fNwkSIntKey *string
+	macVersion, ulFcnt, dlFcnt, devNonce                           *int
+}
+
+func addSessionFlags(fs *flag.FlagSet) *sessionFlags {
+	return &sessionFlags{
+		devAddr:     fs.String("devaddr", "", "DevAddr, the configured one when empty"),
+		nwkKey:      fs.String("nwkkey", "", "NwkKey, the configured one when empty"),
+		appSKey:     fs.String("appskey", "", "AppSKey, the configured one when empty"),
+		nwkSEncKey:  fs.String("nwksenckey", "", "NwkSEncKey, the configured one when empty"),
+		sNwkSIntKey: fs.String("snwksintkey", "", "SNwkSIntKey, the configured one when empty"),
+		fNwkSIntKey: fs.String("fnwksintkey", "", "FNwkSIntKey, the configured one when empty"),
+		macVersion:  fs.Int("macversion", -1, "LoRaWAN version, 0 for 1.0 and 1 for 1.1, the configured one when negative"),
+		ulFcnt:      fs.Int("ulfcnt", -1, "uplink frame counter, the device one when negative"),
+		dlFcnt:      fs.Int("dlfcnt", -1, "downlink frame counter, the device one when negative"),
+		devNonce:    fs.Int("devnonce", -1, "DevNonce, the device one when negative"),
+	}
+}
+
+// device builds the configured device with the session given by the flags.
+func (sf *sessionFlags) device() (*lds.Device, error) {
+	dev := config.Device
+	set := func(field *string, value string) {
+		if value != "" {
+			*field = value
+		}
+	}
+	set(&dev.DevAddress, *sf.devAddr)
+	set(&dev.NwkKey, *sf.nwkKey)
+	set(&dev.AppSKey, *sf.appSKey)
+	set(&dev.NwkSEncKey, *sf.nwkSEncKey)
+	set(&dev.SNwkSIntKey, *sf.sNwkSIntKey)
+	set(&dev.FNwkSIntKey, *sf.fNwkSIntKey)
+	if *sf.macVersion >= 0 {
+		dev.MACVersion = lorawan.MACVersion(*sf.macVersion)
+	}
+
+	d, _, err := config.WithDevice(dev).NewDevice()
+	if err != nil {
+		return nil, err
+	}
+	//Keys given on the command line win over the ones restored from redis.
+	if err := sf.override(d, dev); err != nil {
+		return nil, err
+	}
+	if *sf.ulFcnt >= 0 {
+		d.UlFcnt = uint32(*sf.ulFcnt)
+	}
+	if *sf.dlFcnt >= 0 {
+		d.DlFcnt = uint32(*sf.dlFcnt)
+	}
+	if *sf.devNonce >= 0 {
+		d.DevNonce = lorawan.DevNonce(*sf.devNonce)
+	}
+	return d, nil
+}
+
+func (sf *sessionFlags) override(d *lds.Device, dev conf.Device) error {
+	keys := []struct {
+		flag, value string
+		key         *lorawan.AES128Key
+	}{
+		{*sf.appSKey, dev.AppSKey, &d.AppSKey},
+		{*sf.nwkSEncKey, dev.NwkSEncKey, &d.NwkSEncKey},
+		{*sf.sNwkSIntKey, dev.SNwkSIntKey, &d.SNwkSIntKey},
+		{*sf.fNwkSIntKey, dev.FNwkSIntKey, &d.FNwkSIntKey},
+	}
+	for _, k := range keys {
+		if k.flag == "" {
+			continue
+		}
+		key, err := lds.HexToKey(k.value)
+		if err != nil {
+			return errors.Wrap(err, "key error")
+		}
+		*k.key = key
+	}
+	if *sf.devAddr != "" {
+		devAddr, err := lds.HexToDevAddress(dev.DevAddress)
+		if err != nil {
+			return errors.Wrap(err, "devAddr error")
+		}
+		d.DevAddr = devAddr
+	}
+	return nil
+}
+
+func decode(args []string) error {
+	fs := flag.NewFlagSet("decode", flag.ExitOnError)
+	sf := addSessionFlags(fs)
+	confFCnt := fs.Int("conffcnt", -1, "FCnt of the uplink acknowledged by a downlink, ulfcnt - 1 when negative")
+	txDR := fs.Int("dr", 0, "data rate index of a LoRaWAN 1.1 uplink")
+	txCh := fs.Int("ch", 0, "channel index of a LoRaWAN 1.1 uplink")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: decode [options] <hex or base64 PHYPayload>\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("a PHYPayload is required")
+	}
+	phyBytes, err := lds.ParsePHYPayload(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	d, err := sf.device()
+	if err != nil {
+		return err
+	}
+	ctx := lds.FrameContext{TxDR: uint8(*txDR), TxCh: uint8(*txCh)}
+	if *confFCnt >= 0 {
+		ctx.ConfFCnt = uint32(*confFCnt)
+	} else if d.UlFcnt > 0 {
+		ctx.ConfFCnt = d.UlFcnt - 1
+	}
+
+	frame, err := d.DecodeFrame(phyBytes, ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Print(frame)
+
+	//Tell what an invalid downlink MIC would have validated with.
+	if frame.MICChecked && !frame.MICValid && !frame.Uplink {
+		diag, err := d.DiagnoseMIC(phyBytes)
+		if err != nil {
+			return err
+		}
+		fmt.Print(diag)
+	}
+	return nil
+}
+
+func build(args []string) error {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	sf := addSessionFlags(fs)
+	mTypeName := fs.String("mtype", "", "message type: join, unconfirmed or confirmed, the configured one when empty")
+	fPort := fs.Int("fport", config.RawPayload.FPort, "uplink FPort")
+	payloadHex := fs.String("payload", "", "hex payload, the configured one when empty")
+	adr := fs.Bool("adr", false, "set the ADR bit")
+	fs.Parse(args)
+
+	d, err := sf.device()
+	if err != nil {
+		return err
+	}
+
+	var phyBytes []byte
+	switch strings.ToLower(*mTypeName) {
+	case "join":
+		phyBytes, err = d.BuildJoinRequest()
+	case "", "unconfirmed", "confirmed":
+		mType := config.Device.MType
+		if *mTypeName != "" {
+			mType = lorawan.UnconfirmedDataUp
+			if strings.EqualFold(*mTypeName, "confirmed") {
+				mType = lorawan.ConfirmedDataUp
+			}
+		}
+		var payload []byte
+		if *payloadHex != "" {
+			payload, err = hex.DecodeString(*payloadHex)
+		} else {
+			payload, err = config.Payload(d)
+		}
+		if err != nil {
+			return errors.Wrap(err, "payload error")
+		}
+		_, utx := config.UplinkInfo()
+		phyBytes, err = d.BuildUplink(mType, uint8(*fPort), utx, payload, config.Band.Name, config.DataRate(), nil, lorawan.FCtrl{ADR: *adr})
+	default:
+		return errors.Errorf("unknown message type %q", *mTypeName)
+	}
+	if err != nil {
+		return errors.Wrap(err, "couldn't build frame")
+	}
+
+	fmt.Printf("Base64:     %s\nHex:        %s\n", base64.StdEncoding.EncodeToString(phyBytes), hex.EncodeToString(phyBytes))
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"time"
+
+	"github.com/brocaar/lorawan"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iegomez/lds/conf"
+	"github.com/iegomez/lds/lds"
+)
+
+// startHooks loads the behaviour script when enabled and calls onTimer every timer interval
+// until the sim is closed.
+func (s *sim) startHooks() error {
+	if !config.Behaviour.Enabled {
+		return nil
+	}
+
+	var err error
+	s.hooks, err = config.NewHooks()
+	if err != nil {
+		return err
+	}
+	if config.Behaviour.TimerInterval <= 0 {
+		return nil
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(config.Behaviour.TimerInterval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.Lock()
+				result, err := s.hooks.OnTimer(s.device)
+				s.apply(result, err)
+				s.Unlock()
+				s.schedule(result, err)
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// hookDownlink passes a downlink to the onDownlink hook. It's called with the device locked.
+func (s *sim) hookDownlink(dl *lds.Downlink) {
+	if s.hooks != nil {
+		result, err := s.hooks.OnDownlink(s.device, dl)
+		s.apply(result, err)
+		s.schedule(result, err)
+	}
+}
+
+// apply writes the uplink settings a hook changed to the configuration. It's called with the
+// device locked, as uplinks read them.
+func (s *sim) apply(result *conf.HookResult, err error) {
+	if err == nil {
+		result.Apply(config)
+	}
+}
+
+// schedule sends the uplinks requested by a hook once their delay elapses.
+func (s *sim) schedule(result *conf.HookResult, err error) {
+	if err != nil {
+		log.Errorf("hook error: %s", err)
+		return
+	}
+	for _, u := range result.Uplinks {
+		u := u
+		time.AfterFunc(u.Delay, func() {
+			if err := s.sendUplink(u.MType(), u.FPort, u.Payload, lorawan.FCtrl{}); err != nil {
+				log.Errorf("hook uplink error: %s", err)
+			}
+		})
+	}
+}
+
+// close stops the hooks timer and disconnects the gateways.
+func (s *sim) close() {
+	close(s.stop)
+	s.transport.close()
+}
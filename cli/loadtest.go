@@ -0,0 +1,267 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iegomez/lds/conf"
+	"github.com/iegomez/lds/lds"
+)
+
+// loadTest drives a fleet of devices and collects metrics about their traffic.
+type loadTest struct {
+	*fleet
+	devices  []*lds.Device
+	payloads map[*lds.Device]*conf.Config //Payload configuration of every device.
+	busy     map[*lds.Device]bool         //Devices sending an uplink.
+	metrics  *lds.Metrics
+}
+
+func loadtest(args []string) error {
+	fs := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	devices := fs.Int("devices", 10, "number of devices, copies of the configured one with consecutive DevEUIs and DevAddrs")
+	fleetFile := fs.String("fleet", config.Provisioner.Path, "provisioner CSV file listing the devices, used instead of -devices")
+	rate := fs.Float64("rate", 1, "uplinks per second across the fleet, also used to pace join requests")
+	duration := fs.Duration("duration", time.Minute, "time sending uplinks")
+	joinTimeout := fs.Duration("join-timeout", 10*time.Second, "time to wait for the last join-accepts before sending uplinks")
+	wait := fs.Duration("wait", 5*time.Second, "time to wait for downlinks after the last uplink")
+	confirmed := fs.Bool("confirmed", config.Device.MType == lorawan.ConfirmedDataUp, "send confirmed uplinks")
+	fPort := fs.Int("fport", config.RawPayload.FPort, "uplink FPort")
+	report := fs.String("report", "", "file the report is written to, as CSV when its extension is .csv and as JSON otherwise")
+	fs.Parse(args)
+
+	if *rate <= 0 {
+		return errors.New("rate must be positive")
+	}
+
+	fleetDevices, err := config.Fleet(*fleetFile, *devices)
+	if err != nil {
+		return err
+	}
+	log.Infof("load testing %d devices at %g uplinks/s for %s", len(fleetDevices), *rate, *duration)
+
+	f, err := connectFleet()
+	if err != nil {
+		return err
+	}
+	defer f.transport.close()
+
+	lt := &loadTest{
+		fleet:    f,
+		devices:  fleetDevices,
+		payloads: map[*lds.Device]*conf.Config{},
+		busy:     map[*lds.Device]bool{},
+		metrics:  lds.NewMetrics(),
+	}
+	f.onJoinSent = func(d *lds.Device, err error) {
+		if err != nil {
+			lt.metrics.TransportErrors(1)
+			return
+		}
+		lt.metrics.JoinSent(d.DevEUI)
+	}
+	f.onJoin = func(d *lds.Device) {
+		lt.metrics.JoinAccepted(d.DevEUI)
+	}
+	f.onError = lt.metrics.DownlinkError
+	for _, d := range fleetDevices {
+		d := d
+		lt.payloads[d] = config.WithGenerators()
+		d.OnDownlink = func(dl *lds.Downlink) {
+			lt.metrics.DownlinkReceived(d.DevEUI, dl.ACK)
+		}
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+	defer ticker.Stop()
+
+	if !lt.join(ticker, interrupt, *joinTimeout) {
+		return lt.report(*report)
+	}
+
+	mType := lorawan.UnconfirmedDataUp
+	if *confirmed {
+		mType = lorawan.ConfirmedDataUp
+	}
+	lt.uplinks(ticker, interrupt, *duration, mType, uint8(*fPort))
+
+	select {
+	case <-time.After(*wait):
+	case <-interrupt:
+	}
+	return lt.report(*report)
+}
+
+// join sends a join request for every OTAA device not joined yet and waits for their join-accepts.
+// Devices sharing their root key join one after the other. It returns false when interrupted.
+func (lt *loadTest) join(ticker *time.Ticker, interrupt chan os.Signal, timeout time.Duration) bool {
+	for _, d := range lt.devices {
+		lt.Lock()
+		if d.Profile == "ABP" || d.Joined {
+			lt.add(d)
+			lt.Unlock()
+			continue
+		}
+		if err := lt.fleet.join(d); err != nil {
+			log.Errorf("device %s: %s", d.DevEUI, err)
+		}
+		lt.Unlock()
+
+		select {
+		case <-ticker.C:
+		case <-interrupt:
+			log.Infoln("interrupted")
+			return false
+		}
+	}
+
+	deadline := time.After(timeout)
+	for {
+		lt.Lock()
+		pending := len(lt.joining) + len(lt.queued)
+		lt.Unlock()
+		if pending == 0 {
+			return true
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			log.Warnf("%d devices didn't join", pending)
+			return true
+		case <-interrupt:
+			log.Infoln("interrupted")
+			return false
+		}
+	}
+}
+
+// uplinks sends uplinks from the joined devices in turn, one per tick, during the given time.
+// Uplinks are sent concurrently, a device skipping its turn while its previous uplink is sent.
+func (lt *loadTest) uplinks(ticker *time.Ticker, interrupt chan os.Signal, duration time.Duration, mType lorawan.MType, fPort uint8) {
+	lt.Lock()
+	active := make([]*lds.Device, 0, len(lt.byAddr))
+	for _, d := range lt.devices {
+		if d.Profile == "ABP" || d.Joined {
+			active = append(active, d)
+		}
+	}
+	lt.Unlock()
+	if len(active) == 0 {
+		log.Warnln("no device joined, no uplinks will be sent")
+		return
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	end := time.After(duration)
+	for i := 0; ; i++ {
+		d := active[i%len(active)]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := lt.sendUplink(d, mType, fPort); err != nil {
+				log.Errorf("device %s: %s", d.DevEUI, err)
+			}
+		}()
+
+		select {
+		case <-ticker.C:
+		case <-end:
+			return
+		case <-interrupt:
+			log.Infoln("interrupted")
+			return
+		}
+	}
+}
+
+// sendUplink builds the device payload with the fleet locked and sends it with only the device
+// locked, so that other devices send and downlinks are routed meanwhile.
+func (lt *loadTest) sendUplink(d *lds.Device, mType lorawan.MType, fPort uint8) error {
+	lt.Lock()
+	if lt.busy[d] {
+		lt.Unlock()
+		return errors.New("previous uplink still being sent, skipped")
+	}
+	payload, err := lt.payloads[d].Payload(d)
+	if err != nil {
+		lt.Unlock()
+		return err
+	}
+	lt.busy[d] = true
+	mu := lt.lockDevice(d)
+	lt.Unlock()
+
+	//The uplink is recorded before its downlinks may be routed.
+	_, err = lt.uplink(d, mType, fPort, payload, lorawan.FCtrl{})
+	if err != nil {
+		lt.metrics.TransportErrors(1)
+	} else {
+		lt.metrics.UplinkSent(d.DevEUI, mType == lorawan.ConfirmedDataUp)
+	}
+	mu.Unlock()
+
+	lt.Lock()
+	delete(lt.busy, d)
+	lt.Unlock()
+	return err
+}
+
+// report adds the missed acks to the metrics, prints the summary and writes the report file.
+func (lt *loadTest) report(file string) error {
+	lt.metrics.TransportErrors(lt.transport.missedAcks())
+	r := lt.metrics.Report()
+
+	fmt.Printf("Duration:          %.1f s\n", r.Duration)
+	fmt.Printf("Joins:             %d/%d (%.1f%%)\n", r.JoinAccepts, r.JoinRequests, r.JoinSuccessRate*100)
+	fmt.Printf("Uplinks:           %d (%.2f/s)\n", r.Uplinks, r.UplinkRate)
+	fmt.Printf("Acks:              %d/%d (%.1f%%)\n", r.Acks, r.ConfirmedUplinks, r.AckRate*100)
+	fmt.Printf("Downlinks:         %d\n", r.Downlinks)
+	fmt.Printf("MIC failures:      %d\n", r.MICFailures)
+	fmt.Printf("Downlink errors:   %d\n", r.DownlinkErrors)
+	fmt.Printf("Transport errors:  %d\n", r.TransportErrors)
+	printLatency("Join latency:", r.JoinLatency)
+	printLatency("Downlink RTT:", r.DownlinkRTT)
+
+	if file == "" {
+		return nil
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return errors.Wrap(err, "couldn't create report")
+	}
+	defer f.Close()
+
+	if strings.EqualFold(filepath.Ext(file), ".csv") {
+		err = r.WriteCSV(f)
+	} else {
+		err = r.WriteJSON(f)
+	}
+	if err != nil {
+		return errors.Wrap(err, "couldn't write report")
+	}
+	log.Infof("report written to %s", file)
+	return nil
+}
+
+func printLatency(name string, s lds.LatencyStats) {
+	if s.Count == 0 {
+		fmt.Printf("%-18s no samples\n", name)
+		return
+	}
+	fmt.Printf("%-18s p50 %.0f ms, p90 %.0f ms, p95 %.0f ms, p99 %.0f ms (min %.0f, mean %.0f, max %.0f, %d samples)\n",
+		name, s.P50, s.P90, s.P95, s.P99, s.Min, s.Mean, s.Max, s.Count)
+}
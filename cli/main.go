@@ -1,287 +1,441 @@
+// Command cli runs the simulated device headless, using the same conf files as the GUI.
 package main
 
 import (
 	"encoding/hex"
 	"flag"
-	"math/rand"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
 	"time"
 
-	"github.com/BurntSushi/toml"
-	"github.com/brocaar/loraserver/api/gw"
 	"github.com/brocaar/lorawan"
-	lwband "github.com/brocaar/lorawan/band"
-	MQTT "github.com/eclipse/paho.mqtt.golang"
-	"github.com/golang/protobuf/ptypes"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/iegomez/lds/conf"
 	"github.com/iegomez/lds/lds"
+	"github.com/iegomez/lds/scenario"
 )
 
-type mqtt struct {
-	Server   string `toml:"server"`
-	User     string `toml:"user"`
-	Password string `toml:"password"`
-}
+const usage = `Usage: %s [options] <command> [command options]
+
+Commands:
+  join     send a join request and wait for the join-accept
+  uplink   send a single uplink
+  run      send uplinks periodically until interrupted or the count is reached
+  status   print the device session (keys, counters and nonces)
+  set      set the device counters and nonces
+  reset    clear the device session
+  scenario run scenario files and report their results
+  loadtest drive a fleet of devices at a target uplink rate and report the metrics
+  serve    serve an HTTP API to create and drive devices remotely
+  replay   re-send the uplinks of a capture file
+  pcap     convert a capture file to a LoRaTap pcap file
+  decode   decode a PHYPayload offline with the device session
+  build    build an uplink or join request offline without sending it
+
+Run "%s <command> -h" for the command options.
+
+Options:
+`
+
+var (
+	confFile  *string
+	transKind *string
+	capture   *string
+	pcapFile  *string
+	config    *conf.Config
+)
 
-type gateway struct {
-	MAC string `toml:"mac"`
+// sim is the simulated device with its connections; downlinks may arrive at any time so the
+// device is guarded by a mutex.
+type sim struct {
+	sync.Mutex
+	device    *lds.Device
+	transport *transport
+	joined    chan struct{}
+	downlinks chan string
+	runner    *scenario.Runner
+	hooks     *conf.Hooks
+	stop      chan struct{}
 }
 
-type band struct {
-	Name lwband.Name `toml:"name"`
-}
+func main() {
+	confFile = flag.String("conf", "conf.toml", "path to toml configuration file")
+	transKind = flag.String("transport", autoTransport, "network server transport: mqtt, udp or auto (mqtt when a broker is configured)")
+	capture = flag.String("capture", "", "JSON lines file uplinks and downlinks are appended to, overriding the capture path")
+	pcapFile = flag.String("pcap", "", "LoRaTap pcap file gateway frames are appended to, overriding the capture pcap")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), usage, os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
 
-type device struct {
-	EUI         string             `toml:"eui"`
-	Address     string             `toml:"address"`
-	NwkSEncKey  string             `toml:"network_session_encription_key"`
-	SNwkSIntKey string             `toml:"serving_network_session_integrity_key"`    //For Lorawan 1.0 this is the same as the NwkSEncKey
-	FNwkSIntKey string             `toml:"forwarding_network_session_integrity_key"` //For Lorawan 1.0 this is the same as the NwkSEncKey
-	AppSKey     string             `toml:"application_session_key"`
-	Marshaler   string             `toml:"marshaler"`
-	NwkKey      string             `toml:"nwk_key"`     //Network key, used to be called application key for Lorawan 1.0
-	AppKey      string             `toml:"app_key"`     //Application key, for Lorawan 1.1
-	Major       lorawan.Major      `toml:"major"`       //Lorawan major version
-	MACVersion  lorawan.MACVersion `toml:"mac_version"` //Lorawan MAC version
-	MType       lorawan.MType      `toml:"mtype"`       //LoRaWAN mtype (ConfirmedDataUp or UnconfirmedDataUp)
-}
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
 
-type dataRate struct {
-	Bandwith     int `toml:"bandwith"`
-	SpreadFactor int `toml:"spread_factor"`
-	BitRate      int `toml:"bit_rate"`
-}
+	config = conf.New()
+	if err := config.Load(*confFile); err != nil {
+		log.Fatalf("couldn't load conf file: %s", err)
+	}
+	config.Setup()
+	config.ServePrometheus()
+	if *capture != "" {
+		config.Capture.Path = *capture
+	}
+	if *pcapFile != "" {
+		config.Capture.Pcap = *pcapFile
+	}
+	if err := config.StartCapture(); err != nil {
+		log.Fatalln(err)
+	}
 
-type rxInfo struct {
-	Channel   int     `toml:"channel"`
-	CodeRate  string  `toml:"code_rate"`
-	CrcStatus int     `toml:"crc_status"`
-	Frequency int     `toml:"frequency"`
-	LoRaSNR   float64 `toml:"lora_snr"`
-	RfChain   int     `toml:"rf_chain"`
-	Rssi      int     `toml:"rssi"`
-}
+	commands := map[string]func(args []string) error{
+		"join":     join,
+		"uplink":   uplink,
+		"run":      run,
+		"status":   status,
+		"set":      set,
+		"reset":    reset,
+		"scenario": runScenarios,
+		"loadtest": loadtest,
+		"serve":    serve,
+		"replay":   replay,
+		"pcap":     pcap,
+		"decode":   decode,
+		"build":    build,
+	}
 
-type tomlConfig struct {
-	MQTT        mqtt        `toml:"mqtt"`
-	Band        band        `toml:"band"`
-	Device      device      `timl:"device"`
-	GW          gateway     `toml:"gateway"`
-	DR          dataRate    `toml:"data_rate"`
-	RXInfo      rxInfo      `toml:"rx_info"`
-	DefaultData defaultData `toml:"default_data"`
-	RawPayload  rawPayload  `toml:"raw_payload"`
-}
+	command, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(flag.CommandLine.Output(), "unknown command %q\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
 
-//defaultData holds optional default encoded data.
-type defaultData struct {
-	Names    []string    `toml:"names"`
-	Data     [][]float64 `toml:"data"`
-	Interval int32       `toml:"interval"`
-	Random   bool        `toml:"random"`
+	if err := command(flag.Args()[1:]); err != nil {
+		log.Fatalln(err)
+	}
 }
 
-//rawPayload holds optional raw bytes payload (hex encoded).
-type rawPayload struct {
-	Payload string `toml:"payload"`
-	UseRaw  bool   `toml:"use_raw"`
+// newDevice builds the configured device, restoring its session from redis when present.
+func newDevice() (*lds.Device, error) {
+	d, restored, err := config.NewDevice()
+	if err != nil {
+		return nil, err
+	}
+	if restored {
+		log.Debugf("device %s session restored", config.Device.DevEUI)
+	}
+	return d, nil
 }
 
-var confFile *string
-var config *tomlConfig
-var stop bool
-var marshalers = map[string]int{"json": 0, "protobuf": 1, "v2_json": 2}
-var bands = []lwband.Name{
-	lwband.AS_923,
-	lwband.AU_915_928,
-	lwband.CN_470_510,
-	lwband.CN_779_787,
-	lwband.EU_433,
-	lwband.EU_863_870,
-	lwband.IN_865_867,
-	lwband.KR_920_923,
-	lwband.US_902_928,
-	lwband.RU_864_870,
-}
-var sendOnce bool
-var interval int
+// start builds the device, connects its gateways and starts its hooks.
+func start() (*sim, error) {
+	d, err := newDevice()
+	if err != nil {
+		return nil, err
+	}
 
-func importConf() {
+	s := &sim{
+		device:    d,
+		joined:    make(chan struct{}, 1),
+		downlinks: make(chan string, 10),
+		stop:      make(chan struct{}),
+	}
+	d.OnDownlink = func(dl *lds.Downlink) {
+		if s.runner != nil {
+			s.runner.Downlink(dl)
+		}
+		config.LogLPPDownlink(dl)
+		s.hookDownlink(dl)
+	}
+	s.transport, err = connect(config, *transKind, s.onDownlink)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.startHooks(); err != nil {
+		s.transport.close()
+		return nil, err
+	}
+	return s, nil
+}
 
-	if config == nil {
-		cMqtt := mqtt{}
+func (s *sim) onDownlink(payload []byte) error {
+	s.Lock()
+	defer s.Unlock()
 
-		cDev := device{}
+	wasJoined := s.device.Joined
+	message, err := s.device.ProcessDownlink(payload, s.device.MACVersion, s.transport.isMQTT())
+	config.SetSession(s.device)
+	if err != nil {
+		log.Errorf("downlink error: %s", err)
+		return err
+	}
+	log.Infof("received message: %s", message)
 
-		cGw := gateway{}
+	if !wasJoined && s.device.Joined {
+		select {
+		case s.joined <- struct{}{}:
+		default:
+		}
+		if s.runner != nil {
+			s.runner.JoinAccepted()
+		}
+	}
+	select {
+	case s.downlinks <- message:
+	default:
+	}
+	return nil
+}
 
-		cBand := band{}
+// sendUplink sends a single uplink through every enabled gateway.
+func (s *sim) sendUplink(mType lorawan.MType, fPort uint8, payload []byte, fCtrl lorawan.FCtrl) error {
+	s.Lock()
+	defer s.Unlock()
 
-		cDr := dataRate{}
+	s.device.Move(time.Now())
+	if payload == nil {
+		var err error
+		payload, err = config.Payload(s.device)
+		if err != nil {
+			return err
+		}
+	}
 
-		cRx := rxInfo{}
+	urx, utx := config.UplinkInfo()
+	fCnt, err := s.device.UplinkGateways(s.transport.gateways(), mType, fPort, urx, utx, payload, config.Band.Name, config.DataRate(), nil, fCtrl)
+	if err != nil {
+		return errors.Wrap(err, "couldn't send uplink")
+	}
+	log.Infof("message sent, uplink framecounter is now %d", fCnt)
+	return nil
+}
 
-		dd := defaultData{}
+// Join sends a join request through every enabled gateway.
+func (s *sim) Join() error {
+	s.Lock()
+	defer s.Unlock()
 
-		cPl := rawPayload{}
+	s.device.Move(time.Now())
+	urx, utx := config.UplinkInfo()
+	if err := s.device.JoinGateways(s.transport.gateways(), urx, utx); err != nil {
+		return errors.Wrap(err, "join error")
+	}
+	log.Infoln("join sent")
+	return nil
+}
 
-		config = &tomlConfig{
-			MQTT:        cMqtt,
-			Band:        cBand,
-			Device:      cDev,
-			GW:          cGw,
-			DR:          cDr,
-			RXInfo:      cRx,
-			DefaultData: dd,
-			RawPayload:  cPl,
+// waitDownlinks logs the downlinks received during the given time.
+func (s *sim) waitDownlinks(wait time.Duration) {
+	timeout := time.After(wait)
+	for {
+		select {
+		case <-s.downlinks:
+		case <-timeout:
+			return
 		}
 	}
+}
 
-	if _, err := toml.DecodeFile(*confFile, &config); err != nil {
-		log.Println(err)
-		return
+// saveSession writes the device session keys to the conf file.
+func saveSession() error {
+	name, err := config.Save(*confFile)
+	if err != nil {
+		return errors.Wrap(err, "couldn't save conf file")
 	}
+	log.Infof("session saved to %s", name)
+	return nil
 }
 
-func main() {
+func join(args []string) error {
+	fs := flag.NewFlagSet("join", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 10*time.Second, "time to wait for the join-accept")
+	save := fs.Bool("save", false, "write the session keys to the conf file once joined")
+	fs.Parse(args)
 
-	confFile = flag.String("conf", "conf.toml", "path to toml configuration file")
-	flag.Parse()
-	importConf()
-	run()
+	s, err := start()
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	if err := s.Join(); err != nil {
+		return err
+	}
+
+	select {
+	case <-s.joined:
+	case <-time.After(*timeout):
+		return errors.Errorf("no join-accept received after %s", *timeout)
+	}
+
+	log.Infof("joined with DevAddr %s", config.Device.DevAddress)
+	if *save {
+		return saveSession()
+	}
+	return nil
+}
+
+// uplinkFlags are the options shared by the uplink and run commands.
+type uplinkFlags struct {
+	fPort     *int
+	payload   *string
+	confirmed *bool
+	adr       *bool
+	wait      *time.Duration
 }
 
-func run() {
+func newUplinkFlags(fs *flag.FlagSet) *uplinkFlags {
+	return &uplinkFlags{
+		fPort:     fs.Int("fport", config.RawPayload.FPort, "uplink FPort"),
+		payload:   fs.String("payload", "", "hex encoded payload, overriding the configured one"),
+		confirmed: fs.Bool("confirmed", config.Device.MType == lorawan.ConfirmedDataUp, "send confirmed uplinks"),
+		adr:       fs.Bool("adr", false, "set the ADR bit"),
+		wait:      fs.Duration("wait", 3*time.Second, "time to wait for downlinks after an uplink"),
+	}
+}
 
-	//Connect to the broker
-	opts := MQTT.NewClientOptions()
-	opts.AddBroker(config.MQTT.Server)
-	opts.SetUsername(config.MQTT.User)
-	opts.SetPassword(config.MQTT.Password)
+// send sends an uplink with the flag options and waits for downlinks.
+func (f *uplinkFlags) send(s *sim) error {
+	var payload []byte
+	if *f.payload != "" {
+		var err error
+		payload, err = hex.DecodeString(*f.payload)
+		if err != nil {
+			return errors.Wrap(err, "couldn't decode hex payload")
+		}
+	}
 
-	client := MQTT.NewClient(opts)
+	mType := lorawan.UnconfirmedDataUp
+	if *f.confirmed {
+		mType = lorawan.ConfirmedDataUp
+	}
 
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		log.Println("Connection error")
-		log.Println(token.Error())
+	if err := s.sendUplink(mType, uint8(*f.fPort), payload, lorawan.FCtrl{ADR: *f.adr}); err != nil {
+		return err
 	}
+	s.waitDownlinks(*f.wait)
+	return nil
+}
 
-	log.Println("Connection established.")
+func uplink(args []string) error {
+	fs := flag.NewFlagSet("uplink", flag.ExitOnError)
+	uf := newUplinkFlags(fs)
+	fs.Parse(args)
 
-	dataRate := &lds.DataRate{
-		Bandwidth:    config.DR.Bandwith,
-		Modulation:   "LORA",
-		SpreadFactor: config.DR.SpreadFactor,
-		BitRate:      config.DR.BitRate,
+	s, err := start()
+	if err != nil {
+		return err
 	}
+	defer s.close()
 
-	mult := 1
+	return uf.send(s)
+}
 
-	for {
-		if stop {
-			stop = false
-			return
-		}
-		payload := []byte{}
-
-		if config.RawPayload.UseRaw {
-			var pErr error
-			payload, pErr = hex.DecodeString(config.RawPayload.Payload)
-			if err != nil {
-				log.Errorf("couldn't decode hex payload: %s\n", pErr)
-				return
-			}
-		} else {
-			for _, v := range config.DefaultData.Data {
-				rand.Seed(time.Now().UnixNano() / 10000)
-				if rand.Intn(10) < 5 {
-					mult *= -1
-				}
-				num := float32(v[0])
-				if config.DefaultData.Random {
-					num = float32(v[0] + float64(mult)*rand.Float64()/100)
-				}
-				arr := lds.GenerateFloat(num, float32(v[1]), int32(v[2]))
-				payload = append(payload, arr...)
+func run(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	uf := newUplinkFlags(fs)
+	interval := fs.Duration("interval", 10*time.Second, "time between uplinks")
+	count := fs.Int("count", 0, "number of uplinks to send, 0 for no limit")
+	mix := fs.Bool("mix", len(config.Messages) > 0, "send the configured message mix on its schedules instead of every interval")
+	fs.Parse(args)
+
+	s, err := start()
+	if err != nil {
+		return err
+	}
+	defer s.close()
 
-			}
-		}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
 
-		log.Printf("Bytes: %v\n", payload)
-
-		rxInfo := &lds.RxInfo{
-			Channel:   config.RXInfo.Channel,
-			CodeRate:  config.RXInfo.CodeRate,
-			CrcStatus: config.RXInfo.CrcStatus,
-			DataRate:  dataRate,
-			Frequency: config.RXInfo.Frequency,
-			LoRaSNR:   float32(config.RXInfo.LoRaSNR),
-			Mac:       config.GW.MAC,
-			RfChain:   config.RXInfo.RfChain,
-			Rssi:      config.RXInfo.RfChain,
-			Size:      len(payload),
-			Time:      time.Now().Format(time.RFC3339),
-			Timestamp: int32(time.Now().UnixNano() / 1000000000),
-		}
+	if *mix {
+		return s.runMessages(*count, interrupt)
+	}
 
-		//////
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
 
-		gwID, err := lds.MACToGatewayID(config.GW.MAC)
-		if err != nil {
-			log.Errorf("gw mac error: %s\n", err)
-			return
-		}
-		now := time.Now()
-		rxTime := ptypes.TimestampNow()
-		tsge := ptypes.DurationProto(now.Sub(time.Time{}))
-
-		urx := gw.UplinkRXInfo{
-			GatewayId:         gwID,
-			Rssi:              int32(rxInfo.Rssi),
-			LoraSnr:           float64(rxInfo.LoRaSNR),
-			Channel:           uint32(rxInfo.Channel),
-			RfChain:           uint32(rxInfo.RfChain),
-			TimeSinceGpsEpoch: tsge,
-			Time:              rxTime,
-			Timestamp:         uint32(rxTime.GetSeconds()),
-			Board:             0,
-			Antenna:           0,
-			Location:          nil,
-			FineTimestamp:     nil,
-			FineTimestampType: gw.FineTimestampType_NONE,
+	for sent := 0; *count == 0 || sent < *count; sent++ {
+		if sent > 0 {
+			select {
+			case <-ticker.C:
+			case <-interrupt:
+				log.Infoln("interrupted")
+				return nil
+			}
 		}
-
-		lmi := &gw.LoRaModulationInfo{
-			Bandwidth:       uint32(rxInfo.DataRate.Bandwidth),
-			SpreadingFactor: uint32(rxInfo.DataRate.SpreadFactor),
-			CodeRate:        rxInfo.CodeRate,
+		if err := uf.send(s); err != nil {
+			log.Errorln(err)
 		}
+	}
+	return nil
+}
 
-		umi := &gw.UplinkTXInfo_LoraModulationInfo{
-			LoraModulationInfo: lmi,
-		}
+func status(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	fs.Parse(args)
 
-		utx := gw.UplinkTXInfo{
-			Frequency:      uint32(rxInfo.Frequency),
-			ModulationInfo: umi,
-		}
+	d, err := newDevice()
+	if err != nil {
+		return err
+	}
 
-		//////
-		mType := lorawan.UnconfirmedDataUp
-		if config.Device.MType > 0 {
-			mType = lorawan.ConfirmedDataUp
-		}
+	fmt.Printf("DevEUI:      %s\n", config.Device.DevEUI)
+	fmt.Printf("Profile:     %s\n", d.Profile)
+	fmt.Printf("Joined:      %t\n", d.Joined)
+	fmt.Printf("DevAddr:     %s\n", lds.DevAddressToHex(d.DevAddr))
+	fmt.Printf("NwkSEncKey:  %s\n", lds.KeyToHex(d.NwkSEncKey))
+	fmt.Printf("SNwkSIntKey: %s\n", lds.KeyToHex(d.SNwkSIntKey))
+	fmt.Printf("FNwkSIntKey: %s\n", lds.KeyToHex(d.FNwkSIntKey))
+	fmt.Printf("AppSKey:     %s\n", lds.KeyToHex(d.AppSKey))
+	fmt.Printf("UlFcnt:      %d\n", d.UlFcnt)
+	fmt.Printf("DlFcnt:      %d\n", d.DlFcnt)
+	fmt.Printf("DevNonce:    %d\n", d.DevNonce)
+	fmt.Printf("JoinNonce:   %d\n", d.JoinNonce)
+	if d.Position != nil {
+		fmt.Printf("Position:    %f, %f, %.1f m\n", d.Position.Latitude, d.Position.Longitude, d.Position.Altitude)
+	}
+	return nil
+}
 
-		//Now send an uplink
-		ulfc, err := device.Uplink(client, mType, 1, &urx, &utx, payload, config.GW.MAC, config.Band.Name, *dataRate)
-		if err != nil {
-			log.Printf("couldn't send uplink: %s\n", err)
-		} else {
-			log.Debugf("uplink frame counter is now %d", ulfc)
-		}
+func set(args []string) error {
+	d, err := newDevice()
+	if err != nil {
+		return err
+	}
 
-		time.Sleep(time.Duration(config.DefaultData.Interval) * time.Second)
+	fs := flag.NewFlagSet("set", flag.ExitOnError)
+	ulFcnt := fs.Int("ul-fcnt", int(d.UlFcnt), "uplink frame counter")
+	dlFcnt := fs.Int("dl-fcnt", int(d.DlFcnt), "downlink frame counter")
+	devNonce := fs.Int("dev-nonce", int(d.DevNonce), "dev nonce")
+	joinNonce := fs.Int("join-nonce", int(d.JoinNonce), "join nonce")
+	fs.Parse(args)
 
+	if err := d.SetValues(*ulFcnt, *dlFcnt, *devNonce, *joinNonce); err != nil {
+		return errors.Wrap(err, "couldn't set values")
 	}
+	log.Infof("set UlFcnt %d, DlFcnt %d, DevNonce %d, JoinNonce %d", d.UlFcnt, d.DlFcnt, d.DevNonce, d.JoinNonce)
+	return nil
+}
+
+func reset(args []string) error {
+	fs := flag.NewFlagSet("reset", flag.ExitOnError)
+	fs.Parse(args)
 
+	d, err := newDevice()
+	if err != nil {
+		return err
+	}
+	if err := d.Reset(); err != nil {
+		return errors.Wrap(err, "couldn't reset device")
+	}
+	log.Infof("device %s reset", config.Device.DevEUI)
+	return nil
 }
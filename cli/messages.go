@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iegomez/lds/conf"
+	"github.com/iegomez/lds/lds"
+)
+
+// runMessages sends the message mix on its schedules until interrupted or count uplinks were sent.
+func (s *sim) runMessages(count int, interrupt chan os.Signal) error {
+	scheduler, err := config.Scheduler(time.Now())
+	if err != nil {
+		return err
+	}
+
+	for sent := 0; count == 0 || sent < count; sent++ {
+		i, at := scheduler.Next()
+		if i < 0 {
+			log.Infoln("no more messages scheduled")
+			return nil
+		}
+		m := config.Messages[i]
+		log.Debugf("next message %s at %s", m.Name, at.Format(time.RFC3339))
+
+		select {
+		case <-time.After(time.Until(at)):
+		case <-interrupt:
+			log.Infoln("interrupted")
+			return nil
+		}
+		if err := s.sendMessage(m); err != nil {
+			log.Errorln(err)
+		}
+		lds.DefaultTelemetry.SetSchedulerBacklog(scheduler.Backlog(time.Now()))
+	}
+	return nil
+}
+
+// sendMessage sends an uplink of the message mix.
+func (s *sim) sendMessage(m *conf.Message) error {
+	s.Lock()
+	s.device.Move(time.Now())
+	payload, err := config.MessagePayload(m, s.device)
+	s.Unlock()
+	if err != nil {
+		return err
+	}
+
+	log.Infof("sending message %s", m.Name)
+	return s.sendUplink(m.MType(), uint8(m.FPort), payload, lorawan.FCtrl{})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iegomez/lds/lds"
+)
+
+// pcap converts a capture file to a LoRaTap pcap file.
+func pcap(args []string) error {
+	fs := flag.NewFlagSet("pcap", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: pcap <capture file> <pcap file>\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errors.New("a capture file and a pcap file are required")
+	}
+
+	in, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return errors.Wrap(err, "couldn't open capture")
+	}
+	records, err := lds.ReadCapture(in)
+	in.Close()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(fs.Arg(1))
+	if err != nil {
+		return errors.Wrap(err, "couldn't create pcap file")
+	}
+	defer out.Close()
+	w, err := lds.NewPcapWriter(out, false)
+	if err != nil {
+		return errors.Wrap(err, "couldn't write pcap header")
+	}
+
+	var frames int
+	for _, rec := range records {
+		if len(rec.PHYPayload) == 0 {
+			continue
+		}
+		if err := w.WriteRecord(rec); err != nil {
+			return errors.Wrap(err, "couldn't write pcap file")
+		}
+		frames++
+	}
+	log.Infof("%d frames written to %s", frames, fs.Arg(1))
+	return nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/brocaar/chirpstack-api/go/gw"
+	"github.com/brocaar/lorawan"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iegomez/lds/lds"
+)
+
+// replayFrame is a captured uplink with the records of every gateway that forwarded it.
+type replayFrame struct {
+	records []*lds.CaptureRecord
+}
+
+func (fr *replayFrame) first() *lds.CaptureRecord {
+	return fr.records[0]
+}
+
+// replayer re-sends captured uplinks through a fleet, with a device per captured DevEUI.
+type replayer struct {
+	*fleet
+	devices   map[lorawan.EUI64]*lds.Device
+	reencrypt bool
+}
+
+func replay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	speed := fs.Float64("speed", 1, "timing factor, 1 keeping the original timing, 10 replaying 10 times faster and 0 sending frames back to back")
+	maxGap := fs.Duration("max-gap", 0, "longest wait between two frames, compressing idle periods when set")
+	reencrypt := fs.Bool("reencrypt", false, "rebuild uplinks with the device session and fresh counters instead of re-sending the captured PHYPayloads")
+	wait := fs.Duration("wait", 5*time.Second, "time to wait for downlinks after the last uplink")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: replay [options] <capture file>\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("a capture file is required")
+	}
+	if *speed < 0 {
+		return errors.New("speed can't be negative")
+	}
+
+	file, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return errors.Wrap(err, "couldn't open capture")
+	}
+	records, err := lds.ReadCapture(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	frames := replayFrames(records)
+	if len(frames) == 0 {
+		return errors.New("no uplinks in capture")
+	}
+	log.Infof("replaying %d uplinks", len(frames))
+
+	f, err := connectFleet()
+	if err != nil {
+		return err
+	}
+	defer f.transport.close()
+
+	r := &replayer{
+		fleet:     f,
+		devices:   map[lorawan.EUI64]*lds.Device{},
+		reencrypt: *reencrypt,
+	}
+	if err := r.loadDevices(); err != nil {
+		return err
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	for i, fr := range frames {
+		if i > 0 {
+			gap := fr.first().Time.Sub(frames[i-1].first().Time)
+			if *speed > 0 {
+				gap = time.Duration(float64(gap) / *speed)
+			} else {
+				gap = 0
+			}
+			if *maxGap > 0 && gap > *maxGap {
+				gap = *maxGap
+			}
+			select {
+			case <-time.After(gap):
+			case <-interrupt:
+				log.Infoln("interrupted")
+				return nil
+			}
+		}
+
+		if err := r.send(fr); err != nil {
+			log.Errorf("uplink %d of device %s: %s", i+1, fr.first().DevEUI, err)
+		}
+	}
+
+	select {
+	case <-time.After(*wait):
+	case <-interrupt:
+		log.Infoln("interrupted")
+	}
+	return nil
+}
+
+// replayFrames groups the captured uplinks by frame, as every gateway receiving one records it.
+func replayFrames(records []*lds.CaptureRecord) []*replayFrame {
+	var frames []*replayFrame
+	for _, rec := range records {
+		if rec.Direction != lds.CaptureUp {
+			continue
+		}
+		if n := len(frames); n > 0 {
+			last := frames[n-1].first()
+			if last.DevEUI == rec.DevEUI && bytes.Equal(last.PHYPayload, rec.PHYPayload) {
+				frames[n-1].records = append(frames[n-1].records, rec)
+				continue
+			}
+		}
+		frames = append(frames, &replayFrame{records: []*lds.CaptureRecord{rec}})
+	}
+	return frames
+}
+
+// loadDevices builds the configured device and the provisioner CSV ones, when set.
+func (r *replayer) loadDevices() error {
+	d, err := newDevice()
+	if err != nil {
+		return err
+	}
+	r.devices[d.DevEUI] = d
+
+	if config.Provisioner.Path != "" {
+		provisioned, err := config.Fleet(config.Provisioner.Path, 0)
+		if err != nil {
+			return err
+		}
+		for _, d := range provisioned {
+			r.devices[d.DevEUI] = d
+		}
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	for _, d := range r.devices {
+		r.add(d)
+	}
+	return nil
+}
+
+// device returns the device with the given DevEUI, made of the configured device settings when
+// it's neither the configured one nor a provisioned one.
+func (r *replayer) device(devEUI lorawan.EUI64) (*lds.Device, error) {
+	if d, ok := r.devices[devEUI]; ok {
+		return d, nil
+	}
+
+	dev := config.Device
+	dev.DevEUI = devEUI.String()
+	d, _, err := config.WithDevice(dev).NewDevice()
+	if err != nil {
+		return nil, err
+	}
+	log.Warnf("device %s isn't configured, using the configured device settings", devEUI)
+	r.devices[devEUI] = d
+	r.Lock()
+	r.add(d)
+	r.Unlock()
+	return d, nil
+}
+
+// send replays a captured uplink.
+func (r *replayer) send(fr *replayFrame) error {
+	rec := fr.first()
+	if rec.Error != "" && r.reencrypt {
+		return errors.Errorf("captured uplink couldn't be decoded: %s", rec.Error)
+	}
+	mType, err := lds.ParseMType(rec.MType)
+	if err != nil {
+		return err
+	}
+	d, err := r.device(rec.DevEUI)
+	if err != nil {
+		return err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if r.reencrypt {
+		if mType == lorawan.JoinRequest {
+			return r.join(d)
+		}
+		if d.Profile != "ABP" && !d.Joined {
+			return errors.New("device isn't joined, uplink skipped")
+		}
+		if rec.FPort == nil {
+			return errors.New("uplink without FPort skipped")
+		}
+		_, err := r.uplink(d, mType, *rec.FPort, rec.Payload, lorawan.FCtrl{ADR: adr(rec.PHYPayload)})
+		return err
+	}
+
+	if mType == lorawan.JoinRequest {
+		//The accept is answered to the captured DevNonce, which its session keys derive from.
+		devNonce, ok := joinDevNonce(rec.PHYPayload)
+		if !ok {
+			return errors.New("invalid join request skipped")
+		}
+		d.DevNonce = devNonce
+		r.remove(d)
+		r.joining = append(r.joining, d)
+	}
+	var forwarded int
+	for _, rec := range fr.records {
+		if err := r.forward(d, rec); err != nil {
+			log.Errorf("gateway %s: %s", rec.Gateway, err)
+			continue
+		}
+		forwarded++
+	}
+	if forwarded == 0 {
+		return errors.New("no gateway forwarded the uplink")
+	}
+	return nil
+}
+
+// forward re-sends a captured PHYPayload through the gateway that recorded it, or the first one when
+// it isn't configured, with the captured rx and tx info timestamped now.
+func (r *replayer) forward(d *lds.Device, rec *lds.CaptureRecord) error {
+	if len(r.gateways) == 0 {
+		return errors.New("no gateways to forward through")
+	}
+	g := r.gateways[0]
+	for _, other := range r.gateways {
+		if strings.EqualFold(other.MAC, rec.Gateway) {
+			g = other
+			break
+		}
+	}
+
+	rxInfo, txInfo := config.UplinkInfo()
+	if len(rec.RxInfo) > 0 {
+		rx := &gw.UplinkRXInfo{}
+		if err := jsonpb.Unmarshal(bytes.NewReader(rec.RxInfo), rx); err != nil {
+			return errors.Wrap(err, "rx info error")
+		}
+		rx.Time, rx.TimeSinceGpsEpoch = rxInfo.Time, rxInfo.TimeSinceGpsEpoch
+		rxInfo = rx
+	}
+	if len(rec.TxInfo) > 0 {
+		tx := &gw.UplinkTXInfo{}
+		if err := jsonpb.Unmarshal(bytes.NewReader(rec.TxInfo), tx); err != nil {
+			return errors.Wrap(err, "tx info error")
+		}
+		txInfo = tx
+	}
+	//Captured fine timestamps are stale.
+	rxInfo.FineTimestamp = nil
+	rxInfo.FineTimestampType = gw.FineTimestampType_NONE
+
+	return g.Forward(d, rec.PHYPayload, rxInfo, txInfo)
+}
+
+// adr tells whether a data uplink PHYPayload has its ADR bit set.
+func adr(phyBytes []byte) bool {
+	var phy lorawan.PHYPayload
+	if err := phy.UnmarshalBinary(phyBytes); err != nil {
+		return false
+	}
+	macPayload, ok := phy.MACPayload.(*lorawan.MACPayload)
+	return ok && macPayload.FHDR.FCtrl.ADR
+}
+
+// joinDevNonce returns the DevNonce of a join request PHYPayload.
+func joinDevNonce(phyBytes []byte) (lorawan.DevNonce, bool) {
+	var phy lorawan.PHYPayload
+	if err := phy.UnmarshalBinary(phyBytes); err != nil {
+		return 0, false
+	}
+	jrPayload, ok := phy.MACPayload.(*lorawan.JoinRequestPayload)
+	if !ok {
+		return 0, false
+	}
+	return jrPayload.DevNonce, true
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/brocaar/lorawan"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iegomez/lds/scenario"
+)
+
+// Uplink sends a scenario uplink, falling back to the configured port and payload.
+func (s *sim) Uplink(u scenario.Uplink) error {
+	fPort := config.RawPayload.FPort
+	if u.FPort != nil {
+		fPort = *u.FPort
+	}
+	mType := lorawan.UnconfirmedDataUp
+	if u.Confirmed {
+		mType = lorawan.ConfirmedDataUp
+	}
+	return s.sendUplink(mType, uint8(fPort), u.Payload, lorawan.FCtrl{ADR: u.ADR})
+}
+
+// SetDataRate changes the uplink data rate, keeping the current value for zero arguments.
+func (s *sim) SetDataRate(spreadFactor, bandwidth int) {
+	s.Lock()
+	defer s.Unlock()
+
+	if spreadFactor != 0 {
+		config.DR.SpreadFactor = spreadFactor
+	}
+	if bandwidth != 0 {
+		config.DR.Bandwidth = bandwidth
+	}
+	log.Infof("data rate set to SF%d BW%d", config.DR.SpreadFactor, config.DR.Bandwidth)
+}
+
+// Reset clears the device session and restores the configured keys, as the GUI does.
+func (s *sim) Reset() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.device.Reset(); err != nil {
+		return errors.Wrap(err, "couldn't reset device")
+	}
+	config.Device.Joined = false
+	return config.UpdateDevice(s.device)
+}
+
+func runScenarios(args []string) error {
+	fs := flag.NewFlagSet("scenario", flag.ExitOnError)
+	junit := fs.String("junit", "", "write the results to this JUnit XML file")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return errors.New("no scenario files given")
+	}
+
+	scenarios := make([]*scenario.Scenario, 0, fs.NArg())
+	for _, filename := range fs.Args() {
+		sc, err := scenario.Load(filename)
+		if err != nil {
+			return err
+		}
+		scenarios = append(scenarios, sc)
+	}
+
+	s, err := start()
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	runner := scenario.NewRunner(s)
+	s.Lock()
+	s.runner = runner
+	s.Unlock()
+
+	reports := make([]scenario.Report, 0, len(scenarios))
+	failed := 0
+	for _, sc := range scenarios {
+		report := scenario.Report{Scenario: sc, Results: runner.Run(sc)}
+		if !report.Passed() {
+			failed++
+		}
+		reports = append(reports, report)
+	}
+
+	if *junit != "" {
+		f, err := os.Create(*junit)
+		if err != nil {
+			return errors.Wrap(err, "couldn't create JUnit file")
+		}
+		defer f.Close()
+		if err := scenario.WriteJUnit(f, reports); err != nil {
+			return errors.Wrap(err, "couldn't write JUnit file")
+		}
+	}
+
+	if failed > 0 {
+		return errors.Errorf("%d of %d scenarios failed", failed, len(scenarios))
+	}
+	log.Infof("%d scenarios passed", len(scenarios))
+	return nil
+}
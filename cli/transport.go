@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/brocaar/chirpstack-api/go/gw"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iegomez/lds/conf"
+	"github.com/iegomez/lds/lds"
+)
+
+// Transports to the network server.
+const (
+	autoTransport = "auto"
+	mqttTransport = "mqtt"
+	udpTransport  = "udp"
+)
+
+// transport holds the connections of the configured gateways, either to the MQTT broker
+// (as a gateway bridge) or to the network server UDP port (as a packet forwarder).
+type transport struct {
+	config     *conf.Config
+	onDownlink func(payload []byte) error
+
+	mqttClient    paho.Client
+	gwMQTTClients map[string]paho.Client
+	nsClient      lds.NSClient
+	gwNSClients   map[string]*lds.NSClient
+	plans         map[string]*lds.ChannelPlan
+}
+
+// connect opens the connections of every gateway. With the auto transport MQTT is used when a
+// broker is configured, and UDP otherwise.
+func connect(c *conf.Config, kind string, onDownlink func(payload []byte) error) (*transport, error) {
+	t := &transport{
+		config:        c,
+		onDownlink:    onDownlink,
+		gwMQTTClients: map[string]paho.Client{},
+		gwNSClients:   map[string]*lds.NSClient{},
+		plans:         map[string]*lds.ChannelPlan{},
+	}
+
+	for _, g := range c.AllGateways() {
+		plan := &lds.ChannelPlan{}
+		plan.Set("", g.ConcentratorChannels())
+		t.plans[g.MAC] = plan
+	}
+
+	if kind == autoTransport {
+		kind = udpTransport
+		if c.MQTT.Server != "" {
+			kind = mqttTransport
+		}
+	}
+
+	var err error
+	switch kind {
+	case mqttTransport:
+		err = t.connectMQTT()
+	case udpTransport:
+		err = t.connectUDP()
+	default:
+		err = errors.Errorf("unknown transport %q", kind)
+	}
+	if err != nil {
+		t.close()
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *transport) connectMQTT() error {
+	opts, err := t.config.MainMQTTOptions()
+	if err != nil {
+		return err
+	}
+	t.mqttClient, err = t.newMQTTClient("broker", opts, t.config.SharedGateways())
+	if err != nil {
+		return err
+	}
+
+	//Gateways with their own certificate get their own connection.
+	for _, g := range t.config.Gateways {
+		if g.TLSCert == "" {
+			continue
+		}
+		opts, err := t.config.GatewayMQTTOptions(g)
+		if err != nil {
+			return errors.Wrapf(err, "gateway %s", g.MAC)
+		}
+		client, err := t.newMQTTClient(fmt.Sprintf("gateway %s", g.MAC), opts, []*conf.Gateway{g})
+		if err != nil {
+			return errors.Wrapf(err, "gateway %s", g.MAC)
+		}
+		t.gwMQTTClients[g.MAC] = client
+	}
+	return nil
+}
+
+func (t *transport) newMQTTClient(name string, o *lds.MQTTOptions, gateways []*conf.Gateway) (paho.Client, error) {
+	opts, err := o.ClientOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	opts.SetOnConnectHandler(func(c paho.Client) {
+		log.Infof("MQTT %s: connected", name)
+		lds.DefaultTelemetry.SetConnected("mqtt", name, true)
+		for _, g := range gateways {
+			t.config.Subscribe(c, g, t.onDownlink, t.onGatewayConfiguration)
+		}
+		t.config.PublishConnState(c, gateways, true)
+	})
+	opts.SetConnectionLostHandler(func(c paho.Client, err error) {
+		log.Warnf("MQTT %s: connection lost: %s, reconnecting", name, err)
+		lds.DefaultTelemetry.SetConnected("mqtt", name, false)
+	})
+
+	client := paho.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, errors.Wrap(token.Error(), "mqtt connection error")
+	}
+	return client, nil
+}
+
+func (t *transport) onGatewayConfiguration(mac string, gwConf *gw.GatewayConfiguration) {
+	log.Infof("gateway %s: received configuration version %q with %d channels", mac, gwConf.GetVersion(), len(gwConf.GetChannels()))
+	t.plans[mac].Apply(gwConf)
+}
+
+func (t *transport) connectUDP() error {
+	if err := t.config.SetNSClient(&t.nsClient); err != nil {
+		return err
+	}
+	if err := t.nsClient.Connect(t.config.GW.MAC, t.onDownlink); err != nil {
+		return errors.Wrap(err, "UDP connection error")
+	}
+
+	for _, g := range t.config.Gateways {
+		client, err := t.config.GatewayNSClient(g, &t.nsClient)
+		if err != nil {
+			return errors.Wrapf(err, "gateway %s", g.MAC)
+		}
+		if err := client.Connect(g.MAC, t.onDownlink); err != nil {
+			return errors.Wrapf(err, "gateway %s: UDP connection error", g.MAC)
+		}
+		t.gwNSClients[g.MAC] = client
+	}
+	return nil
+}
+
+// gateways returns the enabled gateways bound to their connections.
+func (t *transport) gateways() []*lds.Gateway {
+	gateways := []*lds.Gateway{}
+	for i, g := range t.config.AllGateways() {
+		if g.Disabled {
+			continue
+		}
+
+		sg := t.config.SimGateway(g)
+		sg.MQTTClient = t.mqttClient
+		if client, ok := t.gwMQTTClients[g.MAC]; ok {
+			sg.MQTTClient = client
+		}
+		sg.ChannelPlan = t.plans[g.MAC]
+
+		if i == 0 {
+			sg.UDPClient = &t.nsClient
+		} else if client, ok := t.gwNSClients[g.MAC]; ok {
+			sg.UDPClient = client
+		}
+
+		gateways = append(gateways, sg)
+	}
+	return gateways
+}
+
+// isMQTT tells whether downlinks arrive through the broker.
+func (t *transport) isMQTT() bool {
+	return t.mqttClient != nil
+}
+
+// missedAcks returns the number of PUSH_DATA packets the network server didn't acknowledge.
+func (t *transport) missedAcks() uint64 {
+	missed := t.nsClient.Stats().PushMissed
+	for _, client := range t.gwNSClients {
+		missed += client.Stats().PushMissed
+	}
+	return missed
+}
+
+// close publishes the gateways offline and closes every connection.
+func (t *transport) close() {
+	if t.mqttClient != nil {
+		t.config.PublishConnState(t.mqttClient, t.config.SharedGateways(), false)
+		t.mqttClient.Disconnect(200)
+		lds.DefaultTelemetry.SetConnected("mqtt", "broker", false)
+	}
+	for mac, client := range t.gwMQTTClients {
+		t.config.PublishConnState(client, []*conf.Gateway{{MAC: mac}}, false)
+		client.Disconnect(200)
+		lds.DefaultTelemetry.SetConnected("mqtt", fmt.Sprintf("gateway %s", mac), false)
+	}
+	if t.nsClient.IsConnected() {
+		if err := t.nsClient.Disconnect(); err != nil {
+			log.Errorf("UDP disconnect error: %s", err)
+		}
+	}
+	for mac, client := range t.gwNSClients {
+		if err := client.Disconnect(); err != nil {
+			log.Errorf("gateway %s: UDP disconnect error: %s", mac, err)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package conf
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iegomez/lds/lds"
+)
+
+// Capture holds the optional traffic capture settings.
+type Capture struct {
+	Path string `toml:"path"` //JSON lines file uplinks and downlinks are appended to, disabled when empty.
+	Pcap string `toml:"pcap"` //LoRaTap pcap file gateway frames are appended to, disabled when empty.
+}
+
+// StartCapture records the traffic of every device to the configured capture files, when set.
+func (c *Config) StartCapture() error {
+	if c.Capture.Path != "" {
+		f, err := os.OpenFile(c.Capture.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return errors.Wrap(err, "couldn't open capture file")
+		}
+		lds.DefaultRecorder = lds.NewRecorder(f)
+		log.Infof("capturing traffic to %s", c.Capture.Path)
+	}
+
+	if c.Capture.Pcap != "" {
+		f, err := os.OpenFile(c.Capture.Pcap, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return errors.Wrap(err, "couldn't open pcap file")
+		}
+		info, err := f.Stat()
+		if err != nil {
+			return errors.Wrap(err, "couldn't open pcap file")
+		}
+		lds.DefaultPcap, err = lds.NewPcapWriter(f, info.Size() > 0)
+		if err != nil {
+			return errors.Wrap(err, "couldn't write pcap header")
+		}
+		log.Infof("writing frames to %s", c.Capture.Pcap)
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+// Package conf holds the simulator configuration shared by the GUI and the CLI, and builds
+// the lds device, gateways and payloads it describes.
+package conf
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/brocaar/lorawan"
+	lwband "github.com/brocaar/lorawan/band"
+	"github.com/iegomez/lds/lds"
+	"github.com/iegomez/lsp"
+	log "github.com/sirupsen/logrus"
+)
+
+// Config is the simulator configuration, read from and written to TOML files.
+type Config struct {
+	MQTT        MQTT           `toml:"mqtt"`
+	Forwarder   Forwarder      `toml:"forwarder"`
+	Band        Band           `toml:"band"`
+	Device      Device         `toml:"device"`
+	GW          Gateway        `toml:"gateway"`
+	Gateways    []*Gateway     `toml:"gateways"`
+	Propagation Propagation    `toml:"propagation"`
+	Mobility    Mobility       `toml:"mobility"`
+	Channel     Channel        `toml:"channel"`
+	DR          DataRate       `toml:"data_rate"`
+	RXInfo      RXInfo         `toml:"rx_info"`
+	RawPayload  RawPayload     `toml:"raw_payload"`
+	EncodedType []*EncodedType `toml:"encoded_type"`
+	LPP         []*LPPChannel  `toml:"lpp"`
+	Messages    []*Message     `toml:"message"`
+	Behaviour   Behaviour      `toml:"behaviour"`
+	LogLevel    string         `toml:"log_level"`
+	RedisConf   Redis          `toml:"redis"`
+	Provisioner Provisioner    `toml:"provisioner"`
+	Prometheus  Prometheus     `toml:"prometheus"`
+	Capture     Capture        `toml:"capture"`
+}
+
+type Redis struct {
+	Addr     string `toml:"addr"`
+	Password string `toml:"password"`
+	DB       int    `toml:"db"`
+}
+
+type MQTT struct {
+	Server             string `toml:"server"`
+	User               string `toml:"user"`
+	Password           string `toml:"password"`
+	DownlinkTopic      string `toml:"downlink_topic"`
+	UplinkTopic        string `toml:"uplink_topic"`
+	StateTopic         string `toml:"state_topic"`  //Retained connection state, disabled when empty.
+	ConfigTopic        string `toml:"config_topic"` //Gateway configuration commands, disabled when empty.
+	Region             string `toml:"region"`       //Fills the {region} topic placeholder.
+	ClientID           string `toml:"client_id"`    //Random when empty.
+	QoS                int    `toml:"qos"`
+	CleanSession       bool   `toml:"clean_session"`
+	KeepAlive          int    `toml:"keepalive"` //Seconds.
+	CACert             string `toml:"ca_cert"`   //PEM file used to verify the broker.
+	TLSCert            string `toml:"tls_cert"`  //PEM client certificate and key.
+	TLSKey             string `toml:"tls_key"`
+	InsecureSkipVerify bool   `toml:"insecure_skip_verify"`
+	WillTopic          string `toml:"will_topic"` //%s is replaced with the gateway MAC.
+	WillPayload        string `toml:"will_payload"`
+	WillRetained       bool   `toml:"will_retained"`
+}
+
+type Forwarder struct {
+	Server        string `toml:"nserver"`
+	Port          string `toml:"nsport"`
+	KeepAlive     int    `toml:"keepalive_interval"` //PULL_DATA interval in seconds.
+	AckTimeout    int    `toml:"ack_timeout"`        //Seconds to wait for PUSH_ACK/PULL_ACK.
+	MaxMissedAcks int    `toml:"max_missed_acks"`    //Consecutive missed PULL_ACKs before reconnecting.
+}
+
+type Gateway struct {
+	MAC           string  `toml:"mac"`
+	BridgeVersion string  `toml:"bridge_version"`
+	Disabled      bool    `toml:"disabled"` //Disabled gateways don't receive uplinks.
+	Server        string  `toml:"nserver"`  //UDP network server override, defaults to the forwarder one.
+	Port          string  `toml:"nsport"`
+	Latitude      float64 `toml:"latitude"`
+	Longitude     float64 `toml:"longitude"`
+	Altitude      float64 `toml:"altitude"`
+	RSSIOffset    int     `toml:"rssi_offset"`        //Added to rx_info.rssi.
+	SNROffset     float64 `toml:"snr_offset"`         //Added to rx_info.lora_snr.
+	SkewMs        int     `toml:"skew_ms"`            //Reception delay in milliseconds.
+	FineTimestamp string  `toml:"fine_timestamp"`     //"plain", "encrypted" or empty for none.
+	FineTSKey     string  `toml:"fine_timestamp_key"` //AES key used for encrypted fine timestamps.
+	AntennaGain   float64 `toml:"antenna_gain"`       //Antenna gain in dBi, used by the propagation model.
+	ClientID      string  `toml:"client_id"`          //MQTT client ID when the gateway has its own certificate.
+	TLSCert       string  `toml:"tls_cert"`           //Client certificate and key, the gateway gets its own MQTT connection when set.
+	TLSKey        string  `toml:"tls_key"`
+	//Concentrator channels, any frequency is received when empty. Replaced by MQTT configuration commands.
+	Channels []*GatewayChannel `toml:"channels"`
+}
+
+type GatewayChannel struct {
+	Frequency        uint32   `toml:"frequency"`
+	Modulation       string   `toml:"modulation"` //"LORA" (default) or "FSK".
+	Bandwidth        uint32   `toml:"bandwidth"`  //kHz, any when 0.
+	SpreadingFactors []uint32 `toml:"spreading_factors"`
+	Bitrate          uint32   `toml:"bitrate"` //FSK only.
+}
+
+type Band struct {
+	Name lwband.Name `toml:"name"`
+}
+
+type DataRate struct {
+	Bandwidth    int    `toml:"bandwith"`
+	SpreadFactor int    `toml:"spread_factor"`
+	BitRate      int    `toml:"bit_rate"`
+	BitRateS     string `toml:"-"`
+}
+
+type RXInfo struct {
+	Channel   int     `toml:"channel"`
+	CodeRate  string  `toml:"code_rate"`
+	CrcStatus int     `toml:"crc_status"`
+	Frequency int     `toml:"frequency"`
+	LoRaSNR   float64 `toml:"lora_snr"`
+	RfChain   int     `toml:"rf_chain"`
+	Rssi      int     `toml:"rssi"`
+	//String representations for numeric values so that we can manage them with input texts.
+	ChannelS   string `toml:"-"`
+	CrcStatusS string `toml:"-"`
+	FrequencyS string `toml:"-"`
+	LoRASNRS   string `toml:"-"`
+	RfChainS   string `toml:"-"`
+	RssiS      string `toml:"-"`
+}
+
+type Device struct {
+	DevEUI        string             `toml:"eui"`
+	DevAddress    string             `toml:"address"`
+	NwkSEncKey    string             `toml:"network_session_encription_key"`
+	SNwkSIntKey   string             `toml:"serving_network_session_integrity_key"`    //For Lorawan 1.0 this is the same as the NwkSEncKey
+	FNwkSIntKey   string             `toml:"forwarding_network_session_integrity_key"` //For Lorawan 1.0 this is the same as the NwkSEncKey
+	AppSKey       string             `toml:"application_session_key"`
+	Marshaler     string             `toml:"marshaler"`
+	NwkKey        string             `toml:"nwk_key"`  //Network key, used to be called application key for Lorawan 1.0
+	AppKey        string             `toml:"app_key"`  //Application key, for Lorawan 1.1
+	JoinEUI       string             `toml:"join_eui"` //JoinEUI for 1.1. (AppEUI on 1.0)
+	Major         lorawan.Major      `toml:"-"`
+	MACVersion    lorawan.MACVersion `toml:"mac_version"` //Lorawan MAC version
+	MType         lorawan.MType      `toml:"-"`
+	Profile       string             `toml:"profile"`
+	Joined        bool               `toml:"joined"`
+	SkipFCntCheck bool               `toml:"skip_fcnt_check"`
+	DiagnoseMIC   bool               `toml:"diagnose_mic"`
+	Latitude      float64            `toml:"latitude"` //Device position, used for gateways time of flight.
+	Longitude     float64            `toml:"longitude"`
+	Altitude      float64            `toml:"altitude"`
+}
+
+//RawPayload holds optional raw bytes payload (hex encoded).
+type RawPayload struct {
+	Payload     string `toml:"payload"`
+	UseRaw      bool   `toml:"use_raw"`
+	Script      string `toml:"script"`
+	UseEncoder  bool   `toml:"use_encoder"`
+	UseLPP      bool   `toml:"use_lpp"`
+	MaxExecTime int    `toml:"max_exec_time"`
+	Obj         string `toml:"js_object"`
+	FPort       int    `toml:"fport"`
+}
+
+type EncodedType struct {
+	Name     string  `toml:"name"`
+	Value    float64 `toml:"value"`
+	MaxValue float64 `toml:"max_value"`
+	MinValue float64 `toml:"min_value"`
+	IsFloat  bool    `toml:"is_float"`
+	NumBytes int     `toml:"num_bytes"`
+	Source   string  `toml:"source"` //"latitude", "longitude" or "altitude" to take the value from the device position.
+
+	Generator string  `toml:"generator"`  //"uniform", "normal", "random_walk", "sine", "sawtooth", "counter", "csv" or empty for the fixed value.
+	StdDev    float64 `toml:"std_dev"`    //Standard deviation around value for "normal".
+	Step      float64 `toml:"step"`       //Largest change for "random_walk" and increment for "counter".
+	Period    float64 `toml:"period"`     //Seconds for "sine" and "sawtooth".
+	CSVFile   string  `toml:"csv_file"`   //File replayed by "csv".
+	CSVColumn string  `toml:"csv_column"` //Header name or 0 based index of the replayed column.
+
+	//Schema encoding, used instead of num_bytes and is_float when bits is set: the value is written as
+	//(value - offset) / scale in bits bits, packing consecutive fields narrower than a byte as bitfields.
+	Type         string  `toml:"type"` //"uint", "int" or "float" (IEEE 754, 32 or 64 bits).
+	Bits         int     `toml:"bits"`
+	LittleEndian bool    `toml:"little_endian"`
+	Scale        float64 `toml:"scale"` //1 when 0.
+	Offset       float64 `toml:"offset"`
+
+	generator        lds.Generator
+	appliedGenerator generatorConf
+	generatorStart   time.Time
+}
+
+type Provisioner struct {
+	Hostname string `toml:"hostname"`
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+	Path     string `toml:"path"`
+	Token    string
+	Devices  []*lsp.Device
+}
+
+// DefaultMaxExecTime is the default JS encoder timeout in milliseconds.
+const DefaultMaxExecTime = 100
+
+// DefaultScript is the JS encoder used when the configuration has none.
+var DefaultScript = `
+// Encode encodes the given object into an array of bytes.
+//  - fPort contains the LoRaWAN fPort number
+//  - obj is an object, e.g. {"temperature": 22.5}
+// The function must return an array of bytes, e.g. [225, 230, 255, 0]
+function Encode(fPort, obj) {
+	return [];
+}
+`
+
+// New returns a configuration with defaults for the options a file may omit.
+func New() *Config {
+	return &Config{
+		MQTT:        MQTT{CleanSession: true, KeepAlive: 30},
+		Forwarder:   Forwarder{KeepAlive: 10, AckTimeout: 3, MaxMissedAcks: 3},
+		Band:        Band{},
+		Device:      Device{MType: lorawan.UnconfirmedDataUp},
+		GW:          Gateway{},
+		Gateways:    []*Gateway{},
+		Propagation: Propagation{TXPower: 14, NoiseFigure: 6, PathLossExponent: 2.7, ReferenceDistance: 1, BaseHeight: 30, MobileHeight: 1.5, Environment: lds.HataUrban},
+		Mobility:    Mobility{},
+		Channel:     Channel{BurstLoss: 1, CaptureThreshold: 6},
+		DR:          DataRate{},
+		RXInfo:      RXInfo{},
+		RawPayload:  RawPayload{MaxExecTime: DefaultMaxExecTime},
+		EncodedType: []*EncodedType{},
+		LPP:         []*LPPChannel{},
+		Messages:    []*Message{},
+		Behaviour:   Behaviour{},
+		Provisioner: Provisioner{},
+	}
+}
+
+// Load decodes a conf file over the current values, so options missing from the file are kept.
+func (c *Config) Load(filename string) error {
+	if _, err := toml.DecodeFile(filename, c); err != nil {
+		return err
+	}
+
+	//Fill string representations of numeric values.
+	c.DR.BitRateS = strconv.Itoa(c.DR.BitRate)
+	c.RXInfo.ChannelS = strconv.Itoa(c.RXInfo.Channel)
+	c.RXInfo.CrcStatusS = strconv.Itoa(c.RXInfo.CrcStatus)
+	c.RXInfo.FrequencyS = strconv.Itoa(c.RXInfo.Frequency)
+	c.RXInfo.LoRASNRS = strconv.FormatFloat(c.RXInfo.LoRaSNR, 'f', -1, 64)
+	c.RXInfo.RfChainS = strconv.Itoa(c.RXInfo.RfChain)
+	c.RXInfo.RssiS = strconv.Itoa(c.RXInfo.Rssi)
+
+	//Set default script when it's not present.
+	if c.RawPayload.Script == "" {
+		c.RawPayload.Script = DefaultScript
+	}
+	if c.Behaviour.Script == "" {
+		c.Behaviour.Script = DefaultHooksScript
+	}
+	return nil
+}
+
+// Setup sets the configured log level and connects to redis, where device sessions are kept.
+func (c *Config) Setup() {
+	log.SetLevel(log.InfoLevel)
+	if l, err := log.ParseLevel(c.LogLevel); err == nil {
+		log.SetLevel(l)
+	}
+
+	//Try to set redis.
+	lds.StartRedis(c.RedisConf.Addr, c.RedisConf.Password, c.RedisConf.DB)
+}
+
+// Save writes the configuration to a conf file, adding the .toml extension when missing,
+// and returns the file name.
+func (c *Config) Save(filename string) (string, error) {
+	if !strings.Contains(filename, ".toml") {
+		filename = fmt.Sprintf("%s.toml", filename)
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if err := toml.NewEncoder(f).Encode(c); err != nil {
+		return "", err
+	}
+	return f.Name(), nil
+}
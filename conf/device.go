@@ -0,0 +1,182 @@
+package conf
+
+import (
+	"time"
+
+	"github.com/brocaar/chirpstack-api/go/gw"
+	"github.com/brocaar/lorawan"
+	lwband "github.com/brocaar/lorawan/band"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iegomez/lds/lds"
+)
+
+// Position returns the configured device position, or nil when it's not set.
+func (d *Device) Position() *lds.Position {
+	if d.Latitude == 0 && d.Longitude == 0 && d.Altitude == 0 {
+		return nil
+	}
+	return &lds.Position{
+		Latitude:  d.Latitude,
+		Longitude: d.Longitude,
+		Altitude:  d.Altitude,
+	}
+}
+
+// NewDevice builds the configured device with its channel over the shared Air and its movement model.
+// When its session is found at redis it's restored, and the configured session keys and address
+// are updated to match it; restored tells so.
+func (c *Config) NewDevice() (d *lds.Device, restored bool, err error) {
+	d = &lds.Device{}
+	if err := c.UpdateDevice(d); err != nil {
+		return nil, false, err
+	}
+	d.Channel = c.Channel.Build(Air)
+
+	model, err := c.Mobility.Build(lds.Position{
+		Latitude:  c.Device.Latitude,
+		Longitude: c.Device.Longitude,
+		Altitude:  c.Device.Altitude,
+	})
+	if err != nil {
+		return nil, false, errors.Wrap(err, "mobility error")
+	}
+	if model != nil {
+		d.SetMobility(model)
+	}
+	d.Move(time.Now())
+
+	//Get redis info.
+	if d.GetInfo() {
+		c.SetSession(d)
+		restored = true
+	}
+	return d, restored, nil
+}
+
+// UpdateDevice applies the configured keys and settings to a device, keeping its counters and nonces.
+func (c *Config) UpdateDevice(d *lds.Device) error {
+	//Build your node with known keys (ABP).
+	devAddr, err := lds.HexToDevAddress(c.Device.DevAddress)
+	if err != nil {
+		log.Errorf("dev addr error: %s", err)
+	}
+
+	nwkSEncKey, err := lds.HexToKey(c.Device.NwkSEncKey)
+	if err != nil {
+		log.Errorf("nwkSEncKey error: %s", err)
+	}
+
+	sNwkSIntKey, err := lds.HexToKey(c.Device.SNwkSIntKey)
+	if err != nil {
+		log.Errorf("sNwkSIntKey error: %s", err)
+	}
+
+	fNwkSIntKey, err := lds.HexToKey(c.Device.FNwkSIntKey)
+	if err != nil {
+		log.Errorf("fNwkSIntKey error: %s", err)
+	}
+
+	appSKey, err := lds.HexToKey(c.Device.AppSKey)
+	if err != nil {
+		log.Errorf("appskey error: %s", err)
+	}
+
+	devEUI, err := lds.HexToEUI(c.Device.DevEUI)
+	if err != nil {
+		return errors.Wrap(err, "devEUI error")
+	}
+
+	appKey, err := lds.HexToKey(c.Device.AppKey)
+	if err != nil {
+		return errors.Wrap(err, "appKey error")
+	}
+	nwkKey, err := lds.HexToKey(c.Device.NwkKey)
+	if err != nil {
+		return errors.Wrap(err, "nwkKey error")
+	}
+	joinEUI, err := lds.HexToEUI(c.Device.JoinEUI)
+	if err != nil {
+		return errors.Wrap(err, "joinEUI error")
+	}
+
+	d.DevEUI = devEUI
+	d.DevAddr = devAddr
+	d.NwkSEncKey = nwkSEncKey
+	d.SNwkSIntKey = sNwkSIntKey
+	d.FNwkSIntKey = fNwkSIntKey
+	d.AppSKey = appSKey
+	d.AppKey = appKey
+	d.NwkKey = nwkKey
+	d.JoinEUI = joinEUI
+	d.Profile = c.Device.Profile
+	d.Major = lorawan.Major(c.Device.Major)
+	d.MACVersion = lorawan.MACVersion(c.Device.MACVersion)
+	d.SkipFCntCheck = c.Device.SkipFCntCheck
+	d.MICDiagnosis = c.Device.DiagnoseMIC
+	d.Position = c.Device.Position()
+	d.Propagation = c.Propagation.Build()
+	d.SetMarshaler(c.Device.Marshaler)
+	return nil
+}
+
+// SetSession copies the device session keys, address and join state to the configuration.
+func (c *Config) SetSession(d *lds.Device) {
+	c.Device.AppSKey = lds.KeyToHex(d.AppSKey)
+	c.Device.FNwkSIntKey = lds.KeyToHex(d.FNwkSIntKey)
+	c.Device.NwkSEncKey = lds.KeyToHex(d.NwkSEncKey)
+	c.Device.SNwkSIntKey = lds.KeyToHex(d.SNwkSIntKey)
+	c.Device.DevAddress = lds.DevAddressToHex(d.DevAddr)
+	c.Device.Joined = d.Joined
+}
+
+// DataRate returns the configured LoRa data rate.
+func (c *Config) DataRate() lwband.DataRate {
+	return lwband.DataRate{
+		Modulation:   lwband.Modulation("LORA"),
+		SpreadFactor: c.DR.SpreadFactor,
+		Bandwidth:    c.DR.Bandwidth,
+		BitRate:      c.DR.BitRate,
+	}
+}
+
+// UplinkInfo builds the base rx and tx info for an uplink; each gateway then applies its own metadata.
+func (c *Config) UplinkInfo() (*gw.UplinkRXInfo, *gw.UplinkTXInfo) {
+	now := time.Now()
+	rxTime, _ := ptypes.TimestampProto(now)
+	tsge := ptypes.DurationProto(lds.TimeSinceGPSEpoch(now))
+
+	urx := &gw.UplinkRXInfo{
+		Rssi:              int32(c.RXInfo.Rssi),
+		LoraSnr:           float64(c.RXInfo.LoRaSNR),
+		Channel:           uint32(c.RXInfo.Channel),
+		RfChain:           uint32(c.RXInfo.RfChain),
+		TimeSinceGpsEpoch: tsge,
+		Time:              rxTime,
+		Board:             0,
+		Antenna:           0,
+		Location:          nil,
+		FineTimestamp:     nil,
+		FineTimestampType: gw.FineTimestampType_NONE,
+		Context:           make([]byte, 4),
+	}
+
+	lmi := &gw.LoRaModulationInfo{
+		Bandwidth:       uint32(c.DR.Bandwidth),
+		SpreadingFactor: uint32(c.DR.SpreadFactor),
+		CodeRate:        c.RXInfo.CodeRate,
+	}
+
+	umi := &gw.UplinkTXInfo_LoraModulationInfo{
+		LoraModulationInfo: lmi,
+	}
+
+	utx := &gw.UplinkTXInfo{
+		Frequency:      uint32(c.RXInfo.Frequency),
+		ModulationInfo: umi,
+	}
+
+	return urx, utx
+}
@@ -0,0 +1,84 @@
+package conf
+
+import (
+	"encoding/binary"
+	"strings"
+
+	"github.com/iegomez/lsp"
+	"github.com/pkg/errors"
+
+	"github.com/iegomez/lds/lds"
+)
+
+// Fleet builds the devices of a load test: the ones listed in the provisioner CSV file at path,
+// or else n copies of the configured device with consecutive DevEUIs and DevAddrs. Settings
+// missing from the CSV are taken from the configured device.
+func (c *Config) Fleet(path string, n int) ([]*lds.Device, error) {
+	var devices []Device
+	if path != "" {
+		rows, err := lsp.Load(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "couldn't load fleet")
+		}
+		for _, row := range rows {
+			devices = append(devices, c.fleetDevice(row))
+		}
+	} else {
+		devEUI, err := lds.HexToEUI(c.Device.DevEUI)
+		if err != nil {
+			return nil, errors.Wrap(err, "devEUI error")
+		}
+		devAddr, _ := lds.HexToDevAddress(c.Device.DevAddress)
+		baseEUI, baseAddr := binary.BigEndian.Uint64(devEUI[:]), binary.BigEndian.Uint32(devAddr[:])
+		for i := 0; i < n; i++ {
+			dev := c.Device
+			binary.BigEndian.PutUint64(devEUI[:], baseEUI+uint64(i))
+			dev.DevEUI = devEUI.String()
+			binary.BigEndian.PutUint32(devAddr[:], baseAddr+uint32(i))
+			dev.DevAddress = lds.DevAddressToHex(devAddr)
+			devices = append(devices, dev)
+		}
+	}
+	if len(devices) == 0 {
+		return nil, errors.New("the fleet has no devices")
+	}
+
+	fleet := make([]*lds.Device, 0, len(devices))
+	for _, dev := range devices {
+		d, _, err := c.WithDevice(dev).NewDevice()
+		if err != nil {
+			return nil, errors.Wrapf(err, "device %s", dev.DevEUI)
+		}
+		fleet = append(fleet, d)
+	}
+	return fleet, nil
+}
+
+// WithDevice returns a copy of the configuration with the given device settings, e.g. to build
+// other devices than the configured one.
+func (c *Config) WithDevice(dev Device) *Config {
+	fc := *c
+	fc.Device = dev
+	return &fc
+}
+
+// fleetDevice returns the configured device with the settings of a provisioner CSV row.
+func (c *Config) fleetDevice(row *lsp.Device) Device {
+	dev := c.Device
+	dev.DevEUI = row.DevEUI
+	dev.SkipFCntCheck = row.SkipFCntCheck
+	set := func(field *string, value string) {
+		if value != "" {
+			*field = value
+		}
+	}
+	set(&dev.DevAddress, row.DevAddr)
+	set(&dev.NwkKey, row.NwkKey)
+	set(&dev.AppKey, row.AppKey)
+	set(&dev.AppSKey, row.AppSKey)
+	set(&dev.FNwkSIntKey, row.FNwkSIntKey)
+	set(&dev.SNwkSIntKey, row.SNwkSIntKey)
+	set(&dev.NwkSEncKey, row.NwkSEncKey)
+	set(&dev.Profile, strings.ToUpper(row.Activation))
+	return dev
+}
@@ -0,0 +1,231 @@
+package conf
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brocaar/chirpstack-api/go/common"
+	"github.com/brocaar/chirpstack-api/go/gw"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iegomez/lds/lds"
+)
+
+// AllGateways returns the main gateway followed by the additional ones.
+func (c *Config) AllGateways() []*Gateway {
+	return append([]*Gateway{&c.GW}, c.Gateways...)
+}
+
+// SharedGateways returns the gateways using the main MQTT connection: the main gateway and
+// those without their own client certificate.
+func (c *Config) SharedGateways() []*Gateway {
+	shared := []*Gateway{}
+	for _, g := range c.AllGateways() {
+		if g.TLSCert == "" || g == &c.GW {
+			shared = append(shared, g)
+		}
+	}
+	return shared
+}
+
+// SimGateway returns the lds gateway for g without transports nor channel plan, which depend on the connections.
+func (c *Config) SimGateway(g *Gateway) *lds.Gateway {
+	sg := &lds.Gateway{
+		MAC:         g.MAC,
+		RSSIOffset:  int32(g.RSSIOffset),
+		SNROffset:   g.SNROffset,
+		Skew:        time.Duration(g.SkewMs) * time.Millisecond,
+		AntennaGain: g.AntennaGain,
+		UplinkTopic: c.MQTT.UplinkTopic,
+		Region:      c.MQTT.Region,
+		QoS:         byte(c.MQTT.QoS),
+	}
+
+	if g.Latitude != 0 || g.Longitude != 0 || g.Altitude != 0 {
+		sg.Location = &common.Location{
+			Latitude:  g.Latitude,
+			Longitude: g.Longitude,
+			Altitude:  g.Altitude,
+			Source:    common.LocationSource_CONFIG,
+		}
+	}
+
+	switch g.FineTimestamp {
+	case "plain":
+		sg.FineTimestamp = gw.FineTimestampType_PLAIN
+	case "encrypted":
+		key, err := lds.HexToKey(g.FineTSKey)
+		if err != nil {
+			log.Errorf("gateway %s: fine timestamp key error: %s", g.MAC, err)
+			break
+		}
+		sg.FineTimestamp = gw.FineTimestampType_ENCRYPTED
+		sg.FineTimestampKey = key
+	}
+
+	return sg
+}
+
+// ConcentratorChannels returns the configured channels of the gateway.
+func (g *Gateway) ConcentratorChannels() []lds.ConcentratorChannel {
+	channels := make([]lds.ConcentratorChannel, 0, len(g.Channels))
+	for _, c := range g.Channels {
+		ch := lds.ConcentratorChannel{
+			Frequency:        c.Frequency,
+			Modulation:       common.Modulation_LORA,
+			Bandwidth:        c.Bandwidth,
+			SpreadingFactors: c.SpreadingFactors,
+			Bitrate:          c.Bitrate,
+		}
+		if strings.EqualFold(c.Modulation, common.Modulation_FSK.String()) {
+			ch.Modulation = common.Modulation_FSK
+		}
+		channels = append(channels, ch)
+	}
+	return channels
+}
+
+// MQTTOptions returns the broker options for a client of the given gateway.
+// cert and key override the ones in the mqtt section.
+func (c *Config) MQTTOptions(clientID, cert, key, mac string) (*lds.MQTTOptions, error) {
+	opts := &lds.MQTTOptions{
+		Server:             c.MQTT.Server,
+		User:               c.MQTT.User,
+		Password:           c.MQTT.Password,
+		ClientID:           clientID,
+		CleanSession:       c.MQTT.CleanSession,
+		KeepAlive:          time.Duration(c.MQTT.KeepAlive) * time.Second,
+		QoS:                byte(c.MQTT.QoS),
+		CACert:             c.MQTT.CACert,
+		TLSCert:            cert,
+		TLSKey:             key,
+		InsecureSkipVerify: c.MQTT.InsecureSkipVerify,
+	}
+
+	//The retained offline state takes precedence over a custom last will.
+	if c.MQTT.StateTopic != "" {
+		offline, err := lds.MarshalConnState(mac, false, c.Device.Marshaler)
+		if err != nil {
+			return nil, err
+		}
+		opts.WillTopic = lds.Topic(c.MQTT.StateTopic, mac, c.MQTT.Region, lds.StateConn)
+		opts.WillPayload = offline
+		opts.WillRetained = true
+	} else if c.MQTT.WillTopic != "" {
+		opts.WillTopic = lds.Topic(c.MQTT.WillTopic, mac, c.MQTT.Region, "")
+		opts.WillPayload = []byte(c.MQTT.WillPayload)
+		opts.WillRetained = c.MQTT.WillRetained
+	}
+	return opts, nil
+}
+
+// MainMQTTOptions returns the broker options of the main connection, using the main
+// gateway certificate and client ID when it has its own.
+func (c *Config) MainMQTTOptions() (*lds.MQTTOptions, error) {
+	cert, key := c.MQTT.TLSCert, c.MQTT.TLSKey
+	if c.GW.TLSCert != "" {
+		cert, key = c.GW.TLSCert, c.GW.TLSKey
+	}
+	clientID := c.MQTT.ClientID
+	if c.GW.ClientID != "" {
+		clientID = c.GW.ClientID
+	}
+	return c.MQTTOptions(clientID, cert, key, c.GW.MAC)
+}
+
+// GatewayMQTTOptions returns the broker options of a gateway with its own client certificate.
+func (c *Config) GatewayMQTTOptions(g *Gateway) (*lds.MQTTOptions, error) {
+	clientID := g.ClientID
+	if clientID == "" {
+		clientID = g.MAC
+	}
+	return c.MQTTOptions(clientID, g.TLSCert, g.TLSKey, g.MAC)
+}
+
+// PublishConnState publishes the retained connection state of the given gateways, when a state topic is set.
+func (c *Config) PublishConnState(client paho.Client, gateways []*Gateway, online bool) {
+	if c.MQTT.StateTopic == "" {
+		return
+	}
+	for _, g := range gateways {
+		payload, err := lds.MarshalConnState(g.MAC, online, c.Device.Marshaler)
+		if err != nil {
+			log.Errorf("gateway %s: conn state error: %s", g.MAC, err)
+			continue
+		}
+		topic := lds.Topic(c.MQTT.StateTopic, g.MAC, c.MQTT.Region, lds.StateConn)
+		if token := client.Publish(topic, byte(c.MQTT.QoS), true, payload); token.Wait() && token.Error() != nil {
+			log.Errorf("publish to %s error: %s", topic, token.Error())
+		}
+	}
+}
+
+// Subscribe subscribes to the downlink and, when a config topic is set, configuration commands of a gateway.
+func (c *Config) Subscribe(client paho.Client, g *Gateway, onDownlink func(payload []byte) error, onConfig func(mac string, conf *gw.GatewayConfiguration)) {
+	mac := g.MAC
+	subscriptions := map[string]paho.MessageHandler{
+		lds.Topic(c.MQTT.DownlinkTopic, mac, c.MQTT.Region, lds.CommandDown): func(client paho.Client, msg paho.Message) {
+			log.Debugf("downlink received by gateway %s", mac)
+			lds.DefaultTelemetry.GatewayDownlink(mac)
+			lds.DefaultPcap.WriteDownlink(msg.Payload(), true)
+			onDownlink(msg.Payload())
+		},
+	}
+	if c.MQTT.ConfigTopic != "" {
+		subscriptions[lds.Topic(c.MQTT.ConfigTopic, mac, c.MQTT.Region, lds.CommandConfig)] = func(client paho.Client, msg paho.Message) {
+			conf, err := lds.UnmarshalGatewayConfiguration(msg.Payload(), c.Device.Marshaler)
+			if err != nil {
+				log.Errorf("gateway %s: %s", mac, err)
+				return
+			}
+			onConfig(mac, conf)
+		}
+	}
+
+	for topic, handler := range subscriptions {
+		if token := client.Subscribe(topic, byte(c.MQTT.QoS), handler); token.Wait() && token.Error() != nil {
+			log.Errorf("subscribe to %s error: %s", topic, token.Error())
+		}
+	}
+}
+
+// SetNSClient applies the forwarder settings to a UDP client of the main gateway.
+func (c *Config) SetNSClient(client *lds.NSClient) error {
+	port, err := strconv.Atoi(c.Forwarder.Port)
+	if err != nil {
+		return errors.New("network server UDP port must be a number")
+	}
+
+	client.Server = c.Forwarder.Server
+	client.Port = port
+	client.KeepAlive = time.Duration(c.Forwarder.KeepAlive) * time.Second
+	client.AckTimeout = time.Duration(c.Forwarder.AckTimeout) * time.Second
+	client.MaxMissedAcks = c.Forwarder.MaxMissedAcks
+	return nil
+}
+
+// GatewayNSClient returns a UDP client for an additional gateway, using its server override
+// and the main client settings otherwise.
+func (c *Config) GatewayNSClient(g *Gateway, main *lds.NSClient) (*lds.NSClient, error) {
+	client := &lds.NSClient{
+		Server:        main.Server,
+		Port:          main.Port,
+		KeepAlive:     main.KeepAlive,
+		AckTimeout:    main.AckTimeout,
+		MaxMissedAcks: main.MaxMissedAcks,
+	}
+	if g.Server != "" {
+		client.Server = g.Server
+	}
+	if g.Port != "" {
+		p, err := strconv.Atoi(g.Port)
+		if err != nil {
+			return nil, errors.New("UDP port must be a number")
+		}
+		client.Port = p
+	}
+	return client, nil
+}
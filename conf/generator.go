@@ -0,0 +1,121 @@
+package conf
+
+import (
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/iegomez/lds/lds"
+)
+
+// Encoded type generator names, an empty one sends the fixed value.
+const (
+	UniformGenerator    = "uniform"
+	NormalGenerator     = "normal"
+	RandomWalkGenerator = "random_walk"
+	SineGenerator       = "sine"
+	SawtoothGenerator   = "sawtooth"
+	CounterGenerator    = "counter"
+	CSVGenerator        = "csv"
+)
+
+// Generators lists the generator names.
+var Generators = []string{UniformGenerator, NormalGenerator, RandomWalkGenerator, SineGenerator, SawtoothGenerator, CounterGenerator, CSVGenerator}
+
+// generatorConf holds the options a generator is built from, to rebuild it when they change.
+type generatorConf struct {
+	Generator string
+	Value     float64
+	MinValue  float64
+	MaxValue  float64
+	StdDev    float64
+	Step      float64
+	Period    float64
+	CSVFile   string
+	CSVColumn string
+}
+
+func (et *EncodedType) generatorConf() generatorConf {
+	return generatorConf{
+		Generator: et.Generator,
+		Value:     et.Value,
+		MinValue:  et.MinValue,
+		MaxValue:  et.MaxValue,
+		StdDev:    et.StdDev,
+		Step:      et.Step,
+		Period:    et.Period,
+		CSVFile:   et.CSVFile,
+		CSVColumn: et.CSVColumn,
+	}
+}
+
+// Copy returns the encoded type options with a generator of their own, e.g. for another device.
+func (et *EncodedType) Copy() *EncodedType {
+	c := *et
+	c.generator, c.appliedGenerator, c.generatorStart = nil, generatorConf{}, time.Time{}
+	return &c
+}
+
+// WithGenerators returns a copy of the configuration whose encoded types have generators of
+// their own, so that every fleet device advances its own counters, walks and CSV rows.
+func (c *Config) WithGenerators() *Config {
+	gc := *c
+	gc.EncodedType = make([]*EncodedType, len(c.EncodedType))
+	for i, et := range c.EncodedType {
+		gc.EncodedType[i] = et.Copy()
+	}
+	return &gc
+}
+
+// value returns the value to encode: the fixed one or the next one of its generator, which
+// keeps its state between uplinks until its options change.
+func (et *EncodedType) value(now time.Time) (float64, error) {
+	if et.Generator == "" {
+		return et.Value, nil
+	}
+
+	if gc := et.generatorConf(); et.generator == nil || gc != et.appliedGenerator {
+		g, err := gc.build()
+		if err != nil {
+			return 0, err
+		}
+		et.generator = g
+		et.appliedGenerator = gc
+		et.generatorStart = now
+	}
+
+	return et.generator.Next(now.Sub(et.generatorStart)), nil
+}
+
+func (gc generatorConf) build() (lds.Generator, error) {
+	period := time.Duration(gc.Period * float64(time.Second))
+	switch gc.Generator {
+	case UniformGenerator:
+		return lds.Uniform{Min: gc.MinValue, Max: gc.MaxValue}, nil
+	case NormalGenerator:
+		return lds.Normal{Mean: gc.Value, StdDev: gc.StdDev, Min: gc.MinValue, Max: gc.MaxValue}, nil
+	case RandomWalkGenerator:
+		return &lds.RandomWalk{Start: gc.Value, Step: gc.Step, Min: gc.MinValue, Max: gc.MaxValue}, nil
+	case SineGenerator:
+		return lds.Sine{Min: gc.MinValue, Max: gc.MaxValue, Period: period}, nil
+	case SawtoothGenerator:
+		return lds.Sawtooth{Min: gc.MinValue, Max: gc.MaxValue, Period: period}, nil
+	case CounterGenerator:
+		return &lds.Counter{Start: gc.Value, Step: gc.Step, Min: gc.MinValue, Max: gc.MaxValue}, nil
+	case CSVGenerator:
+		f, err := os.Open(gc.CSVFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		values, err := lds.LoadCSVColumn(f, gc.CSVColumn)
+		if err != nil {
+			return nil, errors.Wrap(err, gc.CSVFile)
+		}
+		return &lds.Replay{Values: values}, nil
+	}
+
+	return nil, errors.Errorf("unknown generator %q", gc.Generator)
+}
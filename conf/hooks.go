@@ -0,0 +1,298 @@
+package conf
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/pkg/errors"
+	"github.com/robertkrimen/otto"
+
+	"github.com/iegomez/lds/lds"
+)
+
+// Behaviour holds the JS hooks that model the device firmware.
+type Behaviour struct {
+	Enabled       bool   `toml:"enabled"`
+	Script        string `toml:"script"`
+	TimerInterval int    `toml:"timer_interval"` //Seconds between onTimer calls, 0 to disable them.
+}
+
+// DefaultHooksScript is the hooks script used when the configuration has none.
+var DefaultHooksScript = `
+// onDownlink is called with every data downlink received by the device.
+//  - fPort is the downlink fPort, null when it has none
+//  - bytes is the decrypted payload, an array of bytes
+// onTimer is called every timer interval.
+// Both may read the device object (devEUI, devAddr, joined, ulFcnt, dlFcnt, position) and modify
+// its fPort, confirmed, spreadFactor, bandwidth, ulFcnt and dlFcnt, and may schedule reply uplinks
+// with sendUplink(fPort, bytes, delayMs, confirmed). Global variables keep their values between calls.
+function onDownlink(fPort, bytes) {
+}
+
+function onTimer() {
+}
+`
+
+// HookUplink is an uplink scheduled by a hook.
+type HookUplink struct {
+	FPort     uint8
+	Payload   []byte
+	Confirmed bool
+	Delay     time.Duration
+}
+
+// MType returns the message type of the uplink.
+func (u *HookUplink) MType() lorawan.MType {
+	if u.Confirmed {
+		return lorawan.ConfirmedDataUp
+	}
+	return lorawan.UnconfirmedDataUp
+}
+
+// HookResult is what a hook call asked for: the uplinks it scheduled and the uplink settings it
+// changed on the device object, nil when left as they were.
+type HookResult struct {
+	Uplinks      []*HookUplink
+	FPort        *int
+	SpreadFactor *int
+	Bandwidth    *int
+	MType        *lorawan.MType
+}
+
+// Apply writes the uplink settings the hook changed to the configuration.
+func (r *HookResult) Apply(c *Config) {
+	if r.FPort != nil {
+		c.RawPayload.FPort = *r.FPort
+	}
+	if r.SpreadFactor != nil {
+		c.DR.SpreadFactor = *r.SpreadFactor
+	}
+	if r.Bandwidth != nil {
+		c.DR.Bandwidth = *r.Bandwidth
+	}
+	if r.MType != nil {
+		c.Device.MType = *r.MType
+	}
+}
+
+// Hooks runs the behaviour script. The VM is kept between calls so the script may hold state
+// in global variables; calls are serialized.
+type Hooks struct {
+	sync.Mutex
+	config  *Config
+	vm      *otto.Otto
+	uplinks []*HookUplink
+}
+
+// NewHooks loads the behaviour script into a new VM.
+func (c *Config) NewHooks() (*Hooks, error) {
+	h := &Hooks{
+		config: c,
+		vm:     otto.New(),
+	}
+	h.vm.SetStackDepthLimit(32)
+	if err := h.vm.Set("sendUplink", h.sendUplink); err != nil {
+		return nil, err
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	if err := h.run(func() (otto.Value, error) { return h.vm.Run(c.Behaviour.Script) }); err != nil {
+		return nil, errors.Wrap(err, "couldn't load hooks script")
+	}
+	return h, nil
+}
+
+// OnDownlink calls onDownlink with the downlink port and payload.
+func (h *Hooks) OnDownlink(d *lds.Device, dl *lds.Downlink) (*HookResult, error) {
+	h.Lock()
+	defer h.Unlock()
+
+	fPort := otto.NullValue()
+	if dl.FPort != nil {
+		fPort, _ = h.vm.ToValue(int(*dl.FPort))
+	}
+
+	bytes, err := h.vm.Object("[]")
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range dl.Payload {
+		if _, err := bytes.Call("push", int(b)); err != nil {
+			return nil, err
+		}
+	}
+
+	return h.call(d, "onDownlink", fPort, bytes.Value())
+}
+
+// OnTimer calls onTimer.
+func (h *Hooks) OnTimer(d *lds.Device) (*HookResult, error) {
+	h.Lock()
+	defer h.Unlock()
+	return h.call(d, "onTimer")
+}
+
+// call runs a hook when the script defines it, exposing the device and writing back its counters;
+// the configuration is left to the caller, see HookResult.Apply. The caller holds the lock, as values
+// passed to the hook are made by the VM too.
+func (h *Hooks) call(d *lds.Device, name string, args ...interface{}) (*HookResult, error) {
+	fn, err := h.vm.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if !fn.IsFunction() {
+		return &HookResult{}, nil
+	}
+
+	device := h.device(d)
+	if err := h.vm.Set("device", device); err != nil {
+		return nil, err
+	}
+
+	h.uplinks = nil
+	if err := h.run(func() (otto.Value, error) { return fn.Call(otto.NullValue(), args...) }); err != nil {
+		return nil, errors.Wrapf(err, "%s error", name)
+	}
+
+	result, err := h.apply(d, device)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s error", name)
+	}
+	result.Uplinks = h.uplinks
+	return result, nil
+}
+
+// run runs f interrupting it after the configured max execution time.
+func (h *Hooks) run(f func() (otto.Value, error)) (err error) {
+	defer func() {
+		if caught := recover(); caught != nil {
+			err = fmt.Errorf("%s", caught)
+		}
+	}()
+
+	interrupt := make(chan func(), 1)
+	h.vm.Interrupt = interrupt
+	timer := time.AfterFunc(time.Duration(h.config.RawPayload.MaxExecTime)*time.Millisecond, func() {
+		interrupt <- func() {
+			panic(errors.New("execution timeout"))
+		}
+	})
+	defer timer.Stop()
+
+	_, err = f()
+	return err
+}
+
+// device returns the device object exposed to the script.
+func (h *Hooks) device(d *lds.Device) map[string]interface{} {
+	device := map[string]interface{}{
+		"devEUI":       d.DevEUI.String(),
+		"devAddr":      lds.DevAddressToHex(d.DevAddr),
+		"joined":       d.Joined,
+		"ulFcnt":       int(d.UlFcnt),
+		"dlFcnt":       int(d.DlFcnt),
+		"fPort":        h.config.RawPayload.FPort,
+		"confirmed":    h.config.Device.MType == lorawan.ConfirmedDataUp,
+		"spreadFactor": h.config.DR.SpreadFactor,
+		"bandwidth":    h.config.DR.Bandwidth,
+	}
+	if d.Position != nil {
+		device["position"] = map[string]interface{}{
+			lds.LatitudeField:  d.Position.Latitude,
+			lds.LongitudeField: d.Position.Longitude,
+			lds.AltitudeField:  d.Position.Altitude,
+		}
+	}
+	return device
+}
+
+// apply writes the device object counters back to the device and returns the uplink settings
+// the hook changed.
+func (h *Hooks) apply(d *lds.Device, device map[string]interface{}) (*HookResult, error) {
+	before := h.device(d)
+	changed := func(key string) (*int, error) {
+		v, err := intField(device, key)
+		if err != nil || v == before[key] {
+			return nil, err
+		}
+		return &v, nil
+	}
+
+	var err error
+	result := &HookResult{}
+	if result.FPort, err = changed("fPort"); err != nil {
+		return nil, err
+	}
+	if result.SpreadFactor, err = changed("spreadFactor"); err != nil {
+		return nil, err
+	}
+	if result.Bandwidth, err = changed("bandwidth"); err != nil {
+		return nil, err
+	}
+	if confirmed, ok := device["confirmed"].(bool); ok && confirmed != before["confirmed"] {
+		mType := lorawan.UnconfirmedDataUp
+		if confirmed {
+			mType = lorawan.ConfirmedDataUp
+		}
+		result.MType = &mType
+	}
+
+	ulFcnt, err := intField(device, "ulFcnt")
+	if err != nil {
+		return nil, err
+	}
+	dlFcnt, err := intField(device, "dlFcnt")
+	if err != nil {
+		return nil, err
+	}
+	if uint32(ulFcnt) != d.UlFcnt || uint32(dlFcnt) != d.DlFcnt {
+		if err := d.SetValues(ulFcnt, dlFcnt, int(d.DevNonce), int(d.JoinNonce)); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// sendUplink is the JS sendUplink(fPort, bytes, delayMs, confirmed) function.
+func (h *Hooks) sendUplink(call otto.FunctionCall) otto.Value {
+	fPort, err := call.Argument(0).ToInteger()
+	if err != nil || fPort < 0 || fPort > 255 {
+		panic(call.Otto.MakeRangeError("sendUplink: fPort must be a number between 0 and 255"))
+	}
+
+	u := &HookUplink{FPort: uint8(fPort), Payload: []byte{}}
+	if bytes := call.Argument(1); bytes.IsObject() {
+		exported, err := bytes.Export()
+		if err == nil {
+			u.Payload, err = interfaceToByteSlice(exported)
+		}
+		if err != nil {
+			panic(call.Otto.MakeTypeError(fmt.Sprintf("sendUplink: %s", err)))
+		}
+		if u.Payload == nil {
+			u.Payload = []byte{}
+		}
+	}
+	if delay, err := call.Argument(2).ToInteger(); err == nil && delay > 0 {
+		u.Delay = time.Duration(delay) * time.Millisecond
+	}
+	u.Confirmed, _ = call.Argument(3).ToBoolean()
+
+	h.uplinks = append(h.uplinks, u)
+	return otto.UndefinedValue()
+}
+
+func intField(m map[string]interface{}, key string) (int, error) {
+	switch v := m[key].(type) {
+	case int:
+		return v, nil
+	case int64:
+		return int(v), nil
+	case float64:
+		return int(v), nil
+	}
+	return 0, errors.Errorf("device.%s must be a number, got %v", key, m[key])
+}
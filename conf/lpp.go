@@ -0,0 +1,55 @@
+package conf
+
+import (
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iegomez/lds/lds"
+)
+
+type LPPChannel struct {
+	Channel     int       `toml:"channel"`
+	Type        string    `toml:"type"`         //LPP type name, e.g. "temperature", "humidity", "gps" or "accelerometer".
+	Values      []float64 `toml:"values"`       //One value, or three for accelerometer, gyrometer and gps.
+	UsePosition bool      `toml:"use_position"` //Take gps values from the device position.
+}
+
+// LPPPayload encodes the LPP channels as a Cayenne LPP payload.
+func (c *Config) LPPPayload(d *lds.Device) ([]byte, error) {
+	values := make([]lds.LPPValue, 0, len(c.LPP))
+	for _, ch := range c.LPP {
+		t, err := lds.ParseLPPType(ch.Type)
+		if err != nil {
+			return nil, errors.Wrapf(err, "channel %d", ch.Channel)
+		}
+		if ch.Channel < 0 || ch.Channel > 255 {
+			return nil, errors.Errorf("channel %d out of range", ch.Channel)
+		}
+
+		v := lds.LPPValue{Channel: uint8(ch.Channel), Type: t, Values: ch.Values}
+		if ch.UsePosition && t == lds.LPPGPS {
+			if d == nil || d.Position == nil {
+				return nil, errors.Errorf("channel %d: device has no position", ch.Channel)
+			}
+			v.Values = []float64{d.Position.Latitude, d.Position.Longitude, d.Position.Altitude}
+		}
+		values = append(values, v)
+	}
+	return lds.EncodeLPP(values)
+}
+
+// LogLPPDownlink logs the decoded downlink payload when the device uses Cayenne LPP.
+func (c *Config) LogLPPDownlink(dl *lds.Downlink) {
+	if !c.RawPayload.UseLPP || len(dl.Payload) == 0 {
+		return
+	}
+
+	values, err := lds.DecodeLPP(dl.Payload)
+	if err != nil {
+		log.Warnf("couldn't decode LPP downlink: %s", err)
+		return
+	}
+	for _, v := range values {
+		log.Infof("LPP downlink: %s", v)
+	}
+}
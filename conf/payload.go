@@ -0,0 +1,225 @@
+package conf
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/robertkrimen/otto"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iegomez/lds/lds"
+)
+
+// Payload builds the uplink payload of the device: the raw hex bytes, the JS encoder result,
+// the Cayenne LPP channels or the encoded types, in that order of precedence.
+func (c *Config) Payload(d *lds.Device) ([]byte, error) {
+	if c.RawPayload.UseRaw {
+		payload, err := hex.DecodeString(c.RawPayload.Payload)
+		if err != nil {
+			return nil, errors.Wrap(err, "couldn't decode hex payload")
+		}
+		return payload, nil
+	}
+
+	if c.RawPayload.UseEncoder {
+		payload, err := c.EncodeToBytes(d)
+		if err != nil {
+			return nil, errors.Wrap(err, "couldn't encode js object")
+		}
+		return payload, nil
+	}
+
+	if c.RawPayload.UseLPP {
+		payload, err := c.LPPPayload(d)
+		if err != nil {
+			return nil, errors.Wrap(err, "couldn't encode LPP payload")
+		}
+		return payload, nil
+	}
+
+	return c.EncodedPayload(d)
+}
+
+// EncodedPayload packs the encoded types.
+func (c *Config) EncodedPayload(d *lds.Device) ([]byte, error) {
+	pb := &lds.PayloadBuilder{}
+	now := time.Now()
+	for _, v := range c.EncodedType {
+		if err := v.encode(pb, d, now); err != nil {
+			return nil, errors.Wrapf(err, "couldn't encode %s", v.Name)
+		}
+	}
+	return pb.Bytes(), nil
+}
+
+// EncodeToBytes encodes the payload to a slice of bytes.
+// Taken from github.com/brocaar/lora-app-server.
+func (c *Config) EncodeToBytes(d *lds.Device) (b []byte, err error) {
+	defer func() {
+		if caught := recover(); caught != nil {
+			err = fmt.Errorf("%s", caught)
+		}
+	}()
+
+	script := c.RawPayload.Script + "\n\nEncode(fPort, obj);\n"
+
+	vm := otto.New()
+	vm.Interrupt = make(chan func(), 1)
+	vm.SetStackDepthLimit(32)
+	var jsonData interface{}
+	err = json.Unmarshal([]byte(c.RawPayload.Obj), &jsonData)
+	if err != nil {
+		log.Errorf("couldn't unmarshal object: %s", err)
+		return nil, err
+	}
+	log.Debugf("JS object: %v", jsonData)
+	vm.Set("obj", jsonData)
+	vm.Set("fPort", c.RawPayload.FPort)
+	if d != nil && d.Position != nil {
+		vm.Set("position", map[string]interface{}{
+			lds.LatitudeField:  d.Position.Latitude,
+			lds.LongitudeField: d.Position.Longitude,
+			lds.AltitudeField:  d.Position.Altitude,
+		})
+	}
+
+	go func() {
+		time.Sleep(time.Duration(c.RawPayload.MaxExecTime) * time.Millisecond)
+		vm.Interrupt <- func() {
+			panic(errors.New("execution timeout"))
+		}
+	}()
+
+	var val otto.Value
+	val, err = vm.Run(script)
+	if err != nil {
+		return nil, errors.Wrap(err, "js vm error")
+	}
+	if !val.IsObject() {
+		return nil, errors.New("function must return an array")
+	}
+
+	var out interface{}
+	out, err = val.Export()
+	if err != nil {
+		return nil, errors.Wrap(err, "export error")
+	}
+
+	return interfaceToByteSlice(out)
+}
+
+// encode writes the encoded type value, taken from its generator or the device position. Schema
+// fields are written with their bits, the rest with num_bytes; position values with neither use
+// the default position representation.
+func (et *EncodedType) encode(pb *lds.PayloadBuilder, d *lds.Device, now time.Time) error {
+	var value float64
+	if et.Source != "" {
+		if d == nil || d.Position == nil {
+			return errors.New("device has no position")
+		}
+		if et.NumBytes == 0 && et.Bits == 0 {
+			arr, err := d.Position.EncodeField(et.Source)
+			if err != nil {
+				return err
+			}
+			pb.WriteBytes(arr)
+			return nil
+		}
+
+		var err error
+		if value, err = d.Position.Field(et.Source); err != nil {
+			return err
+		}
+	} else {
+		var err error
+		if value, err = et.value(now); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case et.Bits > 0:
+		return pb.WriteField(lds.Field{
+			Type:         et.Type,
+			Bits:         et.Bits,
+			LittleEndian: et.LittleEndian,
+			Scale:        et.Scale,
+			Offset:       et.Offset,
+		}, value)
+	case et.IsFloat:
+		pb.WriteBytes(lds.GenerateFloat(float32(value), float32(et.MaxValue), int32(et.NumBytes)))
+	default:
+		pb.WriteBytes(lds.GenerateInt(int32(value), int32(et.NumBytes)))
+	}
+	return nil
+}
+
+// Taken from github.com/brocaar/lora-app-server.
+func interfaceToByteSlice(obj interface{}) ([]byte, error) {
+	if obj == nil {
+		return nil, errors.New("value must not be nil")
+	}
+
+	if reflect.TypeOf(obj).Kind() != reflect.Slice {
+		return nil, errors.New("value must be an array")
+	}
+
+	s := reflect.ValueOf(obj)
+	l := s.Len()
+
+	var out []byte
+	for i := 0; i < l; i++ {
+		var b int64
+
+		el := s.Index(i).Interface()
+		switch v := el.(type) {
+		case int:
+			b = int64(v)
+		case uint:
+			b = int64(v)
+		case uint8:
+			b = int64(v)
+		case int8:
+			b = int64(v)
+		case uint16:
+			b = int64(v)
+		case int16:
+			b = int64(v)
+		case uint32:
+			b = int64(v)
+		case int32:
+			b = int64(v)
+		case uint64:
+			b = int64(v)
+			if uint64(b) != v {
+				return nil, fmt.Errorf("array value must be in byte range (0 - 255), got: %d", v)
+			}
+		case int64:
+			b = int64(v)
+		case float32:
+			b = int64(v)
+			if float32(b) != v {
+				return nil, fmt.Errorf("array value must be in byte range (0 - 255), got: %f", v)
+			}
+		case float64:
+			b = int64(v)
+			if float64(b) != v {
+				return nil, fmt.Errorf("array value must be in byte range (0 - 255), got: %f", v)
+			}
+		default:
+			return nil, fmt.Errorf("array value must be an array of ints or floats, got: %T", el)
+		}
+
+		if b < 0 || b > 255 {
+			return nil, fmt.Errorf("array value must be in byte range (0 - 255), got: %d", b)
+		}
+
+		out = append(out, byte(b))
+	}
+
+	return out, nil
+}
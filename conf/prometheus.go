@@ -0,0 +1,31 @@
+package conf
+
+import (
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iegomez/lds/lds"
+)
+
+// Prometheus holds the optional metrics endpoint settings.
+type Prometheus struct {
+	Listen string `toml:"listen"` //Address such as ":9100", the endpoint is disabled when empty.
+}
+
+// ServePrometheus serves the simulator metrics at /metrics on the configured address, when set.
+func (c *Config) ServePrometheus() {
+	if c.Prometheus.Listen == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", lds.DefaultTelemetry)
+	server := &http.Server{Addr: c.Prometheus.Listen, Handler: mux}
+	go func() {
+		log.Infof("serving Prometheus metrics at %s/metrics", c.Prometheus.Listen)
+		if err := server.ListenAndServe(); err != nil {
+			log.Errorf("Prometheus endpoint error: %s", err)
+		}
+	}()
+}
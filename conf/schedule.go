@@ -0,0 +1,125 @@
+package conf
+
+import (
+	"encoding/hex"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/pkg/errors"
+
+	"github.com/iegomez/lds/lds"
+)
+
+// Message schedule names.
+const (
+	IntervalSchedule = "interval"
+	PoissonSchedule  = "poisson"
+	CronSchedule     = "cron"
+)
+
+// Message payload sources, an empty one uses the data configuration.
+const (
+	EncoderSource = "encoder"
+	LPPSource     = "lpp"
+	EncodedSource = "encoded_type"
+)
+
+// Message is an uplink of the message mix, sent on its own schedule.
+type Message struct {
+	Name      string  `toml:"name"`
+	FPort     int     `toml:"fport"`
+	Confirmed bool    `toml:"confirmed"`
+	Payload   string  `toml:"payload"`  //Hex bytes, overriding the source.
+	Source    string  `toml:"source"`   //"encoder", "lpp", "encoded_type" or empty for the configured payload.
+	Schedule  string  `toml:"schedule"` //"interval", "poisson" or "cron".
+	Interval  float64 `toml:"interval"` //Seconds between uplinks for "interval", their mean for "poisson".
+	Jitter    float64 `toml:"jitter"`   //Seconds an "interval" uplink may be sent earlier or later.
+	Cron      string  `toml:"cron"`     //"minute hour day-of-month month day-of-week" for "cron".
+}
+
+// MType returns the message type of the message uplinks.
+func (m *Message) MType() lorawan.MType {
+	if m.Confirmed {
+		return lorawan.ConfirmedDataUp
+	}
+	return lorawan.UnconfirmedDataUp
+}
+
+// Build returns the message schedule.
+func (m *Message) Build() (lds.Schedule, error) {
+	seconds := func(s float64) time.Duration {
+		return time.Duration(s * float64(time.Second))
+	}
+
+	switch m.Schedule {
+	case IntervalSchedule:
+		if m.Interval <= 0 {
+			return nil, errors.Errorf("message %s: interval must be positive", m.Name)
+		}
+		return lds.Periodic{Interval: seconds(m.Interval), Jitter: seconds(m.Jitter)}, nil
+	case PoissonSchedule:
+		if m.Interval <= 0 {
+			return nil, errors.Errorf("message %s: interval must be positive", m.Name)
+		}
+		return lds.Poisson{Mean: seconds(m.Interval)}, nil
+	case CronSchedule:
+		cron, err := lds.ParseCron(m.Cron)
+		if err != nil {
+			return nil, errors.Wrapf(err, "message %s", m.Name)
+		}
+		return cron, nil
+	}
+	return nil, errors.Errorf("message %s: unknown schedule %q", m.Name, m.Schedule)
+}
+
+// Scheduler returns a scheduler for the message mix starting at start. Scheduler indexes
+// are the ones of c.Messages.
+func (c *Config) Scheduler(start time.Time) (*lds.Scheduler, error) {
+	if len(c.Messages) == 0 {
+		return nil, errors.New("no messages configured")
+	}
+
+	schedules := make([]lds.Schedule, len(c.Messages))
+	for i, m := range c.Messages {
+		var err error
+		if schedules[i], err = m.Build(); err != nil {
+			return nil, err
+		}
+	}
+	return lds.NewScheduler(start, schedules...), nil
+}
+
+// MessagePayload builds the payload of a message uplink from its own bytes or source.
+func (c *Config) MessagePayload(m *Message, d *lds.Device) ([]byte, error) {
+	if m.Payload != "" {
+		payload, err := hex.DecodeString(m.Payload)
+		if err != nil {
+			return nil, errors.Wrapf(err, "message %s: couldn't decode hex payload", m.Name)
+		}
+		return payload, nil
+	}
+
+	var (
+		payload []byte
+		err     error
+	)
+	switch m.Source {
+	case EncoderSource:
+		payload, err = c.EncodeToBytes(d)
+	case LPPSource:
+		payload, err = c.LPPPayload(d)
+	case EncodedSource:
+		payload, err = c.EncodedPayload(d)
+	case "":
+		payload, err = c.Payload(d)
+	default:
+		err = errors.Errorf("unknown source %q", m.Source)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "message %s", m.Name)
+	}
+	if payload == nil {
+		payload = []byte{}
+	}
+	return payload, nil
+}
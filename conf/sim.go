@@ -0,0 +1,165 @@
+package conf
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/iegomez/lds/lds"
+)
+
+// Path loss model names, NoModel keeps the rx_info RSSI and SNR.
+const (
+	NoModel          = "none"
+	FreeSpaceModel   = "free_space"
+	LogDistanceModel = "log_distance"
+	OkumuraHataModel = "okumura_hata"
+)
+
+type Propagation struct {
+	Model             string  `toml:"model"`              //"free_space", "log_distance", "okumura_hata" or empty to use rx_info values.
+	TXPower           float64 `toml:"tx_power"`           //Device TX power in dBm.
+	TXAntennaGain     float64 `toml:"tx_antenna_gain"`    //Device antenna gain in dBi.
+	ShadowFading      float64 `toml:"shadow_fading"`      //Standard deviation in dB of the shadowing.
+	NoiseFigure       float64 `toml:"noise_figure"`       //Gateway receiver noise figure in dB.
+	PathLossExponent  float64 `toml:"path_loss_exponent"` //Log-distance only.
+	ReferenceDistance float64 `toml:"reference_distance"` //Log-distance only, in meters.
+	ReferenceLoss     float64 `toml:"reference_loss"`     //Log-distance only, defaults to free space loss at the reference distance.
+	BaseHeight        float64 `toml:"base_height"`        //Okumura-Hata gateway antenna height in meters.
+	MobileHeight      float64 `toml:"mobile_height"`      //Okumura-Hata device antenna height in meters.
+	Environment       string  `toml:"environment"`        //Okumura-Hata "urban", "suburban" or "open".
+}
+
+// Build returns the configured propagation model, or nil when rx_info values should be used.
+func (p Propagation) Build() *lds.Propagation {
+	var model lds.PathLossModel
+	switch p.Model {
+	case FreeSpaceModel:
+		model = lds.FreeSpace{}
+	case LogDistanceModel:
+		model = lds.LogDistance{
+			Exponent:          p.PathLossExponent,
+			ReferenceDistance: p.ReferenceDistance,
+			ReferenceLoss:     p.ReferenceLoss,
+		}
+	case OkumuraHataModel:
+		model = lds.OkumuraHata{
+			BaseHeight:   p.BaseHeight,
+			MobileHeight: p.MobileHeight,
+			Environment:  p.Environment,
+		}
+	default:
+		return nil
+	}
+
+	return &lds.Propagation{
+		Model:         model,
+		TXPower:       p.TXPower,
+		TXAntennaGain: p.TXAntennaGain,
+		ShadowFading:  p.ShadowFading,
+		NoiseFigure:   p.NoiseFigure,
+	}
+}
+
+// Mobility model names, FixedModel keeps the device at its configured position.
+const (
+	FixedModel            = "fixed"
+	TrackModel            = "track"
+	ConstantVelocityModel = "constant_velocity"
+	RandomWaypointModel   = "random_waypoint"
+)
+
+type Mobility struct {
+	Model     string  `toml:"model"`      //"track", "constant_velocity", "random_waypoint" or empty for a fixed position.
+	TrackFile string  `toml:"track_file"` //GPX (.gpx) or CSV file replayed by "track".
+	Loop      bool    `toml:"loop"`       //Start the track over when it ends.
+	Speed     float64 `toml:"speed"`      //m/s for "constant_velocity" and track points without time.
+	Bearing   float64 `toml:"bearing"`    //Degrees clockwise from north for "constant_velocity".
+	ClimbRate float64 `toml:"climb_rate"` //m/s for "constant_velocity".
+	Radius    float64 `toml:"radius"`     //Meters around the device position for "random_waypoint".
+	MinSpeed  float64 `toml:"min_speed"`
+	MaxSpeed  float64 `toml:"max_speed"`
+	Pause     int     `toml:"pause"` //Seconds spent at each waypoint.
+}
+
+// Build returns the configured movement model starting from the given position, or nil for a fixed one.
+func (m Mobility) Build(start lds.Position) (lds.Mobility, error) {
+	switch m.Model {
+	case TrackModel:
+		f, err := os.Open(m.TrackFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		var track *lds.Track
+		if strings.EqualFold(filepath.Ext(m.TrackFile), ".gpx") {
+			track, err = lds.LoadGPXTrack(f, m.Speed)
+		} else {
+			track, err = lds.LoadCSVTrack(f, m.Speed)
+		}
+		if err != nil {
+			return nil, err
+		}
+		track.Loop = m.Loop
+		return track, nil
+	case ConstantVelocityModel:
+		return lds.ConstantVelocity{
+			Start:     start,
+			Speed:     m.Speed,
+			Bearing:   m.Bearing,
+			ClimbRate: m.ClimbRate,
+		}, nil
+	case RandomWaypointModel:
+		if m.Radius <= 0 {
+			return nil, errors.New("random waypoint radius must be positive")
+		}
+		return &lds.RandomWaypoint{
+			Center:   start,
+			Radius:   m.Radius,
+			MinSpeed: m.MinSpeed,
+			MaxSpeed: m.MaxSpeed,
+			Pause:    time.Duration(m.Pause) * time.Second,
+		}, nil
+	}
+
+	return nil, nil
+}
+
+// Air is shared by every device built in this process so that their transmissions may collide.
+var Air = &lds.Air{}
+
+type Channel struct {
+	UplinkLoss       float64 `toml:"uplink_loss"`       //Probability of losing an uplink.
+	DownlinkLoss     float64 `toml:"downlink_loss"`     //Probability of losing a downlink.
+	BurstStart       float64 `toml:"burst_start"`       //Probability per frame of entering a loss burst.
+	BurstEnd         float64 `toml:"burst_end"`         //Probability per frame of leaving a loss burst.
+	BurstLoss        float64 `toml:"burst_loss"`        //Probability of losing a frame during a burst.
+	Collisions       bool    `toml:"collisions"`        //Detect overlapping transmissions between simulated devices.
+	CaptureThreshold float64 `toml:"capture_threshold"` //dB a frame must exceed overlapping ones by to survive.
+}
+
+// Build returns the configured channel. Transmissions go through air when collisions are enabled.
+func (c Channel) Build(air *lds.Air) *lds.Channel {
+	loss := func(probability float64) *lds.Loss {
+		return &lds.Loss{
+			Probability: probability,
+			BurstStart:  c.BurstStart,
+			BurstEnd:    c.BurstEnd,
+			BurstLoss:   c.BurstLoss,
+		}
+	}
+
+	channel := &lds.Channel{
+		UplinkLoss:   loss(c.UplinkLoss),
+		DownlinkLoss: loss(c.DownlinkLoss),
+	}
+	if c.Collisions {
+		air.CaptureThreshold = c.CaptureThreshold
+		channel.Air = air
+	}
+	return channel
+}
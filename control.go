@@ -331,6 +331,17 @@ var macCommands = []*macCommandItem{
 	},
 }
 
+// selectedMACCommands returns the MAC commands checked to be sent with uplinks.
+func selectedMACCommands() []*lorawan.MACCommand {
+	var fOpts []*lorawan.MACCommand
+	for i := 0; i < len(macCommands); i++ {
+		if macCommands[i].Use.Value {
+			fOpts = append(fOpts, &macCommands[i].MACCommand)
+		}
+	}
+	return fOpts
+}
+
 func macResetGuiValues() {
 	fCtrlWidgets.ACK.Value = fCtrl.ACK
 	fCtrlWidgets.ADR.Value = fCtrl.ADR
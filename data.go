@@ -1,53 +1,24 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"reflect"
 	"strconv"
-	"time"
+	"strings"
 
 	l "gioui.org/layout"
 	"gioui.org/unit"
 	"gioui.org/widget"
 	"gioui.org/widget/material"
-	"github.com/pkg/errors"
-	"github.com/robertkrimen/otto"
+	"github.com/iegomez/lds/conf"
 	"github.com/scartill/giox"
 	xmat "github.com/scartill/giox/material"
 	log "github.com/sirupsen/logrus"
 )
 
-type encodedType struct {
-	Name     string  `toml:"name"`
-	Value    float64 `toml:"value"`
-	MaxValue float64 `toml:"max_value"`
-	MinValue float64 `toml:"min_value"`
-	IsFloat  bool    `toml:"is_float"`
-	NumBytes int     `toml:"num_bytes"`
-}
-
-//rawPayload holds optional raw bytes payload (hex encoded).
-type rawPayload struct {
-	Payload     string `toml:"payload"`
-	UseRaw      bool   `toml:"use_raw"`
-	Script      string `toml:"script"`
-	UseEncoder  bool   `toml:"use_encoder"`
-	MaxExecTime int    `toml:"max_exec_time"`
-	Obj         string `toml:"js_object"`
-	FPort       int    `toml:"fport"`
-}
-
 var openScript bool
-var defaultScript = `
-// Encode encodes the given object into an array of bytes.
-//  - fPort contains the LoRaWAN fPort number
-//  - obj is an object, e.g. {"temperature": 22.5}
-// The function must return an array of bytes, e.g. [225, 230, 255, 0]
-function Encode(fPort, obj) {
-	return [];
-}
-`
+
+// generatorHint lists the encoded type generators in their editor placeholder.
+var generatorHint = fmt.Sprintf("<%s>", strings.Join(conf.Generators, "/"))
 
 type encodedTypeWidgets struct {
 	Name         widget.Editor
@@ -57,6 +28,18 @@ type encodedTypeWidgets struct {
 	Value        widget.Editor
 	MaxValue     widget.Editor
 	MinValue     widget.Editor
+	Source       widget.Editor
+	Generator    widget.Editor
+	StdDev       widget.Editor
+	Step         widget.Editor
+	Period       widget.Editor
+	CSVFile      widget.Editor
+	CSVColumn    widget.Editor
+	Type         widget.Editor
+	Bits         widget.Editor
+	LittleEndian widget.Bool
+	Scale        widget.Editor
+	Offset       widget.Editor
 }
 
 // MaxEncodedTypes defines max number of simulated data types to send
@@ -105,6 +88,23 @@ func dataResetGuiValues() {
 			fmt.Sprintf("%f", config.EncodedType[i].MaxValue))
 		encodedWidgets[i].MinValue.SetText(
 			fmt.Sprintf("%f", config.EncodedType[i].MinValue))
+		encodedWidgets[i].Source.SetText(config.EncodedType[i].Source)
+		encodedWidgets[i].Generator.SetText(config.EncodedType[i].Generator)
+		encodedWidgets[i].StdDev.SetText(
+			fmt.Sprintf("%f", config.EncodedType[i].StdDev))
+		encodedWidgets[i].Step.SetText(
+			fmt.Sprintf("%f", config.EncodedType[i].Step))
+		encodedWidgets[i].Period.SetText(
+			fmt.Sprintf("%f", config.EncodedType[i].Period))
+		encodedWidgets[i].CSVFile.SetText(config.EncodedType[i].CSVFile)
+		encodedWidgets[i].CSVColumn.SetText(config.EncodedType[i].CSVColumn)
+		encodedWidgets[i].Type.SetText(config.EncodedType[i].Type)
+		encodedWidgets[i].Bits.SetText(strconv.Itoa(config.EncodedType[i].Bits))
+		encodedWidgets[i].LittleEndian.Value = config.EncodedType[i].LittleEndian
+		encodedWidgets[i].Scale.SetText(
+			fmt.Sprintf("%f", config.EncodedType[i].Scale))
+		encodedWidgets[i].Offset.SetText(
+			fmt.Sprintf("%f", config.EncodedType[i].Offset))
 
 	}
 
@@ -127,6 +127,18 @@ func dataForm(th *material.Theme) l.FlexChild {
 		extractFloat(&encodedWidgets[i].Value, &config.EncodedType[i].Value, 0)
 		extractFloat(&encodedWidgets[i].MaxValue, &config.EncodedType[i].MaxValue, 0)
 		extractFloat(&encodedWidgets[i].MinValue, &config.EncodedType[i].MinValue, 0)
+		config.EncodedType[i].Source = encodedWidgets[i].Source.Text()
+		config.EncodedType[i].Generator = encodedWidgets[i].Generator.Text()
+		extractFloat(&encodedWidgets[i].StdDev, &config.EncodedType[i].StdDev, 0)
+		extractFloat(&encodedWidgets[i].Step, &config.EncodedType[i].Step, 0)
+		extractFloat(&encodedWidgets[i].Period, &config.EncodedType[i].Period, 0)
+		config.EncodedType[i].CSVFile = encodedWidgets[i].CSVFile.Text()
+		config.EncodedType[i].CSVColumn = encodedWidgets[i].CSVColumn.Text()
+		config.EncodedType[i].Type = encodedWidgets[i].Type.Text()
+		extractInt(&encodedWidgets[i].Bits, &config.EncodedType[i].Bits, 0)
+		config.EncodedType[i].LittleEndian = encodedWidgets[i].LittleEndian.Value
+		extractFloat(&encodedWidgets[i].Scale, &config.EncodedType[i].Scale, 0)
+		extractFloat(&encodedWidgets[i].Offset, &config.EncodedType[i].Offset, 0)
 	}
 
 	config.RawPayload.Script = funcEditor.Text()
@@ -149,7 +161,7 @@ func dataForm(th *material.Theme) l.FlexChild {
 	}
 
 	for addEncodedType.Clicked() {
-		et := &encodedType{
+		et := &conf.EncodedType{
 			Name:     "New type",
 			Value:    0,
 			MaxValue: 0,
@@ -163,17 +175,17 @@ func dataForm(th *material.Theme) l.FlexChild {
 	for i := 0; i < len(config.EncodedType); i++ {
 		for encodedWidgets[i].DeleteButton.Clicked() {
 			if len(config.EncodedType) == 1 {
-				config.EncodedType = make([]*encodedType, 0)
+				config.EncodedType = make([]*conf.EncodedType, 0)
 			} else {
 				copy(config.EncodedType[i:], config.EncodedType[i+1:])
-				config.EncodedType[len(config.EncodedType)-1] = &encodedType{}
+				config.EncodedType[len(config.EncodedType)-1] = &conf.EncodedType{}
 				config.EncodedType = config.EncodedType[:len(config.EncodedType)-1]
 			}
 		}
 	}
 
 	for clearScriptEditor.Clicked() {
-		config.RawPayload.Script = defaultScript
+		config.RawPayload.Script = conf.DefaultScript
 		funcEditor.SetText(config.RawPayload.Script)
 	}
 
@@ -182,7 +194,7 @@ func dataForm(th *material.Theme) l.FlexChild {
 	}
 
 	widgets := make([]l.FlexChild, 0)
-	if !openScript {
+	if !openScript && !openHooks {
 		widgets = append(widgets,
 			xmat.RigidSection(th, "Raw Data"),
 			xmat.RigidEditor(th, "Raw bytes in hex", "DEADBEEF", &rawBytesEditor),
@@ -228,10 +240,36 @@ func dataForm(th *material.Theme) l.FlexChild {
 						xmat.RigidEditor(th, "Value", "0", &etw.Value),
 						xmat.RigidEditor(th, "Max", "0", &etw.MaxValue),
 						xmat.RigidEditor(th, "Min", "0", &etw.MinValue),
+						xmat.RigidEditor(th, "Source", "<latitude/longitude/altitude>", &etw.Source),
+					)
+				}),
+				l.Rigid(func(gtx l.Context) l.Dimensions {
+					return l.Flex{Axis: l.Horizontal}.Layout(gtx,
+						xmat.RigidEditor(th, "Generator", generatorHint, &etw.Generator),
+						xmat.RigidEditor(th, "Std dev", "0", &etw.StdDev),
+						xmat.RigidEditor(th, "Step", "0", &etw.Step),
+						xmat.RigidEditor(th, "Period (s)", "0", &etw.Period),
+						xmat.RigidEditor(th, "CSV file", "<file>", &etw.CSVFile),
+						xmat.RigidEditor(th, "CSV column", "<name/index>", &etw.CSVColumn),
+					)
+				}),
+				l.Rigid(func(gtx l.Context) l.Dimensions {
+					return l.Flex{Axis: l.Horizontal}.Layout(gtx,
+						xmat.RigidEditor(th, "Type", "<uint/int/float>", &etw.Type),
+						xmat.RigidEditor(th, "Bits", "0", &etw.Bits),
+						xmat.RigidCheckBox(th, "Little endian", &etw.LittleEndian),
+						xmat.RigidEditor(th, "Scale", "1", &etw.Scale),
+						xmat.RigidEditor(th, "Offset", "0", &etw.Offset),
 					)
 				}),
 			)
 		}
+
+		widgets = append(widgets, lppWidgets(th)...)
+		widgets = append(widgets, messagesWidgets(th)...)
+		widgets = append(widgets, behaviourWidgets(th)...)
+	} else if openHooks {
+		widgets = append(widgets, hooksEditorWidgets(th)...)
 	} else {
 		widgets = append(widgets,
 			xmat.RigidSection(th, "JS Encoder"),
@@ -253,118 +291,3 @@ func dataForm(th *material.Theme) l.FlexChild {
 		})
 	})
 }
-
-// EncodeToBytes encodes the payload to a slice of bytes.
-// Taken from github.com/brocaar/lora-app-server.
-func EncodeToBytes() (b []byte, err error) {
-	defer func() {
-		if caught := recover(); caught != nil {
-			err = fmt.Errorf("%s", caught)
-		}
-	}()
-
-	script := config.RawPayload.Script + "\n\nEncode(fPort, obj);\n"
-
-	vm := otto.New()
-	vm.Interrupt = make(chan func(), 1)
-	vm.SetStackDepthLimit(32)
-	var jsonData interface{}
-	err = json.Unmarshal([]byte(config.RawPayload.Obj), &jsonData)
-	if err != nil {
-		log.Errorf("couldn't unmarshal object: %s", err)
-		return nil, err
-	}
-	log.Debugf("JS object: %v", jsonData)
-	vm.Set("obj", jsonData)
-	vm.Set("fPort", config.RawPayload.FPort)
-
-	go func() {
-		time.Sleep(time.Duration(config.RawPayload.MaxExecTime) * time.Millisecond)
-		vm.Interrupt <- func() {
-			panic(errors.New("execution timeout"))
-		}
-	}()
-
-	var val otto.Value
-	val, err = vm.Run(script)
-	if err != nil {
-		return nil, errors.Wrap(err, "js vm error")
-	}
-	if !val.IsObject() {
-		return nil, errors.New("function must return an array")
-	}
-
-	var out interface{}
-	out, err = val.Export()
-	if err != nil {
-		return nil, errors.Wrap(err, "export error")
-	}
-
-	return interfaceToByteSlice(out)
-}
-
-// Taken from github.com/brocaar/lora-app-server.
-func interfaceToByteSlice(obj interface{}) ([]byte, error) {
-	if obj == nil {
-		return nil, errors.New("value must not be nil")
-	}
-
-	if reflect.TypeOf(obj).Kind() != reflect.Slice {
-		return nil, errors.New("value must be an array")
-	}
-
-	s := reflect.ValueOf(obj)
-	l := s.Len()
-
-	var out []byte
-	for i := 0; i < l; i++ {
-		var b int64
-
-		el := s.Index(i).Interface()
-		switch v := el.(type) {
-		case int:
-			b = int64(v)
-		case uint:
-			b = int64(v)
-		case uint8:
-			b = int64(v)
-		case int8:
-			b = int64(v)
-		case uint16:
-			b = int64(v)
-		case int16:
-			b = int64(v)
-		case uint32:
-			b = int64(v)
-		case int32:
-			b = int64(v)
-		case uint64:
-			b = int64(v)
-			if uint64(b) != v {
-				return nil, fmt.Errorf("array value must be in byte range (0 - 255), got: %d", v)
-			}
-		case int64:
-			b = int64(v)
-		case float32:
-			b = int64(v)
-			if float32(b) != v {
-				return nil, fmt.Errorf("array value must be in byte range (0 - 255), got: %f", v)
-			}
-		case float64:
-			b = int64(v)
-			if float64(b) != v {
-				return nil, fmt.Errorf("array value must be in byte range (0 - 255), got: %f", v)
-			}
-		default:
-			return nil, fmt.Errorf("array value must be an array of ints or floats, got: %T", el)
-		}
-
-		if b < 0 || b > 255 {
-			return nil, fmt.Errorf("array value must be in byte range (0 - 255), got: %d", b)
-		}
-
-		out = append(out, byte(b))
-	}
-
-	return out, nil
-}
@@ -1,15 +1,12 @@
 package main
 
 import (
-	"encoding/hex"
 	"fmt"
 	"strconv"
+	"sync"
 	"time"
 
-	"github.com/brocaar/chirpstack-api/go/gw"
 	"github.com/brocaar/lorawan"
-	lwBand "github.com/brocaar/lorawan/band"
-	"github.com/golang/protobuf/ptypes"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/iegomez/lds/lds"
@@ -31,30 +28,13 @@ var (
 	mTypes        = map[lorawan.MType]string{lorawan.UnconfirmedDataUp: "UnconfirmedDataUp", lorawan.ConfirmedDataUp: "ConfirmedDataUp"}
 )
 
-// lds device related vars.
+// lds device related vars. uplinkMu serializes the frames the device sends from the run loop,
+// the message mix and the hooks, along with the hook calls that may change its counters.
 var (
-	cDevice *lds.Device
+	cDevice  *lds.Device
+	uplinkMu sync.Mutex
 )
 
-type device struct {
-	DevEUI        string             `toml:"eui"`
-	DevAddress    string             `toml:"address"`
-	NwkSEncKey    string             `toml:"network_session_encription_key"`
-	SNwkSIntKey   string             `toml:"serving_network_session_integrity_key"`    //For Lorawan 1.0 this is the same as the NwkSEncKey
-	FNwkSIntKey   string             `toml:"forwarding_network_session_integrity_key"` //For Lorawan 1.0 this is the same as the NwkSEncKey
-	AppSKey       string             `toml:"application_session_key"`
-	Marshaler     string             `toml:"marshaler"`
-	NwkKey        string             `toml:"nwk_key"`  //Network key, used to be called application key for Lorawan 1.0
-	AppKey        string             `toml:"app_key"`  //Application key, for Lorawan 1.1
-	JoinEUI       string             `toml:"join_eui"` //JoinEUI for 1.1. (AppEUI on 1.0)
-	Major         lorawan.Major      `toml:"-"`
-	MACVersion    lorawan.MACVersion `toml:"mac_version"` //Lorawan MAC version
-	MType         lorawan.MType      `toml:"-"`
-	Profile       string             `toml:"profile"`
-	Joined        bool               `toml:"joined"`
-	SkipFCntCheck bool               `toml:"skip_fcnt_check"`
-}
-
 // Widgets
 var (
 	deviceEUIEdit      widget.Editor
@@ -72,6 +52,7 @@ var (
 	mTypeCombo         giox.Combo
 	profileCombo       giox.Combo
 	disableFCWCheckbox widget.Bool
+	diagnoseCheckbox   widget.Bool
 	joinButton         widget.Clickable
 	resetButton        widget.Clickable
 	setValuesButton    widget.Clickable
@@ -140,6 +121,7 @@ func deviceResetGuiValues() {
 	mTypeCombo.SelectItem(mTypes[config.Device.MType])
 	profileCombo.SelectItem(config.Device.Profile)
 	disableFCWCheckbox.Value = config.Device.SkipFCntCheck
+	diagnoseCheckbox.Value = config.Device.DiagnoseMIC
 }
 
 func deviceForm(th *material.Theme) l.FlexChild {
@@ -188,6 +170,7 @@ func deviceForm(th *material.Theme) l.FlexChild {
 	}
 
 	config.Device.SkipFCntCheck = disableFCWCheckbox.Value
+	config.Device.DiagnoseMIC = diagnoseCheckbox.Value
 
 	for joinButton.Clicked() {
 		join()
@@ -259,6 +242,7 @@ func deviceForm(th *material.Theme) l.FlexChild {
 	if !comboOpen {
 		rightWidgets = append(rightWidgets,
 			xmat.RigidCheckBox(th, "Disable frame counter validation", &disableFCWCheckbox),
+			xmat.RigidCheckBox(th, "Diagnose MIC failures", &diagnoseCheckbox),
 		)
 
 		buttons := []l.FlexChild{
@@ -303,111 +287,29 @@ func deviceForm(th *material.Theme) l.FlexChild {
 }
 
 func setDevice() {
-	//Build your node with known keys (ABP).
-	nwkSEncHexKey := config.Device.NwkSEncKey
-	sNwkSIntHexKey := config.Device.SNwkSIntKey
-	fNwkSIntHexKey := config.Device.FNwkSIntKey
-	appSHexKey := config.Device.AppSKey
-	devHexAddr := config.Device.DevAddress
-	devAddr, err := lds.HexToDevAddress(devHexAddr)
-	if err != nil {
-		log.Errorf("dev addr error: %s", err)
-	}
-
-	nwkSEncKey, err := lds.HexToKey(nwkSEncHexKey)
-	if err != nil {
-		log.Errorf("nwkSEncKey error: %s", err)
-	}
-
-	sNwkSIntKey, err := lds.HexToKey(sNwkSIntHexKey)
-	if err != nil {
-		log.Errorf("sNwkSIntKey error: %s", err)
-	}
-
-	fNwkSIntKey, err := lds.HexToKey(fNwkSIntHexKey)
-	if err != nil {
-		log.Errorf("fNwkSIntKey error: %s", err)
-	}
-
-	appSKey, err := lds.HexToKey(appSHexKey)
-	if err != nil {
-		log.Errorf("appskey error: %s", err)
-	}
-
-	devEUI, err := lds.HexToEUI(config.Device.DevEUI)
-	if err != nil {
-		log.Errorf("devEUI error: %s", err)
-		return
-	}
-
-	nwkHexKey := config.Device.NwkKey
-	appHexKey := config.Device.AppKey
-
-	appKey, err := lds.HexToKey(appHexKey)
-	if err != nil {
-		log.Errorf("appKey error: %s", err)
-		return
-	}
-	nwkKey, err := lds.HexToKey(nwkHexKey)
-	if err != nil {
-		log.Errorf("nwkKey error: %s", err)
-		return
-	}
-	joinEUI, err := lds.HexToEUI(config.Device.JoinEUI)
-	if err != nil {
-		log.Errorf("joinEUI error: %s", err)
-		return
-	}
-
 	if cDevice == nil {
-		cDevice = &lds.Device{
-			DevEUI:        devEUI,
-			DevAddr:       devAddr,
-			NwkSEncKey:    nwkSEncKey,
-			SNwkSIntKey:   sNwkSIntKey,
-			FNwkSIntKey:   fNwkSIntKey,
-			AppSKey:       appSKey,
-			AppKey:        appKey,
-			NwkKey:        nwkKey,
-			JoinEUI:       joinEUI,
-			Profile:       config.Device.Profile,
-			Major:         lorawan.Major(config.Device.Major),
-			MACVersion:    lorawan.MACVersion(config.Device.MACVersion),
-			SkipFCntCheck: config.Device.SkipFCntCheck,
+		d, restored, err := config.NewDevice()
+		if err != nil {
+			log.Errorln(err)
+			return
 		}
-
-		//Get redis info.
-		if cDevice.GetInfo() {
-			config.Device.NwkSEncKey = lds.KeyToHex(cDevice.NwkSEncKey)
-			config.Device.FNwkSIntKey = lds.KeyToHex(cDevice.FNwkSIntKey)
-			config.Device.SNwkSIntKey = lds.KeyToHex(cDevice.SNwkSIntKey)
-			config.Device.AppSKey = lds.KeyToHex(cDevice.AppSKey)
-			config.Device.DevAddress = lds.DevAddressToHex(cDevice.DevAddr)
-			ulFcnt := int(cDevice.UlFcnt)
-			dlFcnt := int(cDevice.DlFcnt)
-			devNonce := int(cDevice.DevNonce)
-			joinNonce := int(cDevice.JoinNonce)
-			ulFcntEdit.SetText(strconv.Itoa(ulFcnt))
-			dlFcntEdit.SetText(strconv.Itoa(dlFcnt))
-			devNonceEdit.SetText(strconv.Itoa(devNonce))
-			joinNonceEdit.SetText(strconv.Itoa(joinNonce))
+		cDevice = d
+		if restored {
+			ulFcntEdit.SetText(strconv.FormatUint(uint64(cDevice.UlFcnt), 10))
+			dlFcntEdit.SetText(strconv.FormatUint(uint64(cDevice.DlFcnt), 10))
+			devNonceEdit.SetText(strconv.FormatUint(uint64(cDevice.DevNonce), 10))
+			joinNonceEdit.SetText(strconv.FormatUint(uint64(cDevice.JoinNonce), 10))
 		}
-	} else {
-		cDevice.DevEUI = devEUI
-		cDevice.DevAddr = devAddr
-		cDevice.NwkSEncKey = nwkSEncKey
-		cDevice.SNwkSIntKey = sNwkSIntKey
-		cDevice.FNwkSIntKey = fNwkSIntKey
-		cDevice.AppSKey = appSKey
-		cDevice.AppKey = appKey
-		cDevice.NwkKey = nwkKey
-		cDevice.JoinEUI = joinEUI
-		cDevice.Profile = config.Device.Profile
-		cDevice.Major = lorawan.Major(config.Device.Major)
-		cDevice.MACVersion = lorawan.MACVersion(config.Device.MACVersion)
-		cDevice.SkipFCntCheck = config.Device.SkipFCntCheck
-	}
-	cDevice.SetMarshaler(config.Device.Marshaler)
+	} else if err := config.UpdateDevice(cDevice); err != nil {
+		log.Errorln(err)
+		return
+	}
+	setMobility()
+	setChannel()
+	setHooks()
+	cDevice.OnDownlink = activeDevice.onDownlink
+	cDevice.Move(time.Now())
+	watchSession()
 }
 
 func resetDeviceSubform(th *material.Theme) (bool, l.FlexChild) {
@@ -509,52 +411,15 @@ func join() {
 	//Always set device to get any changes to the configuration.
 	setDevice()
 
-	gwID, err := lds.MACToGatewayID(config.GW.MAC)
-	if err != nil {
-		log.Errorf("gw mac error: %s", err)
-		return
-	}
-
-	now := time.Now()
-	rxTime := ptypes.TimestampNow()
-	tsge := ptypes.DurationProto(now.Sub(time.Time{}))
-
-	urx := gw.UplinkRXInfo{
-		GatewayId:         gwID,
-		Rssi:              int32(config.RXInfo.Rssi),
-		LoraSnr:           float64(config.RXInfo.LoRaSNR),
-		Channel:           uint32(config.RXInfo.Channel),
-		RfChain:           uint32(config.RXInfo.RfChain),
-		TimeSinceGpsEpoch: tsge,
-		Time:              rxTime,
-		Board:             0,
-		Antenna:           0,
-		Location:          nil,
-		FineTimestamp:     nil,
-		FineTimestampType: gw.FineTimestampType_NONE,
-		Context:           make([]byte, 4),
-	}
-
-	lmi := &gw.LoRaModulationInfo{
-		Bandwidth:       uint32(config.DR.Bandwidth),
-		SpreadingFactor: uint32(config.DR.SpreadFactor),
-		CodeRate:        config.RXInfo.CodeRate,
-	}
-
-	umi := &gw.UplinkTXInfo_LoraModulationInfo{
-		LoraModulationInfo: lmi,
-	}
+	urx, utx := config.UplinkInfo()
 
-	utx := gw.UplinkTXInfo{
-		Frequency:      uint32(config.RXInfo.Frequency),
-		ModulationInfo: umi,
-	}
+	uplinkMu.Lock()
+	err := cDevice.JoinGateways(simGateways(), urx, utx)
+	uplinkMu.Unlock()
 
-	if !cNSClient.IsConnected() {
-		err = cDevice.Join(mqttClient, config.MQTT.UplinkTopic, config.GW.MAC, &urx, &utx)
-	} else {
-		err = cDevice.JoinUDP(cNSClient, config.GW.MAC, &urx, &utx)
-	}
+	fleetMu.Lock()
+	activeDevice.joining = err == nil
+	fleetMu.Unlock()
 
 	if err != nil {
 		log.Errorf("join error: %s", err)
@@ -574,114 +439,35 @@ func run() {
 
 	setDevice()
 
-	/*dataRate := &lds.DataRate{
-		Bandwidth:    config.DR.Bandwidth,
-		Modulation:   "LORA",
-		SpreadFactor: config.DR.SpreadFactor,
-		BitRate:      config.DR.BitRate,
-	}*/
+	running = true
 
-	//Get DR index from a dr.
-	dataRate := lwBand.DataRate{
-		Modulation:   lwBand.Modulation("LORA"),
-		SpreadFactor: config.DR.SpreadFactor,
-		Bandwidth:    config.DR.Bandwidth,
-		BitRate:      config.DR.BitRate,
+	if repeat && len(config.Messages) > 0 {
+		runMessages()
+		return
 	}
 
-	running = true
-
 	for {
 		if stop {
 			stop = false
 			running = false
 			return
 		}
-		payload := []byte{}
-		var pErr error
-
-		if config.RawPayload.UseRaw {
-			payload, pErr = hex.DecodeString(config.RawPayload.Payload)
-			if pErr != nil {
-				log.Errorf("couldn't decode hex payload: %s", pErr)
-				running = false
-				return
-			}
-		} else if config.RawPayload.UseEncoder {
-			payload, pErr = EncodeToBytes()
-			if pErr != nil {
-				log.Errorf("couldn't encode js object: %s", pErr)
-				running = false
-				return
-			}
-		} else {
-			for _, v := range config.EncodedType {
-				if v.IsFloat {
-					arr := lds.GenerateFloat(float32(v.Value), float32(v.MaxValue), int32(v.NumBytes))
-					payload = append(payload, arr...)
-				} else {
-					arr := lds.GenerateInt(int32(v.Value), int32(v.NumBytes))
-					payload = append(payload, arr...)
-				}
-			}
-		}
+		uplinkMu.Lock()
+		cDevice.Move(time.Now())
 
-		gwID, err := lds.MACToGatewayID(config.GW.MAC)
+		payload, err := config.Payload(cDevice)
 		if err != nil {
-			log.Errorf("gw mac error: %s", err)
+			uplinkMu.Unlock()
+			log.Errorln(err)
 			running = false
 			return
 		}
-		now := time.Now()
-		rxTime := ptypes.TimestampNow()
-		tsge := ptypes.DurationProto(now.Sub(time.Time{}))
-
-		urx := gw.UplinkRXInfo{
-			GatewayId:         gwID,
-			Rssi:              int32(config.RXInfo.Rssi),
-			LoraSnr:           float64(config.RXInfo.LoRaSNR),
-			Channel:           uint32(config.RXInfo.Channel),
-			RfChain:           uint32(config.RXInfo.RfChain),
-			TimeSinceGpsEpoch: tsge,
-			Time:              rxTime,
-			Board:             0,
-			Antenna:           0,
-			Location:          nil,
-			FineTimestamp:     nil,
-			FineTimestampType: gw.FineTimestampType_NONE,
-			Context:           make([]byte, 4),
-		}
 
-		lmi := &gw.LoRaModulationInfo{
-			Bandwidth:       uint32(config.DR.Bandwidth),
-			SpreadingFactor: uint32(config.DR.SpreadFactor),
-			CodeRate:        config.RXInfo.CodeRate,
-		}
-
-		umi := &gw.UplinkTXInfo_LoraModulationInfo{
-			LoraModulationInfo: lmi,
-		}
-
-		utx := gw.UplinkTXInfo{
-			Frequency:      uint32(config.RXInfo.Frequency),
-			ModulationInfo: umi,
-		}
-
-		var fOpts []*lorawan.MACCommand
-		for i := 0; i < len(macCommands); i++ {
-			if macCommands[i].Use.Value {
-				fOpts = append(fOpts, &macCommands[i].MACCommand)
-			}
-		}
+		urx, utx := config.UplinkInfo()
 
 		//Now send an uplink
-		var ulfc uint32
-
-		if !cNSClient.IsConnected() {
-			ulfc, err = cDevice.Uplink(mqttClient, config.MQTT.UplinkTopic, config.Device.MType, uint8(config.RawPayload.FPort), &urx, &utx, payload, config.GW.MAC, config.Band.Name, dataRate, fOpts, fCtrl)
-		} else {
-			ulfc, err = cDevice.UplinkUDP(cNSClient, config.Device.MType, uint8(config.RawPayload.FPort), &urx, &utx, payload, config.GW.MAC, config.Band.Name, dataRate, fOpts, fCtrl)
-		}
+		ulfc, err := cDevice.UplinkGateways(simGateways(), config.Device.MType, uint8(config.RawPayload.FPort), urx, utx, payload, config.Band.Name, config.DataRate(), selectedMACCommands(), fCtrl)
+		uplinkMu.Unlock()
 
 		if err != nil {
 			log.Errorf("couldn't send uplink: %s", err)
@@ -702,17 +488,22 @@ func run() {
 
 func onIncomingDownlink(payload []byte) error {
 	log.Debugf("Incoming Downlink len=%d", len(payload))
+	mqtt := mqttClient != nil && mqttClient.IsConnected()
+	//Downlinks of other fleet devices than the open one are processed in the background.
+	if g := downlinkDevice(payload, mqtt); g != nil && g != activeDevice {
+		return g.processDownlink(payload, mqtt)
+	}
+
 	err := error(nil)
 	if cDevice != nil {
-		mqtt := mqttClient != nil && mqttClient.IsConnected()
+		fleetMu.Lock()
 		dlMessage, err := cDevice.ProcessDownlink(payload, cDevice.MACVersion, mqtt)
+		if cDevice.Joined {
+			activeDevice.joining = false
+		}
+		fleetMu.Unlock()
 		//Update keys when necessary.
-		config.Device.AppSKey = lds.KeyToHex(cDevice.AppSKey)
-		config.Device.FNwkSIntKey = lds.KeyToHex(cDevice.FNwkSIntKey)
-		config.Device.NwkSEncKey = lds.KeyToHex(cDevice.NwkSEncKey)
-		config.Device.SNwkSIntKey = lds.KeyToHex(cDevice.SNwkSIntKey)
-		config.Device.DevAddress = lds.DevAddressToHex(cDevice.DevAddr)
-		config.Device.Joined = cDevice.Joined
+		config.SetSession(cDevice)
 
 		//Update session keys based on join-accept
 		if cDevice.Profile == "OTAA" && cDevice.Joined {
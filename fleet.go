@@ -0,0 +1,407 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	l "gioui.org/layout"
+	"gioui.org/unit"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+	"github.com/brocaar/lorawan"
+	"github.com/iegomez/lds/conf"
+	"github.com/iegomez/lds/lds"
+	xmat "github.com/scartill/giox/material"
+	log "github.com/sirupsen/logrus"
+)
+
+// MaxDevices defines max number of devices in the GUI fleet.
+const MaxDevices = 50
+
+// macCommandState holds whether a MAC command is sent and its payload.
+type macCommandState struct {
+	use     bool
+	payload []byte
+}
+
+// guiDevice is a device of the GUI fleet. The configuration and forms hold the settings of the
+// active device; the others keep theirs here until their tab is opened.
+type guiDevice struct {
+	settings     conf.Device
+	rawPayload   conf.RawPayload
+	encodedType  []*conf.EncodedType
+	lpp          []*conf.LPPChannel
+	fCtrl        lorawan.FCtrl
+	macCommands  []macCommandState
+	dev          *lds.Device
+	lastDownlink *lds.Downlink
+	open         bool //Whether it has a tab.
+	joining      bool //Whether it sent a join request and didn't join yet.
+
+	tabButton    widget.Clickable
+	openButton   widget.Clickable
+	closeButton  widget.Clickable
+	removeButton widget.Clickable
+}
+
+// Fleet devices, guarded by fleetMu as downlinks are routed from the transports goroutines. The
+// settings and forms of the active device belong to the UI goroutine.
+var (
+	fleetMu      sync.Mutex
+	guiDevices   []*guiDevice
+	activeDevice *guiDevice
+
+	addDeviceButton widget.Clickable
+)
+
+func createFleetForm() {
+	activeDevice = &guiDevice{open: true}
+	guiDevices = []*guiDevice{activeDevice}
+}
+
+// save keeps the configured settings and the current device as the device ones.
+func (g *guiDevice) save() {
+	g.settings = config.Device
+	g.rawPayload = config.RawPayload
+	g.encodedType = config.EncodedType
+	g.lpp = config.LPP
+	g.fCtrl = fCtrl
+	g.macCommands = make([]macCommandState, len(macCommands))
+	for i, command := range macCommands {
+		g.macCommands[i].use = command.Use.Value
+		if command.MACCommand.Payload != nil {
+			g.macCommands[i].payload, _ = command.MACCommand.Payload.MarshalBinary()
+		}
+	}
+	g.dev = cDevice
+}
+
+// load makes the device settings the configured ones and the device the current one.
+func (g *guiDevice) load() {
+	config.Device = g.settings
+	config.RawPayload = g.rawPayload
+	config.EncodedType = g.encodedType
+	config.LPP = g.lpp
+	fCtrl = g.fCtrl
+	for i, state := range g.macCommands {
+		macCommands[i].Use.Value = state.use
+		if macCommands[i].MACCommand.Payload != nil && len(state.payload) > 0 {
+			macCommands[i].MACCommand.Payload.UnmarshalBinary(state.payload)
+		}
+	}
+	cDevice = g.dev
+}
+
+// activate opens the device tab, swapping its settings into the configuration and forms.
+func (g *guiDevice) activate() {
+	g.open = true
+	if g == activeDevice {
+		return
+	}
+	if running {
+		log.Warnln("stop sending before switching devices")
+		return
+	}
+
+	fleetMu.Lock()
+	activeDevice.save()
+	activeDevice = g
+	g.load()
+	fleetMu.Unlock()
+	resetGuiValues()
+	setDevice()
+}
+
+// onDownlink keeps the last downlink of the device, running the downlink behaviour of the
+// active one. It's called with fleetMu held.
+func (g *guiDevice) onDownlink(dl *lds.Downlink) {
+	g.lastDownlink = dl
+	if g == activeDevice {
+		onDeviceDownlink(dl)
+	}
+}
+
+// addDevice adds a copy of the active device with the next free DevEUI and DevAddr.
+func addDevice() {
+	if len(guiDevices) >= MaxDevices {
+		log.Warnf("the fleet is limited to %d devices", MaxDevices)
+		return
+	}
+	fleetMu.Lock()
+	activeDevice.save()
+	fleetMu.Unlock()
+
+	g := &guiDevice{
+		settings:    activeDevice.settings,
+		rawPayload:  activeDevice.rawPayload,
+		fCtrl:       activeDevice.fCtrl,
+		macCommands: activeDevice.macCommands,
+	}
+	for _, et := range activeDevice.encodedType {
+		g.encodedType = append(g.encodedType, et.Copy())
+	}
+	for _, ch := range activeDevice.lpp {
+		c := *ch
+		c.Values = append([]float64(nil), ch.Values...)
+		g.lpp = append(g.lpp, &c)
+	}
+
+	devEUI, err := lds.HexToEUI(g.settings.DevEUI)
+	if err != nil {
+		log.Errorf("devEUI error: %s", err)
+		return
+	}
+	devAddr, _ := lds.HexToDevAddress(g.settings.DevAddress)
+	fleetMu.Lock()
+	for taken := true; taken; {
+		binary.BigEndian.PutUint64(devEUI[:], binary.BigEndian.Uint64(devEUI[:])+1)
+		binary.BigEndian.PutUint32(devAddr[:], binary.BigEndian.Uint32(devAddr[:])+1)
+		taken = false
+		for _, other := range guiDevices {
+			if other.eui() == devEUI.String() {
+				taken = true
+			}
+		}
+	}
+	fleetMu.Unlock()
+	g.settings.DevEUI = devEUI.String()
+	g.settings.DevAddress = lds.DevAddressToHex(devAddr)
+	//ABP sessions are kept, OTAA devices join on their own.
+	if g.settings.Profile != "ABP" {
+		g.settings.Joined = false
+	}
+
+	//Like the active device, it moves and shares the air with the rest of the fleet.
+	d, _, err := config.WithDevice(g.settings).NewDevice()
+	if err != nil {
+		log.Errorln(err)
+		return
+	}
+	d.OnDownlink = g.onDownlink
+	g.dev = d
+
+	fleetMu.Lock()
+	guiDevices = append(guiDevices, g)
+	fleetMu.Unlock()
+	log.Infof("added device %s", g.settings.DevEUI)
+}
+
+// removeDevice removes a device from the fleet; the active one can't be removed.
+func removeDevice(g *guiDevice) {
+	if g == activeDevice {
+		log.Warnln("open another device before removing this one")
+		return
+	}
+	fleetMu.Lock()
+	defer fleetMu.Unlock()
+	for i, other := range guiDevices {
+		if other == g {
+			guiDevices = append(guiDevices[:i], guiDevices[i+1:]...)
+			return
+		}
+	}
+}
+
+// current returns the device settings and device, which are the configured ones when active. It's
+// called from the UI goroutine with fleetMu held.
+func (g *guiDevice) current() (conf.Device, *lds.Device) {
+	if g == activeDevice {
+		return config.Device, cDevice
+	}
+	return g.settings, g.dev
+}
+
+func (g *guiDevice) eui() string {
+	settings, _ := g.current()
+	return settings.DevEUI
+}
+
+// downlinkDevice returns the fleet device a downlink is meant for: the one with its DevAddr for
+// data downlinks and, for join-accepts, the device waiting for one whose keys validate it, the
+// active one first as devices sharing their root keys validate each other's join-accepts. It
+// returns nil when none is found or the downlink is meant for the active device, leaving it to
+// the active device.
+func downlinkDevice(payload []byte, mqtt bool) *guiDevice {
+	phy, ok, err := lds.DownlinkPHYPayload(payload, mqtt)
+	if err != nil || !ok {
+		return nil
+	}
+	phyBytes, err := phy.MarshalBinary()
+	if err != nil {
+		return nil
+	}
+
+	fleetMu.Lock()
+	defer fleetMu.Unlock()
+	if phy.MHDR.MType == lorawan.JoinAccept {
+		validates := func(d *lds.Device) bool {
+			frame, err := d.DecodeFrame(phyBytes, lds.FrameContext{})
+			return err == nil && frame.MICValid
+		}
+		if activeDevice.joining && cDevice != nil && validates(cDevice) {
+			return nil
+		}
+		for _, g := range guiDevices {
+			if g != activeDevice && g.joining && g.dev != nil && validates(g.dev) {
+				return g
+			}
+		}
+		return nil
+	}
+
+	macPayload, ok := phy.MACPayload.(*lorawan.MACPayload)
+	if !ok {
+		return nil
+	}
+	for _, g := range guiDevices {
+		d := g.dev
+		if g == activeDevice || d == nil {
+			continue
+		}
+		if (d.Joined || d.Profile == "ABP") && macPayload.FHDR.DevAddr == d.DevAddr {
+			return g
+		}
+	}
+	return nil
+}
+
+// processDownlink processes a downlink of an inactive device, keeping its session settings.
+func (g *guiDevice) processDownlink(payload []byte, mqtt bool) error {
+	fleetMu.Lock()
+	defer fleetMu.Unlock()
+	dlMessage, err := g.dev.ProcessDownlink(payload, g.dev.MACVersion, mqtt)
+	if g.dev.Joined {
+		g.joining = false
+	}
+	c := config.WithDevice(g.settings)
+	c.SetSession(g.dev)
+	g.settings = c.Device
+	if err != nil {
+		log.Errorf("device %s downlink error: %s", g.settings.DevEUI, err)
+		return err
+	}
+	log.Infof("device %s received message: %s", g.settings.DevEUI, dlMessage)
+	return nil
+}
+
+// fleetDevices returns a copy of the fleet devices, to handle their buttons without fleetMu.
+func fleetDevices() []*guiDevice {
+	fleetMu.Lock()
+	defer fleetMu.Unlock()
+	return append([]*guiDevice(nil), guiDevices...)
+}
+
+// deviceTabs shows a tab for every open device when there are more than one.
+func deviceTabs(th *material.Theme) (l.FlexChild, bool) {
+	for _, g := range fleetDevices() {
+		for g.tabButton.Clicked() {
+			g.activate()
+		}
+	}
+
+	fleetMu.Lock()
+	defer fleetMu.Unlock()
+	var tabs []l.FlexChild
+	for _, g := range guiDevices {
+		if !g.open {
+			continue
+		}
+		label := g.eui()
+		if g == activeDevice {
+			label = fmt.Sprintf("[%s]", label)
+		}
+		tabs = append(tabs, xmat.RigidButton(th, label, &g.tabButton))
+	}
+	if len(tabs) < 2 {
+		return l.FlexChild{}, false
+	}
+	return l.Rigid(func(gtx l.Context) l.Dimensions {
+		return l.Flex{Axis: l.Horizontal}.Layout(gtx, tabs...)
+	}), true
+}
+
+// fleetCell lays out a table cell of the given width.
+func fleetCell(th *material.Theme, text string, width float32) l.FlexChild {
+	return l.Rigid(func(gtx l.Context) l.Dimensions {
+		gtx.Constraints.Min.X = gtx.Px(unit.Dp(width))
+		gtx.Constraints.Max.X = gtx.Constraints.Min.X
+		return material.Label(th, unit.Dp(14), text).Layout(gtx)
+	})
+}
+
+// Fleet table column widths.
+var fleetColumns = []float32{140, 70, 50, 90, 90, 220}
+
+func fleetRow(th *material.Theme, cells []string, buttons ...l.FlexChild) l.FlexChild {
+	var row []l.FlexChild
+	for i, text := range cells {
+		row = append(row, fleetCell(th, text, fleetColumns[i]))
+	}
+	row = append(row, buttons...)
+	return l.Rigid(func(gtx l.Context) l.Dimensions {
+		return l.Flex{Axis: l.Horizontal, Alignment: l.Middle}.Layout(gtx, row...)
+	})
+}
+
+func fleetForm(th *material.Theme) l.FlexChild {
+	for addDeviceButton.Clicked() {
+		addDevice()
+	}
+
+	widgets := []l.FlexChild{
+		xmat.RigidSection(th, "Fleet"),
+		xmat.RigidLabel(th, "Downlinks reach every device; the open one is driven by the Device, Control and Data forms."),
+		xmat.RigidButton(th, "Add device", &addDeviceButton),
+		fleetRow(th, []string{"DevEUI", "DevAddr", "Joined", "FCnt up/down", "Last RSSI", "Last downlink"}),
+	}
+
+	for _, g := range fleetDevices() {
+		for g.openButton.Clicked() {
+			g.activate()
+		}
+		for g.closeButton.Clicked() {
+			if g != activeDevice {
+				g.open = false
+			}
+		}
+		for g.removeButton.Clicked() {
+			removeDevice(g)
+		}
+	}
+
+	fleetMu.Lock()
+	defer fleetMu.Unlock()
+	for _, g := range guiDevices {
+		settings, d := g.current()
+		cells := []string{settings.DevEUI, settings.DevAddress, "-", "-", "-", "-"}
+		if d != nil {
+			cells[1] = lds.DevAddressToHex(d.DevAddr)
+			cells[2] = fmt.Sprintf("%t", d.Joined || d.Profile == "ABP")
+			cells[3] = fmt.Sprintf("%d/%d", d.UlFcnt, d.DlFcnt)
+			if d.LastRSSI != 0 {
+				cells[4] = fmt.Sprintf("%d dBm, %.1f dB", d.LastRSSI, d.LastSNR)
+			}
+		}
+		if dl := g.lastDownlink; dl != nil {
+			cells[5] = fmt.Sprintf("FCnt %d, %s ago", dl.FCnt, time.Since(dl.Time).Truncate(time.Second))
+		}
+
+		buttons := []l.FlexChild{xmat.RigidButton(th, "Open", &g.openButton)}
+		if g != activeDevice {
+			if g.open {
+				buttons = append(buttons, xmat.RigidButton(th, "Close", &g.closeButton))
+			}
+			buttons = append(buttons, xmat.RigidButton(th, "Remove", &g.removeButton))
+		}
+		widgets = append(widgets, fleetRow(th, cells, buttons...))
+	}
+
+	inset := l.Inset{Top: unit.Dp(10), Left: unit.Dp(10)}
+	return l.Rigid(func(gtx l.Context) l.Dimensions {
+		return inset.Layout(gtx, func(gtx l.Context) l.Dimensions {
+			return l.Flex{Axis: l.Vertical}.Layout(gtx, widgets...)
+		})
+	})
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"strconv"
 
 	l "gioui.org/layout"
@@ -15,65 +16,90 @@ import (
 // cNSClient is a direct NetworkServer connection handle
 var cNSClient lds.NSClient
 
-type forwarder struct {
-	Server string `toml:"nserver"`
-	Port   string `toml:"nsport"`
-}
-
 var (
-	nserverEdit     widget.Editor
-	nportEdit       widget.Editor
-	nsConnectButton widget.Clickable
+	nserverEdit        widget.Editor
+	nportEdit          widget.Editor
+	keepAliveEdit      widget.Editor
+	ackTimeoutEdit     widget.Editor
+	maxMissedAcksEdit  widget.Editor
+	nsConnectButton    widget.Clickable
+	nsDisconnectButton widget.Clickable
 )
 
 func forwarderResetGuiValues() {
 	nserverEdit.SetText(config.Forwarder.Server)
 	nportEdit.SetText(config.Forwarder.Port)
+	keepAliveEdit.SetText(strconv.Itoa(config.Forwarder.KeepAlive))
+	ackTimeoutEdit.SetText(strconv.Itoa(config.Forwarder.AckTimeout))
+	maxMissedAcksEdit.SetText(strconv.Itoa(config.Forwarder.MaxMissedAcks))
 }
 
 func forwarderForm(th *material.Theme) l.FlexChild {
 
 	config.Forwarder.Server = nserverEdit.Text()
 	config.Forwarder.Port = nportEdit.Text()
+	extractInt(&keepAliveEdit, &config.Forwarder.KeepAlive, 10)
+	extractInt(&ackTimeoutEdit, &config.Forwarder.AckTimeout, 3)
+	extractInt(&maxMissedAcksEdit, &config.Forwarder.MaxMissedAcks, 3)
 
 	for nsConnectButton.Clicked() {
 		forwarderConnect()
 	}
 
-	wLabel := matx.RigidSection(th, "Forwarder")
-	wNS := matx.RigidEditor(th, "Network Server:", "192.168.1.1", &nserverEdit)
-	wNP := matx.RigidEditor(th, "UDP Port:", "1680", &nportEdit)
+	for nsDisconnectButton.Clicked() {
+		if err := cNSClient.Disconnect(); err != nil {
+			log.Errorf("UDP disconnect error: %s", err)
+		}
+		disconnectGatewaysUDP()
+	}
+
+	widgets := []l.FlexChild{
+		matx.RigidSection(th, "Forwarder"),
+		matx.RigidEditor(th, "Network Server:", "192.168.1.1", &nserverEdit),
+		matx.RigidEditor(th, "UDP Port:", "1680", &nportEdit),
+		matx.RigidEditor(th, "Keepalive (s):", "10", &keepAliveEdit),
+		matx.RigidEditor(th, "Ack timeout (s):", "3", &ackTimeoutEdit),
+		matx.RigidEditor(th, "Max missed acks:", "3", &maxMissedAcksEdit),
+	}
 
-	var wConnect l.FlexChild
 	if mqttClient == nil || !mqttClient.IsConnected() {
 		if !cNSClient.IsConnected() {
-			wConnect = matx.RigidButton(th, "Connect", &nsConnectButton)
+			widgets = append(widgets, matx.RigidButton(th, "Connect", &nsConnectButton))
 		} else {
-			wConnect = matx.RigidLabel(th, "UDP Listening")
+			stats := cNSClient.Stats()
+			widgets = append(widgets,
+				matx.RigidLabel(th, "UDP Listening"),
+				matx.RigidLabel(th, fmt.Sprintf("PUSH acked/missed: %d/%d - RTT: %s", stats.PushAcked, stats.PushMissed, stats.LastPushRTT)),
+				matx.RigidLabel(th, fmt.Sprintf("PULL acked/missed: %d/%d - RTT: %s", stats.PullAcked, stats.PullMissed, stats.LastPullRTT)),
+				matx.RigidLabel(th, fmt.Sprintf("Reconnects: %d", stats.Reconnects)),
+				matx.RigidButton(th, "Disconnect", &nsDisconnectButton),
+			)
 		}
 	} else {
-		wConnect = matx.RigidLabel(th, "MQTT Connected")
+		widgets = append(widgets, matx.RigidLabel(th, "MQTT Connected"))
 	}
 
 	inset := l.Inset{Left: unit.Dp(30)}
 	return l.Rigid(func(gtx l.Context) l.Dimensions {
 		return inset.Layout(gtx, func(gtx l.Context) l.Dimensions {
-			return l.Flex{Axis: l.Vertical}.Layout(gtx, wLabel, wNS, wNP, wConnect)
+			return l.Flex{Axis: l.Vertical}.Layout(gtx, widgets...)
 		})
 	})
 }
 
 func forwarderConnect() error {
-	port, err := strconv.Atoi(config.Forwarder.Port)
-
-	if err != nil {
-		log.Warn("network server UDP port must be a number")
+	if err := config.SetNSClient(&cNSClient); err != nil {
+		log.Warn(err)
 		return err
 	}
 
-	cNSClient.Server = config.Forwarder.Server
-	cNSClient.Port = port
-	cNSClient.Connect(config.GW.MAC, onIncomingDownlink)
+	resetChannelPlans()
+
+	if err := cNSClient.Connect(config.GW.MAC, onIncomingDownlink); err != nil {
+		log.Errorf("UDP connection error: %s", err)
+		return err
+	}
+	connectGatewaysUDP()
 	log.Infoln("UDP Forwarder started (MQTT disabled)")
 
 	return nil
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	l "gioui.org/layout"
+	"gioui.org/unit"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+	"github.com/iegomez/lds/lds"
+	xmat "github.com/scartill/giox/material"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	framePayloadEdit  widget.Editor
+	frameConfFCntEdit widget.Editor
+	frameTxDREdit     widget.Editor
+	frameTxChEdit     widget.Editor
+	decodeFrameButton widget.Clickable
+	buildFrameButton  widget.Clickable
+	buildJoinButton   widget.Clickable
+
+	frameResult []string
+)
+
+// decodeFrame decodes the PHYPayload in the editor with the current device session.
+func decodeFrame() {
+	if cDevice == nil {
+		log.Warnln("set the device first")
+		return
+	}
+	phyBytes, err := lds.ParsePHYPayload(framePayloadEdit.Text())
+	if err != nil {
+		frameResult = []string{err.Error()}
+		return
+	}
+
+	var confFCnt, txDR, txCh int
+	extractInt(&frameConfFCntEdit, &confFCnt, 0)
+	extractInt(&frameTxDREdit, &txDR, 0)
+	extractInt(&frameTxChEdit, &txCh, 0)
+	frame, err := cDevice.DecodeFrame(phyBytes, lds.FrameContext{ConfFCnt: uint32(confFCnt), TxDR: uint8(txDR), TxCh: uint8(txCh)})
+	if err != nil {
+		frameResult = []string{err.Error()}
+		return
+	}
+	result := frame.String()
+	if frame.MICChecked && !frame.MICValid && !frame.Uplink {
+		if diag, err := cDevice.DiagnoseMIC(phyBytes); err == nil {
+			result += diag.String()
+		}
+	}
+	frameResult = strings.Split(strings.TrimSpace(result), "\n")
+}
+
+// buildFrame builds the next uplink, or a join request, with the current device session and
+// data settings, without sending it.
+func buildFrame(join bool) {
+	if cDevice == nil {
+		log.Warnln("set the device first")
+		return
+	}
+
+	var phyBytes []byte
+	var err error
+	if join {
+		phyBytes, err = cDevice.BuildJoinRequest()
+	} else {
+		var payload []byte
+		if payload, err = config.Payload(cDevice); err != nil {
+			frameResult = []string{err.Error()}
+			return
+		}
+		_, utx := config.UplinkInfo()
+		phyBytes, err = cDevice.BuildUplink(config.Device.MType, uint8(config.RawPayload.FPort), utx, payload, config.Band.Name, config.DataRate(), selectedMACCommands(), fCtrl)
+	}
+	if err != nil {
+		frameResult = []string{fmt.Sprintf("couldn't build frame: %s", err)}
+		return
+	}
+
+	framePayloadEdit.SetText(hex.EncodeToString(phyBytes))
+	frameResult = []string{
+		fmt.Sprintf("Base64:     %s", base64.StdEncoding.EncodeToString(phyBytes)),
+		fmt.Sprintf("Hex:        %s", hex.EncodeToString(phyBytes)),
+	}
+}
+
+func framesForm(th *material.Theme) l.FlexChild {
+	for decodeFrameButton.Clicked() {
+		decodeFrame()
+	}
+	for buildFrameButton.Clicked() {
+		buildFrame(false)
+	}
+	for buildJoinButton.Clicked() {
+		buildFrame(true)
+	}
+
+	widgets := []l.FlexChild{
+		xmat.RigidSection(th, "Frames"),
+		xmat.RigidEditor(th, "PHYPayload", "<hex or base64>", &framePayloadEdit),
+		l.Rigid(func(gtx l.Context) l.Dimensions {
+			return l.Flex{Axis: l.Horizontal}.Layout(gtx,
+				xmat.RigidEditor(th, "ConfFCnt", "<acknowledged uplink FCnt>", &frameConfFCntEdit),
+				xmat.RigidEditor(th, "TxDR", "<1.1 uplinks>", &frameTxDREdit),
+				xmat.RigidEditor(th, "TxCh", "<1.1 uplinks>", &frameTxChEdit),
+			)
+		}),
+		l.Rigid(func(gtx l.Context) l.Dimensions {
+			return l.Flex{Axis: l.Horizontal}.Layout(gtx,
+				xmat.RigidButton(th, "Decode", &decodeFrameButton),
+				xmat.RigidButton(th, "Build uplink", &buildFrameButton),
+				xmat.RigidButton(th, "Build join request", &buildJoinButton),
+			)
+		}),
+	}
+	for _, line := range frameResult {
+		widgets = append(widgets, xmat.RigidLabel(th, line))
+	}
+
+	inset := l.Inset{Top: unit.Dp(10), Left: unit.Dp(10)}
+	return l.Rigid(func(gtx l.Context) l.Dimensions {
+		return inset.Layout(gtx, func(gtx l.Context) l.Dimensions {
+			return l.Flex{Axis: l.Vertical}.Layout(gtx, widgets...)
+		})
+	})
+}
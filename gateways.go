@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	l "gioui.org/layout"
+	"gioui.org/unit"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+	"github.com/iegomez/lds/conf"
+	"github.com/iegomez/lds/lds"
+	"github.com/scartill/giox"
+	xmat "github.com/scartill/giox/material"
+	log "github.com/sirupsen/logrus"
+)
+
+// MaxGateways defines max number of additional simulated gateways.
+const MaxGateways = 10
+
+// gwNSClients holds the UDP connections of additional gateways, keyed by MAC.
+var gwNSClients = map[string]*lds.NSClient{}
+
+// gwChannelPlans holds the channel plan of every gateway, keyed by MAC.
+var gwChannelPlans = struct {
+	sync.Mutex
+	plans map[string]*lds.ChannelPlan
+}{plans: map[string]*lds.ChannelPlan{}}
+
+type gatewayWidgets struct {
+	MAC          widget.Editor
+	Enabled      widget.Bool
+	Latitude     widget.Editor
+	Longitude    widget.Editor
+	Altitude     widget.Editor
+	RSSIOffset   widget.Editor
+	SNROffset    widget.Editor
+	SkewMs       widget.Editor
+	AntennaGain  widget.Editor
+	FineTS       widget.Bool
+	EncryptFTS   widget.Bool
+	FineTSKey    widget.Editor
+	ClientID     widget.Editor
+	TLSCert      widget.Editor
+	TLSKey       widget.Editor
+	DeleteButton widget.Clickable
+}
+
+var (
+	gwWidgets        []gatewayWidgets
+	addGatewayButton widget.Clickable
+
+	devLatitudeEdit  widget.Editor
+	devLongitudeEdit widget.Editor
+	devAltitudeEdit  widget.Editor
+)
+
+func createGatewaysForm() {
+	gwWidgets = make([]gatewayWidgets, MaxGateways+1)
+}
+
+func gatewaysResetGuiValues() {
+	devLatitudeEdit.SetText(strconv.FormatFloat(config.Device.Latitude, 'f', -1, 64))
+	devLongitudeEdit.SetText(strconv.FormatFloat(config.Device.Longitude, 'f', -1, 64))
+	devAltitudeEdit.SetText(strconv.FormatFloat(config.Device.Altitude, 'f', -1, 64))
+
+	for i, g := range config.AllGateways() {
+		gwWidgets[i].MAC.SetText(g.MAC)
+		gwWidgets[i].Enabled.Value = !g.Disabled
+		gwWidgets[i].Latitude.SetText(strconv.FormatFloat(g.Latitude, 'f', -1, 64))
+		gwWidgets[i].Longitude.SetText(strconv.FormatFloat(g.Longitude, 'f', -1, 64))
+		gwWidgets[i].Altitude.SetText(strconv.FormatFloat(g.Altitude, 'f', -1, 64))
+		gwWidgets[i].RSSIOffset.SetText(strconv.Itoa(g.RSSIOffset))
+		gwWidgets[i].SNROffset.SetText(strconv.FormatFloat(g.SNROffset, 'f', -1, 64))
+		gwWidgets[i].SkewMs.SetText(strconv.Itoa(g.SkewMs))
+		gwWidgets[i].AntennaGain.SetText(strconv.FormatFloat(g.AntennaGain, 'f', -1, 64))
+		gwWidgets[i].FineTS.Value = g.FineTimestamp != ""
+		gwWidgets[i].EncryptFTS.Value = g.FineTimestamp == "encrypted"
+		gwWidgets[i].FineTSKey.SetText(g.FineTSKey)
+		gwWidgets[i].ClientID.SetText(g.ClientID)
+		gwWidgets[i].TLSCert.SetText(g.TLSCert)
+		gwWidgets[i].TLSKey.SetText(g.TLSKey)
+	}
+}
+
+func gatewaysForm(th *material.Theme) l.FlexChild {
+	extractFloat(&devLatitudeEdit, &config.Device.Latitude, 0)
+	extractFloat(&devLongitudeEdit, &config.Device.Longitude, 0)
+	extractFloat(&devAltitudeEdit, &config.Device.Altitude, 0)
+
+	for i, g := range config.AllGateways() {
+		//The main gateway MAC is edited at the connection form.
+		if i > 0 {
+			g.MAC = gwWidgets[i].MAC.Text()
+		}
+		g.Disabled = !gwWidgets[i].Enabled.Value
+		extractFloat(&gwWidgets[i].Latitude, &g.Latitude, 0)
+		extractFloat(&gwWidgets[i].Longitude, &g.Longitude, 0)
+		extractFloat(&gwWidgets[i].Altitude, &g.Altitude, 0)
+		extractInt(&gwWidgets[i].RSSIOffset, &g.RSSIOffset, 0)
+		extractFloat(&gwWidgets[i].SNROffset, &g.SNROffset, 0)
+		extractInt(&gwWidgets[i].SkewMs, &g.SkewMs, 0)
+		extractFloat(&gwWidgets[i].AntennaGain, &g.AntennaGain, 0)
+		g.FineTimestamp = ""
+		if gwWidgets[i].FineTS.Value {
+			g.FineTimestamp = "plain"
+			if gwWidgets[i].EncryptFTS.Value {
+				g.FineTimestamp = "encrypted"
+			}
+		}
+		g.FineTSKey = gwWidgets[i].FineTSKey.Text()
+		g.ClientID = gwWidgets[i].ClientID.Text()
+		g.TLSCert = gwWidgets[i].TLSCert.Text()
+		g.TLSKey = gwWidgets[i].TLSKey.Text()
+	}
+
+	for addGatewayButton.Clicked() {
+		if len(config.Gateways) < MaxGateways {
+			config.Gateways = append(config.Gateways, &conf.Gateway{})
+			gatewaysResetGuiValues()
+			log.Println("added new gateway")
+		}
+	}
+
+	for i := 1; i <= len(config.Gateways); i++ {
+		for gwWidgets[i].DeleteButton.Clicked() {
+			config.Gateways = append(config.Gateways[:i-1], config.Gateways[i:]...)
+			gatewaysResetGuiValues()
+		}
+	}
+
+	moves := mobilityWidgets(th)
+	radio := propagationWidgets(th)
+
+	//An expanded combo is shown alone so that its items aren't overlapped.
+	var expanded []l.FlexChild
+	if mobilityModelCombo.IsExpanded() {
+		expanded = moves
+	} else if propagationModelCombo.IsExpanded() || hataEnvironmentCombo.IsExpanded() {
+		expanded = radio
+	}
+	if expanded != nil {
+		inset := l.Inset{Left: unit.Dp(30)}
+		return l.Rigid(func(gtx l.Context) l.Dimensions {
+			return inset.Layout(gtx, func(gtx l.Context) l.Dimensions {
+				return l.Flex{Axis: l.Vertical}.Layout(gtx, expanded...)
+			})
+		})
+	}
+
+	widgets := []l.FlexChild{
+		xmat.RigidSection(th, "Gateways"),
+		xmat.RigidLabel(th, "Every enabled gateway receives each uplink with its own offsets and skew."),
+		xmat.RigidLabel(th, "Device position (start of its movement; time of flight to located gateways is added to their timestamps)"),
+		l.Rigid(func(gtx l.Context) l.Dimensions {
+			return l.Flex{Axis: l.Horizontal}.Layout(gtx,
+				xmat.RigidEditor(th, "Lat", "0", &devLatitudeEdit),
+				xmat.RigidEditor(th, "Lng", "0", &devLongitudeEdit),
+				xmat.RigidEditor(th, "Alt", "0", &devAltitudeEdit),
+			)
+		}),
+	}
+	widgets = append(widgets, moves...)
+	widgets = append(widgets, radio...)
+	widgets = append(widgets, channelWidgets(th)...)
+
+	if len(config.Gateways) < MaxGateways {
+		widgets = append(widgets, xmat.RigidButton(th, "Add gateway", &addGatewayButton))
+	}
+
+	for i := range config.AllGateways() {
+		gww := &gwWidgets[i]
+
+		header := []l.FlexChild{}
+		if i == 0 {
+			header = append(header, xmat.RigidLabel(th, fmt.Sprintf("Main gateway %s", config.GW.MAC)))
+		} else {
+			header = append(header, xmat.RigidEditor(th, "MAC", "<gateway MAC>", &gww.MAC))
+		}
+		header = append(header, xmat.RigidCheckBox(th, "Enabled", &gww.Enabled))
+		header = append(header, xmat.RigidLabel(th, channelPlanSummary(config.AllGateways()[i].MAC)))
+		if i > 0 {
+			header = append(header, xmat.RigidButton(th, "Delete", &gww.DeleteButton))
+		}
+
+		widgets = append(widgets,
+			xmat.RigidSeparator(th, &giox.Separator{}),
+			l.Rigid(func(gtx l.Context) l.Dimensions {
+				return l.Flex{Axis: l.Horizontal}.Layout(gtx, header...)
+			}),
+			l.Rigid(func(gtx l.Context) l.Dimensions {
+				return l.Flex{Axis: l.Horizontal}.Layout(gtx,
+					xmat.RigidEditor(th, "Lat", "0", &gww.Latitude),
+					xmat.RigidEditor(th, "Lng", "0", &gww.Longitude),
+					xmat.RigidEditor(th, "Alt", "0", &gww.Altitude),
+				)
+			}),
+			l.Rigid(func(gtx l.Context) l.Dimensions {
+				return l.Flex{Axis: l.Horizontal}.Layout(gtx,
+					xmat.RigidEditor(th, "RSSI offset", "0", &gww.RSSIOffset),
+					xmat.RigidEditor(th, "SNR offset", "0", &gww.SNROffset),
+					xmat.RigidEditor(th, "Skew (ms)", "0", &gww.SkewMs),
+					xmat.RigidEditor(th, "Gain (dBi)", "0", &gww.AntennaGain),
+				)
+			}),
+			l.Rigid(func(gtx l.Context) l.Dimensions {
+				return l.Flex{Axis: l.Horizontal}.Layout(gtx,
+					xmat.RigidCheckBox(th, "Fine timestamp", &gww.FineTS),
+					xmat.RigidCheckBox(th, "Encrypted", &gww.EncryptFTS),
+					xmat.RigidEditor(th, "Key", "<fine timestamp AES key>", &gww.FineTSKey),
+				)
+			}),
+			l.Rigid(func(gtx l.Context) l.Dimensions {
+				return l.Flex{Axis: l.Horizontal}.Layout(gtx,
+					xmat.RigidEditor(th, "MQTT client ID", "<gateway MAC>", &gww.ClientID),
+					xmat.RigidEditor(th, "Client cert", "<shared connection>", &gww.TLSCert),
+					xmat.RigidEditor(th, "Client key", "<path to PEM>", &gww.TLSKey),
+				)
+			}),
+		)
+	}
+
+	inset := l.Inset{Left: unit.Dp(30)}
+	return l.Rigid(func(gtx l.Context) l.Dimensions {
+		return inset.Layout(gtx, func(gtx l.Context) l.Dimensions {
+			return l.Flex{Axis: l.Vertical}.Layout(gtx, widgets...)
+		})
+	})
+}
+
+// simGateways returns the enabled gateways bound to their transports.
+func simGateways() []*lds.Gateway {
+	gateways := []*lds.Gateway{}
+	for i, g := range config.AllGateways() {
+		if g.Disabled {
+			continue
+		}
+
+		sg := config.SimGateway(g)
+		sg.MQTTClient = mqttClient
+		if client, ok := gwMQTTClients[g.MAC]; ok {
+			sg.MQTTClient = client
+		}
+		sg.ChannelPlan = channelPlan(g.MAC)
+
+		if i == 0 {
+			sg.UDPClient = &cNSClient
+		} else if client, ok := gwNSClients[g.MAC]; ok {
+			sg.UDPClient = client
+		}
+
+		gateways = append(gateways, sg)
+	}
+	return gateways
+}
+
+// connectGatewaysUDP opens a UDP connection for every additional gateway.
+func connectGatewaysUDP() {
+	for _, g := range config.Gateways {
+		if _, ok := gwNSClients[g.MAC]; ok {
+			continue
+		}
+
+		client, err := config.GatewayNSClient(g, &cNSClient)
+		if err != nil {
+			log.Warnf("gateway %s: %s", g.MAC, err)
+			continue
+		}
+
+		mac := g.MAC
+		err = client.Connect(mac, func(payload []byte) error {
+			log.Debugf("downlink received by gateway %s", mac)
+			return onIncomingDownlink(payload)
+		})
+		if err != nil {
+			log.Errorf("gateway %s: UDP connection error: %s", mac, err)
+			continue
+		}
+		gwNSClients[mac] = client
+	}
+}
+
+// disconnectGatewaysUDP closes the UDP connections of additional gateways.
+func disconnectGatewaysUDP() {
+	for mac, client := range gwNSClients {
+		if err := client.Disconnect(); err != nil {
+			log.Errorf("gateway %s: UDP disconnect error: %s", mac, err)
+		}
+		delete(gwNSClients, mac)
+	}
+}
+
+// channelPlan returns the channel plan of a gateway, creating an empty one (listening on every channel) if needed.
+func channelPlan(mac string) *lds.ChannelPlan {
+	gwChannelPlans.Lock()
+	defer gwChannelPlans.Unlock()
+
+	plan, ok := gwChannelPlans.plans[mac]
+	if !ok {
+		plan = &lds.ChannelPlan{}
+		gwChannelPlans.plans[mac] = plan
+	}
+	return plan
+}
+
+// resetChannelPlans sets every gateway plan to its configured channels, dropping configurations received by MQTT.
+func resetChannelPlans() {
+	for _, g := range config.AllGateways() {
+		channelPlan(g.MAC).Set("", g.ConcentratorChannels())
+	}
+}
+
+// channelPlanSummary describes the channels a gateway listens to.
+func channelPlanSummary(mac string) string {
+	plan := channelPlan(mac)
+	channels := plan.Channels()
+	if len(channels) == 0 {
+		return "Listening on any channel"
+	}
+	if plan.Version() != "" {
+		return fmt.Sprintf("Listening on %d channels (configuration %s)", len(channels), plan.Version())
+	}
+	return fmt.Sprintf("Listening on %d channels", len(channels))
+}
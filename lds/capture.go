@@ -0,0 +1,205 @@
+package lds
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/brocaar/chirpstack-api/go/gw"
+	"github.com/brocaar/lorawan"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Capture record directions.
+const (
+	CaptureUp   = "up"
+	CaptureDown = "down"
+)
+
+// CaptureRecord is an uplink forwarded by a gateway or a downlink processed by a device, as written
+// to a capture file. Uplinks carry the gateway rx and tx info and downlinks the ProcessDownlink
+// outcome; Decoded is the decrypted PHYPayload JSON when the keys allowed decoding it.
+type CaptureRecord struct {
+	Time       time.Time       `json:"time"`
+	Direction  string          `json:"direction"` //"up" or "down".
+	Transport  string          `json:"transport"` //"udp" or "mqtt".
+	Gateway    string          `json:"gateway,omitempty"`
+	DevEUI     lorawan.EUI64   `json:"devEUI"`
+	PHYPayload []byte          `json:"phyPayload"`
+	Envelope   []byte          `json:"envelope,omitempty"` //UDP packet body or MQTT message.
+	RxInfo     json.RawMessage `json:"rxInfo,omitempty"`
+	TxInfo     json.RawMessage `json:"txInfo,omitempty"`
+	MType      string          `json:"mType"`
+	FCnt       *uint32         `json:"fCnt,omitempty"`
+	FPort      *uint8          `json:"fPort,omitempty"`
+	Payload    []byte          `json:"payload,omitempty"` //Decrypted FRMPayload.
+	Decoded    json.RawMessage `json:"decoded,omitempty"`
+	Result     string          `json:"result,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// Recorder writes capture records as JSON lines.
+type Recorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// DefaultRecorder records the traffic of every device when set.
+var DefaultRecorder *Recorder
+
+// NewRecorder returns a recorder writing to w.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{enc: json.NewEncoder(w)}
+}
+
+// Record writes a record. It does nothing on a nil recorder.
+func (r *Recorder) Record(rec *CaptureRecord) error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.enc.Encode(rec)
+}
+
+// ReadCapture reads the records of a capture file.
+func ReadCapture(r io.Reader) ([]*CaptureRecord, error) {
+	var records []*CaptureRecord
+	dec := json.NewDecoder(r)
+	for {
+		rec := &CaptureRecord{}
+		if err := dec.Decode(rec); err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "capture record %d", len(records)+1)
+		}
+		records = append(records, rec)
+	}
+}
+
+// ParseMType returns the message type with the given name, e.g. "ConfirmedDataUp".
+func ParseMType(name string) (lorawan.MType, error) {
+	for mType := lorawan.JoinRequest; mType <= lorawan.Proprietary; mType++ {
+		if mType.String() == name {
+			return mType, nil
+		}
+	}
+	return 0, errors.Errorf("unknown message type %q", name)
+}
+
+// recordUplink records an uplink forwarded by the gateway, decrypting it with the device keys.
+func (d *Device) recordUplink(g *Gateway, transport string, phyBytes, envelope []byte, rxInfo *gw.UplinkRXInfo, txInfo *gw.UplinkTXInfo) {
+	r := DefaultRecorder
+	if r == nil {
+		return
+	}
+
+	rec := &CaptureRecord{
+		Time:       time.Now(),
+		Direction:  CaptureUp,
+		Transport:  transport,
+		Gateway:    g.MAC,
+		DevEUI:     d.DevEUI,
+		PHYPayload: phyBytes,
+		Envelope:   envelope,
+	}
+	var m jsonpb.Marshaler
+	if s, err := m.MarshalToString(rxInfo); err == nil {
+		rec.RxInfo = json.RawMessage(s)
+	}
+	if s, err := m.MarshalToString(txInfo); err == nil {
+		rec.TxInfo = json.RawMessage(s)
+	}
+
+	var phy lorawan.PHYPayload
+	if err := phy.UnmarshalBinary(phyBytes); err != nil {
+		rec.Error = err.Error()
+	} else if err := d.decodeUplink(&phy, rec); err != nil {
+		rec.Error = err.Error()
+	}
+
+	if err := r.Record(rec); err != nil {
+		log.Errorf("capture error: %s", err)
+	}
+}
+
+// decodeUplink decrypts an uplink PHYPayload of the device and sets the record fields from it.
+func (d *Device) decodeUplink(phy *lorawan.PHYPayload, rec *CaptureRecord) error {
+	rec.MType = phy.MHDR.MType.String()
+	if macPayload, ok := phy.MACPayload.(*lorawan.MACPayload); ok {
+		fCnt := macPayload.FHDR.FCnt
+		rec.FCnt = &fCnt
+		rec.FPort = macPayload.FPort
+
+		frmKey := d.AppSKey
+		if macPayload.FPort != nil && *macPayload.FPort == 0 {
+			frmKey = d.NwkSEncKey
+		}
+		if err := phy.DecryptFRMPayload(frmKey); err != nil {
+			return err
+		}
+		if d.MACVersion != lorawan.LoRaWAN1_0 {
+			if err := phy.DecryptFOpts(d.NwkSEncKey); err != nil {
+				return err
+			}
+		}
+		for _, frmPayload := range macPayload.FRMPayload {
+			if dp, ok := frmPayload.(*lorawan.DataPayload); ok {
+				rec.Payload = append(rec.Payload, dp.Bytes...)
+			}
+		}
+	}
+
+	decoded, err := phy.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	rec.Decoded = decoded
+	return nil
+}
+
+// recordDownlink records a downlink given to ProcessDownlink with its outcome.
+func (d *Device) recordDownlink(envelope []byte, mqtt bool, payload []byte, result string, err error) {
+	r := DefaultRecorder
+	if r == nil {
+		return
+	}
+
+	rec := &CaptureRecord{
+		Time:      time.Now(),
+		Direction: CaptureDown,
+		Transport: "udp",
+		DevEUI:    d.DevEUI,
+		Envelope:  envelope,
+	}
+	if mqtt {
+		rec.Transport = "mqtt"
+	}
+
+	var phy lorawan.PHYPayload
+	if phy.UnmarshalText(payload) == nil {
+		rec.PHYPayload, _ = phy.MarshalBinary()
+		rec.MType = phy.MHDR.MType.String()
+		if macPayload, ok := phy.MACPayload.(*lorawan.MACPayload); ok {
+			fCnt := macPayload.FHDR.FCnt
+			rec.FCnt = &fCnt
+			rec.FPort = macPayload.FPort
+		}
+	}
+
+	//Processed downlinks are described by their decrypted PHYPayload JSON.
+	if err != nil {
+		rec.Error = err.Error()
+	} else if json.Valid([]byte(result)) {
+		rec.Decoded = json.RawMessage(result)
+	} else {
+		rec.Result = result
+	}
+
+	if err := r.Record(rec); err != nil {
+		log.Errorf("capture error: %s", err)
+	}
+}
@@ -0,0 +1,164 @@
+package lds
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// LPPType is a Cayenne Low Power Payload data type.
+type LPPType uint8
+
+// Cayenne LPP data types.
+const (
+	LPPDigitalInput  LPPType = 0
+	LPPDigitalOutput LPPType = 1
+	LPPAnalogInput   LPPType = 2
+	LPPAnalogOutput  LPPType = 3
+	LPPIlluminance   LPPType = 101
+	LPPPresence      LPPType = 102
+	LPPTemperature   LPPType = 103
+	LPPHumidity      LPPType = 104
+	LPPAccelerometer LPPType = 113
+	LPPBarometer     LPPType = 115
+	LPPGyrometer     LPPType = 134
+	LPPGPS           LPPType = 136
+)
+
+// lppType describes how a type's values are encoded: each one takes size bytes and is
+// multiplied by its multiplier before being written as an integer.
+type lppType struct {
+	name        string
+	size        int
+	signed      bool
+	multipliers []float64
+}
+
+var lppTypes = map[LPPType]lppType{
+	LPPDigitalInput:  {"digital_input", 1, false, []float64{1}},
+	LPPDigitalOutput: {"digital_output", 1, false, []float64{1}},
+	LPPAnalogInput:   {"analog_input", 2, true, []float64{100}},
+	LPPAnalogOutput:  {"analog_output", 2, true, []float64{100}},
+	LPPIlluminance:   {"illuminance", 2, false, []float64{1}},
+	LPPPresence:      {"presence", 1, false, []float64{1}},
+	LPPTemperature:   {"temperature", 2, true, []float64{10}},
+	LPPHumidity:      {"humidity", 1, false, []float64{2}},
+	LPPAccelerometer: {"accelerometer", 2, true, []float64{1000, 1000, 1000}},
+	LPPBarometer:     {"barometer", 2, false, []float64{10}},
+	LPPGyrometer:     {"gyrometer", 2, true, []float64{100, 100, 100}},
+	LPPGPS:           {"gps", 3, true, []float64{10000, 10000, 100}},
+}
+
+// LPPTypeNames lists the names of the supported LPP types.
+func LPPTypeNames() []string {
+	names := make([]string, 0, len(lppTypes))
+	for _, t := range lppTypes {
+		names = append(names, t.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseLPPType returns the LPP type with the given name, such as "temperature" or "gps".
+func ParseLPPType(name string) (LPPType, error) {
+	for id, t := range lppTypes {
+		if strings.EqualFold(t.name, strings.TrimSpace(name)) {
+			return id, nil
+		}
+	}
+	return 0, errors.Errorf("unknown LPP type %q", name)
+}
+
+func (t LPPType) String() string {
+	if info, ok := lppTypes[t]; ok {
+		return info.name
+	}
+	return fmt.Sprintf("LPPType(%d)", uint8(t))
+}
+
+// Values returns how many values the type holds, e.g. 3 for the accelerometer axes.
+func (t LPPType) Values() int {
+	return len(lppTypes[t].multipliers)
+}
+
+// LPPValue is a channel reading. Accelerometer and gyrometer values are the x, y and z axes,
+// and GPS ones latitude, longitude and altitude.
+type LPPValue struct {
+	Channel uint8
+	Type    LPPType
+	Values  []float64
+}
+
+func (v LPPValue) String() string {
+	return fmt.Sprintf("channel %d %s %v", v.Channel, v.Type, v.Values)
+}
+
+// EncodeLPP encodes the readings as a Cayenne LPP payload.
+func EncodeLPP(values []LPPValue) ([]byte, error) {
+	var b []byte
+	for _, v := range values {
+		info, ok := lppTypes[v.Type]
+		if !ok {
+			return nil, errors.Errorf("channel %d: unknown LPP type %d", v.Channel, v.Type)
+		}
+		if len(v.Values) != len(info.multipliers) {
+			return nil, errors.Errorf("channel %d: %s takes %d values, got %d", v.Channel, info.name, len(info.multipliers), len(v.Values))
+		}
+
+		b = append(b, v.Channel, byte(v.Type))
+		for i, value := range v.Values {
+			raw := int64(math.Round(value * info.multipliers[i]))
+			bits := uint(info.size * 8)
+			min, max := int64(0), int64(1)<<bits-1
+			if info.signed {
+				min, max = -(int64(1) << (bits - 1)), int64(1)<<(bits-1)-1
+			}
+			if raw < min || raw > max {
+				return nil, errors.Errorf("channel %d: %s value %g out of range", v.Channel, info.name, value)
+			}
+			for j := info.size - 1; j >= 0; j-- {
+				b = append(b, byte(uint64(raw)>>(uint(j)*8)))
+			}
+		}
+	}
+	return b, nil
+}
+
+// DecodeLPP decodes a Cayenne LPP payload.
+func DecodeLPP(b []byte) ([]LPPValue, error) {
+	var values []LPPValue
+	for i := 0; i < len(b); {
+		if len(b)-i < 2 {
+			return nil, errors.Errorf("LPP payload truncated at byte %d", i)
+		}
+		v := LPPValue{Channel: b[i], Type: LPPType(b[i+1])}
+		info, ok := lppTypes[v.Type]
+		if !ok {
+			return nil, errors.Errorf("channel %d: unknown LPP type %d", v.Channel, v.Type)
+		}
+		i += 2
+
+		if len(b)-i < info.size*len(info.multipliers) {
+			return nil, errors.Errorf("channel %d: %s value truncated", v.Channel, info.name)
+		}
+		for _, multiplier := range info.multipliers {
+			var raw uint64
+			for j := 0; j < info.size; j++ {
+				raw = raw<<8 | uint64(b[i+j])
+			}
+			i += info.size
+
+			value := int64(raw)
+			bits := uint(info.size * 8)
+			if info.signed && raw&(1<<(bits-1)) != 0 {
+				value -= int64(1) << bits
+			}
+			v.Values = append(v.Values, float64(value)/multiplier)
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
@@ -0,0 +1,116 @@
+package lds
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func TestLPP(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  []LPPValue
+		payload string
+	}{
+		{
+			name:    "temperature",
+			values:  []LPPValue{{Channel: 3, Type: LPPTemperature, Values: []float64{27.2}}},
+			payload: "03670110",
+		},
+		{
+			name:    "negative temperature",
+			values:  []LPPValue{{Channel: 1, Type: LPPTemperature, Values: []float64{-4.1}}},
+			payload: "0167ffd7",
+		},
+		{
+			name:    "humidity",
+			values:  []LPPValue{{Channel: 5, Type: LPPHumidity, Values: []float64{64}}},
+			payload: "056880",
+		},
+		{
+			name:    "accelerometer",
+			values:  []LPPValue{{Channel: 6, Type: LPPAccelerometer, Values: []float64{1.234, -1.234, 0}}},
+			payload: "067104d2fb2e0000",
+		},
+		{
+			name:    "gps",
+			values:  []LPPValue{{Channel: 1, Type: LPPGPS, Values: []float64{42.3519, -87.9094, 10}}},
+			payload: "018806765ff2960a0003e8",
+		},
+		{
+			name: "several channels",
+			values: []LPPValue{
+				{Channel: 3, Type: LPPDigitalInput, Values: []float64{1}},
+				{Channel: 4, Type: LPPBarometer, Values: []float64{1013.2}},
+			},
+			payload: "03000104732794",
+		},
+		{
+			name:    "empty",
+			payload: "",
+		},
+	}
+
+	for _, test := range tests {
+		want, err := hex.DecodeString(test.payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := EncodeLPP(test.values)
+		if err != nil {
+			t.Errorf("%s: encode failed: %s", test.name, err)
+		} else if !bytes.Equal(b, want) {
+			t.Errorf("%s: encoded %x, want %x", test.name, b, want)
+		}
+
+		values, err := DecodeLPP(want)
+		if err != nil {
+			t.Errorf("%s: decode failed: %s", test.name, err)
+		} else if !reflect.DeepEqual(values, test.values) {
+			t.Errorf("%s: decoded %v, want %v", test.name, values, test.values)
+		}
+	}
+}
+
+func TestEncodeLPPErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []LPPValue
+	}{
+		{"unknown type", []LPPValue{{Channel: 1, Type: 200, Values: []float64{1}}}},
+		{"missing values", []LPPValue{{Channel: 1, Type: LPPGPS, Values: []float64{1, 2}}}},
+		{"unsigned negative", []LPPValue{{Channel: 1, Type: LPPIlluminance, Values: []float64{-1}}}},
+		{"unsigned overflow", []LPPValue{{Channel: 1, Type: LPPDigitalInput, Values: []float64{256}}}},
+		{"signed overflow", []LPPValue{{Channel: 1, Type: LPPTemperature, Values: []float64{3276.8}}}},
+	}
+
+	for _, test := range tests {
+		if _, err := EncodeLPP(test.values); err == nil {
+			t.Errorf("%s: encode didn't fail", test.name)
+		}
+	}
+}
+
+func TestDecodeLPPErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+	}{
+		{"channel only", "03"},
+		{"unknown type", "03c801"},
+		{"truncated value", "036701"},
+		{"truncated second channel", "0367011004"},
+	}
+
+	for _, test := range tests {
+		b, err := hex.DecodeString(test.payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := DecodeLPP(b); err == nil {
+			t.Errorf("%s: decode didn't fail", test.name)
+		}
+	}
+}
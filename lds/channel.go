@@ -0,0 +1,160 @@
+package lds
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brocaar/chirpstack-api/go/gw"
+)
+
+// Channel impairs the frames exchanged by a device: random or bursty losses in both
+// directions, and collisions with other devices sharing the same Air.
+type Channel struct {
+	UplinkLoss   *Loss
+	DownlinkLoss *Loss
+	Air          *Air
+}
+
+// Loss drops frames using a Gilbert-Elliott model: frames are lost with Probability in the good
+// state and with BurstLoss in the bad (burst) one, which is entered with BurstStart probability
+// per frame and left with BurstEnd probability. With BurstStart zero losses are independent.
+type Loss struct {
+	Probability float64
+	BurstStart  float64
+	BurstEnd    float64
+	BurstLoss   float64
+
+	mu    sync.Mutex
+	burst bool
+}
+
+// Drop tells whether the next frame is lost. A nil Loss never drops.
+func (l *Loss) Drop() bool {
+	if l == nil {
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.burst {
+		l.burst = rand.Float64() >= l.BurstEnd
+	} else {
+		l.burst = rand.Float64() < l.BurstStart
+	}
+
+	if l.burst {
+		return rand.Float64() < l.BurstLoss
+	}
+	return rand.Float64() < l.Probability
+}
+
+// defaultCaptureThreshold is the power difference in dB a LoRa frame needs over an
+// overlapping one on the same frequency and SF to be demodulated.
+const defaultCaptureThreshold = 6
+
+// Air keeps the frames being received by each gateway, so that overlapping transmissions on
+// the same frequency and spreading factor collide. A frame survives a collision (capture effect)
+// when it's at least CaptureThreshold dB stronger than every frame it overlaps with.
+type Air struct {
+	CaptureThreshold float64
+
+	mu     sync.Mutex
+	frames map[string][]*airFrame
+}
+
+type airFrame struct {
+	frequency uint32
+	sf        uint32
+	rssi      float64
+	start     time.Time
+	end       time.Time
+}
+
+// transmit puts a frame on air at the given gateway.
+func (a *Air) transmit(gwMAC string, txInfo *gw.UplinkTXInfo, rssi float64, start time.Time, airtime time.Duration) *airFrame {
+	f := &airFrame{
+		frequency: txInfo.GetFrequency(),
+		sf:        txInfo.GetLoraModulationInfo().GetSpreadingFactor(),
+		rssi:      rssi,
+		start:     start,
+		end:       start.Add(airtime),
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.frames == nil {
+		a.frames = make(map[string][]*airFrame)
+	}
+
+	//Forget frames that ended long enough ago not to overlap with any frame still on air.
+	frames := a.frames[gwMAC][:0]
+	for _, other := range a.frames[gwMAC] {
+		if other.end.Add(maxAirtime).After(start) {
+			frames = append(frames, other)
+		}
+	}
+	a.frames[gwMAC] = append(frames, f)
+
+	return f
+}
+
+// survives tells whether a frame on air at the given gateway was received despite overlapping
+// frames. It must be called once the frame ended.
+func (a *Air) survives(gwMAC string, f *airFrame) bool {
+	threshold := a.CaptureThreshold
+	if threshold == 0 {
+		threshold = defaultCaptureThreshold
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, other := range a.frames[gwMAC] {
+		if other == f || other.frequency != f.frequency || other.sf != f.sf {
+			continue
+		}
+		if other.start.Before(f.end) && f.start.Before(other.end) && f.rssi-other.rssi < threshold {
+			return false
+		}
+	}
+
+	return true
+}
+
+// maxAirtime bounds the duration of any LoRa frame (SF12 BW125, 255 bytes is below 10s).
+const maxAirtime = 10 * time.Second
+
+// TimeOnAir returns the duration of a LoRa frame with the given PHYPayload size, using an
+// 8 symbols preamble, explicit header and CRC.
+func TimeOnAir(payloadSize int, mod *gw.LoRaModulationInfo) time.Duration {
+	sf := float64(mod.GetSpreadingFactor())
+	bw := float64(mod.GetBandwidth()) * 1000
+	if sf == 0 || bw == 0 {
+		return 0
+	}
+
+	cr := 1.0
+	if parts := strings.Split(mod.GetCodeRate(), "/"); len(parts) == 2 {
+		if den, err := strconv.Atoi(parts[1]); err == nil && den > 4 {
+			cr = float64(den - 4)
+		}
+	}
+
+	tSym := math.Pow(2, sf) / bw
+	de := 0.0
+	if tSym >= 0.016 {
+		de = 1
+	}
+
+	preamble := (8 + 4.25) * tSym
+	symbols := math.Ceil((8*float64(payloadSize)-4*sf+28+16)/(4*(sf-2*de))) * (cr + 4)
+	payload := (8 + math.Max(symbols, 0)) * tSym
+
+	return time.Duration((preamble + payload) * float64(time.Second))
+}
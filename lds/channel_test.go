@@ -0,0 +1,36 @@
+package lds
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brocaar/chirpstack-api/go/gw"
+)
+
+func TestTimeOnAir(t *testing.T) {
+	tests := []struct {
+		name        string
+		payloadSize int
+		mod         *gw.LoRaModulationInfo
+		want        time.Duration
+	}{
+		{"SF7 BW125", 13, &gw.LoRaModulationInfo{SpreadingFactor: 7, Bandwidth: 125, CodeRate: "4/5"}, 46336 * time.Microsecond},
+		{"SF7 BW250", 13, &gw.LoRaModulationInfo{SpreadingFactor: 7, Bandwidth: 250, CodeRate: "4/5"}, 23168 * time.Microsecond},
+		{"SF9 BW125", 51, &gw.LoRaModulationInfo{SpreadingFactor: 9, Bandwidth: 125, CodeRate: "4/5"}, 328704 * time.Microsecond},
+		//Low data rate optimization is on from SF11 at 125 kHz.
+		{"SF12 BW125", 13, &gw.LoRaModulationInfo{SpreadingFactor: 12, Bandwidth: 125, CodeRate: "4/5"}, 1155072 * time.Microsecond},
+		{"CR 4/8", 13, &gw.LoRaModulationInfo{SpreadingFactor: 7, Bandwidth: 125, CodeRate: "4/8"}, 61696 * time.Microsecond},
+		//A missing or bad code rate counts as 4/5.
+		{"no code rate", 13, &gw.LoRaModulationInfo{SpreadingFactor: 7, Bandwidth: 125}, 46336 * time.Microsecond},
+		{"empty payload", 0, &gw.LoRaModulationInfo{SpreadingFactor: 7, Bandwidth: 125, CodeRate: "4/5"}, 25856 * time.Microsecond},
+		{"no spreading factor", 13, &gw.LoRaModulationInfo{Bandwidth: 125, CodeRate: "4/5"}, 0},
+		{"no modulation", 13, nil, 0},
+	}
+
+	for _, test := range tests {
+		got := TimeOnAir(test.payloadSize, test.mod)
+		if diff := got - test.want; diff < -time.Microsecond || diff > time.Microsecond {
+			t.Errorf("%s: TimeOnAir(%d) = %s, want %s", test.name, test.payloadSize, got, test.want)
+		}
+	}
+}
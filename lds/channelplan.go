@@ -0,0 +1,115 @@
+package lds
+
+import (
+	"sync"
+
+	"github.com/brocaar/chirpstack-api/go/common"
+	"github.com/brocaar/chirpstack-api/go/gw"
+	"github.com/pkg/errors"
+)
+
+// ConcentratorChannel is a channel a gateway concentrator demodulates: LoRa with the given
+// bandwidth (kHz) and spreading factors, or FSK with the given bitrate.
+type ConcentratorChannel struct {
+	Frequency        uint32
+	Modulation       common.Modulation
+	Bandwidth        uint32
+	SpreadingFactors []uint32
+	Bitrate          uint32
+}
+
+// ChannelPlan is the set of channels a gateway listens to. The zero value listens to every
+// channel until a plan is set.
+type ChannelPlan struct {
+	mu       sync.RWMutex
+	version  string
+	channels []ConcentratorChannel
+}
+
+// Set replaces the plan channels.
+func (p *ChannelPlan) Set(version string, channels []ConcentratorChannel) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.version = version
+	p.channels = channels
+}
+
+// Apply sets the plan from a gateway configuration command.
+func (p *ChannelPlan) Apply(conf *gw.GatewayConfiguration) {
+	channels := make([]ConcentratorChannel, 0, len(conf.GetChannels()))
+	for _, c := range conf.GetChannels() {
+		ch := ConcentratorChannel{
+			Frequency:  c.GetFrequency(),
+			Modulation: c.GetModulation(),
+		}
+		if lora := c.GetLoraModulationConfig(); lora != nil {
+			ch.Bandwidth = lora.GetBandwidth()
+			ch.SpreadingFactors = lora.GetSpreadingFactors()
+		}
+		if fsk := c.GetFskModulationConfig(); fsk != nil {
+			ch.Bitrate = fsk.GetBitrate()
+		}
+		channels = append(channels, ch)
+	}
+	p.Set(conf.GetVersion(), channels)
+}
+
+// Version returns the version of the configuration the plan was set from.
+func (p *ChannelPlan) Version() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.version
+}
+
+// Channels returns a copy of the plan channels.
+func (p *ChannelPlan) Channels() []ConcentratorChannel {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]ConcentratorChannel(nil), p.channels...)
+}
+
+// Accepts returns an error when no channel of the plan demodulates a frame sent with txInfo.
+// A nil or empty plan accepts every frame.
+func (p *ChannelPlan) Accepts(txInfo *gw.UplinkTXInfo) error {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if len(p.channels) == 0 {
+		return nil
+	}
+
+	for _, ch := range p.channels {
+		if ch.Frequency != txInfo.GetFrequency() || ch.Modulation != txInfo.GetModulation() {
+			continue
+		}
+
+		if ch.Modulation == common.Modulation_FSK {
+			if ch.Bitrate == 0 || ch.Bitrate == txInfo.GetFskModulationInfo().GetBitrate() {
+				return nil
+			}
+			continue
+		}
+
+		lora := txInfo.GetLoraModulationInfo()
+		if ch.Bandwidth != 0 && ch.Bandwidth != lora.GetBandwidth() {
+			continue
+		}
+		if len(ch.SpreadingFactors) == 0 {
+			return nil
+		}
+		for _, sf := range ch.SpreadingFactors {
+			if sf == lora.GetSpreadingFactor() {
+				return nil
+			}
+		}
+	}
+
+	if lora := txInfo.GetLoraModulationInfo(); lora != nil {
+		return errors.Errorf("not listening on %d Hz SF%d BW%d", txInfo.GetFrequency(), lora.GetSpreadingFactor(), lora.GetBandwidth())
+	}
+	return errors.Errorf("not listening on %d Hz %s", txInfo.GetFrequency(), txInfo.GetModulation())
+}
@@ -0,0 +1,280 @@
+package lds
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/brocaar/lorawan"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// MICCandidate is a combination of key, LoRaWAN version and counters a frame MIC validates with.
+// Differences lists how it differs from what the device used.
+type MICCandidate struct {
+	Key         string
+	MACVersion  lorawan.MACVersion
+	FCnt        uint32
+	ConfFCnt    uint32
+	DevNonce    lorawan.DevNonce
+	Differences []string
+}
+
+// MICDiagnosis lists the combinations a frame the device failed to validate would have validated
+// with, closest first, along with the likely session mismatch.
+type MICDiagnosis struct {
+	JoinAccept bool
+	Candidates []MICCandidate
+	Hints      []string
+}
+
+// maxMICCandidates is the number of candidates kept in a diagnosis.
+const maxMICCandidates = 5
+
+type namedKey struct {
+	name string
+	key  lorawan.AES128Key
+}
+
+// addKey appends a key, or adds its name to an equal one already listed.
+func addKey(keys []namedKey, name string, key lorawan.AES128Key) []namedKey {
+	for i := range keys {
+		if keys[i].key == key {
+			keys[i].name += " = " + name
+			return keys
+		}
+	}
+	return append(keys, namedKey{name, key})
+}
+
+// DiagnoseMIC tries the device keys, both LoRaWAN versions and counters around the device ones
+// to find what a downlink or join-accept MIC validates with. Data downlinks are tried with the
+// session keys, the ones derived from the root keys with and without OptNeg, FCnt with other upper
+// 16 bits and nearby ConfFCnt values, and join-accepts with either root key and nearby DevNonces.
+func (d *Device) DiagnoseMIC(phyBytes []byte) (*MICDiagnosis, error) {
+	var phy lorawan.PHYPayload
+	if err := phy.UnmarshalBinary(phyBytes); err != nil {
+		return nil, errors.Wrap(err, "couldn't unmarshal PHYPayload")
+	}
+
+	diag := &MICDiagnosis{}
+	switch phy.MHDR.MType {
+	case lorawan.JoinAccept:
+		diag.JoinAccept = true
+		d.diagnoseJoinAccept(phyBytes, diag)
+	case lorawan.UnconfirmedDataDown, lorawan.ConfirmedDataDown:
+		d.diagnoseDownlink(phy, diag)
+	default:
+		return nil, errors.Errorf("%s frames aren't diagnosed", phy.MHDR.MType)
+	}
+
+	sort.SliceStable(diag.Candidates, func(i, j int) bool {
+		return len(diag.Candidates[i].Differences) < len(diag.Candidates[j].Differences)
+	})
+	if len(diag.Candidates) > maxMICCandidates {
+		diag.Candidates = diag.Candidates[:maxMICCandidates]
+	}
+	if len(diag.Candidates) > 0 {
+		diag.Hints = append(diag.Hints, diag.Candidates[0].Differences...)
+	} else {
+		diag.Hints = append(diag.Hints, "no combination validates: the frame may be meant for another device or the root keys differ")
+	}
+	return diag, nil
+}
+
+func (d *Device) diagnoseDownlink(phy lorawan.PHYPayload, diag *MICDiagnosis) {
+	macPayload, ok := phy.MACPayload.(*lorawan.MACPayload)
+	if !ok {
+		return
+	}
+	if macPayload.FHDR.DevAddr != d.DevAddr {
+		diag.Hints = append(diag.Hints, fmt.Sprintf("frame DevAddr %s isn't the device one, %s", macPayload.FHDR.DevAddr, d.DevAddr))
+	}
+
+	keys := addKey(nil, "SNwkSIntKey", d.SNwkSIntKey)
+	keys = addKey(keys, "NwkSEncKey", d.NwkSEncKey)
+	keys = addKey(keys, "FNwkSIntKey", d.FNwkSIntKey)
+	keys = addKey(keys, "AppSKey", d.AppSKey)
+	if d.Profile != "ABP" && d.Joined {
+		keys = d.derivedKeys(keys)
+	}
+
+	//ProcessDownlink checks the 16 bits FCnt as received.
+	fCnt16 := macPayload.FHDR.FCnt & 0xffff
+	var fCnts []uint32
+	for _, high := range []uint32{0, d.DlFcnt >> 16, d.DlFcnt>>16 + 1, d.DlFcnt>>16 - 1, d.UlFcnt >> 16} {
+		fCnts = appendUnique(fCnts, high<<16|fCnt16)
+	}
+	//ProcessDownlink acknowledges UlFcnt - 1, even before the first uplink.
+	confFCnts := []uint32{d.UlFcnt - 1}
+	for _, delta := range []int{0, -2, 1, -3} {
+		if confFCnt := int64(d.UlFcnt) + int64(delta); confFCnt >= 0 {
+			confFCnts = appendUnique(confFCnts, uint32(confFCnt))
+		}
+	}
+	//Without ACK, both versions compute the same MIC.
+	versions := []lorawan.MACVersion{d.MACVersion}
+	if macPayload.FHDR.FCtrl.ACK {
+		versions = append(versions, 1-d.MACVersion)
+	}
+
+	for _, key := range keys {
+		for _, mv := range versions {
+			for _, fCnt := range fCnts {
+				for i, confFCnt := range confFCnts {
+					//ConfFCnt is only part of LoRaWAN 1.1 MICs of acknowledgements.
+					if i > 0 && (mv == lorawan.LoRaWAN1_0 || !macPayload.FHDR.FCtrl.ACK) {
+						break
+					}
+					macPayload.FHDR.FCnt = fCnt
+					if ok, err := phy.ValidateDownlinkDataMIC(mv, confFCnt, key.key); err != nil || !ok {
+						continue
+					}
+
+					c := MICCandidate{Key: key.name, MACVersion: mv, FCnt: fCnt, ConfFCnt: confFCnt}
+					if key.name != "SNwkSIntKey" && !strings.HasPrefix(key.name, "SNwkSIntKey ") {
+						c.Differences = append(c.Differences, fmt.Sprintf("validates with %s instead of SNwkSIntKey: the session keys differ from the network server ones", key.name))
+					}
+					if mv != d.MACVersion {
+						c.Differences = append(c.Differences, fmt.Sprintf("validates as LoRaWAN %s while the device uses %s", macVersionName(mv), macVersionName(d.MACVersion)))
+					}
+					if fCnt != fCnt16 {
+						c.Differences = append(c.Differences, fmt.Sprintf("validates with the 32 bits FCnt %d instead of %d: the downlink counter rolled over", fCnt, fCnt16))
+					}
+					if mv == lorawan.LoRaWAN1_1 && macPayload.FHDR.FCtrl.ACK && confFCnt != confFCnts[0] {
+						c.Differences = append(c.Differences, fmt.Sprintf("validates with ConfFCnt %d instead of %d: the acknowledged uplink isn't the last one sent", confFCnt, confFCnts[0]))
+					}
+					diag.Candidates = append(diag.Candidates, c)
+				}
+			}
+		}
+	}
+}
+
+// derivedKeys adds the network session keys derived from the root keys with the device join
+// nonces, as LoRaWAN 1.0 and 1.1 network servers would.
+func (d *Device) derivedKeys(keys []namedKey) []namedKey {
+	roots := []namedKey{{"NwkKey", d.NwkKey}, {"AppKey", d.AppKey}}
+	derivations := []struct {
+		name   string
+		derive func(optNeg bool, nwkKey lorawan.AES128Key, netID lorawan.NetID, joinEUI lorawan.EUI64, joinNonce lorawan.JoinNonce, devNonce lorawan.DevNonce) (lorawan.AES128Key, error)
+	}{
+		{"FNwkSIntKey", getFNwkSIntKey},
+		{"SNwkSIntKey", getSNwkSIntKey},
+		{"NwkSEncKey", getNwkSEncKey},
+	}
+	for _, root := range roots {
+		for _, optNeg := range []bool{false, true} {
+			for _, derivation := range derivations {
+				key, err := derivation.derive(optNeg, root.key, d.NetID, d.JoinEUI, d.JoinNonce, d.DevNonce)
+				if err != nil {
+					continue
+				}
+				keys = addKey(keys, fmt.Sprintf("%s derived from %s with OptNeg %t", derivation.name, root.name, optNeg), key)
+			}
+		}
+	}
+	return keys
+}
+
+func (d *Device) diagnoseJoinAccept(phyBytes []byte, diag *MICDiagnosis) {
+	var devNonces []lorawan.DevNonce
+	for _, delta := range []int{0, -1, 1, -2, 2} {
+		devNonces = append(devNonces, lorawan.DevNonce(int(d.DevNonce)+delta))
+	}
+	roots := []namedKey{{"NwkKey", d.NwkKey}, {"AppKey", d.AppKey}}
+
+	for _, root := range roots {
+		var phy lorawan.PHYPayload
+		if err := phy.UnmarshalBinary(phyBytes); err != nil {
+			return
+		}
+		if err := phy.DecryptJoinAcceptPayload(root.key); err != nil {
+			continue
+		}
+		jap, ok := phy.MACPayload.(*lorawan.JoinAcceptPayload)
+		if !ok {
+			continue
+		}
+
+		micKey, micKeyName := root.key, root.name
+		if jap.DLSettings.OptNeg {
+			key, err := getJSIntKey(root.key, d.DevEUI)
+			if err != nil {
+				continue
+			}
+			micKey, micKeyName = key, fmt.Sprintf("JSIntKey derived from %s", root.name)
+		}
+
+		for _, devNonce := range devNonces {
+			if ok, err := phy.ValidateDownlinkJoinMIC(0xFF, d.JoinEUI, devNonce, micKey); err != nil || !ok {
+				continue
+			}
+			c := MICCandidate{Key: micKeyName, MACVersion: d.MACVersion, DevNonce: devNonce}
+			if root.name != "NwkKey" && root.key != d.NwkKey {
+				c.Differences = append(c.Differences, fmt.Sprintf("encrypted with %s instead of NwkKey: the network server has other root keys", root.name))
+			}
+			if devNonce != d.DevNonce {
+				c.Differences = append(c.Differences, fmt.Sprintf("validates with DevNonce %d instead of %d: the join request answered isn't the last one sent", devNonce, d.DevNonce))
+			}
+			diag.Candidates = append(diag.Candidates, c)
+		}
+	}
+}
+
+func appendUnique(values []uint32, v uint32) []uint32 {
+	for _, other := range values {
+		if other == v {
+			return values
+		}
+	}
+	return append(values, v)
+}
+
+func macVersionName(mv lorawan.MACVersion) string {
+	if mv == lorawan.LoRaWAN1_0 {
+		return "1.0"
+	}
+	return "1.1"
+}
+
+// String describes the diagnosis, hints first.
+func (diag *MICDiagnosis) String() string {
+	var b strings.Builder
+	for _, hint := range diag.Hints {
+		fmt.Fprintf(&b, "Hint:       %s\n", hint)
+	}
+	for _, c := range diag.Candidates {
+		switch {
+		case diag.JoinAccept:
+			fmt.Fprintf(&b, "Candidate:  %s, DevNonce %d\n", c.Key, c.DevNonce)
+		case c.MACVersion == lorawan.LoRaWAN1_1:
+			fmt.Fprintf(&b, "Candidate:  %s, LoRaWAN 1.1, FCnt %d, ConfFCnt %d\n", c.Key, c.FCnt, c.ConfFCnt)
+		default:
+			fmt.Fprintf(&b, "Candidate:  %s, LoRaWAN 1.0, FCnt %d\n", c.Key, c.FCnt)
+		}
+	}
+	return b.String()
+}
+
+// diagnoseMICFailure logs what a base64 PHYPayload the device failed to validate would have
+// validated with, when MIC diagnosis is enabled.
+func (d *Device) diagnoseMICFailure(payload []byte) {
+	if !d.MICDiagnosis {
+		return
+	}
+	phyBytes, err := ParsePHYPayload(string(payload))
+	if err != nil {
+		log.Warnf("MIC diagnosis error: %s", err)
+		return
+	}
+	diag, err := d.DiagnoseMIC(phyBytes)
+	if err != nil {
+		log.Warnf("MIC diagnosis error: %s", err)
+		return
+	}
+	for _, line := range strings.Split(strings.TrimSpace(diag.String()), "\n") {
+		log.Warnf("MIC diagnosis: %s", line)
+	}
+}
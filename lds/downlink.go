@@ -0,0 +1,103 @@
+package lds
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/pkg/errors"
+)
+
+// Downlink is a data downlink received by a device, once validated and decrypted.
+type Downlink struct {
+	Time        time.Time
+	MType       lorawan.MType
+	FCnt        uint32
+	FPort       *uint8
+	ACK         bool
+	FPending    bool
+	Payload     []byte
+	MACCommands []lorawan.MACCommand
+}
+
+// newDownlink collects the downlink fields from a decrypted data PHYPayload, taking MAC commands
+// both from FOpts and from FRMPayload when FPort is 0.
+func newDownlink(phy lorawan.PHYPayload, macPayload *lorawan.MACPayload) *Downlink {
+	dl := &Downlink{
+		Time:     time.Now(),
+		MType:    phy.MHDR.MType,
+		FCnt:     macPayload.FHDR.FCnt,
+		FPort:    macPayload.FPort,
+		ACK:      macPayload.FHDR.FCtrl.ACK,
+		FPending: macPayload.FHDR.FCtrl.FPending,
+	}
+
+	for _, opt := range macPayload.FHDR.FOpts {
+		if cmd, ok := opt.(*lorawan.MACCommand); ok {
+			dl.MACCommands = append(dl.MACCommands, *cmd)
+		}
+	}
+
+	for _, pl := range macPayload.FRMPayload {
+		switch p := pl.(type) {
+		case *lorawan.DataPayload:
+			dl.Payload = append(dl.Payload, p.Bytes...)
+		case *lorawan.MACCommand:
+			dl.MACCommands = append(dl.MACCommands, *p)
+		}
+	}
+
+	return dl
+}
+
+// HasMACCommand tells whether the downlink carries the given MAC command, given by name
+// (e.g. "LinkADRReq") or CID (e.g. "3" or "0x03").
+func (dl *Downlink) HasMACCommand(command string) bool {
+	for _, cmd := range dl.MACCommands {
+		if strings.EqualFold(cmd.CID.String(), command) {
+			return true
+		}
+		if cid, err := strconv.ParseUint(command, 0, 8); err == nil && lorawan.CID(cid) == cmd.CID {
+			return true
+		}
+	}
+	return false
+}
+
+// downlinkPayload returns the base64 PHYPayload of a downlink message, as published by the
+// broker or sent by the network server; ok is false for UDP packets other than PULL_RESP.
+func downlinkPayload(dlMessage []byte, mqtt bool) (payload []byte, ok bool, err error) {
+	if mqtt {
+		var df map[string]interface{}
+		if err := json.Unmarshal(dlMessage, &df); err != nil {
+			return nil, false, err
+		}
+		phyPayload, ok := df["phyPayload"].(string)
+		if !ok {
+			return nil, false, errors.New("downlink has no phyPayload")
+		}
+		return []byte(phyPayload), true, nil
+	}
+
+	var contents map[string]interface{}
+	result, payloadBase, err := UDPParsePacket(dlMessage, &contents)
+	if err != nil || !result {
+		return nil, false, err
+	}
+	return []byte(payloadBase), true, nil
+}
+
+// DownlinkPHYPayload returns the still encrypted PHYPayload of a downlink message, so it may be
+// routed to its device before being processed; ok is false for UDP packets other than PULL_RESP.
+func DownlinkPHYPayload(dlMessage []byte, mqtt bool) (phy lorawan.PHYPayload, ok bool, err error) {
+	payload, ok, err := downlinkPayload(dlMessage, mqtt)
+	if err != nil || !ok {
+		return phy, false, err
+	}
+	if err := phy.UnmarshalText(payload); err != nil {
+		return phy, false, err
+	}
+	return phy, true, nil
+}
@@ -0,0 +1,228 @@
+package lds
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/brocaar/chirpstack-api/go/gw"
+	"github.com/brocaar/lorawan"
+	"github.com/brocaar/lorawan/band"
+	"github.com/pkg/errors"
+)
+
+// FrameContext holds what a data frame MIC depends on besides the session: the FCnt of the uplink
+// a downlink acknowledges and, for LoRaWAN 1.1 uplinks, the data rate and channel indexes.
+type FrameContext struct {
+	ConfFCnt uint32
+	TxDR     uint8
+	TxCh     uint8
+}
+
+// Frame is a PHYPayload decoded offline with a device session. PHY holds the decrypted payload,
+// with FCnt extended to 32 bits from the session counters and MAC commands decoded.
+type Frame struct {
+	PHY         lorawan.PHYPayload
+	Uplink      bool
+	MICChecked  bool //Whether the MIC could be computed.
+	MICValid    bool
+	FRMPayload  []byte
+	MACCommands []lorawan.MACCommand
+	Errors      []string //Steps that failed, e.g. decrypting with a wrong key.
+}
+
+var hexPayload = regexp.MustCompile(`^([0-9a-fA-F]{2})+$`)
+
+// ParsePHYPayload reads a hex or base64 encoded PHYPayload.
+func ParsePHYPayload(text string) ([]byte, error) {
+	text = strings.TrimSpace(text)
+	if hexPayload.MatchString(text) {
+		return hex.DecodeString(text)
+	}
+	b, err := base64.StdEncoding.DecodeString(text)
+	if err != nil {
+		return nil, errors.New("PHYPayload is neither hex nor base64")
+	}
+	return b, nil
+}
+
+// fullFCnt extends a 16 bits FCnt with the upper bits of the expected counter, assuming the
+// counter rolled over when it would be lower than expected.
+func fullFCnt(expected uint32, fCnt uint32) uint32 {
+	full := expected&0xffff0000 | fCnt&0xffff
+	if full < expected && expected-full > 0x8000 {
+		full += 0x10000
+	}
+	return full
+}
+
+// DecodeFrame decrypts a PHYPayload with the device session and checks its MIC, without changing
+// the device. Data frames FCnt are extended from UlFcnt for uplinks and DlFcnt for downlinks, and
+// join-accepts are validated against the device DevNonce.
+func (d *Device) DecodeFrame(phyBytes []byte, ctx FrameContext) (*Frame, error) {
+	f := &Frame{}
+	if err := f.PHY.UnmarshalBinary(phyBytes); err != nil {
+		return nil, errors.Wrap(err, "couldn't unmarshal PHYPayload")
+	}
+
+	switch f.PHY.MHDR.MType {
+	case lorawan.JoinRequest:
+		f.Uplink = true
+		f.check(f.PHY.ValidateUplinkJoinMIC(d.NwkKey))
+	case lorawan.JoinAccept:
+		d.decodeJoinAccept(f)
+	case lorawan.UnconfirmedDataUp, lorawan.ConfirmedDataUp:
+		f.Uplink = true
+		d.decodeData(f, ctx)
+	case lorawan.UnconfirmedDataDown, lorawan.ConfirmedDataDown:
+		d.decodeData(f, ctx)
+	default:
+		f.Errors = append(f.Errors, fmt.Sprintf("%s frames aren't decoded", f.PHY.MHDR.MType))
+	}
+	return f, nil
+}
+
+func (f *Frame) check(ok bool, err error) {
+	if err != nil {
+		f.Errors = append(f.Errors, fmt.Sprintf("mic: %s", err))
+		return
+	}
+	f.MICChecked, f.MICValid = true, ok
+}
+
+func (d *Device) decodeJoinAccept(f *Frame) {
+	if err := f.PHY.DecryptJoinAcceptPayload(d.NwkKey); err != nil {
+		f.Errors = append(f.Errors, fmt.Sprintf("decrypt: %s", err))
+		return
+	}
+	jap, ok := f.PHY.MACPayload.(*lorawan.JoinAcceptPayload)
+	if !ok {
+		f.Errors = append(f.Errors, "mac payload is not a join accept payload")
+		return
+	}
+
+	key := d.NwkKey
+	if jap.DLSettings.OptNeg {
+		var err error
+		if key, err = getJSIntKey(d.NwkKey, d.DevEUI); err != nil {
+			f.Errors = append(f.Errors, fmt.Sprintf("mic: %s", err))
+			return
+		}
+	}
+	f.check(f.PHY.ValidateDownlinkJoinMIC(0xFF, d.JoinEUI, d.DevNonce, key))
+}
+
+func (d *Device) decodeData(f *Frame, ctx FrameContext) {
+	macPayload, ok := f.PHY.MACPayload.(*lorawan.MACPayload)
+	if !ok {
+		f.Errors = append(f.Errors, "can't convert mac payload")
+		return
+	}
+
+	//The MIC is checked as the device computes it, with NwkSEncKey for LoRaWAN 1.0 uplinks.
+	if f.Uplink {
+		macPayload.FHDR.FCnt = fullFCnt(d.UlFcnt, macPayload.FHDR.FCnt)
+		if d.MACVersion == lorawan.LoRaWAN1_0 {
+			f.check(f.PHY.ValidateUplinkDataMIC(lorawan.LoRaWAN1_0, 0, 0, 0, d.NwkSEncKey, d.NwkSEncKey))
+		} else {
+			f.check(f.PHY.ValidateUplinkDataMIC(d.MACVersion, ctx.ConfFCnt, ctx.TxDR, ctx.TxCh, d.FNwkSIntKey, d.SNwkSIntKey))
+		}
+	} else {
+		macPayload.FHDR.FCnt = fullFCnt(d.DlFcnt, macPayload.FHDR.FCnt)
+		f.check(f.PHY.ValidateDownlinkDataMIC(d.MACVersion, ctx.ConfFCnt, d.SNwkSIntKey))
+	}
+
+	frmKey := d.AppSKey
+	if macPayload.FPort != nil && *macPayload.FPort == 0 {
+		frmKey = d.NwkSEncKey
+	}
+	if err := f.PHY.DecryptFRMPayload(frmKey); err != nil {
+		f.Errors = append(f.Errors, fmt.Sprintf("decrypt FRMPayload: %s", err))
+	} else if macPayload.FPort != nil && *macPayload.FPort == 0 {
+		if err := f.PHY.DecodeFRMPayloadToMACCommands(); err != nil {
+			f.Errors = append(f.Errors, fmt.Sprintf("decode FRMPayload MAC commands: %s", err))
+		}
+	}
+
+	if d.MACVersion == lorawan.LoRaWAN1_0 {
+		if err := f.PHY.DecodeFOptsToMACCommands(); err != nil {
+			f.Errors = append(f.Errors, fmt.Sprintf("decode FOpts: %s", err))
+		}
+	} else if err := f.PHY.DecryptFOpts(d.NwkSEncKey); err != nil {
+		f.Errors = append(f.Errors, fmt.Sprintf("decrypt FOpts: %s", err))
+	}
+
+	for _, opt := range macPayload.FHDR.FOpts {
+		if cmd, ok := opt.(*lorawan.MACCommand); ok {
+			f.MACCommands = append(f.MACCommands, *cmd)
+		}
+	}
+	for _, pl := range macPayload.FRMPayload {
+		switch p := pl.(type) {
+		case *lorawan.DataPayload:
+			f.FRMPayload = append(f.FRMPayload, p.Bytes...)
+		case *lorawan.MACCommand:
+			f.MACCommands = append(f.MACCommands, *p)
+		}
+	}
+}
+
+// String describes the frame field by field.
+func (f *Frame) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "MHDR:       %s, %s\n", f.PHY.MHDR.MType, f.PHY.MHDR.Major)
+
+	switch p := f.PHY.MACPayload.(type) {
+	case *lorawan.JoinRequestPayload:
+		fmt.Fprintf(&b, "JoinEUI:    %s\nDevEUI:     %s\nDevNonce:   %d\n", p.JoinEUI, p.DevEUI, p.DevNonce)
+	case *lorawan.JoinAcceptPayload:
+		fmt.Fprintf(&b, "JoinNonce:  %d\nHomeNetID:  %s\nDevAddr:    %s\n", p.JoinNonce, p.HomeNetID, p.DevAddr)
+		fmt.Fprintf(&b, "DLSettings: OptNeg %t, RX2 DR %d, RX1 DR offset %d\nRXDelay:    %d\n",
+			p.DLSettings.OptNeg, p.DLSettings.RX2DataRate, p.DLSettings.RX1DROffset, p.RXDelay)
+		if p.CFList != nil {
+			fmt.Fprintf(&b, "CFList:     %+v\n", p.CFList.Payload)
+		}
+	case *lorawan.MACPayload:
+		fc := p.FHDR.FCtrl
+		fmt.Fprintf(&b, "DevAddr:    %s\n", p.FHDR.DevAddr)
+		if f.Uplink {
+			fmt.Fprintf(&b, "FCtrl:      ADR %t, ADRACKReq %t, ACK %t, ClassB %t\n", fc.ADR, fc.ADRACKReq, fc.ACK, fc.ClassB)
+		} else {
+			fmt.Fprintf(&b, "FCtrl:      ADR %t, ACK %t, FPending %t\n", fc.ADR, fc.ACK, fc.FPending)
+		}
+		fmt.Fprintf(&b, "FCnt:       %d\n", p.FHDR.FCnt)
+		if p.FPort != nil {
+			fmt.Fprintf(&b, "FPort:      %d\n", *p.FPort)
+		}
+		fmt.Fprintf(&b, "FRMPayload: %s\n", hex.EncodeToString(f.FRMPayload))
+		for _, cmd := range f.MACCommands {
+			fmt.Fprintf(&b, "MAC:        %s %+v\n", cmd.CID, cmd.Payload)
+		}
+	}
+
+	mic := "not checked"
+	if f.MICChecked && f.MICValid {
+		mic = "valid"
+	} else if f.MICChecked {
+		mic = "INVALID"
+	}
+	fmt.Fprintf(&b, "MIC:        %s (%s)\n", f.PHY.MIC, mic)
+	for _, e := range f.Errors {
+		fmt.Fprintf(&b, "Error:      %s\n", e)
+	}
+	return b.String()
+}
+
+// BuildUplink builds a data uplink with the device session and current UlFcnt, as UplinkGateways
+// would send it, without sending it nor changing the device.
+func (d *Device) BuildUplink(mType lorawan.MType, fPort uint8, txInfo *gw.UplinkTXInfo, payload []byte, bandName band.Name, dataRate band.DataRate, macCommands []*lorawan.MACCommand, fCtrl lorawan.FCtrl) ([]byte, error) {
+	return d.marshalPhyPayload(mType, fPort, nil, txInfo, payload, bandName, dataRate, macCommands, fCtrl)
+}
+
+// BuildJoinRequest builds a join request with the device DevNonce, without sending it nor
+// changing the device.
+func (d *Device) BuildJoinRequest() ([]byte, error) {
+	return d.joinRequest()
+}
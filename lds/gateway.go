@@ -0,0 +1,275 @@
+package lds
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/brocaar/chirpstack-api/go/common"
+	"github.com/brocaar/chirpstack-api/go/gw"
+	"github.com/brocaar/lorawan"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Gateway is a simulated gateway that forwards device frames to the network server,
+// either as a gateway bridge over MQTT or as a packet forwarder over UDP.
+type Gateway struct {
+	MAC string
+	// Location is reported in the rx info when set.
+	Location *common.Location
+	// RSSIOffset and SNROffset are added to the base rx info of every frame received by this gateway.
+	RSSIOffset int32
+	SNROffset  float64
+	// Skew delays the reception at this gateway and is added to its rx timestamps.
+	Skew time.Duration
+	// FineTimestamp sets the kind of fine timestamp reported, computed from the device
+	// position and the gateway location when both are known.
+	FineTimestamp    gw.FineTimestampType
+	FineTimestampKey lorawan.AES128Key
+	// AntennaGain in dBi, used by the device propagation model.
+	AntennaGain float64
+	// ChannelPlan restricts the frames the gateway receives, when set.
+	ChannelPlan *ChannelPlan
+
+	// MQTTClient and UplinkTopic are used when UDPClient is not connected, publishing with QoS.
+	// The topic is a template filled by Topic with the gateway MAC and Region.
+	MQTTClient  MQTT.Client
+	UplinkTopic string
+	Region      string
+	QoS         byte
+	UDPClient   *NSClient
+}
+
+// rxInfo returns a copy of the base rx info as seen by this gateway for a device at pos (if known).
+func (g *Gateway) rxInfo(base *gw.UplinkRXInfo, pos *Position) (*gw.UplinkRXInfo, error) {
+	gwID, err := MACToGatewayID(g.MAC)
+	if err != nil {
+		return nil, errors.Wrap(err, "gw mac error")
+	}
+
+	rx := proto.Clone(base).(*gw.UplinkRXInfo)
+	rx.GatewayId = gwID
+	rx.Rssi += g.RSSIOffset
+	rx.LoraSnr += g.SNROffset
+	if g.Location != nil {
+		rx.Location = g.Location
+	}
+
+	//Reception is delayed by the gateway skew and the time of flight from the device.
+	delay := g.Skew
+	if pos != nil && g.Location != nil {
+		delay += TimeOfFlight(pos.Distance(LocationToPosition(g.Location)))
+	}
+
+	if rx.TimeSinceGpsEpoch != nil {
+		d, err := ptypes.Duration(rx.TimeSinceGpsEpoch)
+		if err == nil {
+			rx.TimeSinceGpsEpoch = ptypes.DurationProto(d + delay)
+		}
+	}
+
+	if rx.Time == nil {
+		return rx, nil
+	}
+
+	t, err := ptypes.Timestamp(rx.Time)
+	if err != nil {
+		return nil, errors.Wrap(err, "rx time error")
+	}
+	t = t.Add(delay)
+	rx.Time, _ = ptypes.TimestampProto(t)
+
+	switch g.FineTimestamp {
+	case gw.FineTimestampType_PLAIN:
+		rx.FineTimestampType = gw.FineTimestampType_PLAIN
+		rx.FineTimestamp = &gw.UplinkRXInfo_PlainFineTimestamp{
+			PlainFineTimestamp: &gw.PlainFineTimestamp{Time: rx.Time},
+		}
+	case gw.FineTimestampType_ENCRYPTED:
+		encrypted, err := encryptFineTimestamp(g.FineTimestampKey, t)
+		if err != nil {
+			return nil, err
+		}
+		//Only the seconds are sent in the clear, the network server adds the decrypted nanoseconds.
+		rx.Time, _ = ptypes.TimestampProto(t.Truncate(time.Second))
+		rx.FineTimestampType = gw.FineTimestampType_ENCRYPTED
+		rx.FineTimestamp = &gw.UplinkRXInfo_EncryptedFineTimestamp{
+			EncryptedFineTimestamp: &gw.EncryptedFineTimestamp{EncryptedNs: encrypted},
+		}
+	}
+
+	return rx, nil
+}
+
+// Forward sends a PHYPayload through the gateway's transport as is, e.g. to replay a captured frame.
+// The device marshals MQTT frames and is the one the frame is counted and recorded for.
+func (g *Gateway) Forward(d *Device, phyBytes []byte, rxInfo *gw.UplinkRXInfo, txInfo *gw.UplinkTXInfo) error {
+	transport := "mqtt"
+	if g.UDPClient != nil && g.UDPClient.IsConnected() {
+		transport = "udp"
+	}
+	envelope, err := g.forward(d, phyBytes, rxInfo, txInfo)
+	if err != nil {
+		return err
+	}
+	DefaultTelemetry.forwarded(d.DevEUI, g.MAC, phyBytes)
+	DefaultPcap.WriteUplink(phyBytes, rxInfo, txInfo)
+	d.recordUplink(g, transport, phyBytes, envelope, rxInfo, txInfo)
+	return nil
+}
+
+// forward sends a PHYPayload through the gateway's transport, returning the UDP packet body or
+// MQTT message sent.
+func (g *Gateway) forward(d *Device, phyBytes []byte, rxInfo *gw.UplinkRXInfo, txInfo *gw.UplinkTXInfo) ([]byte, error) {
+	if g.UDPClient != nil && g.UDPClient.IsConnected() {
+		return g.UDPClient.sendWithPayload(phyBytes, g.MAC, rxInfo, txInfo)
+	}
+
+	if g.MQTTClient == nil || !g.MQTTClient.IsConnected() {
+		return nil, errors.New("gateway has no connected transport")
+	}
+
+	message := &gw.UplinkFrame{
+		PhyPayload: phyBytes,
+		RxInfo:     rxInfo,
+		TxInfo:     txInfo,
+	}
+
+	log.Debugf("frame: %+v\n", message)
+
+	b, err := d.marshal(message)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal uplink frame error")
+	}
+
+	return b, publish(g.MQTTClient, Topic(g.UplinkTopic, g.MAC, g.Region, EventUp), g.QoS, b)
+}
+
+// link overrides the rx RSSI and SNR with the ones given by the device propagation model, when
+// both ends are located. It returns false when the gateway can't demodulate the frame.
+func (g *Gateway) link(d *Device, rx *gw.UplinkRXInfo, txInfo *gw.UplinkTXInfo) bool {
+	if d.Propagation == nil || d.Propagation.Model == nil || d.Position == nil || g.Location == nil {
+		return true
+	}
+
+	distance := d.Position.Distance(LocationToPosition(g.Location))
+	rssi, snr, ok := d.Propagation.Link(distance, txInfo, g.AntennaGain)
+	if !ok {
+		log.Infof("gateway %s: frame lost at %.0f m (rssi %.1f, snr %.1f below demodulation floor)", g.MAC, distance, rssi, snr)
+		return false
+	}
+
+	rx.Rssi = int32(math.Round(rssi)) + g.RSSIOffset
+	rx.LoraSnr = math.Round(snr*10)/10 + g.SNROffset
+
+	return true
+}
+
+// forward delivers the same PHYPayload through every given gateway, each one applying its own
+// rx metadata and skew. Frames lost by the device channel, out of radio range or outside of the
+// gateway channel plan aren't received, and when the channel has an Air, gateways forward them
+// once on air time is over and only if they survived collisions. It only fails when every gateway receiving the frame failed to forward it.
+func (d *Device) forward(gateways []*Gateway, phyBytes []byte, rxInfo *gw.UplinkRXInfo, txInfo *gw.UplinkTXInfo) error {
+	if len(gateways) == 0 {
+		return errors.New("no gateways to forward through")
+	}
+
+	var air *Air
+	if d.Channel != nil {
+		if d.Channel.UplinkLoss.Drop() {
+			log.Warnln("uplink lost on channel")
+			return nil
+		}
+		air = d.Channel.Air
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		failures int
+		lost     int
+		lastErr  error
+		best     *gw.UplinkRXInfo
+	)
+
+	start := time.Now()
+	airtime := TimeOnAir(len(phyBytes), txInfo.GetLoraModulationInfo())
+
+	for _, g := range gateways {
+		if err := g.ChannelPlan.Accepts(txInfo); err != nil {
+			log.Warnf("gateway %s: %s", g.MAC, err)
+			lost++
+			continue
+		}
+
+		rx, err := g.rxInfo(rxInfo, d.Position)
+		if err != nil {
+			log.Errorf("gateway %s: %s", g.MAC, err)
+			failures++
+			lastErr = err
+			continue
+		}
+
+		if !g.link(d, rx, txInfo) {
+			lost++
+			continue
+		}
+
+		var frame *airFrame
+		if air != nil {
+			frame = air.transmit(g.MAC, txInfo, float64(rx.Rssi), start, airtime)
+		}
+
+		wg.Add(1)
+		go func(g *Gateway, rx *gw.UplinkRXInfo, frame *airFrame) {
+			defer wg.Done()
+			if frame != nil {
+				time.Sleep(time.Until(frame.end))
+				if !air.survives(g.MAC, frame) {
+					log.Infof("gateway %s: frame lost in a collision", g.MAC)
+					mu.Lock()
+					lost++
+					mu.Unlock()
+					return
+				}
+			}
+			if g.Skew > 0 {
+				time.Sleep(g.Skew)
+			}
+			if err := g.Forward(d, phyBytes, rx, txInfo); err != nil {
+				log.Errorf("gateway %s: %s", g.MAC, err)
+				mu.Lock()
+				failures++
+				lastErr = err
+				mu.Unlock()
+				return
+			}
+			log.Debugf("gateway %s forwarded frame (rssi %d, snr %.1f)", g.MAC, rx.Rssi, rx.LoraSnr)
+			mu.Lock()
+			if best == nil || rx.Rssi > best.Rssi {
+				best = rx
+			}
+			mu.Unlock()
+		}(g, rx, frame)
+	}
+
+	wg.Wait()
+	if best != nil {
+		d.LastRSSI, d.LastSNR = best.Rssi, best.LoraSnr
+	}
+
+	if lost == len(gateways) {
+		log.Warnln("uplink wasn't received by any gateway")
+		return nil
+	}
+
+	if failures+lost == len(gateways) {
+		return lastErr
+	}
+
+	return nil
+}
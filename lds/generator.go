@@ -0,0 +1,214 @@
+package lds
+
+import (
+	"encoding/csv"
+	"io"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Generator produces the successive values of a payload field, one per uplink.
+type Generator interface {
+	// Next returns the field value after elapsed time since the generator started.
+	Next(elapsed time.Duration) float64
+}
+
+// clamp limits v to [min, max] when the range is set.
+func clamp(v, min, max float64) float64 {
+	if max <= min {
+		return v
+	}
+	return math.Max(min, math.Min(max, v))
+}
+
+// Uniform draws values uniformly between Min and Max.
+type Uniform struct {
+	Min float64
+	Max float64
+}
+
+// Next implements Generator.
+func (g Uniform) Next(elapsed time.Duration) float64 {
+	return g.Min + rand.Float64()*(g.Max-g.Min)
+}
+
+// Normal draws normally distributed values around Mean, clamped to [Min, Max] when Max > Min.
+type Normal struct {
+	Mean   float64
+	StdDev float64
+	Min    float64
+	Max    float64
+}
+
+// Next implements Generator.
+func (g Normal) Next(elapsed time.Duration) float64 {
+	return clamp(g.Mean+rand.NormFloat64()*g.StdDev, g.Min, g.Max)
+}
+
+// RandomWalk starts at Start and moves up to Step in either direction on every value, staying
+// within [Min, Max] when Max > Min.
+type RandomWalk struct {
+	Start float64
+	Step  float64
+	Min   float64
+	Max   float64
+
+	mu      sync.Mutex
+	value   float64
+	started bool
+}
+
+// Next implements Generator.
+func (g *RandomWalk) Next(elapsed time.Duration) float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.started {
+		g.started = true
+		g.value = clamp(g.Start, g.Min, g.Max)
+		return g.value
+	}
+	g.value = clamp(g.value+(rand.Float64()*2-1)*g.Step, g.Min, g.Max)
+	return g.value
+}
+
+// Sine oscillates between Min and Max with the given Period, starting at the midpoint.
+type Sine struct {
+	Min    float64
+	Max    float64
+	Period time.Duration
+}
+
+// Next implements Generator.
+func (g Sine) Next(elapsed time.Duration) float64 {
+	if g.Period <= 0 {
+		return g.Min
+	}
+	mid := (g.Min + g.Max) / 2
+	amplitude := (g.Max - g.Min) / 2
+	return mid + amplitude*math.Sin(2*math.Pi*float64(elapsed)/float64(g.Period))
+}
+
+// Sawtooth rises linearly from Min to Max over each Period.
+type Sawtooth struct {
+	Min    float64
+	Max    float64
+	Period time.Duration
+}
+
+// Next implements Generator.
+func (g Sawtooth) Next(elapsed time.Duration) float64 {
+	if g.Period <= 0 {
+		return g.Min
+	}
+	fraction := float64(elapsed%g.Period) / float64(g.Period)
+	return g.Min + fraction*(g.Max-g.Min)
+}
+
+// Counter starts at Start and adds Step on every value, wrapping around to Min once it goes
+// past Max when Max > Min.
+type Counter struct {
+	Start float64
+	Step  float64
+	Min   float64
+	Max   float64
+
+	mu      sync.Mutex
+	value   float64
+	started bool
+}
+
+// Next implements Generator.
+func (g *Counter) Next(elapsed time.Duration) float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.started {
+		g.started = true
+		g.value = g.Start
+		return g.value
+	}
+	g.value += g.Step
+	if g.Max > g.Min && g.value > g.Max {
+		g.value = g.Min
+	}
+	return g.value
+}
+
+// Replay returns Values in order, starting over after the last one.
+type Replay struct {
+	Values []float64
+
+	mu   sync.Mutex
+	next int
+}
+
+// Next implements Generator.
+func (g *Replay) Next(elapsed time.Duration) float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if len(g.Values) == 0 {
+		return 0
+	}
+	v := g.Values[g.next]
+	g.next = (g.next + 1) % len(g.Values)
+	return v
+}
+
+// LoadCSVColumn reads the values of a CSV column, given by its header name or its 0 based index.
+// A header row is skipped.
+func LoadCSVColumn(r io.Reader, column string) ([]float64, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, errors.Wrap(err, "csv read error")
+	}
+	if len(records) == 0 {
+		return nil, errors.New("csv has no rows")
+	}
+
+	index, err := strconv.Atoi(column)
+	if err != nil {
+		index = -1
+		for i, name := range records[0] {
+			if strings.EqualFold(strings.TrimSpace(name), strings.TrimSpace(column)) {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			return nil, errors.Errorf("csv has no column %q", column)
+		}
+	}
+
+	var values []float64
+	for i, rec := range records {
+		if index >= len(rec) {
+			return nil, errors.Errorf("csv row %d has no column %d", i+1, index)
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(rec[index]), 64)
+		if err != nil {
+			//Skip the header.
+			if i == 0 {
+				continue
+			}
+			return nil, errors.Wrapf(err, "csv row %d", i+1)
+		}
+		values = append(values, v)
+	}
+	if len(values) == 0 {
+		return nil, errors.New("csv column has no values")
+	}
+
+	return values, nil
+}
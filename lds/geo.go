@@ -0,0 +1,112 @@
+package lds
+
+import (
+	"crypto/aes"
+	"encoding/binary"
+	"math"
+	"time"
+
+	"github.com/brocaar/chirpstack-api/go/common"
+	"github.com/brocaar/lorawan"
+	"github.com/pkg/errors"
+)
+
+const (
+	earthRadius   = 6371008.8 //Mean earth radius in meters.
+	speedOfLight  = 299792458 //Meters per second.
+	gpsLeapOffset = 18 * time.Second
+)
+
+var gpsEpoch = time.Date(1980, time.January, 6, 0, 0, 0, 0, time.UTC)
+
+// Position is a WGS84 point with altitude in meters.
+type Position struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Altitude  float64 `json:"altitude"`
+}
+
+// Position fields that may be encoded into payloads.
+const (
+	LatitudeField  = "latitude"
+	LongitudeField = "longitude"
+	AltitudeField  = "altitude"
+)
+
+// Field returns the value of the named position field.
+func (p Position) Field(name string) (float64, error) {
+	switch name {
+	case LatitudeField:
+		return p.Latitude, nil
+	case LongitudeField:
+		return p.Longitude, nil
+	case AltitudeField:
+		return p.Altitude, nil
+	}
+	return 0, errors.Errorf("unknown position field %q", name)
+}
+
+// EncodeField encodes the named position field with its default representation
+// (see GenerateLat, GenerateLng and GenerateAltitude).
+func (p Position) EncodeField(name string) ([]byte, error) {
+	switch name {
+	case LatitudeField:
+		return GenerateLat(float32(p.Latitude)), nil
+	case LongitudeField:
+		return GenerateLng(float32(p.Longitude)), nil
+	case AltitudeField:
+		return GenerateAltitude(float32(p.Altitude)), nil
+	}
+	return nil, errors.Errorf("unknown position field %q", name)
+}
+
+// LocationToPosition converts a gateway location to a Position.
+func LocationToPosition(loc *common.Location) Position {
+	return Position{
+		Latitude:  loc.GetLatitude(),
+		Longitude: loc.GetLongitude(),
+		Altitude:  loc.GetAltitude(),
+	}
+}
+
+// Distance returns the straight line distance in meters between two positions,
+// using the haversine great-circle distance and the altitude difference.
+func (p Position) Distance(o Position) float64 {
+	lat1 := p.Latitude * math.Pi / 180
+	lat2 := o.Latitude * math.Pi / 180
+	dLat := lat2 - lat1
+	dLng := (o.Longitude - p.Longitude) * math.Pi / 180
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	ground := 2 * earthRadius * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+	height := o.Altitude - p.Altitude
+
+	return math.Sqrt(ground*ground + height*height)
+}
+
+// TimeOfFlight returns the propagation time of a radio signal over the given distance in meters.
+func TimeOfFlight(distance float64) time.Duration {
+	return time.Duration(distance / speedOfLight * float64(time.Second))
+}
+
+// TimeSinceGPSEpoch returns the GPS time of t (GPS time doesn't have leap seconds).
+func TimeSinceGPSEpoch(t time.Time) time.Duration {
+	return t.Sub(gpsEpoch) + gpsLeapOffset
+}
+
+// encryptFineTimestamp encrypts the nanosecond part of t the way LoRa gateways v2 do,
+// so that the network server can decrypt it with the gateway board fine-timestamp key.
+func encryptFineTimestamp(key lorawan.AES128Key, t time.Time) ([]byte, error) {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, errors.Wrap(err, "new cipher error")
+	}
+
+	plain := make([]byte, block.BlockSize())
+	binary.BigEndian.PutUint64(plain[len(plain)-8:], uint64(t.Nanosecond())*32)
+
+	encrypted := make([]byte, block.BlockSize())
+	block.Encrypt(encrypted, plain)
+
+	return encrypted, nil
+}
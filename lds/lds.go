@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"math"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/brocaar/chirpstack-api/go/gw"
@@ -38,18 +39,43 @@ type Device struct {
 	DlFcnt        uint32             `json:"dlFcnt"`
 	marshal       func(msg proto.Message) ([]byte, error)
 	unmarshal     func(b []byte, msg proto.Message) error
-	Profile       string            `json:"profile"`
-	Joined        bool              `json:"joined"`
-	DevNonce      lorawan.DevNonce  `json:"devNonce"`
-	JoinNonce     lorawan.JoinNonce `json:"joinNonce"`
-	SkipFCntCheck bool              `toml:"skip_fcnt_check"`
+	Profile       string             `json:"profile"`
+	Joined        bool               `json:"joined"`
+	DevNonce      lorawan.DevNonce   `json:"devNonce"`
+	JoinNonce     lorawan.JoinNonce  `json:"joinNonce"`
+	NetID         lorawan.NetID      `json:"netID"`
+	SkipFCntCheck bool               `toml:"skip_fcnt_check"`
+	MICDiagnosis  bool               `json:"-"` //Log what a downlink failing MIC validation would validate with.
+	Position      *Position          `json:"position"`
+	Propagation   *Propagation       `json:"-"`
+	Mobility      Mobility           `json:"-"`
+	Channel       *Channel           `json:"-"`
+	OnDownlink    func(dl *Downlink) `json:"-"` //Called with every processed data downlink.
+	LastRSSI      int32              `json:"-"` //Strongest gateway RSSI of the last uplink.
+	LastSNR       float64            `json:"-"`
+	mobilityStart time.Time
+	sessionMu     sync.Mutex
+	session       *SessionState
+	subscribers   map[chan SessionEvent]struct{}
 }
 
 var redisClient *redis.Client
 
+// MIC validation errors returned by ProcessDownlink.
+var (
+	ErrJoinMIC     = errors.New("validate downlink join mic not ok")
+	ErrDownlinkMIC = errors.New("downlink error: invalid mic")
+)
+
+// IsMICError tells whether a ProcessDownlink error is a failed MIC validation.
+func IsMICError(err error) bool {
+	cause := errors.Cause(err)
+	return cause == ErrJoinMIC || cause == ErrDownlinkMIC
+}
+
 //StartRedis tries to connect to Redis (used for DevNonce and JoinNonce).
 func StartRedis(addr, password string, db int) error {
-	log.Debugf("Connecting to redis %s %s %s", addr, password, db)
+	log.Debugf("Connecting to redis %s %s %d", addr, password, db)
 	redisClient = redis.NewClient(&redis.Options{
 		Addr:     addr,
 		Password: password,
@@ -66,9 +92,14 @@ func StartRedis(addr, password string, db int) error {
 
 //SetMarshaler sets marshaling and unmarshaling functions according to the given option.
 func (d *Device) SetMarshaler(opt string) {
+	d.marshal, d.unmarshal = marshalers(opt)
+}
+
+//marshalers returns the marshaling and unmarshaling functions for "json", "protobuf" or plain old json.
+func marshalers(opt string) (func(msg proto.Message) ([]byte, error), func(b []byte, msg proto.Message) error) {
 	switch opt {
 	case "json":
-		d.marshal = func(msg proto.Message) ([]byte, error) {
+		marshal := func(msg proto.Message) ([]byte, error) {
 			marshaler := &jsonpb.Marshaler{
 				EnumsAsInts:  false,
 				EmitDefaults: true,
@@ -77,30 +108,33 @@ func (d *Device) SetMarshaler(opt string) {
 			return []byte(str), err
 		}
 
-		d.unmarshal = func(b []byte, msg proto.Message) error {
+		unmarshal := func(b []byte, msg proto.Message) error {
 			unmarshaler := &jsonpb.Unmarshaler{
 				AllowUnknownFields: true, // we don't want to fail on unknown fields
 			}
 			return unmarshaler.Unmarshal(bytes.NewReader(b), msg)
 		}
+		return marshal, unmarshal
 
 	case "protobuf":
-		d.marshal = func(msg proto.Message) ([]byte, error) {
+		marshal := func(msg proto.Message) ([]byte, error) {
 			return proto.Marshal(msg)
 		}
 
-		d.unmarshal = func(b []byte, msg proto.Message) error {
+		unmarshal := func(b []byte, msg proto.Message) error {
 			return proto.Unmarshal(b, msg)
 		}
+		return marshal, unmarshal
 	default:
 		//Plain old json.
-		d.marshal = func(msg proto.Message) ([]byte, error) {
+		marshal := func(msg proto.Message) ([]byte, error) {
 			return json.Marshal(msg)
 		}
 
-		d.unmarshal = func(b []byte, msg proto.Message) error {
+		unmarshal := func(b []byte, msg proto.Message) error {
 			return json.Unmarshal(b, msg)
 		}
+		return marshal, unmarshal
 	}
 }
 
@@ -115,8 +149,8 @@ func (d *Device) RedisSet(key string, value interface{}, exp time.Duration) erro
 	return err
 }
 
-// Join sends a join request for a given device (OTAA) and rxInfo.
-func (d *Device) marshalJoinPayload(gwMac string, rxInfo *gw.UplinkRXInfo, txInfo *gw.UplinkTXInfo) ([]byte, error) {
+// marshalJoinPayload builds a join request with the next DevNonce.
+func (d *Device) marshalJoinPayload(rxInfo *gw.UplinkRXInfo, txInfo *gw.UplinkTXInfo) ([]byte, error) {
 
 	d.Joined = false
 	devNonceKey := fmt.Sprintf("dev-nonce-%s", d.DevEUI[:])
@@ -132,6 +166,11 @@ func (d *Device) marshalJoinPayload(gwMac string, rxInfo *gw.UplinkRXInfo, txInf
 
 	d.DevNonce = lorawan.DevNonce(devNonce)
 
+	return d.joinRequest()
+}
+
+// joinRequest builds a join request with the device DevNonce.
+func (d *Device) joinRequest() ([]byte, error) {
 	joinPhy := lorawan.PHYPayload{
 		MHDR: lorawan.MHDR{
 			MType: lorawan.JoinRequest,
@@ -155,57 +194,32 @@ func (d *Device) marshalJoinPayload(gwMac string, rxInfo *gw.UplinkRXInfo, txInf
 
 // Join sends a join request for a given device (OTAA) and rxInfo.
 func (d *Device) Join(client MQTT.Client, topicTemplate, gwMac string, rxInfo *gw.UplinkRXInfo, txInfo *gw.UplinkTXInfo) error {
-
-	joinStr, err := d.marshalJoinPayload(gwMac, rxInfo, txInfo)
-
-	if err != nil {
-		log.Errorf("Unable to marshal join payload: %s", err)
-		return err
-	}
-
-	message := &gw.UplinkFrame{
-		PhyPayload: joinStr,
-		RxInfo:     rxInfo,
-		TxInfo:     txInfo,
-	}
-
-	log.Infof("frame: %+v\n", message)
-
-	topic := fmt.Sprintf(topicTemplate, gwMac)
-
-	b, err := d.marshal(message)
-	if err != nil {
-		log.Errorf("error marshaling join message: %s", err)
-		return err
-	}
-
-	pErr := publish(client, topic, b)
-
-	return pErr
+	return d.JoinGateways([]*Gateway{{MAC: gwMac, MQTTClient: client, UplinkTopic: topicTemplate}}, rxInfo, txInfo)
 }
 
 // JoinUDP sends a join request for a given device (OTAA) and rxInfo via raw packet_forwarder protocol
-func (d *Device) JoinUDP(cClient NSClient, gwMac string, rxInfo *gw.UplinkRXInfo, txInfo *gw.UplinkTXInfo) error {
-
-	phyBytes, err := d.marshalJoinPayload(gwMac, rxInfo, txInfo)
+func (d *Device) JoinUDP(cClient *NSClient, gwMac string, rxInfo *gw.UplinkRXInfo, txInfo *gw.UplinkTXInfo) error {
+	return d.JoinGateways([]*Gateway{{MAC: gwMac, UDPClient: cClient}}, rxInfo, txInfo)
+}
 
-	if err != nil {
-		log.Debugf("marshal PHY join payload error: %s\n", err)
-		return err
-	}
+// JoinGateways sends a join request for a given device (OTAA) through every given gateway.
+func (d *Device) JoinGateways(gateways []*Gateway, rxInfo *gw.UplinkRXInfo, txInfo *gw.UplinkTXInfo) error {
 
-	log.Debugln("Sending UDP join payload")
-	err = cClient.sendWithPayload(phyBytes, gwMac, rxInfo, txInfo)
+	joinStr, err := d.marshalJoinPayload(rxInfo, txInfo)
 
 	if err != nil {
 		log.Errorf("Unable to marshal join payload: %s", err)
 		return err
 	}
 
+	if err := d.forward(gateways, joinStr, rxInfo, txInfo); err != nil {
+		return err
+	}
+	d.updateSession(SessionJoinRequest, nil)
 	return nil
 }
 
-func (d *Device) marshalPhyPayload(mType lorawan.MType, fPort uint8, rxInfo *gw.UplinkRXInfo, txInfo *gw.UplinkTXInfo, payload []byte, gwMAC string, bandName band.Name, dataRate band.DataRate, macCommands []*lorawan.MACCommand, fCtrl lorawan.FCtrl) ([]byte, error) {
+func (d *Device) marshalPhyPayload(mType lorawan.MType, fPort uint8, rxInfo *gw.UplinkRXInfo, txInfo *gw.UplinkTXInfo, payload []byte, bandName band.Name, dataRate band.DataRate, macCommands []*lorawan.MACCommand, fCtrl lorawan.FCtrl) ([]byte, error) {
 
 	var fOpts = make([]lorawan.Payload, len(macCommands))
 	for i := 0; i < len(fOpts); i++ {
@@ -297,58 +311,18 @@ func (d *Device) marshalPhyPayload(mType lorawan.MType, fPort uint8, rxInfo *gw.
 
 //Uplink sends an uplink message as if it was sent from a lora-gateway-bridge.
 func (d *Device) Uplink(client MQTT.Client, topicTemplate string, mType lorawan.MType, fPort uint8, rxInfo *gw.UplinkRXInfo, txInfo *gw.UplinkTXInfo, payload []byte, gwMAC string, bandName band.Name, dataRate band.DataRate, macCommands []*lorawan.MACCommand, fCtrl lorawan.FCtrl) (uint32, error) {
-
-	//Get uplink frame counter.
-	ulFcntKey := fmt.Sprintf("ul-fcnt-%s", d.DevEUI[:])
-	uf, err := redisClient.Get(ulFcntKey).Result()
-	if err == nil {
-		ufn, err := strconv.Atoi(uf)
-		if err == nil {
-			d.UlFcnt = uint32(ufn)
-		}
-	}
-
-	phyBytes, err := d.marshalPhyPayload(mType, fPort, rxInfo, txInfo, payload, gwMAC, bandName, dataRate, macCommands, fCtrl)
-
-	if err != nil {
-		if err != nil {
-			log.Debugf("marshal PHY payload error: %s\n", err)
-			return d.UlFcnt, err
-		}
-	}
-
-	message := gw.UplinkFrame{
-		PhyPayload: phyBytes,
-		RxInfo:     rxInfo,
-		TxInfo:     txInfo,
-	}
-
-	log.Debugf("message: %+v\n", message)
-	log.Debugf("payload: %v\n", string(message.PhyPayload))
-
-	bytes, err := d.marshal(&message)
-	if err != nil {
-		return d.UlFcnt, err
-	}
-
-	log.Debugf("marshaled message: %v\n", string(bytes))
-
-	topic := fmt.Sprintf(topicTemplate, gwMAC)
-
-	if token := client.Publish(topic, 0, false, bytes); token.Wait() && token.Error() != nil {
-		log.Errorf("publish error: %s", token.Error())
-		return d.UlFcnt, token.Error()
-	}
-
-	//Message was sent, UlFcnt can be set.
-	d.UlFcnt++
-	d.RedisSet(ulFcntKey, d.UlFcnt, 0)
-
-	return d.UlFcnt, nil
+	gateways := []*Gateway{{MAC: gwMAC, MQTTClient: client, UplinkTopic: topicTemplate}}
+	return d.UplinkGateways(gateways, mType, fPort, rxInfo, txInfo, payload, bandName, dataRate, macCommands, fCtrl)
 }
 
 //UplinkUDP sends an uplink message via raw `packet-forwarder` protocol
-func (d *Device) UplinkUDP(cClient NSClient, mType lorawan.MType, fPort uint8, rxInfo *gw.UplinkRXInfo, txInfo *gw.UplinkTXInfo, payload []byte, gwMAC string, bandName band.Name, dataRate band.DataRate, macCommands []*lorawan.MACCommand, fCtrl lorawan.FCtrl) (uint32, error) {
+func (d *Device) UplinkUDP(cClient *NSClient, mType lorawan.MType, fPort uint8, rxInfo *gw.UplinkRXInfo, txInfo *gw.UplinkTXInfo, payload []byte, gwMAC string, bandName band.Name, dataRate band.DataRate, macCommands []*lorawan.MACCommand, fCtrl lorawan.FCtrl) (uint32, error) {
+	gateways := []*Gateway{{MAC: gwMAC, UDPClient: cClient}}
+	return d.UplinkGateways(gateways, mType, fPort, rxInfo, txInfo, payload, bandName, dataRate, macCommands, fCtrl)
+}
+
+//UplinkGateways sends an uplink message that is received by every given gateway.
+func (d *Device) UplinkGateways(gateways []*Gateway, mType lorawan.MType, fPort uint8, rxInfo *gw.UplinkRXInfo, txInfo *gw.UplinkTXInfo, payload []byte, bandName band.Name, dataRate band.DataRate, macCommands []*lorawan.MACCommand, fCtrl lorawan.FCtrl) (uint32, error) {
 
 	//Get uplink frame counter.
 	ulFcntKey := fmt.Sprintf("ul-fcnt-%s", d.DevEUI[:])
@@ -360,22 +334,22 @@ func (d *Device) UplinkUDP(cClient NSClient, mType lorawan.MType, fPort uint8, r
 		}
 	}
 
-	phyBytes, err := d.marshalPhyPayload(mType, fPort, rxInfo, txInfo, payload, gwMAC, bandName, dataRate, macCommands, fCtrl)
+	phyBytes, err := d.marshalPhyPayload(mType, fPort, rxInfo, txInfo, payload, bandName, dataRate, macCommands, fCtrl)
 
 	if err != nil {
 		log.Debugf("marshal PHY payload error: %s\n", err)
 		return d.UlFcnt, err
 	}
 
-	err = cClient.sendWithPayload(phyBytes, gwMAC, rxInfo, txInfo)
-	if err != nil {
-		log.Debugf("Unable to send UDP datagram: %s\n", err)
+	if err := d.forward(gateways, phyBytes, rxInfo, txInfo); err != nil {
+		log.Debugf("Unable to forward uplink: %s\n", err)
 		return d.UlFcnt, err
 	}
 
 	//Message was sent, UlFcnt can be set.
 	d.UlFcnt++
 	d.RedisSet(ulFcntKey, d.UlFcnt, 0)
+	d.uplinkSent(macCommands)
 
 	return d.UlFcnt, nil
 }
@@ -384,30 +358,18 @@ func (d *Device) UplinkUDP(cClient NSClient, mType lorawan.MType, fPort uint8, r
 func (d *Device) ProcessDownlink(dlMessage []byte, mv lorawan.MACVersion, mqtt bool) (string, error) {
 	log.Debugf("original dlmessage: %s", string(dlMessage))
 
-	var payload []byte = nil
-	if mqtt {
-		var df map[string]interface{}
-
-		err := json.Unmarshal(dlMessage, &df)
-		if err != nil {
-			return "", err
-		}
-
-		payload = []byte(df["phyPayload"].(string))
-	} else {
-		var contents map[string]interface{}
-
-		result, payloadBase, err := UDPParsePacket(dlMessage, &contents)
-
-		if err != nil {
-			return "", err
-		}
-
-		if !result {
-			return "Service (non-PULL_RESP) ignored", nil
-		}
+	payload, ok, err := downlinkPayload(dlMessage, mqtt)
+	if err != nil {
+		DefaultTelemetry.downlinkProcessed(d.DevEUI, false, err)
+		return "", err
+	}
+	if !ok {
+		return "Service (non-PULL_RESP) ignored", nil
+	}
 
-		payload = []byte(payloadBase)
+	if d.Channel != nil && d.Channel.DownlinkLoss.Drop() {
+		d.recordDownlink(dlMessage, mqtt, payload, "Downlink lost on channel", nil)
+		return "Downlink lost on channel", nil
 	}
 
 	var phy lorawan.PHYPayload
@@ -415,23 +377,30 @@ func (d *Device) ProcessDownlink(dlMessage []byte, mv lorawan.MACVersion, mqtt b
 
 	if err := phy.UnmarshalText(payload); err != nil {
 		log.Error("failed at unmarshal")
+		DefaultTelemetry.downlinkProcessed(d.DevEUI, false, err)
+		d.recordDownlink(dlMessage, mqtt, payload, "", err)
 		return "", err
 	}
 
 	//Now we need to check the profile and if we are joined.
 	if d.Profile == "ABP" || d.Joined {
-		return d.processDownlink(phy, payload, mv)
+		message, err := d.processDownlink(phy, payload, mv)
+		DefaultTelemetry.downlinkProcessed(d.DevEUI, false, err)
+		d.recordDownlink(dlMessage, mqtt, payload, message, err)
+		return message, err
 	}
 
 	//If we are not joined, we need to process the join response.
-	return d.processJoinResponse(phy, payload, mv)
-
+	message, err := d.processJoinResponse(phy, payload, mv)
+	DefaultTelemetry.downlinkProcessed(d.DevEUI, true, err)
+	d.recordDownlink(dlMessage, mqtt, payload, message, err)
+	return message, err
 }
 
 func (d *Device) processJoinResponse(phy lorawan.PHYPayload, payload []byte, mv lorawan.MACVersion) (string, error) {
 	log.Infoln("processing join response")
 
-	log.Debugln("Network key on join: %s", KeyToHex(d.NwkKey))
+	log.Debugf("Network key on join: %s", KeyToHex(d.NwkKey))
 	err := phy.DecryptJoinAcceptPayload(d.NwkKey)
 	if err != nil {
 		log.Errorf("can't decrypt join accept: %s", err)
@@ -453,7 +422,8 @@ func (d *Device) processJoinResponse(phy lorawan.PHYPayload, payload []byte, mv
 			return "", err
 		}
 		if !ok {
-			return "", errors.New("validate downlink join mic not ok")
+			d.diagnoseMICFailure(payload)
+			return "", ErrJoinMIC
 		}
 	} else {
 		ok, err := phy.ValidateDownlinkJoinMIC(0xFF, d.JoinEUI, d.DevNonce, d.NwkKey)
@@ -461,7 +431,8 @@ func (d *Device) processJoinResponse(phy lorawan.PHYPayload, payload []byte, mv
 			return "", err
 		}
 		if !ok {
-			return "", errors.New("validate downlink join mic not ok")
+			d.diagnoseMICFailure(payload)
+			return "", ErrJoinMIC
 		}
 	}
 
@@ -488,8 +459,10 @@ func (d *Device) processJoinResponse(phy lorawan.PHYPayload, payload []byte, mv
 		return "", errors.New("got lower or equal JoinNonce from server")
 	}
 	d.JoinNonce = jap.JoinNonce
+	d.NetID = jap.HomeNetID
 	log.Infof("setting join nonce: %d", d.JoinNonce)
 	d.RedisSet(joinNonceKey, uint16(jap.JoinNonce), 0)
+	d.RedisSet(fmt.Sprintf("net-id-%s", d.DevEUI[:]), d.NetID.String(), 0)
 
 	d.FNwkSIntKey, err = getFNwkSIntKey(jap.DLSettings.OptNeg, d.NwkKey, jap.HomeNetID, d.JoinEUI, jap.JoinNonce, d.DevNonce)
 	if d.MACVersion == 0 {
@@ -533,6 +506,7 @@ func (d *Device) processJoinResponse(phy lorawan.PHYPayload, payload []byte, mv
 	d.RedisSet(dlFcntKey, d.DlFcnt, 0)
 
 	log.Infoln("Join successful!")
+	d.joined(jap)
 
 	return string(phyJSON), nil
 }
@@ -560,14 +534,31 @@ func (d *Device) processDownlink(phy lorawan.PHYPayload, payload []byte, mv lora
 			return "", err
 		}
 		if !ok {
-			return "", errors.New("downlink error: invalid mic")
+			d.diagnoseMICFailure(payload)
+			return "", ErrDownlinkMIC
 		}
 	}
 
-	if err := phy.DecryptFRMPayload(d.AppSKey); err != nil {
+	macPayload, ok := phy.MACPayload.(*lorawan.MACPayload)
+	if !ok {
+		return "", errors.New("can't convert mac payload")
+	}
+
+	//FRMPayload carries MAC commands encrypted with the network session key on FPort 0.
+	frmKey := d.AppSKey
+	if macPayload.FPort != nil && *macPayload.FPort == 0 {
+		frmKey = d.NwkSEncKey
+	}
+	if err := phy.DecryptFRMPayload(frmKey); err != nil {
 		log.Error("failed at downlink frm payload decryption")
 		return "", err
 	}
+	if macPayload.FPort != nil && *macPayload.FPort == 0 {
+		if err := phy.DecodeFRMPayloadToMACCommands(); err != nil {
+			log.Error("failed at downlink frm payload to mac commands decoding")
+			return "", err
+		}
+	}
 
 	if d.MACVersion == lorawan.LoRaWAN1_0 {
 		if err := phy.DecodeFOptsToMACCommands(); err != nil {
@@ -587,10 +578,6 @@ func (d *Device) processDownlink(phy lorawan.PHYPayload, payload []byte, mv lora
 		return "", err
 	}
 
-	macPayload, ok := phy.MACPayload.(*lorawan.MACPayload)
-	if !ok {
-		return "", errors.New("can't convert mac payload")
-	}
 	log.Infof("mac payload: %+v", macPayload)
 
 	log.Infof("fctrl: %+v", macPayload.FHDR.FCtrl)
@@ -605,6 +592,12 @@ func (d *Device) processDownlink(phy lorawan.PHYPayload, payload []byte, mv lora
 
 	log.Infof("dlFcnt: %d / received Fcnt: %d", d.DlFcnt, macPayload.FHDR.FCnt)
 
+	dl := newDownlink(phy, macPayload)
+	d.applyDownlink(dl)
+	if d.OnDownlink != nil {
+		d.OnDownlink(dl)
+	}
+
 	return string(phyJSON), nil
 }
 
@@ -620,12 +613,15 @@ func (d *Device) Reset() error {
 	redisAppSKey := fmt.Sprintf("ul-AppSKey-%s", d.DevEUI[:])
 	redisDevAddr := fmt.Sprintf("ul-devAddr-%s", d.DevEUI[:])
 	joinKey := fmt.Sprintf("join-%s", d.DevEUI[:])
-	_, oErr := redisClient.Del(dlFcntKey, ulFcntKey, joinNonceKey, devNonceKey, redisFNwksSIntKey, redisNwkSEncKey, redisSNwkSIntKey, redisAppSKey, redisDevAddr, joinKey).Result()
+	netIDKey := fmt.Sprintf("net-id-%s", d.DevEUI[:])
+	_, oErr := redisClient.Del(dlFcntKey, ulFcntKey, joinNonceKey, devNonceKey, redisFNwksSIntKey, redisNwkSEncKey, redisSNwkSIntKey, redisAppSKey, redisDevAddr, joinKey, netIDKey).Result()
 	if oErr == nil {
 		d.DlFcnt = 0
 		d.UlFcnt = 0
 		d.DevNonce = 0
 		d.JoinNonce = 0
+		d.NetID = lorawan.NetID{}
+		d.Joined = false
 		var err error
 		d.FNwkSIntKey, err = HexToKey("00000000000000000000000000000000")
 		if err != nil {
@@ -647,6 +643,9 @@ func (d *Device) Reset() error {
 		if err != nil {
 			return err
 		}
+		d.updateSession(SessionReset, func(s *SessionState) {
+			*s = newSessionState()
+		})
 	}
 	return oErr
 }
@@ -733,6 +732,16 @@ func (d *Device) GetInfo() bool {
 	} else {
 		log.Warningf("[redis] missing join nonce key: %s", err)
 	}
+	netIDKey := fmt.Sprintf("net-id-%s", d.DevEUI[:])
+	snid, err := redisClient.Get(netIDKey).Result()
+	if err == nil {
+		if err := d.NetID.UnmarshalText([]byte(snid)); err != nil {
+			log.Errorf("redis convert error: %s", err)
+			d.NetID = lorawan.NetID{}
+		}
+	} else {
+		log.Warningf("[redis] missing net id key: %s", err)
+	}
 	devNonceKey := fmt.Sprintf("dev-nonce-%s", d.DevEUI[:])
 	sdn, err := redisClient.Get(devNonceKey).Result()
 	if err == nil {
@@ -897,11 +906,11 @@ func testMIC(appKey [16]byte, appEUI, devEUI [8]byte) error {
 }
 
 //publish publishes a message to the broker.
-func publish(client MQTT.Client, topic string, bytes []byte) error {
+func publish(client MQTT.Client, topic string, qos byte, bytes []byte) error {
 
 	log.Infof("sending to topic %s", topic)
 
-	if token := client.Publish(topic, 0, false, bytes); token.Wait() && token.Error() != nil {
+	if token := client.Publish(topic, qos, false, bytes); token.Wait() && token.Error() != nil {
 		log.Errorf("publish error: %s", token.Error())
 		return token.Error()
 	}
@@ -943,23 +952,26 @@ func generateLight(l int16) []byte {
 	return bRep
 }
 
-func generateAltitude(a float32) []byte {
+//GenerateAltitude generates a 2 byte representation of an altitude, clamping it to ±1200 meters.
+func GenerateAltitude(a float32) []byte {
 
-	alt := uint16(float32(a/1200) * float32(math.Pow(2, 15)))
+	alt := uint16(int16(math.Max(math.Min(float64(a/1200)*math.Pow(2, 15), math.MaxInt16), math.MinInt16)))
 	bRep := make([]byte, 2)
 	binary.BigEndian.PutUint16(bRep, alt)
 	return bRep
 }
 
-func generateLat(l float32) []byte {
-	lat := uint32((l / 90.0) * float32(math.Pow(2, 31)))
+//GenerateLat generates a 4 byte representation of a latitude, clamping 90 to the largest value.
+func GenerateLat(l float32) []byte {
+	lat := uint32(int32(math.Min(float64(l/90.0)*math.Pow(2, 31), math.MaxInt32)))
 	bRep := make([]byte, 4)
 	binary.BigEndian.PutUint32(bRep, lat)
 	return bRep
 }
 
-func generateLng(l float32) []byte {
-	lng := uint32((l / 180.0) * float32(math.Pow(2, 31)))
+//GenerateLng generates a 4 byte representation of a longitude, clamping 180 to the largest value.
+func GenerateLng(l float32) []byte {
+	lng := uint32(int32(math.Min(float64(l/180.0)*math.Pow(2, 31), math.MaxInt32)))
 	bRep := make([]byte, 4)
 	binary.BigEndian.PutUint32(bRep, lng)
 	return bRep
@@ -0,0 +1,285 @@
+package lds
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/brocaar/lorawan"
+)
+
+// LatencyBuckets are the upper bounds, in milliseconds, of the latency histogram buckets.
+var LatencyBuckets = []float64{50, 100, 250, 500, 1000, 2000, 5000, 10000}
+
+// Metrics collects the outcome and latency of the traffic of a fleet of devices. Join-accept
+// latency is measured from the last join request of the device, and downlink round trip time
+// from its last uplink to the first downlink that follows it.
+type Metrics struct {
+	mu    sync.Mutex
+	start time.Time
+
+	joinRequests     uint64
+	joinAccepts      uint64
+	uplinks          uint64
+	confirmedUplinks uint64
+	acks             uint64
+	downlinks        uint64
+	micFailures      uint64
+	downlinkErrors   uint64
+	transportErrors  uint64
+
+	joinLatencies []time.Duration
+	rtts          []time.Duration
+
+	pendingJoins   map[lorawan.EUI64]time.Time
+	pendingUplinks map[lorawan.EUI64]time.Time
+	firstUplink    time.Time
+	lastUplink     time.Time
+}
+
+// NewMetrics starts collecting metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		start:          time.Now(),
+		pendingJoins:   map[lorawan.EUI64]time.Time{},
+		pendingUplinks: map[lorawan.EUI64]time.Time{},
+	}
+}
+
+// JoinSent records a join request of the device.
+func (m *Metrics) JoinSent(devEUI lorawan.EUI64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.joinRequests++
+	m.pendingJoins[devEUI] = time.Now()
+}
+
+// JoinAccepted records a valid join-accept for the device.
+func (m *Metrics) JoinAccepted(devEUI lorawan.EUI64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.joinAccepts++
+	if sent, ok := m.pendingJoins[devEUI]; ok {
+		m.joinLatencies = append(m.joinLatencies, time.Since(sent))
+		delete(m.pendingJoins, devEUI)
+	}
+}
+
+// UplinkSent records a data uplink of the device.
+func (m *Metrics) UplinkSent(devEUI lorawan.EUI64, confirmed bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.uplinks++
+	if confirmed {
+		m.confirmedUplinks++
+	}
+	now := time.Now()
+	m.pendingUplinks[devEUI] = now
+	if m.firstUplink.IsZero() {
+		m.firstUplink = now
+	}
+	m.lastUplink = now
+}
+
+// DownlinkReceived records a valid data downlink for the device, telling whether it acknowledges an uplink.
+func (m *Metrics) DownlinkReceived(devEUI lorawan.EUI64, ack bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.downlinks++
+	if ack {
+		m.acks++
+	}
+	if sent, ok := m.pendingUplinks[devEUI]; ok {
+		m.rtts = append(m.rtts, time.Since(sent))
+		delete(m.pendingUplinks, devEUI)
+	}
+}
+
+// DownlinkError records a downlink that couldn't be processed, counting MIC failures apart.
+func (m *Metrics) DownlinkError(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if IsMICError(err) {
+		m.micFailures++
+		return
+	}
+	m.downlinkErrors++
+}
+
+// TransportErrors records n messages that couldn't be sent or weren't acknowledged by the network server.
+func (m *Metrics) TransportErrors(n uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.transportErrors += n
+}
+
+// LatencyStats summarizes latency samples, in milliseconds. Histogram[i] counts the samples up to
+// LatencyBuckets[i] and above the previous bound, and the last count the ones above every bound.
+type LatencyStats struct {
+	Count     int     `json:"count"`
+	Min       float64 `json:"min"`
+	Mean      float64 `json:"mean"`
+	P50       float64 `json:"p50"`
+	P90       float64 `json:"p90"`
+	P95       float64 `json:"p95"`
+	P99       float64 `json:"p99"`
+	Max       float64 `json:"max"`
+	Histogram []int   `json:"histogram"`
+}
+
+// MetricsReport is a summary of the collected metrics. The uplink rate is measured between the first
+// and the last uplinks, and the other rates are fractions between 0 and 1.
+type MetricsReport struct {
+	Start            time.Time    `json:"start"`
+	Duration         float64      `json:"durationSeconds"`
+	JoinRequests     uint64       `json:"joinRequests"`
+	JoinAccepts      uint64       `json:"joinAccepts"`
+	JoinSuccessRate  float64      `json:"joinSuccessRate"`
+	Uplinks          uint64       `json:"uplinks"`
+	UplinkRate       float64      `json:"uplinksPerSecond"`
+	ConfirmedUplinks uint64       `json:"confirmedUplinks"`
+	Acks             uint64       `json:"acks"`
+	AckRate          float64      `json:"ackRate"`
+	Downlinks        uint64       `json:"downlinks"`
+	MICFailures      uint64       `json:"micFailures"`
+	DownlinkErrors   uint64       `json:"downlinkErrors"`
+	TransportErrors  uint64       `json:"transportErrors"`
+	LatencyBuckets   []float64    `json:"latencyBuckets"`
+	JoinLatency      LatencyStats `json:"joinLatency"`
+	DownlinkRTT      LatencyStats `json:"downlinkRTT"`
+}
+
+// Report summarizes the metrics collected so far.
+func (m *Metrics) Report() *MetricsReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	elapsed := time.Since(m.start)
+	r := &MetricsReport{
+		Start:            m.start,
+		Duration:         elapsed.Seconds(),
+		JoinRequests:     m.joinRequests,
+		JoinAccepts:      m.joinAccepts,
+		JoinSuccessRate:  ratio(m.joinAccepts, m.joinRequests),
+		Uplinks:          m.uplinks,
+		ConfirmedUplinks: m.confirmedUplinks,
+		Acks:             m.acks,
+		AckRate:          ratio(m.acks, m.confirmedUplinks),
+		Downlinks:        m.downlinks,
+		MICFailures:      m.micFailures,
+		DownlinkErrors:   m.downlinkErrors,
+		TransportErrors:  m.transportErrors,
+		LatencyBuckets:   LatencyBuckets,
+		JoinLatency:      latencyStats(m.joinLatencies),
+		DownlinkRTT:      latencyStats(m.rtts),
+	}
+	if span := m.lastUplink.Sub(m.firstUplink); span > 0 {
+		r.UplinkRate = float64(m.uplinks-1) / span.Seconds()
+	}
+	return r
+}
+
+func ratio(n, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
+
+func latencyStats(samples []time.Duration) LatencyStats {
+	stats := LatencyStats{
+		Count:     len(samples),
+		Histogram: make([]int, len(LatencyBuckets)+1),
+	}
+	if len(samples) == 0 {
+		return stats
+	}
+
+	ms := make([]float64, len(samples))
+	sum := 0.0
+	for i, s := range samples {
+		ms[i] = float64(s) / float64(time.Millisecond)
+		sum += ms[i]
+		stats.Histogram[sort.SearchFloat64s(LatencyBuckets, ms[i])]++
+	}
+	sort.Float64s(ms)
+
+	percentile := func(p float64) float64 {
+		return ms[int(math.Ceil(p/100*float64(len(ms))))-1]
+	}
+	stats.Min = ms[0]
+	stats.Mean = sum / float64(len(ms))
+	stats.P50 = percentile(50)
+	stats.P90 = percentile(90)
+	stats.P95 = percentile(95)
+	stats.P99 = percentile(99)
+	stats.Max = ms[len(ms)-1]
+	return stats
+}
+
+// WriteJSON writes the report as indented JSON.
+func (r *MetricsReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteCSV writes the report as metric,value rows, with latencies in milliseconds.
+func (r *MetricsReport) WriteCSV(w io.Writer) error {
+	rows := [][]string{
+		{"metric", "value"},
+		{"start", r.Start.Format(time.RFC3339)},
+		{"duration_seconds", formatFloat(r.Duration)},
+		{"join_requests", strconv.FormatUint(r.JoinRequests, 10)},
+		{"join_accepts", strconv.FormatUint(r.JoinAccepts, 10)},
+		{"join_success_rate", formatFloat(r.JoinSuccessRate)},
+		{"uplinks", strconv.FormatUint(r.Uplinks, 10)},
+		{"uplinks_per_second", formatFloat(r.UplinkRate)},
+		{"confirmed_uplinks", strconv.FormatUint(r.ConfirmedUplinks, 10)},
+		{"acks", strconv.FormatUint(r.Acks, 10)},
+		{"ack_rate", formatFloat(r.AckRate)},
+		{"downlinks", strconv.FormatUint(r.Downlinks, 10)},
+		{"mic_failures", strconv.FormatUint(r.MICFailures, 10)},
+		{"downlink_errors", strconv.FormatUint(r.DownlinkErrors, 10)},
+		{"transport_errors", strconv.FormatUint(r.TransportErrors, 10)},
+	}
+	rows = append(rows, r.JoinLatency.rows("join_latency", r.LatencyBuckets)...)
+	rows = append(rows, r.DownlinkRTT.rows("downlink_rtt", r.LatencyBuckets)...)
+
+	cw := csv.NewWriter(w)
+	if err := cw.WriteAll(rows); err != nil {
+		return err
+	}
+	return cw.Error()
+}
+
+func (s LatencyStats) rows(prefix string, buckets []float64) [][]string {
+	rows := [][]string{
+		{prefix + "_count", strconv.Itoa(s.Count)},
+		{prefix + "_min_ms", formatFloat(s.Min)},
+		{prefix + "_mean_ms", formatFloat(s.Mean)},
+		{prefix + "_p50_ms", formatFloat(s.P50)},
+		{prefix + "_p90_ms", formatFloat(s.P90)},
+		{prefix + "_p95_ms", formatFloat(s.P95)},
+		{prefix + "_p99_ms", formatFloat(s.P99)},
+		{prefix + "_max_ms", formatFloat(s.Max)},
+	}
+	for i, count := range s.Histogram {
+		name := fmt.Sprintf("%s_over_%s_ms", prefix, formatFloat(buckets[len(buckets)-1]))
+		if i < len(buckets) {
+			name = fmt.Sprintf("%s_le_%s_ms", prefix, formatFloat(buckets[i]))
+		}
+		rows = append(rows, []string{name, strconv.Itoa(count)})
+	}
+	return rows
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,312 @@
+package lds
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"io"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Mobility moves a device over time.
+type Mobility interface {
+	// PositionAt returns the device position after elapsed time since the movement started.
+	PositionAt(elapsed time.Duration) Position
+}
+
+// SetMobility attaches a movement model to the device, starting now.
+func (d *Device) SetMobility(m Mobility) {
+	d.Mobility = m
+	d.mobilityStart = time.Now()
+}
+
+// Move updates the device position from its movement model and returns it.
+func (d *Device) Move(now time.Time) *Position {
+	if d.Mobility == nil {
+		return d.Position
+	}
+	pos := d.Mobility.PositionAt(now.Sub(d.mobilityStart))
+	d.Position = &pos
+	return d.Position
+}
+
+// destination returns the point reached from p after distance meters at bearing degrees (clockwise from north).
+func (p Position) destination(distance, bearing float64) Position {
+	lat1 := p.Latitude * math.Pi / 180
+	lng1 := p.Longitude * math.Pi / 180
+	brng := bearing * math.Pi / 180
+	delta := distance / earthRadius
+
+	lat2 := math.Asin(math.Sin(lat1)*math.Cos(delta) + math.Cos(lat1)*math.Sin(delta)*math.Cos(brng))
+	lng2 := lng1 + math.Atan2(math.Sin(brng)*math.Sin(delta)*math.Cos(lat1), math.Cos(delta)-math.Sin(lat1)*math.Sin(lat2))
+
+	return Position{
+		Latitude:  lat2 * 180 / math.Pi,
+		Longitude: math.Mod(lng2*180/math.Pi+540, 360) - 180,
+		Altitude:  p.Altitude,
+	}
+}
+
+// interpolate returns the point at fraction f of the way from p to o.
+func (p Position) interpolate(o Position, f float64) Position {
+	return Position{
+		Latitude:  p.Latitude + (o.Latitude-p.Latitude)*f,
+		Longitude: p.Longitude + (o.Longitude-p.Longitude)*f,
+		Altitude:  p.Altitude + (o.Altitude-p.Altitude)*f,
+	}
+}
+
+// ConstantVelocity moves in a straight line from Start at Speed m/s towards Bearing degrees,
+// climbing at ClimbRate m/s.
+type ConstantVelocity struct {
+	Start     Position
+	Speed     float64
+	Bearing   float64
+	ClimbRate float64
+}
+
+// PositionAt implements Mobility.
+func (m ConstantVelocity) PositionAt(elapsed time.Duration) Position {
+	s := elapsed.Seconds()
+	pos := m.Start.destination(m.Speed*s, m.Bearing)
+	pos.Altitude = m.Start.Altitude + m.ClimbRate*s
+	return pos
+}
+
+// TrackPoint is a track position reached at Offset since the track start.
+type TrackPoint struct {
+	Position
+	Offset time.Duration
+}
+
+// Track replays a recorded path, interpolating between points. When Loop is set the track
+// starts over after its last point, otherwise the device stays there.
+type Track struct {
+	Points []TrackPoint
+	Loop   bool
+}
+
+// PositionAt implements Mobility.
+func (t *Track) PositionAt(elapsed time.Duration) Position {
+	if len(t.Points) == 0 {
+		return Position{}
+	}
+
+	last := t.Points[len(t.Points)-1]
+	if t.Loop && last.Offset > 0 {
+		elapsed %= last.Offset
+	}
+	if elapsed >= last.Offset {
+		return last.Position
+	}
+
+	for i := 1; i < len(t.Points); i++ {
+		a, b := t.Points[i-1], t.Points[i]
+		if elapsed > b.Offset {
+			continue
+		}
+		span := b.Offset - a.Offset
+		if span <= 0 {
+			return b.Position
+		}
+		return a.Position.interpolate(b.Position, float64(elapsed-a.Offset)/float64(span))
+	}
+
+	return t.Points[0].Position
+}
+
+// newTrack builds a track from positions and their times. Points without a time are
+// placed after the previous one at speed m/s.
+func newTrack(positions []Position, times []time.Time, speed float64) (*Track, error) {
+	if len(positions) == 0 {
+		return nil, errors.New("track has no points")
+	}
+
+	track := &Track{Points: make([]TrackPoint, len(positions))}
+	var start time.Time
+	for i, pos := range positions {
+		track.Points[i].Position = pos
+		if i == 0 {
+			start = times[0]
+			continue
+		}
+
+		prev := track.Points[i-1]
+		switch {
+		case !times[i].IsZero() && !start.IsZero():
+			track.Points[i].Offset = times[i].Sub(start)
+		case speed > 0:
+			track.Points[i].Offset = prev.Offset + time.Duration(prev.Distance(pos)/speed*float64(time.Second))
+		default:
+			return nil, errors.Errorf("track point %d has no time and no speed was given", i)
+		}
+
+		if track.Points[i].Offset < prev.Offset {
+			return nil, errors.Errorf("track point %d goes back in time", i)
+		}
+	}
+
+	return track, nil
+}
+
+type gpxFile struct {
+	Points []struct {
+		Lat  float64 `xml:"lat,attr"`
+		Lon  float64 `xml:"lon,attr"`
+		Ele  float64 `xml:"ele"`
+		Time string  `xml:"time"`
+	} `xml:"trk>trkseg>trkpt"`
+}
+
+// LoadGPXTrack reads the track points of a GPX file. Their times are kept when present,
+// otherwise points are spaced for a device moving at speed m/s.
+func LoadGPXTrack(r io.Reader, speed float64) (*Track, error) {
+	var gpx gpxFile
+	if err := xml.NewDecoder(r).Decode(&gpx); err != nil {
+		return nil, errors.Wrap(err, "gpx decode error")
+	}
+
+	positions := make([]Position, len(gpx.Points))
+	times := make([]time.Time, len(gpx.Points))
+	for i, p := range gpx.Points {
+		positions[i] = Position{Latitude: p.Lat, Longitude: p.Lon, Altitude: p.Ele}
+		if p.Time != "" {
+			t, err := time.Parse(time.RFC3339, p.Time)
+			if err != nil {
+				return nil, errors.Wrapf(err, "gpx point %d time error", i)
+			}
+			times[i] = t
+		}
+	}
+
+	return newTrack(positions, times, speed)
+}
+
+// LoadCSVTrack reads a track from CSV rows of latitude,longitude[,altitude[,seconds]], where seconds
+// is the offset since the track start. A header row is skipped. Rows without seconds are spaced
+// for a device moving at speed m/s.
+func LoadCSVTrack(r io.Reader, speed float64) (*Track, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, errors.Wrap(err, "csv read error")
+	}
+
+	var (
+		positions []Position
+		times     []time.Time
+		origin    = time.Unix(0, 0)
+	)
+	for i, rec := range records {
+		if len(rec) < 2 {
+			return nil, errors.Errorf("csv row %d: latitude and longitude are required", i+1)
+		}
+
+		//Skip the header.
+		if _, err := strconv.ParseFloat(strings.TrimSpace(rec[0]), 64); err != nil && i == 0 {
+			continue
+		}
+
+		values := make([]float64, len(rec))
+		for j, field := range rec {
+			v, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "csv row %d", i+1)
+			}
+			values[j] = v
+		}
+
+		pos := Position{Latitude: values[0], Longitude: values[1]}
+		if len(values) > 2 {
+			pos.Altitude = values[2]
+		}
+		var t time.Time
+		if len(values) > 3 {
+			t = origin.Add(time.Duration(values[3] * float64(time.Second)))
+		}
+		positions = append(positions, pos)
+		times = append(times, t)
+	}
+
+	return newTrack(positions, times, speed)
+}
+
+// RandomWaypoint moves the device between random points within Radius meters of Center, at a
+// random speed between MinSpeed and MaxSpeed m/s, pausing at each waypoint.
+type RandomWaypoint struct {
+	Center   Position
+	Radius   float64
+	MinSpeed float64
+	MaxSpeed float64
+	Pause    time.Duration
+
+	mu      sync.Mutex
+	from    Position
+	to      Position
+	legFrom time.Duration
+	legTo   time.Duration
+	started bool
+}
+
+// PositionAt implements Mobility. Elapsed times are expected not to go backwards.
+func (m *RandomWaypoint) PositionAt(elapsed time.Duration) Position {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	//There's nowhere to go without a radius.
+	if m.Radius <= 0 {
+		return m.Center
+	}
+
+	if !m.started {
+		m.started = true
+		m.to = m.Center
+		m.legTo = 0
+		m.nextLeg()
+	}
+
+	for elapsed >= m.legTo+m.Pause {
+		m.nextLeg()
+		//A leg too short to take any time keeps the device still, so it lasts until now
+		//instead of being stepped through one after another.
+		if m.legTo == m.legFrom {
+			if elapsed > m.legTo {
+				m.legTo = elapsed
+			}
+			break
+		}
+	}
+
+	if elapsed <= m.legFrom {
+		return m.from
+	}
+	if elapsed >= m.legTo {
+		return m.to
+	}
+	return m.from.interpolate(m.to, float64(elapsed-m.legFrom)/float64(m.legTo-m.legFrom))
+}
+
+// nextLeg picks a new waypoint, leaving the current one after the pause.
+func (m *RandomWaypoint) nextLeg() {
+	m.from = m.to
+	m.legFrom = m.legTo + m.Pause
+
+	//Uniform point in the disc around the center.
+	distance := m.Radius * math.Sqrt(rand.Float64())
+	m.to = m.Center.destination(distance, rand.Float64()*360)
+
+	speed := m.MinSpeed + rand.Float64()*(m.MaxSpeed-m.MinSpeed)
+	if speed <= 0 {
+		speed = 1
+	}
+	m.legTo = m.legFrom + time.Duration(m.from.Distance(m.to)/speed*float64(time.Second))
+}
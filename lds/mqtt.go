@@ -0,0 +1,97 @@
+package lds
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+)
+
+// MQTTOptions are the broker connection settings of a gateway bridge client.
+type MQTTOptions struct {
+	Server   string
+	User     string
+	Password string
+	// ClientID defaults to a random one when empty.
+	ClientID     string
+	CleanSession bool
+	KeepAlive    time.Duration
+	// QoS is used for publishing and subscribing.
+	QoS byte
+
+	// CACert, TLSCert and TLSKey are PEM file paths. The CA certificate verifies the broker
+	// and the certificate and key authenticate the client.
+	CACert             string
+	TLSCert            string
+	TLSKey             string
+	InsecureSkipVerify bool
+
+	// WillTopic, when set, gets WillPayload published by the broker if the client disconnects ungracefully.
+	WillTopic    string
+	WillPayload  []byte
+	WillRetained bool
+}
+
+// ClientOptions returns the paho client options for these settings.
+func (o *MQTTOptions) ClientOptions() (*MQTT.ClientOptions, error) {
+	opts := MQTT.NewClientOptions()
+	opts.AddBroker(o.Server)
+	opts.SetUsername(o.User)
+	opts.SetPassword(o.Password)
+	opts.SetAutoReconnect(true)
+	opts.SetCleanSession(o.CleanSession)
+
+	clientID := o.ClientID
+	if clientID == "" {
+		clientID = fmt.Sprintf("lds-%d", time.Now().UnixNano())
+	}
+	opts.SetClientID(clientID)
+
+	if o.KeepAlive > 0 {
+		opts.SetKeepAlive(o.KeepAlive)
+	}
+
+	if o.WillTopic != "" {
+		opts.SetBinaryWill(o.WillTopic, o.WillPayload, o.QoS, o.WillRetained)
+	}
+
+	if o.CACert != "" || o.TLSCert != "" || o.TLSKey != "" || o.InsecureSkipVerify {
+		tlsConfig, err := o.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	return opts, nil
+}
+
+func (o *MQTTOptions) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: o.InsecureSkipVerify}
+
+	if o.CACert != "" {
+		rawCA, err := ioutil.ReadFile(o.CACert)
+		if err != nil {
+			return nil, errors.Wrap(err, "read ca cert error")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(rawCA) {
+			return nil, errors.Errorf("no certificates found in %s", o.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if o.TLSCert != "" || o.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(o.TLSCert, o.TLSKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "load client certificate error")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
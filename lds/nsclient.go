@@ -9,37 +9,92 @@ import (
 	"fmt"
 	"math/rand"
 	"net"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/brocaar/chirpstack-api/go/gw"
+	"github.com/golang/protobuf/ptypes"
 	"github.com/golang/protobuf/ptypes/duration"
 	log "github.com/sirupsen/logrus"
 )
 
+// Semtech UDP protocol identifiers.
+const (
+	udpProtocolVersion = 0x02
+
+	pushData = 0x00
+	pushAck  = 0x01
+	pullData = 0x02
+	pullResp = 0x03
+	pullAck  = 0x04
+)
+
+// Defaults used when the client options are left empty.
+const (
+	defaultKeepAlive     = 10 * time.Second
+	defaultAckTimeout    = 3 * time.Second
+	defaultMaxMissedAcks = 3
+)
+
 // NSClient is a raw UDP client
 type NSClient struct {
 	Server string
 	Port   int
 
+	// KeepAlive is the PULL_DATA interval.
+	KeepAlive time.Duration
+	// AckTimeout is how long to wait for a PUSH_ACK or PULL_ACK before counting it as missed.
+	AckTimeout time.Duration
+	// MaxMissedAcks is the number of consecutive PULL_ACKs that may be missed before reconnecting.
+	MaxMissedAcks int
+
+	mu        sync.Mutex
 	connected bool
 	connexion *net.UDPConn
+	gwMAC     string
+	onReceive udpPacketCallback
+	pending   map[uint16]pendingAck
+	missed    int
+	stats     NSClientStats
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// NSClientStats holds acknowledgement counters and latencies of a NSClient.
+type NSClientStats struct {
+	PushSent    uint64
+	PushAcked   uint64
+	PushMissed  uint64
+	PullSent    uint64
+	PullAcked   uint64
+	PullMissed  uint64
+	Reconnects  uint64
+	LastPushRTT time.Duration
+	LastPullRTT time.Duration
+}
+
+type pendingAck struct {
+	id     byte
+	sentAt time.Time
 }
 
 type pfpacket struct {
-	Time string  `json:"time"`
-	TMMS uint64  `json:"tmms"`
-	TMST uint32  `json:"tmst"`
-	Chan uint32  `json:"chan"`
-	RFCH uint32  `json:"rfch"`
-	Freq float32 `json:"freq"`
-	Stat int32   `json:"stat"`
-	Modu string  `json:"modu"`
-	DatR string  `json:"datr"`
-	CorR string  `json:"codr"`
-	RSSI int32   `json:"rssi"`
-	LSNR float64 `json:"lsnr"`
-	Size uint32  `json:"size"`
-	Data string  `json:"data"`
+	Time  string  `json:"time"`
+	TMMS  uint64  `json:"tmms"`
+	TMST  uint32  `json:"tmst"`
+	FTime *uint32 `json:"ftime,omitempty"`
+	Chan  uint32  `json:"chan"`
+	RFCH  uint32  `json:"rfch"`
+	Freq  float32 `json:"freq"`
+	Stat  int32   `json:"stat"`
+	Modu  string  `json:"modu"`
+	DatR  string  `json:"datr"`
+	CorR  string  `json:"codr"`
+	RSSI  int32   `json:"rssi"`
+	LSNR  float64 `json:"lsnr"`
+	Size  uint32  `json:"size"`
+	Data  string  `json:"data"`
 }
 
 type pfproto struct {
@@ -48,68 +103,186 @@ type pfproto struct {
 
 // IsConnected checks if listening for incoming UDP
 func (client *NSClient) IsConnected() bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
 	return client.connected
 }
 
+// Stats returns a copy of the acknowledgement counters.
+func (client *NSClient) Stats() NSClientStats {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.stats
+}
+
 type udpPacketCallback func(payload []byte) error
 
-// Connect starts listening incoming UDP
+// Connect resolves the network server address and starts the keepalive and receive loops.
+// The client keeps running, reconnecting when acks stop arriving, until Disconnect is called.
 func (client *NSClient) Connect(gwMAC string, onReceive udpPacketCallback) error {
-
-	ip := net.ParseIP(client.Server)
-
-	if ip == nil {
-		return errors.New("bad network server IP")
+	if client.IsConnected() {
+		return errors.New("already connected")
 	}
 
-	addr := net.UDPAddr{
-		IP:   ip,
-		Port: client.Port,
+	if _, err := hex.DecodeString(gwMAC); err != nil {
+		return fmt.Errorf("bad gateway MAC: %s", err)
 	}
 
-	conn, err := net.DialUDP("udp", nil, &addr)
+	if client.KeepAlive <= 0 {
+		client.KeepAlive = defaultKeepAlive
+	}
+	if client.AckTimeout <= 0 {
+		client.AckTimeout = defaultAckTimeout
+	}
+	if client.MaxMissedAcks <= 0 {
+		client.MaxMissedAcks = defaultMaxMissedAcks
+	}
 
+	conn, err := client.dial()
 	if err != nil {
 		return err
 	}
+
+	client.mu.Lock()
+	client.gwMAC = gwMAC
+	client.onReceive = onReceive
 	client.connexion = conn
+	client.pending = make(map[uint16]pendingAck)
+	client.missed = 0
+	client.done = make(chan struct{})
+	client.connected = true
+	client.mu.Unlock()
+	DefaultTelemetry.SetConnected("udp", gwMAC, true)
 
-	log.Infoln("UDP listening bindpoint=%s", conn.LocalAddr())
-	go client.receiveUDP(onReceive)
-	go client.sendPullData(gwMAC)
+	log.Infof("UDP listening bindpoint=%s", conn.LocalAddr())
+
+	client.wg.Add(2)
+	go client.receiveUDP(conn)
+	go client.keepAlive()
 
-	client.connected = true
 	return nil
 }
 
-func (client *NSClient) receiveUDP(onReceive udpPacketCallback) {
-	defer client.connexion.Close()
+// Disconnect stops the keepalive and receive loops and closes the socket.
+func (client *NSClient) Disconnect() error {
+	client.mu.Lock()
+	if !client.connected {
+		client.mu.Unlock()
+		return errors.New("not connected")
+	}
+	client.connected = false
+	close(client.done)
+	conn := client.connexion
+	client.connexion = nil
+	gwMAC := client.gwMAC
+	client.mu.Unlock()
+	DefaultTelemetry.SetConnected("udp", gwMAC, false)
+
+	var err error
+	if conn != nil {
+		err = conn.Close()
+	}
+	client.wg.Wait()
+
+	log.Infoln("UDP forwarder disconnected")
+	return err
+}
+
+// dial resolves Server (IPv4, IPv6 or hostname) and opens the UDP socket.
+func (client *NSClient) dial() (*net.UDPConn, error) {
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(client.Server, strconv.Itoa(client.Port)))
+	if err != nil {
+		return nil, fmt.Errorf("bad network server address: %s", err)
+	}
+
+	return net.DialUDP("udp", nil, addr)
+}
+
+func (client *NSClient) receiveUDP(conn *net.UDPConn) {
+	defer client.wg.Done()
 	buffer := make([]byte, 2048)
 
-	for true {
-		size, _, err := client.connexion.ReadFromUDP(buffer)
+	for {
+		size, err := conn.Read(buffer)
 
-		if size <= 0 {
-			log.Warningf("Incoming packet size %d", size)
+		if err != nil {
+			select {
+			case <-client.done:
+				return
+			default:
+			}
+
+			client.mu.Lock()
+			current := client.connexion == conn
+			client.mu.Unlock()
+			if !current {
+				//The connection was replaced by a reconnection.
+				return
+			}
+
+			log.Errorf("Unable to receive incoming packet %s", err)
+			time.Sleep(time.Second)
 			continue
 		}
 
-		if err != nil {
-			log.Errorf("Unable to receive incoming packet %s", err)
+		if size < 4 {
+			log.Warningf("Incoming packet size %d", size)
 			continue
 		}
 
-		message := buffer[0:size]
-		onReceive(message)
+		message := make([]byte, size)
+		copy(message, buffer[0:size])
+		client.handlePacket(message)
 	}
 }
 
-func createGWHeader(id byte, gwMAC string) ([]byte, error) {
-	version := byte(0x02)
-	token := rand.Int()
-	tokenlsb := byte(token & 0x00FF)
-	tokenmsb := byte((token & 0xFF00) >> 8)
-	header := []byte{version, tokenmsb, tokenlsb, id}
+// handlePacket matches acks against pending tokens and hands PULL_RESP packets to the callback.
+func (client *NSClient) handlePacket(packet []byte) {
+	token := uint16(packet[1])<<8 | uint16(packet[2])
+	id := packet[3]
+
+	switch id {
+	case pushAck, pullAck:
+		client.mu.Lock()
+		p, ok := client.pending[token]
+		if ok && ((id == pushAck && p.id == pushData) || (id == pullAck && p.id == pullData)) {
+			delete(client.pending, token)
+			rtt := time.Since(p.sentAt)
+			kind := "push"
+			if id == pushAck {
+				client.stats.PushAcked++
+				client.stats.LastPushRTT = rtt
+			} else {
+				client.stats.PullAcked++
+				client.stats.LastPullRTT = rtt
+				client.missed = 0
+				kind = "pull"
+			}
+			gwMAC := client.gwMAC
+			client.mu.Unlock()
+			DefaultTelemetry.ackReceived(gwMAC, kind, rtt)
+			log.Debugf("Got ack 0x%02x for token %d in %s", id, token, rtt)
+			return
+		}
+		client.mu.Unlock()
+		log.Warningf("Unexpected ack 0x%02x with token %d", id, token)
+	case pullResp:
+		client.mu.Lock()
+		onReceive := client.onReceive
+		gwMAC := client.gwMAC
+		client.mu.Unlock()
+		DefaultTelemetry.GatewayDownlink(gwMAC)
+		DefaultPcap.WriteDownlink(packet, false)
+		if onReceive != nil {
+			onReceive(packet)
+		}
+	default:
+		log.Debugf("Ignoring incoming message id 0x%02x", id)
+	}
+}
+
+func createGWHeader(id byte, token uint16, gwMAC string) ([]byte, error) {
+	header := []byte{udpProtocolVersion, byte(token >> 8), byte(token), id}
 
 	gwbytes, err := hex.DecodeString(gwMAC)
 
@@ -122,42 +295,167 @@ func createGWHeader(id byte, gwMAC string) ([]byte, error) {
 	return gwheader, nil
 }
 
-func (client *NSClient) sendPullData(gwMAC string) {
-	for true {
-		datagram, err := createGWHeader(byte(0x02), gwMAC)
+// keepAlive sends PULL_DATA every KeepAlive, expires unanswered tokens and reconnects
+// when MaxMissedAcks consecutive PULL_ACKs were missed.
+func (client *NSClient) keepAlive() {
+	defer client.wg.Done()
+
+	ticker := time.NewTicker(client.KeepAlive)
+	defer ticker.Stop()
+
+	client.sendPullData()
+
+	for {
+		select {
+		case <-client.done:
+			return
+		case <-ticker.C:
+		}
+
+		client.expireAcks()
+
+		client.mu.Lock()
+		missed := client.missed
+		client.mu.Unlock()
+
+		if missed >= client.MaxMissedAcks {
+			log.Warningf("Missed %d PULL_ACKs, reconnecting to %s:%d", missed, client.Server, client.Port)
+			client.reconnect()
+		}
+
+		client.sendPullData()
+	}
+}
+
+func (client *NSClient) expireAcks() {
+	client.mu.Lock()
+	defer client.mu.Unlock()
 
-		if err == nil {
-			log.Infoln("Sending PULL_DATA heartbeat")
-			client.send(datagram)
+	for token, p := range client.pending {
+		if time.Since(p.sentAt) < client.AckTimeout {
+			continue
+		}
+		delete(client.pending, token)
+		if p.id == pullData {
+			client.stats.PullMissed++
+			client.missed++
+			DefaultTelemetry.ackMissed(client.gwMAC, "pull")
 		} else {
-			log.Errorf("Unable to create PULL_DATA packet: %s", err)
+			client.stats.PushMissed++
+			DefaultTelemetry.ackMissed(client.gwMAC, "push")
 		}
+	}
+}
+
+// reconnect replaces the socket with a freshly resolved one.
+func (client *NSClient) reconnect() {
+	conn, err := client.dial()
+	if err != nil {
+		log.Errorf("UDP reconnection failed: %s", err)
+		return
+	}
 
-		time.Sleep(time.Second * 10)
+	client.mu.Lock()
+	if !client.connected {
+		client.mu.Unlock()
+		conn.Close()
+		return
+	}
+	old := client.connexion
+	client.connexion = conn
+	client.pending = make(map[uint16]pendingAck)
+	client.missed = 0
+	client.stats.Reconnects++
+	client.wg.Add(1)
+	client.mu.Unlock()
+
+	if old != nil {
+		old.Close()
 	}
+
+	log.Infof("UDP reconnected bindpoint=%s", conn.LocalAddr())
+	go client.receiveUDP(conn)
 }
 
-func (client *NSClient) send(bytes []byte) error {
-	_, err := client.connexion.Write(bytes)
-	return err
+func (client *NSClient) sendPullData() {
+	client.mu.Lock()
+	gwMAC := client.gwMAC
+	client.mu.Unlock()
+
+	log.Debugln("Sending PULL_DATA heartbeat")
+	if err := client.sendWithToken(pullData, gwMAC, nil); err != nil {
+		log.Errorf("Unable to send PULL_DATA packet: %s", err)
+	}
+}
+
+// sendWithToken builds a header with a fresh token, registers it as pending and sends the datagram.
+func (client *NSClient) sendWithToken(id byte, gwMAC string, body []byte) error {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if client.connexion == nil {
+		return errors.New("not connected")
+	}
+
+	token := uint16(rand.Intn(0x10000))
+	for _, ok := client.pending[token]; ok; _, ok = client.pending[token] {
+		token++
+	}
+
+	gwheader, err := createGWHeader(id, token, gwMAC)
+	if err != nil {
+		return err
+	}
+
+	datagram := bytes.Join([][]byte{gwheader, body}, []byte{})
+	if _, err := client.connexion.Write(datagram); err != nil {
+		return err
+	}
+
+	client.pending[token] = pendingAck{id: id, sentAt: time.Now()}
+	if id == pullData {
+		client.stats.PullSent++
+	} else {
+		client.stats.PushSent++
+	}
+
+	return nil
 }
 
 func toMilliseconds(d *duration.Duration) uint64 {
-	return uint64(d.Seconds)*1000 + uint64(d.Nanos)/1000
+	return uint64(d.Seconds)*1000 + uint64(d.Nanos)/1000000
+}
+
+func toMicroseconds(d *duration.Duration) uint64 {
+	return uint64(d.Seconds)*1000000 + uint64(d.Nanos)/1000
 }
 
-func (client *NSClient) sendWithPayload(payload []byte, gwMAC string, rxInfo *gw.UplinkRXInfo, txInfo *gw.UplinkTXInfo) error {
+// sendWithPayload sends the PHYPayload as a PUSH_DATA packet, returning its JSON body.
+func (client *NSClient) sendWithPayload(payload []byte, gwMAC string, rxInfo *gw.UplinkRXInfo, txInfo *gw.UplinkTXInfo) ([]byte, error) {
 
 	phyBase := base64.StdEncoding.EncodeToString(payload)
 
 	gps := rxInfo.GetTimeSinceGpsEpoch()
-	utc := time.Now().Format(time.RFC3339)
+	rxTime := time.Now()
+	if rxInfo.GetTime() != nil {
+		if t, err := ptypes.Timestamp(rxInfo.GetTime()); err == nil {
+			rxTime = t
+		}
+	}
 	mod := txInfo.GetLoraModulationInfo()
 
 	packet := pfpacket{}
-	packet.Time = utc
-	packet.TMMS = toMilliseconds(gps) / 1000
-	packet.TMST = uint32(toMilliseconds(gps) / 1000 / 1000)
+	packet.Time = rxTime.UTC().Format(time.RFC3339Nano)
+	if gps != nil {
+		packet.TMMS = toMilliseconds(gps)
+		//The concentrator counter is a free running 32 bits microseconds counter.
+		packet.TMST = uint32(toMicroseconds(gps))
+	}
+	//Semtech UDP only carries plain fine timestamps (nanoseconds since last PPS).
+	if plain := rxInfo.GetPlainFineTimestamp(); plain != nil {
+		ftime := uint32(plain.GetTime().GetNanos())
+		packet.FTime = &ftime
+	}
 	packet.Chan = rxInfo.GetChannel()
 	packet.RFCH = rxInfo.GetRfChain()
 	packet.Freq = float32(txInfo.GetFrequency()) / 1000000.0
@@ -177,21 +475,10 @@ func (client *NSClient) sendWithPayload(payload []byte, gwMAC string, rxInfo *gw
 	log.Debugf("Marshalled upstream JSON %s", packetJSON)
 
 	if err != nil {
-		return err
-	}
-
-	gwheader, err := createGWHeader(0x00, gwMAC)
-
-	if err != nil {
-		return err
+		return nil, err
 	}
 
-	jsonbytes := []byte(packetJSON)
-	datagram := bytes.Join([][]byte{gwheader, jsonbytes}, []byte{})
-
-	client.send(datagram)
-
-	return nil
+	return packetJSON, client.sendWithToken(pushData, gwMAC, packetJSON)
 }
 
 // UDPParsePacket extract metadata and physial payload from a packet
@@ -204,18 +491,17 @@ func UDPParsePacket(packet []byte, result *map[string]interface{}) (bool, string
 
 	version := int8(packet[0])
 
-	if version != 0x02 {
+	if version != udpProtocolVersion {
 		log.Warningf("Bad incoming version %d", version)
 		return false, "", nil
 	}
 
-	token := int16(packet[1]) + int16(packet[2])<<8
+	token := uint16(packet[1])<<8 | uint16(packet[2])
 	id := int8(packet[3])
 
 	log.Debugf("Incoming message {%d, %d}", id, token)
 
-	// PULL_RESP == 0x03
-	if id != 0x03 {
+	if id != pullResp {
 		return false, "", nil
 	}
 
@@ -0,0 +1,195 @@
+package lds
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/brocaar/chirpstack-api/go/gw"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	linkTypeLoRaTap = 270 //LINKTYPE_LORATAP.
+	loRaTapLength   = 15  //LoRaTap version 0 header length.
+	loRaWANSyncWord = 0x34
+)
+
+// LoRaTapInfo is the radio metadata of a frame written to a pcap file.
+type LoRaTapInfo struct {
+	Frequency       uint32 //Hz.
+	Bandwidth       uint32 //kHz.
+	SpreadingFactor uint32
+	RSSI            float64 //dBm, unknown for downlinks.
+	SNR             float64 //dB, unknown for downlinks.
+}
+
+// PcapWriter writes LoRaWAN frames with their LoRaTap radio header to a pcap file, as captured by
+// a gateway, so that they may be opened with the Wireshark LoRaWAN dissector.
+type PcapWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// DefaultPcap writes the traffic of every gateway when set.
+var DefaultPcap *PcapWriter
+
+// NewPcapWriter writes the pcap file header to w, unless appending to a pcap file, and returns a
+// writer for its frames.
+func NewPcapWriter(w io.Writer, appending bool) (*PcapWriter, error) {
+	if !appending {
+		header := make([]byte, 24)
+		binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+		binary.LittleEndian.PutUint16(header[4:], 2)
+		binary.LittleEndian.PutUint16(header[6:], 4)
+		binary.LittleEndian.PutUint32(header[16:], 65535)
+		binary.LittleEndian.PutUint32(header[20:], linkTypeLoRaTap)
+		if _, err := w.Write(header); err != nil {
+			return nil, err
+		}
+	}
+	return &PcapWriter{w: w}, nil
+}
+
+// WriteFrame writes a PHYPayload received or sent at t. It does nothing on a nil writer.
+func (p *PcapWriter) WriteFrame(t time.Time, phyBytes []byte, info LoRaTapInfo) error {
+	if p == nil {
+		return nil
+	}
+
+	//LoRaTap v0 header: version, padding, length, frequency, bandwidth in 125 kHz steps,
+	//spreading factor, packet, max and current RSSI as dBm + 139, SNR in quarters of dB and sync word.
+	tap := make([]byte, loRaTapLength)
+	binary.BigEndian.PutUint16(tap[2:], loRaTapLength)
+	binary.BigEndian.PutUint32(tap[4:], info.Frequency)
+	tap[8] = byte(info.Bandwidth / 125)
+	tap[9] = byte(info.SpreadingFactor)
+	if info.RSSI != 0 {
+		rssi := byte(math.Max(0, math.Min(255, math.Round(info.RSSI+139))))
+		tap[10], tap[11], tap[12] = rssi, rssi, rssi
+	}
+	tap[13] = byte(int8(math.Max(-128, math.Min(127, math.Round(info.SNR*4)))))
+	tap[14] = loRaWANSyncWord
+
+	record := make([]byte, 16)
+	binary.LittleEndian.PutUint32(record[0:], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(tap)+len(phyBytes)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(tap)+len(phyBytes)))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, b := range [][]byte{record, tap, phyBytes} {
+		if _, err := p.w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteUplink writes an uplink forwarded by a gateway with its rx and tx info.
+func (p *PcapWriter) WriteUplink(phyBytes []byte, rxInfo *gw.UplinkRXInfo, txInfo *gw.UplinkTXInfo) {
+	if p == nil {
+		return
+	}
+	mod := txInfo.GetLoraModulationInfo()
+	info := LoRaTapInfo{
+		Frequency:       txInfo.GetFrequency(),
+		Bandwidth:       mod.GetBandwidth(),
+		SpreadingFactor: mod.GetSpreadingFactor(),
+		RSSI:            float64(rxInfo.GetRssi()),
+		SNR:             rxInfo.GetLoraSnr(),
+	}
+	if err := p.WriteFrame(time.Now(), phyBytes, info); err != nil {
+		log.Errorf("pcap error: %s", err)
+	}
+}
+
+// WriteDownlink writes a downlink message received by a gateway, taking the radio settings from
+// the UDP txpk or the MQTT downlink frame tx info. Other UDP packets than PULL_RESP are ignored.
+func (p *PcapWriter) WriteDownlink(dlMessage []byte, mqtt bool) {
+	if p == nil {
+		return
+	}
+	phy, ok, err := DownlinkPHYPayload(dlMessage, mqtt)
+	if err != nil || !ok {
+		return
+	}
+	phyBytes, err := phy.MarshalBinary()
+	if err != nil {
+		return
+	}
+	if err := p.WriteFrame(time.Now(), phyBytes, downlinkTapInfo(dlMessage, mqtt)); err != nil {
+		log.Errorf("pcap error: %s", err)
+	}
+}
+
+// downlinkTapInfo returns the radio settings of a downlink message, leaving the unknown ones empty.
+func downlinkTapInfo(dlMessage []byte, mqtt bool) LoRaTapInfo {
+	var info LoRaTapInfo
+	if mqtt {
+		var df struct {
+			TxInfo struct {
+				Frequency          uint32 `json:"frequency"`
+				LoRaModulationInfo struct {
+					Bandwidth       uint32 `json:"bandwidth"`
+					SpreadingFactor uint32 `json:"spreadingFactor"`
+				} `json:"loRaModulationInfo"`
+			} `json:"txInfo"`
+		}
+		if json.Unmarshal(dlMessage, &df) == nil {
+			info.Frequency = df.TxInfo.Frequency
+			info.Bandwidth = df.TxInfo.LoRaModulationInfo.Bandwidth
+			info.SpreadingFactor = df.TxInfo.LoRaModulationInfo.SpreadingFactor
+		}
+		return info
+	}
+
+	if len(dlMessage) < 4 {
+		return info
+	}
+	var pr struct {
+		TXPK struct {
+			Freq float64 `json:"freq"`
+			DatR string  `json:"datr"`
+		} `json:"txpk"`
+	}
+	if json.Unmarshal(dlMessage[4:], &pr) == nil {
+		info.Frequency = uint32(math.Round(pr.TXPK.Freq * 1000000))
+		fmt.Sscanf(pr.TXPK.DatR, "SF%dBW%d", &info.SpreadingFactor, &info.Bandwidth)
+	}
+	return info
+}
+
+// WriteRecord writes a capture record, e.g. to convert a capture file.
+func (p *PcapWriter) WriteRecord(rec *CaptureRecord) error {
+	var info LoRaTapInfo
+	switch rec.Direction {
+	case CaptureUp:
+		var meta struct {
+			Rssi     float64 `json:"rssi"`
+			LoRaSNR  float64 `json:"loRaSNR"`
+			Freq     uint32  `json:"frequency"`
+			LoRaInfo struct {
+				Bandwidth       uint32 `json:"bandwidth"`
+				SpreadingFactor uint32 `json:"spreadingFactor"`
+			} `json:"loRaModulationInfo"`
+		}
+		json.Unmarshal(rec.RxInfo, &meta)
+		json.Unmarshal(rec.TxInfo, &meta)
+		info = LoRaTapInfo{
+			Frequency:       meta.Freq,
+			Bandwidth:       meta.LoRaInfo.Bandwidth,
+			SpreadingFactor: meta.LoRaInfo.SpreadingFactor,
+			RSSI:            meta.Rssi,
+			SNR:             meta.LoRaSNR,
+		}
+	case CaptureDown:
+		info = downlinkTapInfo(rec.Envelope, rec.Transport == "mqtt")
+	}
+	return p.WriteFrame(rec.Time, rec.PHYPayload, info)
+}
@@ -0,0 +1,131 @@
+package lds
+
+import (
+	"math"
+	"math/rand"
+
+	"github.com/brocaar/chirpstack-api/go/gw"
+)
+
+// PathLossModel computes the path loss in dB over a distance in meters at a frequency in Hz.
+type PathLossModel interface {
+	PathLoss(distance, frequency float64) float64
+}
+
+// FreeSpace is the free-space (Friis) path loss model.
+type FreeSpace struct{}
+
+// PathLoss implements PathLossModel.
+func (FreeSpace) PathLoss(distance, frequency float64) float64 {
+	return freeSpacePathLoss(distance, frequency)
+}
+
+// LogDistance is the log-distance path loss model. When ReferenceLoss is zero,
+// the free-space loss at ReferenceDistance is used.
+type LogDistance struct {
+	Exponent          float64
+	ReferenceDistance float64
+	ReferenceLoss     float64
+}
+
+// PathLoss implements PathLossModel.
+func (m LogDistance) PathLoss(distance, frequency float64) float64 {
+	d0 := m.ReferenceDistance
+	if d0 <= 0 {
+		d0 = 1
+	}
+	pl0 := m.ReferenceLoss
+	if pl0 == 0 {
+		pl0 = freeSpacePathLoss(d0, frequency)
+	}
+	if distance < d0 {
+		distance = d0
+	}
+	return pl0 + 10*m.Exponent*math.Log10(distance/d0)
+}
+
+// Okumura-Hata environments.
+const (
+	HataUrban    = "urban"
+	HataSuburban = "suburban"
+	HataOpen     = "open"
+)
+
+// OkumuraHata is the Okumura-Hata path loss model for small and medium cities,
+// with suburban and open area corrections. Heights are in meters.
+type OkumuraHata struct {
+	BaseHeight   float64
+	MobileHeight float64
+	Environment  string
+}
+
+// PathLoss implements PathLossModel.
+func (m OkumuraHata) PathLoss(distance, frequency float64) float64 {
+	f := frequency / 1e6
+	d := math.Max(distance, 1) / 1000
+	hb := math.Max(m.BaseHeight, 1)
+	hm := math.Max(m.MobileHeight, 1)
+
+	logF := math.Log10(f)
+	aHm := (1.1*logF-0.7)*hm - (1.56*logF - 0.8)
+	loss := 69.55 + 26.16*logF - 13.82*math.Log10(hb) - aHm + (44.9-6.55*math.Log10(hb))*math.Log10(d)
+
+	switch m.Environment {
+	case HataSuburban:
+		loss -= 2*math.Pow(math.Log10(f/28), 2) + 5.4
+	case HataOpen:
+		loss -= 4.78*logF*logF - 18.33*logF + 40.94
+	}
+
+	return loss
+}
+
+func freeSpacePathLoss(distance, frequency float64) float64 {
+	distance = math.Max(distance, 1)
+	return 20*math.Log10(distance) + 20*math.Log10(frequency) - 147.55
+}
+
+// demodulationFloor holds the minimum SNR (dB) a LoRa receiver can demodulate for each SF.
+var demodulationFloor = map[uint32]float64{
+	6:  -5,
+	7:  -7.5,
+	8:  -10,
+	9:  -12.5,
+	10: -15,
+	11: -17.5,
+	12: -20,
+}
+
+// Propagation derives the RSSI and SNR seen by a gateway from the link geometry.
+type Propagation struct {
+	Model PathLossModel
+	// TXPower of the device in dBm and TXAntennaGain of its antenna in dBi.
+	TXPower       float64
+	TXAntennaGain float64
+	// ShadowFading is the standard deviation in dB of the log-normal shadowing.
+	ShadowFading float64
+	// NoiseFigure of the gateway receiver in dB.
+	NoiseFigure float64
+}
+
+// Link returns the RSSI (dBm) and SNR (dB) of a frame sent with txInfo over distance meters and
+// received with rxAntennaGain dBi, and whether the SNR is above the SF demodulation floor.
+func (p *Propagation) Link(distance float64, txInfo *gw.UplinkTXInfo, rxAntennaGain float64) (float64, float64, bool) {
+	mod := txInfo.GetLoraModulationInfo()
+	bandwidth := float64(mod.GetBandwidth()) * 1000
+
+	rssi := p.TXPower + p.TXAntennaGain + rxAntennaGain - p.Model.PathLoss(distance, float64(txInfo.GetFrequency()))
+	if p.ShadowFading > 0 {
+		rssi -= rand.NormFloat64() * p.ShadowFading
+	}
+
+	noiseFloor := -174 + 10*math.Log10(bandwidth) + p.NoiseFigure
+	snr := rssi - noiseFloor
+
+	floor, ok := demodulationFloor[mod.GetSpreadingFactor()]
+	if !ok {
+		floor = demodulationFloor[12]
+	}
+
+	return rssi, snr, snr >= floor
+}
@@ -0,0 +1,212 @@
+package lds
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Schedule decides when uplinks are sent.
+type Schedule interface {
+	// Next returns the time of the uplink following the one at after.
+	Next(after time.Time) time.Time
+}
+
+// Periodic sends every Interval, moved up to Jitter earlier or later at random.
+type Periodic struct {
+	Interval time.Duration
+	Jitter   time.Duration
+}
+
+// Next implements Schedule.
+func (s Periodic) Next(after time.Time) time.Time {
+	next := after.Add(s.Interval)
+	if s.Jitter > 0 {
+		next = next.Add(time.Duration((rand.Float64()*2 - 1) * float64(s.Jitter)))
+	}
+	if !next.After(after) {
+		next = after.Add(time.Millisecond)
+	}
+	return next
+}
+
+// Poisson sends at random with exponentially distributed times between uplinks averaging Mean.
+type Poisson struct {
+	Mean time.Duration
+}
+
+// Next implements Schedule.
+func (s Poisson) Next(after time.Time) time.Time {
+	next := after.Add(time.Duration(rand.ExpFloat64() * float64(s.Mean)))
+	if !next.After(after) {
+		next = after.Add(time.Millisecond)
+	}
+	return next
+}
+
+// Cron sends at the minutes matching a cron expression.
+type Cron struct {
+	minutes, hours, days, months, weekdays uint64
+	anyDay, anyWeekday                     bool
+}
+
+// ParseCron parses a "minute hour day-of-month month day-of-week" expression. Fields take *,
+// values, ranges (1-5), steps (*/15, 0-30/10 or 5/15, which runs from 5 to the field maximum)
+// and lists of them (1,15). Weekdays go from
+// 0 (Sunday) to 6, 7 being Sunday too. As in cron, when both days of month and of week are
+// restricted either may match.
+func ParseCron(expr string) (*Cron, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, errors.Errorf("cron expression %q must have 5 fields", expr)
+	}
+
+	c := &Cron{}
+	var err error
+	if c.minutes, err = cronField(fields[0], 0, 59); err != nil {
+		return nil, errors.Wrap(err, "minute")
+	}
+	if c.hours, err = cronField(fields[1], 0, 23); err != nil {
+		return nil, errors.Wrap(err, "hour")
+	}
+	if c.days, err = cronField(fields[2], 1, 31); err != nil {
+		return nil, errors.Wrap(err, "day of month")
+	}
+	if c.months, err = cronField(fields[3], 1, 12); err != nil {
+		return nil, errors.Wrap(err, "month")
+	}
+	if c.weekdays, err = cronField(fields[4], 0, 7); err != nil {
+		return nil, errors.Wrap(err, "day of week")
+	}
+	if c.weekdays&(1<<7) != 0 {
+		c.weekdays |= 1
+	}
+	c.anyDay = strings.HasPrefix(fields[2], "*")
+	c.anyWeekday = strings.HasPrefix(fields[4], "*")
+	return c, nil
+}
+
+// cronField returns the bit set of the values matched by a cron field.
+func cronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		step, stepped := 1, false
+		if i := strings.Index(part, "/"); i >= 0 {
+			stepped = true
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return 0, errors.Errorf("bad step in %q", part)
+			}
+			part = part[:i]
+		}
+
+		from, to := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, errors.Errorf("bad value %q", part)
+			}
+			//A single value with a step starts a range ending at the maximum.
+			if !stepped {
+				to = from
+			}
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, errors.Errorf("bad value %q", part)
+				}
+			}
+		}
+		if from < min || to > max || from > to {
+			return 0, errors.Errorf("%q out of range %d-%d", part, min, max)
+		}
+
+		for v := from; v <= to; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+func (c *Cron) dayMatches(t time.Time) bool {
+	day := c.days&(1<<uint(t.Day())) != 0
+	weekday := c.weekdays&(1<<uint(t.Weekday())) != 0
+	if c.anyDay || c.anyWeekday {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+// Next implements Schedule. It returns the zero time when no minute matches within five years.
+func (c *Cron) Next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.months&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hours&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minutes&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Scheduler interleaves several schedules, such as the ones of a message mix.
+type Scheduler struct {
+	schedules []Schedule
+	next      []time.Time
+}
+
+// NewScheduler starts the schedules at start.
+func NewScheduler(start time.Time, schedules ...Schedule) *Scheduler {
+	s := &Scheduler{
+		schedules: schedules,
+		next:      make([]time.Time, len(schedules)),
+	}
+	for i, schedule := range schedules {
+		s.next[i] = schedule.Next(start)
+	}
+	return s
+}
+
+// Next returns the index of the schedule due first and its time, and advances it. The index
+// is -1 when no schedule has further uplinks.
+func (s *Scheduler) Next() (int, time.Time) {
+	due := -1
+	for i, t := range s.next {
+		if t.IsZero() {
+			continue
+		}
+		if due < 0 || t.Before(s.next[due]) {
+			due = i
+		}
+	}
+	if due < 0 {
+		return -1, time.Time{}
+	}
+
+	at := s.next[due]
+	s.next[due] = s.schedules[due].Next(at)
+	return due, at
+}
+
+// Backlog returns how many schedules are due at now, i.e. the uplinks running late.
+func (s *Scheduler) Backlog(now time.Time) int {
+	n := 0
+	for _, t := range s.next {
+		if !t.IsZero() && !t.After(now) {
+			n++
+		}
+	}
+	return n
+}
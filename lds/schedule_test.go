@@ -0,0 +1,136 @@
+package lds
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr    string
+		minutes uint64
+		wantErr bool
+	}{
+		{expr: "* * * * *", minutes: 1<<60 - 1},
+		{expr: "0 * * * *", minutes: 1},
+		{expr: "1,15 * * * *", minutes: 1<<1 | 1<<15},
+		{expr: "1-3 * * * *", minutes: 1<<1 | 1<<2 | 1<<3},
+		{expr: "*/20 * * * *", minutes: 1 | 1<<20 | 1<<40},
+		{expr: "0-30/10 * * * *", minutes: 1 | 1<<10 | 1<<20 | 1<<30},
+		{expr: "5/15 * * * *", minutes: 1<<5 | 1<<20 | 1<<35 | 1<<50},
+		{expr: "* * * *", wantErr: true},
+		{expr: "* * * * * *", wantErr: true},
+		{expr: "60 * * * *", wantErr: true},
+		{expr: "* 24 * * *", wantErr: true},
+		{expr: "* * 0 * *", wantErr: true},
+		{expr: "* * * 13 *", wantErr: true},
+		{expr: "* * * * 8", wantErr: true},
+		{expr: "5-1 * * * *", wantErr: true},
+		{expr: "*/0 * * * *", wantErr: true},
+		{expr: "a * * * *", wantErr: true},
+	}
+
+	for _, test := range tests {
+		c, err := ParseCron(test.expr)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("ParseCron(%q) didn't fail", test.expr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseCron(%q) failed: %s", test.expr, err)
+			continue
+		}
+		if c.minutes != test.minutes {
+			t.Errorf("ParseCron(%q) minutes = %b, want %b", test.expr, c.minutes, test.minutes)
+		}
+	}
+}
+
+func TestParseCronSunday(t *testing.T) {
+	c, err := ParseCron("* * * * 7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.weekdays&1 == 0 {
+		t.Errorf("weekday 7 doesn't match Sunday")
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(year int, month time.Month, day, hour, min, sec int) time.Time {
+		return time.Date(year, month, day, hour, min, sec, 0, time.UTC)
+	}
+
+	tests := []struct {
+		expr  string
+		after time.Time
+		want  time.Time
+	}{
+		{"* * * * *", at(2026, 1, 1, 0, 0, 0), at(2026, 1, 1, 0, 1, 0)},
+		{"* * * * *", at(2026, 1, 1, 0, 0, 30), at(2026, 1, 1, 0, 1, 0)},
+		{"*/15 * * * *", at(2026, 1, 1, 0, 14, 59), at(2026, 1, 1, 0, 15, 0)},
+		{"*/15 * * * *", at(2026, 1, 1, 0, 15, 0), at(2026, 1, 1, 0, 30, 0)},
+		{"30 9 * * *", at(2026, 1, 1, 10, 0, 0), at(2026, 1, 2, 9, 30, 0)},
+		{"0 0 1 * *", at(2026, 1, 15, 0, 0, 0), at(2026, 2, 1, 0, 0, 0)},
+		{"0 0 * 3 *", at(2026, 4, 1, 0, 0, 0), at(2027, 3, 1, 0, 0, 0)},
+		{"0 0 29 2 *", at(2026, 1, 1, 0, 0, 0), at(2028, 2, 29, 0, 0, 0)},
+		//2026-01-01 is a Thursday.
+		{"0 12 * * 1", at(2026, 1, 1, 0, 0, 0), at(2026, 1, 5, 12, 0, 0)},
+		{"0 12 * * 7", at(2026, 1, 1, 0, 0, 0), at(2026, 1, 4, 12, 0, 0)},
+		//With days of month and of week restricted either matches.
+		{"0 0 10 * 6", at(2026, 1, 1, 0, 0, 0), at(2026, 1, 3, 0, 0, 0)},
+		{"0 0 2 * 6", at(2026, 1, 1, 0, 0, 0), at(2026, 1, 2, 0, 0, 0)},
+		{"59 23 31 12 *", at(2026, 12, 31, 23, 58, 0), at(2026, 12, 31, 23, 59, 0)},
+		{"0 0 31 2 *", at(2026, 1, 1, 0, 0, 0), time.Time{}},
+	}
+
+	for _, test := range tests {
+		c, err := ParseCron(test.expr)
+		if err != nil {
+			t.Errorf("ParseCron(%q) failed: %s", test.expr, err)
+			continue
+		}
+		if got := c.Next(test.after); !got.Equal(test.want) {
+			t.Errorf("%q next after %s = %s, want %s", test.expr, test.after, got, test.want)
+		}
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	never, err := ParseCron("0 0 31 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewScheduler(start,
+		Periodic{Interval: 2 * time.Minute},
+		Periodic{Interval: 3 * time.Minute},
+		never,
+	)
+
+	want := []struct {
+		index   int
+		minutes int
+	}{
+		{0, 2}, {1, 3}, {0, 4}, {0, 6}, {1, 6}, {0, 8}, {1, 9},
+	}
+	for _, w := range want {
+		i, at := s.Next()
+		if i != w.index || !at.Equal(start.Add(time.Duration(w.minutes)*time.Minute)) {
+			t.Fatalf("Next() = %d, %s, want %d at minute %d", i, at, w.index, w.minutes)
+		}
+	}
+
+	if n := s.Backlog(start.Add(20 * time.Minute)); n != 2 {
+		t.Errorf("Backlog() = %d, want 2", n)
+	}
+	if n := s.Backlog(start); n != 0 {
+		t.Errorf("Backlog() = %d, want 0", n)
+	}
+
+	if i, _ := NewScheduler(start, never).Next(); i != -1 {
+		t.Errorf("Next() = %d without uplinks, want -1", i)
+	}
+}
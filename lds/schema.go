@@ -0,0 +1,136 @@
+package lds
+
+import (
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// Schema field types.
+const (
+	UintField  = "uint"  //Unsigned integer.
+	IntField   = "int"   //Two's complement signed integer.
+	FloatField = "float" //IEEE 754, 32 or 64 bits.
+)
+
+// Field describes how a payload value is written: the value is stored as the raw integer
+// (value - Offset) / Scale, or as a float, in Bits bits. Little endian fields must take whole bytes.
+type Field struct {
+	Type         string
+	Bits         int
+	LittleEndian bool
+	Scale        float64 //1 when 0.
+	Offset       float64
+}
+
+// Validate checks the field can be written.
+func (f Field) Validate() error {
+	switch f.Type {
+	case UintField, IntField:
+		if f.Bits < 1 || f.Bits > 64 {
+			return errors.Errorf("%s fields take 1 to 64 bits, got %d", f.Type, f.Bits)
+		}
+	case FloatField:
+		if f.Bits != 32 && f.Bits != 64 {
+			return errors.Errorf("float fields take 32 or 64 bits, got %d", f.Bits)
+		}
+	default:
+		return errors.Errorf("unknown field type %q", f.Type)
+	}
+	if f.LittleEndian && f.Bits%8 != 0 {
+		return errors.Errorf("little endian fields must take whole bytes, got %d bits", f.Bits)
+	}
+	return nil
+}
+
+// Raw returns the bits representing value, in the lowest Bits bits.
+func (f Field) Raw(value float64) (uint64, error) {
+	if err := f.Validate(); err != nil {
+		return 0, err
+	}
+
+	scale := f.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	x := (value - f.Offset) / scale
+
+	switch f.Type {
+	case FloatField:
+		if f.Bits == 32 {
+			return uint64(math.Float32bits(float32(x))), nil
+		}
+		return math.Float64bits(x), nil
+	case UintField:
+		//2^Bits - 1 isn't exact for 64 bits, so the bounds compare to powers of 2.
+		r := math.Round(x)
+		if !(r >= 0 && r < math.Ldexp(1, f.Bits)) {
+			return 0, errors.Errorf("value %g doesn't fit in %d unsigned bits", value, f.Bits)
+		}
+		return uint64(r), nil
+	default:
+		r := math.Round(x)
+		if !(r >= -math.Ldexp(1, f.Bits-1) && r < math.Ldexp(1, f.Bits-1)) {
+			return 0, errors.Errorf("value %g doesn't fit in %d signed bits", value, f.Bits)
+		}
+		raw := uint64(int64(r))
+		if f.Bits < 64 {
+			raw &= 1<<uint(f.Bits) - 1
+		}
+		return raw, nil
+	}
+}
+
+// PayloadBuilder writes payload fields most significant bit first, so consecutive fields
+// narrower than a byte are packed as bitfields. The last byte is padded with zeros.
+type PayloadBuilder struct {
+	buf  []byte
+	bits int
+}
+
+// WriteBits writes the lowest n bits of v.
+func (b *PayloadBuilder) WriteBits(v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if b.bits%8 == 0 {
+			b.buf = append(b.buf, 0)
+		}
+		if v>>uint(i)&1 == 1 {
+			b.buf[len(b.buf)-1] |= 1 << uint(7-b.bits%8)
+		}
+		b.bits++
+	}
+}
+
+// WriteBytes writes whole bytes, which needn't be byte aligned.
+func (b *PayloadBuilder) WriteBytes(p []byte) {
+	if b.bits%8 == 0 {
+		b.buf = append(b.buf, p...)
+		b.bits += len(p) * 8
+		return
+	}
+	for _, v := range p {
+		b.WriteBits(uint64(v), 8)
+	}
+}
+
+// WriteField writes value as described by f.
+func (b *PayloadBuilder) WriteField(f Field, value float64) error {
+	raw, err := f.Raw(value)
+	if err != nil {
+		return err
+	}
+
+	if !f.LittleEndian {
+		b.WriteBits(raw, f.Bits)
+		return nil
+	}
+	for i := 0; i < f.Bits/8; i++ {
+		b.WriteBits(raw>>uint(i*8), 8)
+	}
+	return nil
+}
+
+// Bytes returns the payload written so far.
+func (b *PayloadBuilder) Bytes() []byte {
+	return b.buf
+}
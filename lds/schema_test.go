@@ -0,0 +1,139 @@
+package lds
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestFieldRaw(t *testing.T) {
+	tests := []struct {
+		name    string
+		field   Field
+		value   float64
+		raw     uint64
+		wantErr bool
+	}{
+		{"uint8", Field{Type: UintField, Bits: 8}, 255, 0xff, false},
+		{"uint8 overflow", Field{Type: UintField, Bits: 8}, 256, 0, true},
+		{"uint negative", Field{Type: UintField, Bits: 8}, -1, 0, true},
+		{"uint rounded", Field{Type: UintField, Bits: 8}, 1.5, 2, false},
+		{"uint64 max", Field{Type: UintField, Bits: 64}, math.Ldexp(1, 64) - 4096, math.MaxUint64 - 4095, false},
+		{"uint64 overflow", Field{Type: UintField, Bits: 64}, math.Ldexp(1, 64), 0, true},
+		{"int8 min", Field{Type: IntField, Bits: 8}, -128, 0x80, false},
+		{"int8 max", Field{Type: IntField, Bits: 8}, 127, 0x7f, false},
+		{"int8 overflow", Field{Type: IntField, Bits: 8}, 128, 0, true},
+		{"int12 negative", Field{Type: IntField, Bits: 12}, -1, 0xfff, false},
+		{"int64 min", Field{Type: IntField, Bits: 64}, -math.Ldexp(1, 63), 1 << 63, false},
+		{"int64 overflow", Field{Type: IntField, Bits: 64}, math.Ldexp(1, 63), 0, true},
+		{"scale and offset", Field{Type: IntField, Bits: 16, Scale: 0.1, Offset: -40}, -20, 200, false},
+		{"float32", Field{Type: FloatField, Bits: 32}, 1.5, uint64(math.Float32bits(1.5)), false},
+		{"float64", Field{Type: FloatField, Bits: 64}, -2.25, math.Float64bits(-2.25), false},
+		{"float16", Field{Type: FloatField, Bits: 16}, 1, 0, true},
+		{"no bits", Field{Type: UintField}, 1, 0, true},
+		{"65 bits", Field{Type: IntField, Bits: 65}, 1, 0, true},
+		{"unknown type", Field{Type: "bool", Bits: 1}, 1, 0, true},
+		{"little endian bits", Field{Type: UintField, Bits: 12, LittleEndian: true}, 1, 0, true},
+	}
+
+	for _, test := range tests {
+		raw, err := test.field.Raw(test.value)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: Raw(%g) didn't fail", test.name, test.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Raw(%g) failed: %s", test.name, test.value, err)
+			continue
+		}
+		if raw != test.raw {
+			t.Errorf("%s: Raw(%g) = %#x, want %#x", test.name, test.value, raw, test.raw)
+		}
+	}
+}
+
+func TestPayloadBuilder(t *testing.T) {
+	type write struct {
+		field Field
+		value float64
+	}
+
+	tests := []struct {
+		name   string
+		writes []write
+		want   []byte
+	}{
+		{
+			name: "big endian",
+			writes: []write{
+				{Field{Type: UintField, Bits: 16}, 0x0102},
+				{Field{Type: IntField, Bits: 8}, -2},
+			},
+			want: []byte{0x01, 0x02, 0xfe},
+		},
+		{
+			name: "little endian",
+			writes: []write{
+				{Field{Type: UintField, Bits: 32, LittleEndian: true}, 0x01020304},
+			},
+			want: []byte{0x04, 0x03, 0x02, 0x01},
+		},
+		{
+			name: "bitfields",
+			writes: []write{
+				{Field{Type: UintField, Bits: 1}, 1},
+				{Field{Type: UintField, Bits: 3}, 5},
+				{Field{Type: UintField, Bits: 4}, 0xa},
+				{Field{Type: UintField, Bits: 8}, 0xff},
+			},
+			want: []byte{0xda, 0xff},
+		},
+		{
+			name: "padding",
+			writes: []write{
+				{Field{Type: UintField, Bits: 3}, 7},
+				{Field{Type: UintField, Bits: 8}, 0xff},
+			},
+			want: []byte{0xff, 0xe0},
+		},
+		{
+			name: "unaligned little endian",
+			writes: []write{
+				{Field{Type: UintField, Bits: 4}, 0xf},
+				{Field{Type: UintField, Bits: 16, LittleEndian: true}, 0x1234},
+			},
+			want: []byte{0xf3, 0x41, 0x20},
+		},
+		{
+			name: "float",
+			writes: []write{
+				{Field{Type: FloatField, Bits: 32}, 1},
+			},
+			want: []byte{0x3f, 0x80, 0x00, 0x00},
+		},
+	}
+
+	for _, test := range tests {
+		var b PayloadBuilder
+		for _, w := range test.writes {
+			if err := b.WriteField(w.field, w.value); err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+		}
+		if !bytes.Equal(b.Bytes(), test.want) {
+			t.Errorf("%s: got %x, want %x", test.name, b.Bytes(), test.want)
+		}
+	}
+}
+
+func TestPayloadBuilderWriteBytes(t *testing.T) {
+	var b PayloadBuilder
+	b.WriteBytes([]byte{0x01, 0x02})
+	b.WriteBits(1, 1)
+	b.WriteBytes([]byte{0xff})
+	if want := []byte{0x01, 0x02, 0xff, 0x80}; !bytes.Equal(b.Bytes(), want) {
+		t.Errorf("got %x, want %x", b.Bytes(), want)
+	}
+}
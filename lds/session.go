@@ -0,0 +1,312 @@
+package lds
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/brocaar/lorawan"
+)
+
+// Session event kinds.
+const (
+	SessionJoinRequest = "join_request"
+	SessionJoined      = "joined"
+	SessionUplink      = "uplink"
+	SessionDownlink    = "downlink"
+	SessionReset       = "reset"
+)
+
+// sessionEventsBuffer is the number of events a subscriber may fall behind before losing them.
+const sessionEventsBuffer = 16
+
+// SessionChannel is an uplink channel added by the join-accept CFList or a NewChannelReq.
+type SessionChannel struct {
+	Index     int
+	Frequency uint32 //Hz, 0 when the channel was removed.
+	MinDR     int
+	MaxDR     int
+}
+
+// SessionState is the device session along with the radio settings the network server set up
+// through the join-accept and downlink MAC commands, as a device accepting them would apply
+// them. Settings the network server didn't change are -1, or 0 for RX2Frequency.
+type SessionState struct {
+	DevAddr     lorawan.DevAddr
+	Joined      bool
+	NwkSEncKey  lorawan.AES128Key
+	SNwkSIntKey lorawan.AES128Key
+	FNwkSIntKey lorawan.AES128Key
+	AppSKey     lorawan.AES128Key
+	UlFcnt      uint32
+	DlFcnt      uint32
+
+	DataRate     int
+	TXPower      int //TX power index.
+	NbTrans      int
+	ChMasks      map[uint8]lorawan.ChMask //Masks of 16 channels blocks, by ChMaskCntl.
+	AllChannels  bool                     //Every channel turned on by a LinkADRReq.
+	Channels     []SessionChannel
+	RX1DROffset  int
+	RX2DataRate  int
+	RX2Frequency uint32 //Hz.
+	RXDelay      int    //Seconds.
+
+	PendingAnswers []lorawan.CID //Answers to requests the device didn't send yet.
+	JoinAccept     *lorawan.JoinAcceptPayload
+	JoinedAt       time.Time
+	LastDownlink   time.Time
+}
+
+// SessionEvent tells a session change along with the state after it.
+type SessionEvent struct {
+	Time  time.Time
+	Kind  string
+	State SessionState
+}
+
+// answers maps the requests a device answers to their answer names.
+var answers = map[lorawan.CID]string{
+	lorawan.LinkADRReq:          "LinkADRAns",
+	lorawan.DutyCycleReq:        "DutyCycleAns",
+	lorawan.RXParamSetupReq:     "RXParamSetupAns",
+	lorawan.DevStatusReq:        "DevStatusAns",
+	lorawan.NewChannelReq:       "NewChannelAns",
+	lorawan.RXTimingSetupReq:    "RXTimingSetupAns",
+	lorawan.TXParamSetupReq:     "TXParamSetupAns",
+	lorawan.DLChannelReq:        "DLChannelAns",
+	lorawan.ADRParamSetupReq:    "ADRParamSetupAns",
+	lorawan.RejoinParamSetupReq: "RejoinParamSetupAns",
+	lorawan.PingSlotChannelReq:  "PingSlotChannelAns",
+	lorawan.BeaconFreqReq:       "BeaconFreqAns",
+}
+
+// AnswerName returns the name of the answer to a request, e.g. LinkADRAns for LinkADRReq.
+func AnswerName(cid lorawan.CID) string {
+	if name, ok := answers[cid]; ok {
+		return name
+	}
+	return cid.String()
+}
+
+func newSessionState() SessionState {
+	return SessionState{DataRate: -1, TXPower: -1, NbTrans: -1, RX1DROffset: -1, RX2DataRate: -1, RXDelay: -1}
+}
+
+// EnabledChannels describes the channels enabled by LinkADRReq masks, or the band defaults when
+// the network server didn't set any.
+func (s SessionState) EnabledChannels() string {
+	if len(s.ChMasks) == 0 {
+		if s.AllChannels {
+			return "all"
+		}
+		return "band defaults"
+	}
+	var cntls []int
+	for cntl := range s.ChMasks {
+		cntls = append(cntls, int(cntl))
+	}
+	sort.Ints(cntls)
+
+	var enabled []string
+	for _, cntl := range cntls {
+		for i, on := range s.ChMasks[uint8(cntl)] {
+			if on {
+				enabled = append(enabled, fmt.Sprintf("%d", cntl*16+i))
+			}
+		}
+	}
+	if len(enabled) == 0 {
+		return "none"
+	}
+	return strings.Join(enabled, ",")
+}
+
+// State returns the current device session state.
+func (d *Device) State() SessionState {
+	d.sessionMu.Lock()
+	defer d.sessionMu.Unlock()
+	return d.stateLocked()
+}
+
+func (d *Device) stateLocked() SessionState {
+	if d.session == nil {
+		s := newSessionState()
+		d.session = &s
+	}
+	s := *d.session
+	s.DevAddr, s.Joined = d.DevAddr, d.Joined
+	s.NwkSEncKey, s.SNwkSIntKey, s.FNwkSIntKey, s.AppSKey = d.NwkSEncKey, d.SNwkSIntKey, d.FNwkSIntKey, d.AppSKey
+	s.UlFcnt, s.DlFcnt = d.UlFcnt, d.DlFcnt
+
+	s.ChMasks = make(map[uint8]lorawan.ChMask, len(d.session.ChMasks))
+	for cntl, mask := range d.session.ChMasks {
+		s.ChMasks[cntl] = mask
+	}
+	s.Channels = append([]SessionChannel(nil), d.session.Channels...)
+	s.PendingAnswers = append([]lorawan.CID(nil), d.session.PendingAnswers...)
+	return s
+}
+
+// Subscribe returns a channel receiving the device session events and a function to stop
+// receiving them, which closes the channel. Events are dropped while the channel is full.
+func (d *Device) Subscribe() (<-chan SessionEvent, func()) {
+	events := make(chan SessionEvent, sessionEventsBuffer)
+	d.sessionMu.Lock()
+	if d.subscribers == nil {
+		d.subscribers = map[chan SessionEvent]struct{}{}
+	}
+	d.subscribers[events] = struct{}{}
+	d.sessionMu.Unlock()
+
+	return events, func() {
+		d.sessionMu.Lock()
+		defer d.sessionMu.Unlock()
+		if _, ok := d.subscribers[events]; ok {
+			delete(d.subscribers, events)
+			close(events)
+		}
+	}
+}
+
+// updateSession applies a change to the session state and sends the event to subscribers.
+func (d *Device) updateSession(kind string, update func(s *SessionState)) {
+	d.sessionMu.Lock()
+	defer d.sessionMu.Unlock()
+	if d.session == nil {
+		s := newSessionState()
+		d.session = &s
+	}
+	if update != nil {
+		update(d.session)
+	}
+
+	ev := SessionEvent{Time: time.Now(), Kind: kind, State: d.stateLocked()}
+	for events := range d.subscribers {
+		select {
+		case events <- ev:
+		default:
+		}
+	}
+}
+
+// joined starts a new session with the join-accept settings.
+func (d *Device) joined(jap *lorawan.JoinAcceptPayload) {
+	d.updateSession(SessionJoined, func(s *SessionState) {
+		*s = newSessionState()
+		ja := *jap
+		s.JoinAccept = &ja
+		s.JoinedAt = time.Now()
+		s.LastDownlink = s.JoinedAt
+		s.RX1DROffset = int(jap.DLSettings.RX1DROffset)
+		s.RX2DataRate = int(jap.DLSettings.RX2DataRate)
+		s.RXDelay = int(jap.RXDelay)
+		if s.RXDelay == 0 {
+			s.RXDelay = 1
+		}
+		if jap.CFList == nil {
+			return
+		}
+		switch p := jap.CFList.Payload.(type) {
+		case *lorawan.CFListChannelPayload:
+			//CFList channels follow the 3 default channels.
+			for i, freq := range p.Channels {
+				if freq != 0 {
+					s.Channels = append(s.Channels, SessionChannel{Index: 3 + i, Frequency: freq, MinDR: -1, MaxDR: -1})
+				}
+			}
+		case *lorawan.CFListChannelMaskPayload:
+			s.ChMasks = map[uint8]lorawan.ChMask{}
+			for i, mask := range p.ChannelMasks {
+				s.ChMasks[uint8(i)] = mask
+			}
+		}
+	})
+}
+
+// applyDownlink applies the downlink MAC commands to the session state.
+func (d *Device) applyDownlink(dl *Downlink) {
+	d.updateSession(SessionDownlink, func(s *SessionState) {
+		s.LastDownlink = dl.Time
+		for _, cmd := range dl.MACCommands {
+			if _, ok := answers[cmd.CID]; ok {
+				s.addPendingAnswer(cmd.CID)
+			}
+
+			switch p := cmd.Payload.(type) {
+			case *lorawan.LinkADRReqPayload:
+				s.DataRate, s.TXPower, s.NbTrans = int(p.DataRate), int(p.TXPower), int(p.Redundancy.NbRep)
+				s.applyChMask(p.Redundancy.ChMaskCntl, p.ChMask)
+			case *lorawan.RXParamSetupReqPayload:
+				s.RX1DROffset = int(p.DLSettings.RX1DROffset)
+				s.RX2DataRate = int(p.DLSettings.RX2DataRate)
+				s.RX2Frequency = p.Frequency
+			case *lorawan.RXTimingSetupReqPayload:
+				s.RXDelay = int(p.Delay)
+				if s.RXDelay == 0 {
+					s.RXDelay = 1
+				}
+			case *lorawan.NewChannelReqPayload:
+				s.setChannel(SessionChannel{Index: int(p.ChIndex), Frequency: p.Freq, MinDR: int(p.MinDR), MaxDR: int(p.MaxDR)})
+			}
+		}
+	})
+}
+
+// applyChMask applies a LinkADRReq channel mask: ChMaskCntl 0 to 4 set a 16 channels block, 6
+// turns every channel on and 7 turns the first 64 off, setting the last block.
+func (s *SessionState) applyChMask(cntl uint8, mask lorawan.ChMask) {
+	if s.ChMasks == nil {
+		s.ChMasks = map[uint8]lorawan.ChMask{}
+	}
+	s.AllChannels = cntl == 6
+	switch {
+	case cntl <= 4:
+		s.ChMasks[cntl] = mask
+	case cntl == 6:
+		s.ChMasks = nil
+	case cntl == 7:
+		for block := uint8(0); block < 4; block++ {
+			s.ChMasks[block] = lorawan.ChMask{}
+		}
+		s.ChMasks[4] = mask
+	}
+}
+
+func (s *SessionState) setChannel(ch SessionChannel) {
+	for i := range s.Channels {
+		if s.Channels[i].Index == ch.Index {
+			s.Channels[i] = ch
+			return
+		}
+	}
+	s.Channels = append(s.Channels, ch)
+	sort.Slice(s.Channels, func(i, j int) bool { return s.Channels[i].Index < s.Channels[j].Index })
+}
+
+func (s *SessionState) addPendingAnswer(cid lorawan.CID) {
+	for _, pending := range s.PendingAnswers {
+		if pending == cid {
+			return
+		}
+	}
+	s.PendingAnswers = append(s.PendingAnswers, cid)
+}
+
+// uplinkSent clears the pending answers sent with an uplink.
+func (d *Device) uplinkSent(macCommands []*lorawan.MACCommand) {
+	d.updateSession(SessionUplink, func(s *SessionState) {
+		var pending []lorawan.CID
+		for _, cid := range s.PendingAnswers {
+			answered := false
+			for _, cmd := range macCommands {
+				answered = answered || cmd.CID == cid
+			}
+			if !answered {
+				pending = append(pending, cid)
+			}
+		}
+		s.PendingAnswers = pending
+	})
+}
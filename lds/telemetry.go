@@ -0,0 +1,239 @@
+package lds
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brocaar/lorawan"
+)
+
+// Telemetry metric names.
+const (
+	metricUplinks          = "lds_uplinks_total"
+	metricJoinRequests     = "lds_join_requests_total"
+	metricJoinAccepts      = "lds_join_accepts_total"
+	metricDownlinks        = "lds_downlinks_total"
+	metricGatewayDownlinks = "lds_gateway_downlinks_total"
+	metricDownlinkFailures = "lds_downlink_failures_total"
+	metricConnected        = "lds_transport_connected"
+	metricAckLatency       = "lds_udp_ack_latency_seconds"
+	metricAcksMissed       = "lds_udp_acks_missed_total"
+	metricSchedulerBacklog = "lds_scheduler_backlog"
+)
+
+var telemetryMetrics = []struct {
+	name, kind, help string
+}{
+	{metricUplinks, "counter", "Data uplinks forwarded, by device and gateway."},
+	{metricJoinRequests, "counter", "Join requests forwarded, by device and gateway."},
+	{metricJoinAccepts, "counter", "Join-accepts accepted, by device."},
+	{metricDownlinks, "counter", "Data downlinks processed, by device."},
+	{metricGatewayDownlinks, "counter", "Downlinks received, by gateway."},
+	{metricDownlinkFailures, "counter", "Downlinks ProcessDownlink failed on, by device and reason (mic or decode)."},
+	{metricConnected, "gauge", "Whether a transport client is connected, by transport (mqtt or udp) and client."},
+	{metricAckLatency, "histogram", "Time between a UDP PUSH_DATA or PULL_DATA and its ack, by gateway and type (push or pull)."},
+	{metricAcksMissed, "counter", "UDP PUSH_DATA and PULL_DATA packets not acknowledged in time, by gateway and type (push or pull)."},
+	{metricSchedulerBacklog, "gauge", "Message mix uplinks due but not sent yet."},
+}
+
+// ackLatencyBuckets are the upper bounds, in seconds, of the UDP ack latency histogram.
+var ackLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+type histogram struct {
+	counts []uint64 //Per bucket, the last one counting the samples above every bound.
+	sum    float64
+	count  uint64
+}
+
+// Telemetry counts the traffic of the simulated devices and gateways and tracks the state of the
+// transport clients, serving them in the Prometheus text format. Devices, gateways and UDP clients
+// report to DefaultTelemetry.
+type Telemetry struct {
+	mu         sync.Mutex
+	values     map[string]map[string]float64    //Metric name to labels to value.
+	histograms map[string]map[string]*histogram //Metric name to labels to histogram.
+}
+
+// DefaultTelemetry is the telemetry the lds package reports to.
+var DefaultTelemetry = NewTelemetry()
+
+// NewTelemetry returns an empty telemetry.
+func NewTelemetry() *Telemetry {
+	return &Telemetry{
+		values:     map[string]map[string]float64{},
+		histograms: map[string]map[string]*histogram{},
+	}
+}
+
+// labels renders label name and value pairs.
+func labels(pairs ...string) string {
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(pairs[i+1])
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, pairs[i], value))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (t *Telemetry) add(name string, v float64, pairs ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.values[name] == nil {
+		t.values[name] = map[string]float64{}
+	}
+	t.values[name][labels(pairs...)] += v
+}
+
+func (t *Telemetry) set(name string, v float64, pairs ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.values[name] == nil {
+		t.values[name] = map[string]float64{}
+	}
+	t.values[name][labels(pairs...)] = v
+}
+
+func (t *Telemetry) observe(name string, v float64, pairs ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.histograms[name] == nil {
+		t.histograms[name] = map[string]*histogram{}
+	}
+	key := labels(pairs...)
+	h, ok := t.histograms[name][key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(ackLatencyBuckets)+1)}
+		t.histograms[name][key] = h
+	}
+	h.counts[sort.SearchFloat64s(ackLatencyBuckets, v)]++
+	h.sum += v
+	h.count++
+}
+
+// forwarded counts a join request or data uplink forwarded by a gateway.
+func (t *Telemetry) forwarded(devEUI lorawan.EUI64, gwMAC string, phyBytes []byte) {
+	if len(phyBytes) == 0 {
+		return
+	}
+	name := metricUplinks
+	if lorawan.MType(phyBytes[0]>>5) == lorawan.JoinRequest {
+		name = metricJoinRequests
+	}
+	t.add(name, 1, "dev_eui", devEUI.String(), "gateway", gwMAC)
+}
+
+// downlinkProcessed counts a downlink given to ProcessDownlink, by its outcome.
+func (t *Telemetry) downlinkProcessed(devEUI lorawan.EUI64, join bool, err error) {
+	switch {
+	case err == nil && join:
+		t.add(metricJoinAccepts, 1, "dev_eui", devEUI.String())
+	case err == nil:
+		t.add(metricDownlinks, 1, "dev_eui", devEUI.String())
+	case IsMICError(err):
+		t.add(metricDownlinkFailures, 1, "dev_eui", devEUI.String(), "reason", "mic")
+	default:
+		t.add(metricDownlinkFailures, 1, "dev_eui", devEUI.String(), "reason", "decode")
+	}
+}
+
+// GatewayDownlink counts a downlink received by a gateway.
+func (t *Telemetry) GatewayDownlink(gwMAC string) {
+	t.add(metricGatewayDownlinks, 1, "gateway", gwMAC)
+}
+
+// SetConnected records the connection state of a transport client, e.g. ("mqtt", "broker", true).
+func (t *Telemetry) SetConnected(transport, client string, connected bool) {
+	v := 0.0
+	if connected {
+		v = 1
+	}
+	t.set(metricConnected, v, "transport", transport, "client", client)
+}
+
+// SetSchedulerBacklog records the number of message mix uplinks due but not sent yet.
+func (t *Telemetry) SetSchedulerBacklog(n int) {
+	t.set(metricSchedulerBacklog, float64(n))
+}
+
+// ackReceived records the latency of a UDP ack, kind being "push" or "pull".
+func (t *Telemetry) ackReceived(gwMAC, kind string, rtt time.Duration) {
+	t.observe(metricAckLatency, rtt.Seconds(), "gateway", gwMAC, "type", kind)
+}
+
+// ackMissed counts a UDP packet that wasn't acknowledged in time, kind being "push" or "pull".
+func (t *Telemetry) ackMissed(gwMAC, kind string) {
+	t.add(metricAcksMissed, 1, "gateway", gwMAC, "type", kind)
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format.
+func (t *Telemetry) WriteTo(w io.Writer) (int64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var b strings.Builder
+	for _, m := range telemetryMetrics {
+		values, histograms := t.values[m.name], t.histograms[m.name]
+		if len(values) == 0 && len(histograms) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+
+		for _, key := range sortedKeys(values) {
+			fmt.Fprintf(&b, "%s%s %g\n", m.name, braces(key), values[key])
+		}
+
+		keys := make([]string, 0, len(histograms))
+		for key := range histograms {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			h := histograms[key]
+			var cumulative uint64
+			for i, bound := range ackLatencyBuckets {
+				cumulative += h.counts[i]
+				fmt.Fprintf(&b, "%s_bucket%s %d\n", m.name, braces(joinLabels(key, labels("le", fmt.Sprint(bound)))), cumulative)
+			}
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", m.name, braces(joinLabels(key, labels("le", "+Inf"))), h.count)
+			fmt.Fprintf(&b, "%s_sum%s %g\n", m.name, braces(key), h.sum)
+			fmt.Fprintf(&b, "%s_count%s %d\n", m.name, braces(key), h.count)
+		}
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// ServeHTTP serves the metrics to Prometheus.
+func (t *Telemetry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	t.WriteTo(w)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
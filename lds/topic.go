@@ -0,0 +1,86 @@
+package lds
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/brocaar/chirpstack-api/go/gw"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+)
+
+// Event, command and state types filling the {type} placeholder of topic templates.
+const (
+	EventUp       = "up"
+	CommandDown   = "down"
+	CommandConfig = "config"
+	StateConn     = "conn"
+)
+
+// Topic fills a topic template for a gateway. The {id} (or {gateway_id}, {mac}) placeholder
+// is replaced with the gateway ID, {region} with the region and {type} with the event, command
+// or state type, e.g. "{region}/gateway/{id}/event/{type}". For older templates, %s is
+// replaced with the gateway ID too.
+func Topic(template, gatewayID, region, kind string) string {
+	return strings.NewReplacer(
+		"{id}", gatewayID,
+		"{gateway_id}", gatewayID,
+		"{mac}", gatewayID,
+		"{region}", region,
+		"{type}", kind,
+		"%s", gatewayID,
+	).Replace(template)
+}
+
+// Connection states.
+const (
+	ConnStateOffline = "OFFLINE"
+	ConnStateOnline  = "ONLINE"
+)
+
+// ConnState is the ChirpStack gateway connection state message, published retained on the state/conn topic.
+type ConnState struct {
+	GatewayID string `json:"gatewayId"`
+	State     string `json:"state"`
+}
+
+// MarshalConnState marshals a connection state message with the given marshaler ("json", "protobuf" or plain old json).
+func MarshalConnState(gatewayID string, online bool, marshaler string) ([]byte, error) {
+	state := ConnState{GatewayID: gatewayID, State: ConnStateOffline}
+	if online {
+		state.State = ConnStateOnline
+	}
+
+	if marshaler != "protobuf" {
+		return json.Marshal(state)
+	}
+
+	//ConnState is not part of the gw API package yet: gateway_id = 1 (string), state = 2 (enum, ONLINE = 1).
+	buf := proto.NewBuffer(nil)
+	if err := buf.EncodeVarint(1<<3 | proto.WireBytes); err != nil {
+		return nil, err
+	}
+	if err := buf.EncodeStringBytes(gatewayID); err != nil {
+		return nil, err
+	}
+	if online {
+		if err := buf.EncodeVarint(2<<3 | proto.WireVarint); err != nil {
+			return nil, err
+		}
+		if err := buf.EncodeVarint(1); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalGatewayConfiguration unmarshals a command/config message with the given marshaler.
+func UnmarshalGatewayConfiguration(b []byte, marshaler string) (*gw.GatewayConfiguration, error) {
+	_, unmarshal := marshalers(marshaler)
+
+	var conf gw.GatewayConfiguration
+	if err := unmarshal(b, &conf); err != nil {
+		return nil, errors.Wrap(err, "unmarshal gateway configuration error")
+	}
+	return &conf, nil
+}
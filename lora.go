@@ -30,34 +30,6 @@ var (
 	}
 )
 
-type band struct {
-	Name lwband.Name `toml:"name"`
-}
-
-type dataRate struct {
-	Bandwidth    int    `toml:"bandwith"`
-	SpreadFactor int    `toml:"spread_factor"`
-	BitRate      int    `toml:"bit_rate"`
-	BitRateS     string `toml:"-"`
-}
-
-type rxInfo struct {
-	Channel   int     `toml:"channel"`
-	CodeRate  string  `toml:"code_rate"`
-	CrcStatus int     `toml:"crc_status"`
-	Frequency int     `toml:"frequency"`
-	LoRaSNR   float64 `toml:"lora_snr"`
-	RfChain   int     `toml:"rf_chain"`
-	Rssi      int     `toml:"rssi"`
-	//String representations for numeric values so that we can manage them with input texts.
-	ChannelS   string `toml:"-"`
-	CrcStatusS string `toml:"-"`
-	FrequencyS string `toml:"-"`
-	LoRASNRS   string `toml:"-"`
-	RfChainS   string `toml:"-"`
-	RssiS      string `toml:"-"`
-}
-
 var (
 	loraBandCombo     giox.Combo
 	bandwidthCombo    giox.Combo
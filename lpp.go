@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	l "gioui.org/layout"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+	"github.com/iegomez/lds/conf"
+	"github.com/iegomez/lds/lds"
+	"github.com/scartill/giox"
+	xmat "github.com/scartill/giox/material"
+	log "github.com/sirupsen/logrus"
+)
+
+type lppChannelWidgets struct {
+	Channel      widget.Editor
+	Type         widget.Editor
+	Values       widget.Editor
+	UsePosition  widget.Bool
+	DeleteButton widget.Clickable
+}
+
+// MaxLPPChannels defines max number of Cayenne LPP channels to send
+const MaxLPPChannels = 10
+
+var (
+	useLPPCheckbox  widget.Bool
+	addLPPChannel   widget.Clickable
+	lppChannelEdits []lppChannelWidgets
+)
+
+// lppTypeHint lists the LPP types in their editor placeholder.
+var lppTypeHint = fmt.Sprintf("<%s>", strings.Join(lds.LPPTypeNames(), "/"))
+
+func createLPPForm() {
+	lppChannelEdits = make([]lppChannelWidgets, MaxLPPChannels)
+}
+
+func lppResetGuiValues() {
+	useLPPCheckbox.Value = config.RawPayload.UseLPP
+	for i := 0; i < len(config.LPP) && i < MaxLPPChannels; i++ {
+		lppChannelEdits[i].Channel.SetText(strconv.Itoa(config.LPP[i].Channel))
+		lppChannelEdits[i].Type.SetText(config.LPP[i].Type)
+		lppChannelEdits[i].Values.SetText(formatFloats(config.LPP[i].Values))
+		lppChannelEdits[i].UsePosition.Value = config.LPP[i].UsePosition
+	}
+}
+
+// lppWidgets reads the LPP widgets into config and returns them for the data tab.
+func lppWidgets(th *material.Theme) []l.FlexChild {
+	config.RawPayload.UseLPP = useLPPCheckbox.Value
+	for i := 0; i < len(config.LPP); i++ {
+		extractInt(&lppChannelEdits[i].Channel, &config.LPP[i].Channel, 0)
+		config.LPP[i].Type = lppChannelEdits[i].Type.Text()
+		config.LPP[i].Values = parseFloats(lppChannelEdits[i].Values.Text())
+		config.LPP[i].UsePosition = lppChannelEdits[i].UsePosition.Value
+	}
+
+	for addLPPChannel.Clicked() {
+		if len(config.LPP) >= MaxLPPChannels {
+			log.Warnf("at most %d LPP channels may be sent", MaxLPPChannels)
+			continue
+		}
+		ch := &conf.LPPChannel{
+			Channel: len(config.LPP) + 1,
+			Type:    "temperature",
+			Values:  []float64{0},
+		}
+		config.LPP = append(config.LPP, ch)
+		lppChannelEdits[len(config.LPP)-1] = lppChannelWidgets{}
+		lppChannelEdits[len(config.LPP)-1].Channel.SetText(strconv.Itoa(ch.Channel))
+		lppChannelEdits[len(config.LPP)-1].Type.SetText(ch.Type)
+		lppChannelEdits[len(config.LPP)-1].Values.SetText(formatFloats(ch.Values))
+	}
+
+	for i := 0; i < len(config.LPP); i++ {
+		for lppChannelEdits[i].DeleteButton.Clicked() {
+			config.LPP = append(config.LPP[:i], config.LPP[i+1:]...)
+			lppResetGuiValues()
+		}
+	}
+
+	widgets := []l.FlexChild{
+		xmat.RigidSection(th, "Cayenne LPP"),
+		l.Rigid(func(gtx l.Context) l.Dimensions {
+			return l.Flex{Axis: l.Horizontal}.Layout(gtx,
+				xmat.RigidCheckBox(th, "Use Cayenne LPP", &useLPPCheckbox),
+				xmat.RigidButton(th, "Add LPP channel", &addLPPChannel),
+			)
+		}),
+	}
+
+	for i := 0; i < len(config.LPP); i++ {
+		lw := &lppChannelEdits[i]
+		widgets = append(widgets,
+			xmat.RigidSeparator(th, &giox.Separator{}),
+			l.Rigid(func(gtx l.Context) l.Dimensions {
+				return l.Flex{Axis: l.Horizontal}.Layout(gtx,
+					xmat.RigidEditor(th, "Channel", "<channel>", &lw.Channel),
+					xmat.RigidEditor(th, "Type", lppTypeHint, &lw.Type),
+					xmat.RigidEditor(th, "Values", "<v1, v2, v3>", &lw.Values),
+					xmat.RigidCheckBox(th, "GPS from position", &lw.UsePosition),
+					xmat.RigidButton(th, "Delete", &lw.DeleteButton),
+				)
+			}),
+		)
+	}
+
+	return widgets
+}
+
+func formatFloats(values []float64) string {
+	s := make([]string, len(values))
+	for i, v := range values {
+		s[i] = strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return strings.Join(s, ", ")
+}
+
+// parseFloats reads comma separated values, taking 0 for the invalid ones.
+func parseFloats(text string) []float64 {
+	var values []float64
+	for _, field := range strings.Split(text, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			v = 0
+		}
+		values = append(values, v)
+	}
+	return values
+}
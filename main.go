@@ -304,20 +304,32 @@ func resetGuiValues() {
 	deviceResetGuiValues()
 	macResetGuiValues()
 	dataResetGuiValues()
+	lppResetGuiValues()
+	messagesResetGuiValues()
+	behaviourResetGuiValues()
 	provResetGuiValues()
+	gatewaysResetGuiValues()
+	propagationResetGuiValues()
+	mobilityResetGuiValues()
+	channelResetGuiValues()
 }
 
 var (
-	serversButton widget.Clickable
-	deviceButton  widget.Clickable
-	loraButton    widget.Clickable
-	controlButton widget.Clickable
-	dataButton    widget.Clickable
+	serversButton  widget.Clickable
+	deviceButton   widget.Clickable
+	loraButton     widget.Clickable
+	controlButton  widget.Clickable
+	dataButton     widget.Clickable
+	gatewaysButton widget.Clickable
+	framesButton   widget.Clickable
+	fleetButton    widget.Clickable
+	sessionButton  widget.Clickable
 
 	tabIndex uint
 )
 
 func mainWindow(gtx l.Context, th *material.Theme) {
+	applyHookChanges()
 	wOutputForm := outputForm(th)
 
 	wMenu, isMenuOpen := buildMenu(th)
@@ -353,6 +365,22 @@ func mainWindow(gtx l.Context, th *material.Theme) {
 		tabIndex = 4
 	}
 
+	for gatewaysButton.Clicked() {
+		tabIndex = 5
+	}
+
+	for framesButton.Clicked() {
+		tabIndex = 6
+	}
+
+	for fleetButton.Clicked() {
+		tabIndex = 7
+	}
+
+	for sessionButton.Clicked() {
+		tabIndex = 8
+	}
+
 	tabsWidget := l.Rigid(func(gtx l.Context) l.Dimensions {
 		p100 := gtx.Px(unit.Dp(100))
 		p500 := gtx.Px(unit.Dp(500))
@@ -363,6 +391,10 @@ func mainWindow(gtx l.Context, th *material.Theme) {
 			xmat.RigidButton(th, "LoRa", &loraButton),
 			xmat.RigidButton(th, "Control", &controlButton),
 			xmat.RigidButton(th, "Data", &dataButton),
+			xmat.RigidButton(th, "Gateways", &gatewaysButton),
+			xmat.RigidButton(th, "Frames", &framesButton),
+			xmat.RigidButton(th, "Fleet", &fleetButton),
+			xmat.RigidButton(th, "Session", &sessionButton),
 		)
 	})
 
@@ -372,6 +404,10 @@ func mainWindow(gtx l.Context, th *material.Theme) {
 	wLoraForm := loRaForm(th)
 	wControlForm := controlForm(th)
 	wDataForm := dataForm(th)
+	wGatewaysForm := gatewaysForm(th)
+	wFramesForm := framesForm(th)
+	wFleetForm := fleetForm(th)
+	wSessionForm := sessionForm(th)
 
 	var selectedWidget l.FlexChild
 	switch tabIndex {
@@ -391,6 +427,22 @@ func mainWindow(gtx l.Context, th *material.Theme) {
 		selectedWidget = wControlForm
 	case 4:
 		selectedWidget = wDataForm
+	case 5:
+		selectedWidget = wGatewaysForm
+	case 6:
+		selectedWidget = wFramesForm
+	case 7:
+		selectedWidget = wFleetForm
+	case 8:
+		selectedWidget = wSessionForm
+	}
+
+	//Open devices tabs are shown above the forms.
+	if wDeviceTabs, ok := deviceTabs(th); ok && tabIndex != 0 && tabIndex != 7 {
+		wSelected := selectedWidget
+		selectedWidget = l.Rigid(func(gtx l.Context) l.Dimensions {
+			return l.Flex{Axis: l.Vertical}.Layout(gtx, wDeviceTabs, wSelected)
+		})
 	}
 
 	l.NW.Layout(gtx, func(gtx l.Context) l.Dimensions {
@@ -438,16 +490,27 @@ func main() {
 	createLoRaForm()
 	createDeviceForm()
 	createDataForm()
+	createLPPForm()
+	createMessagesForm()
+	createGatewaysForm()
+	createPropagationForm()
+	createMobilityForm()
 	createOutputForm()
+	createFleetForm()
 	tabIndex = 0
 
 	importConf()
 	resetGuiValues()
 	setDevice()
+	config.ServePrometheus()
+	if err := config.StartCapture(); err != nil {
+		log.Errorln(err)
+	}
 
 	go func() {
 		defer os.Exit(0)
 		w := app.NewWindow(app.Size(unit.Dp(1024), unit.Dp(768)))
+		window = w
 		if err := loop(w); err != nil {
 			log.Fatal(err)
 		}
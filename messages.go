@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	l "gioui.org/layout"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+	"github.com/iegomez/lds/conf"
+	"github.com/iegomez/lds/lds"
+	"github.com/scartill/giox"
+	xmat "github.com/scartill/giox/material"
+	log "github.com/sirupsen/logrus"
+)
+
+type messageWidgets struct {
+	Name         widget.Editor
+	FPort        widget.Editor
+	Confirmed    widget.Bool
+	Payload      widget.Editor
+	Source       widget.Editor
+	Schedule     widget.Editor
+	Interval     widget.Editor
+	Jitter       widget.Editor
+	Cron         widget.Editor
+	DeleteButton widget.Clickable
+}
+
+// MaxMessages defines max number of messages in the mix
+const MaxMessages = 10
+
+var (
+	addMessageButton widget.Clickable
+	messageEdits     []messageWidgets
+)
+
+func createMessagesForm() {
+	messageEdits = make([]messageWidgets, MaxMessages)
+}
+
+func messagesResetGuiValues() {
+	//There are only MaxMessages editors, so loaded messages beyond them are dropped.
+	if len(config.Messages) > MaxMessages {
+		log.Warnf("at most %d messages may be set, ignoring the rest", MaxMessages)
+		config.Messages = config.Messages[:MaxMessages]
+	}
+	for i := 0; i < len(config.Messages); i++ {
+		m := config.Messages[i]
+		messageEdits[i].Name.SetText(m.Name)
+		messageEdits[i].FPort.SetText(strconv.Itoa(m.FPort))
+		messageEdits[i].Confirmed.Value = m.Confirmed
+		messageEdits[i].Payload.SetText(m.Payload)
+		messageEdits[i].Source.SetText(m.Source)
+		messageEdits[i].Schedule.SetText(m.Schedule)
+		messageEdits[i].Interval.SetText(strconv.FormatFloat(m.Interval, 'f', -1, 64))
+		messageEdits[i].Jitter.SetText(strconv.FormatFloat(m.Jitter, 'f', -1, 64))
+		messageEdits[i].Cron.SetText(m.Cron)
+	}
+}
+
+// messagesWidgets reads the message mix widgets into config and returns them for the data tab.
+func messagesWidgets(th *material.Theme) []l.FlexChild {
+	for i := 0; i < len(config.Messages); i++ {
+		m := config.Messages[i]
+		m.Name = messageEdits[i].Name.Text()
+		extractInt(&messageEdits[i].FPort, &m.FPort, 1)
+		m.Confirmed = messageEdits[i].Confirmed.Value
+		m.Payload = messageEdits[i].Payload.Text()
+		m.Source = messageEdits[i].Source.Text()
+		m.Schedule = messageEdits[i].Schedule.Text()
+		extractFloat(&messageEdits[i].Interval, &m.Interval, 0)
+		extractFloat(&messageEdits[i].Jitter, &m.Jitter, 0)
+		m.Cron = messageEdits[i].Cron.Text()
+	}
+
+	for addMessageButton.Clicked() {
+		if len(config.Messages) >= MaxMessages {
+			log.Warnf("at most %d messages may be set", MaxMessages)
+			continue
+		}
+		config.Messages = append(config.Messages, &conf.Message{
+			Name:     fmt.Sprintf("message %d", len(config.Messages)+1),
+			FPort:    config.RawPayload.FPort,
+			Schedule: conf.IntervalSchedule,
+			Interval: float64(interval),
+		})
+		messagesResetGuiValues()
+	}
+
+	for i := 0; i < len(config.Messages); i++ {
+		for messageEdits[i].DeleteButton.Clicked() {
+			config.Messages = append(config.Messages[:i], config.Messages[i+1:]...)
+			messagesResetGuiValues()
+		}
+	}
+
+	widgets := []l.FlexChild{
+		xmat.RigidSection(th, "Message mix"),
+		xmat.RigidLabel(th, `When messages are set, "Send every X seconds" sends them on their own schedules.`),
+		xmat.RigidButton(th, "Add message", &addMessageButton),
+	}
+
+	for i := 0; i < len(config.Messages); i++ {
+		mw := &messageEdits[i]
+		widgets = append(widgets,
+			xmat.RigidSeparator(th, &giox.Separator{}),
+			l.Rigid(func(gtx l.Context) l.Dimensions {
+				return l.Flex{Axis: l.Horizontal}.Layout(gtx,
+					xmat.RigidEditor(th, "Name", "<name>", &mw.Name),
+					xmat.RigidEditor(th, "fPort", "<fport>", &mw.FPort),
+					xmat.RigidCheckBox(th, "Confirmed", &mw.Confirmed),
+					xmat.RigidEditor(th, "Payload", "<hex>", &mw.Payload),
+					xmat.RigidEditor(th, "Source", "<encoder/lpp/encoded_type>", &mw.Source),
+					xmat.RigidButton(th, "Delete", &mw.DeleteButton),
+				)
+			}),
+			l.Rigid(func(gtx l.Context) l.Dimensions {
+				return l.Flex{Axis: l.Horizontal}.Layout(gtx,
+					xmat.RigidEditor(th, "Schedule", "<interval/poisson/cron>", &mw.Schedule),
+					xmat.RigidEditor(th, "Interval (s)", "0", &mw.Interval),
+					xmat.RigidEditor(th, "Jitter (s)", "0", &mw.Jitter),
+					xmat.RigidEditor(th, "Cron", "<m h dom mon dow>", &mw.Cron),
+				)
+			}),
+		)
+	}
+
+	return widgets
+}
+
+// runMessages sends the message mix on its schedules until stopped.
+func runMessages() {
+	defer func() {
+		stop = false
+		running = false
+	}()
+
+	//The scheduler indexes the messages it was built with, which may be deleted meanwhile.
+	messages := append([]*conf.Message(nil), config.Messages...)
+	scheduler, err := config.Scheduler(time.Now())
+	if err != nil {
+		log.Errorln(err)
+		return
+	}
+
+	for {
+		i, at := scheduler.Next()
+		if i < 0 {
+			log.Infoln("no more messages scheduled")
+			return
+		}
+		for wait := time.Until(at); wait > 0; wait = time.Until(at) {
+			if stop || !running {
+				return
+			}
+			if wait > 500*time.Millisecond {
+				wait = 500 * time.Millisecond
+			}
+			time.Sleep(wait)
+		}
+		if stop || !running {
+			return
+		}
+		sendMessage(messages[i])
+		lds.DefaultTelemetry.SetSchedulerBacklog(scheduler.Backlog(time.Now()))
+	}
+}
+
+// sendMessage sends an uplink of the message mix.
+func sendMessage(m *conf.Message) {
+	uplinkMu.Lock()
+	defer uplinkMu.Unlock()
+	cDevice.Move(time.Now())
+	payload, err := config.MessagePayload(m, cDevice)
+	if err != nil {
+		log.Errorln(err)
+		return
+	}
+
+	urx, utx := config.UplinkInfo()
+	ulfc, err := cDevice.UplinkGateways(simGateways(), m.MType(), uint8(m.FPort), urx, utx, payload, config.Band.Name, config.DataRate(), selectedMACCommands(), fCtrl)
+	if err != nil {
+		log.Errorf("couldn't send message %s: %s", m.Name, err)
+	} else {
+		log.Infof("message %s sent, uplink framecounter is now %d", m.Name, ulfc)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	l "gioui.org/layout"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+	"github.com/iegomez/lds/conf"
+	"github.com/iegomez/lds/lds"
+	"github.com/scartill/giox"
+	xmat "github.com/scartill/giox/material"
+	log "github.com/sirupsen/logrus"
+)
+
+// appliedMobility is the configuration of the device's current movement model.
+var appliedMobility conf.Mobility
+
+var (
+	mobilityModelCombo giox.Combo
+	trackFileEdit      widget.Editor
+	trackLoopCheckbox  widget.Bool
+	speedEdit          widget.Editor
+	bearingEdit        widget.Editor
+	climbRateEdit      widget.Editor
+	radiusEdit         widget.Editor
+	minSpeedEdit       widget.Editor
+	maxSpeedEdit       widget.Editor
+	pauseEdit          widget.Editor
+)
+
+func createMobilityForm() {
+	mobilityModelCombo = giox.MakeCombo([]string{conf.FixedModel, conf.TrackModel, conf.ConstantVelocityModel, conf.RandomWaypointModel}, "<select mobility>")
+}
+
+func mobilityResetGuiValues() {
+	m := &config.Mobility
+	if m.Model == "" {
+		mobilityModelCombo.SelectItem(conf.FixedModel)
+	} else {
+		mobilityModelCombo.SelectItem(m.Model)
+	}
+	trackFileEdit.SetText(m.TrackFile)
+	trackLoopCheckbox.Value = m.Loop
+	speedEdit.SetText(strconv.FormatFloat(m.Speed, 'f', -1, 64))
+	bearingEdit.SetText(strconv.FormatFloat(m.Bearing, 'f', -1, 64))
+	climbRateEdit.SetText(strconv.FormatFloat(m.ClimbRate, 'f', -1, 64))
+	radiusEdit.SetText(strconv.FormatFloat(m.Radius, 'f', -1, 64))
+	minSpeedEdit.SetText(strconv.FormatFloat(m.MinSpeed, 'f', -1, 64))
+	maxSpeedEdit.SetText(strconv.FormatFloat(m.MaxSpeed, 'f', -1, 64))
+	pauseEdit.SetText(strconv.Itoa(m.Pause))
+}
+
+// mobilityWidgets reads the mobility editors into config and returns them for the gateways tab.
+func mobilityWidgets(th *material.Theme) []l.FlexChild {
+	m := &config.Mobility
+	m.Model = ""
+	if mobilityModelCombo.HasSelected() && mobilityModelCombo.SelectedText() != conf.FixedModel {
+		m.Model = mobilityModelCombo.SelectedText()
+	}
+	m.TrackFile = trackFileEdit.Text()
+	m.Loop = trackLoopCheckbox.Value
+	extractFloat(&speedEdit, &m.Speed, 0)
+	extractFloat(&bearingEdit, &m.Bearing, 0)
+	extractFloat(&climbRateEdit, &m.ClimbRate, 0)
+	extractFloat(&radiusEdit, &m.Radius, 0)
+	extractFloat(&minSpeedEdit, &m.MinSpeed, 0)
+	extractFloat(&maxSpeedEdit, &m.MaxSpeed, 0)
+	extractInt(&pauseEdit, &m.Pause, 0)
+
+	widgets := []l.FlexChild{
+		labelCombo(th, "Mobility", &mobilityModelCombo),
+	}
+	if mobilityModelCombo.IsExpanded() {
+		return widgets
+	}
+
+	switch m.Model {
+	case conf.TrackModel:
+		widgets = append(widgets, l.Rigid(func(gtx l.Context) l.Dimensions {
+			return l.Flex{Axis: l.Horizontal}.Layout(gtx,
+				xmat.RigidEditor(th, "Track file", "<path to .gpx or .csv>", &trackFileEdit),
+				xmat.RigidEditor(th, "Speed (m/s)", "0", &speedEdit),
+				xmat.RigidCheckBox(th, "Loop", &trackLoopCheckbox),
+			)
+		}))
+	case conf.ConstantVelocityModel:
+		widgets = append(widgets, l.Rigid(func(gtx l.Context) l.Dimensions {
+			return l.Flex{Axis: l.Horizontal}.Layout(gtx,
+				xmat.RigidEditor(th, "Speed (m/s)", "0", &speedEdit),
+				xmat.RigidEditor(th, "Bearing (°)", "0", &bearingEdit),
+				xmat.RigidEditor(th, "Climb (m/s)", "0", &climbRateEdit),
+			)
+		}))
+	case conf.RandomWaypointModel:
+		widgets = append(widgets, l.Rigid(func(gtx l.Context) l.Dimensions {
+			return l.Flex{Axis: l.Horizontal}.Layout(gtx,
+				xmat.RigidEditor(th, "Radius (m)", "0", &radiusEdit),
+				xmat.RigidEditor(th, "Min speed (m/s)", "0", &minSpeedEdit),
+				xmat.RigidEditor(th, "Max speed (m/s)", "0", &maxSpeedEdit),
+				xmat.RigidEditor(th, "Pause (s)", "0", &pauseEdit),
+			)
+		}))
+	}
+
+	if m.Model != "" && cDevice != nil && cDevice.Position != nil {
+		pos := cDevice.Position
+		widgets = append(widgets, xmat.RigidLabel(th, fmt.Sprintf("Current position: %.6f, %.6f, %.1f m", pos.Latitude, pos.Longitude, pos.Altitude)))
+	}
+
+	return widgets
+}
+
+// setMobility replaces the device movement model when its configuration changed.
+func setMobility() {
+	if config.Mobility == appliedMobility && (cDevice.Mobility != nil || config.Mobility.Model == "") {
+		return
+	}
+
+	model, err := config.Mobility.Build(lds.Position{
+		Latitude:  config.Device.Latitude,
+		Longitude: config.Device.Longitude,
+		Altitude:  config.Device.Altitude,
+	})
+	if err != nil {
+		log.Errorf("mobility error: %s", err)
+		return
+	}
+	cDevice.SetMobility(model)
+	appliedMobility = config.Mobility
+}
@@ -2,31 +2,33 @@ package main
 
 import (
 	"fmt"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
 	l "gioui.org/layout"
 	"gioui.org/unit"
 	"gioui.org/widget"
 	"gioui.org/widget/material"
+	"github.com/brocaar/chirpstack-api/go/gw"
 	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/iegomez/lds/conf"
+	"github.com/iegomez/lds/lds"
 	matx "github.com/scartill/giox/material"
 	log "github.com/sirupsen/logrus"
 )
 
 var mqttClient paho.Client
 
-type mqtt struct {
-	Server        string `toml:"server"`
-	User          string `toml:"user"`
-	Password      string `toml:"password"`
-	DownlinkTopic string `toml:"downlink_topic"`
-	UplinkTopic   string `toml:"uplink_topic"`
-}
+// gwMQTTClients holds the broker connections of gateways with their own client certificate, keyed by MAC.
+var gwMQTTClients = map[string]paho.Client{}
 
-type gateway struct {
-	MAC           string `toml:"mac"`
-	BridgeVersion string `toml:"bridge_version"`
-}
+// mqttStatus keeps the last connection event of every MQTT client, keyed by client name.
+var mqttStatus = struct {
+	sync.Mutex
+	events map[string]string
+}{events: map[string]string{}}
 
 var (
 	mqttServerEdit       widget.Editor
@@ -35,6 +37,20 @@ var (
 	mqttMACEdit          widget.Editor
 	mqttDownlinkEdit     widget.Editor
 	mqttUplinkEdit       widget.Editor
+	mqttStateTopicEdit   widget.Editor
+	mqttConfigTopicEdit  widget.Editor
+	mqttRegionEdit       widget.Editor
+	mqttClientIDEdit     widget.Editor
+	mqttQoSEdit          widget.Editor
+	mqttKeepAliveEdit    widget.Editor
+	mqttCleanSessionBox  widget.Bool
+	mqttCACertEdit       widget.Editor
+	mqttTLSCertEdit      widget.Editor
+	mqttTLSKeyEdit       widget.Editor
+	mqttInsecureBox      widget.Bool
+	mqttWillTopicEdit    widget.Editor
+	mqttWillPayloadEdit  widget.Editor
+	mqttWillRetainedBox  widget.Bool
 	mqttConnectButton    widget.Clickable
 	mqttDisconnectButton widget.Clickable
 )
@@ -46,6 +62,20 @@ func mqttResetGuiValue() {
 	mqttMACEdit.SetText(config.GW.MAC)
 	mqttDownlinkEdit.SetText(config.MQTT.DownlinkTopic)
 	mqttUplinkEdit.SetText(config.MQTT.UplinkTopic)
+	mqttStateTopicEdit.SetText(config.MQTT.StateTopic)
+	mqttConfigTopicEdit.SetText(config.MQTT.ConfigTopic)
+	mqttRegionEdit.SetText(config.MQTT.Region)
+	mqttClientIDEdit.SetText(config.MQTT.ClientID)
+	mqttQoSEdit.SetText(strconv.Itoa(config.MQTT.QoS))
+	mqttKeepAliveEdit.SetText(strconv.Itoa(config.MQTT.KeepAlive))
+	mqttCleanSessionBox.Value = config.MQTT.CleanSession
+	mqttCACertEdit.SetText(config.MQTT.CACert)
+	mqttTLSCertEdit.SetText(config.MQTT.TLSCert)
+	mqttTLSKeyEdit.SetText(config.MQTT.TLSKey)
+	mqttInsecureBox.Value = config.MQTT.InsecureSkipVerify
+	mqttWillTopicEdit.SetText(config.MQTT.WillTopic)
+	mqttWillPayloadEdit.SetText(config.MQTT.WillPayload)
+	mqttWillRetainedBox.Value = config.MQTT.WillRetained
 }
 
 func mqttForm(th *material.Theme) l.FlexChild {
@@ -56,13 +86,27 @@ func mqttForm(th *material.Theme) l.FlexChild {
 	config.GW.MAC = mqttMACEdit.Text()
 	config.MQTT.DownlinkTopic = mqttDownlinkEdit.Text()
 	config.MQTT.UplinkTopic = mqttUplinkEdit.Text()
+	config.MQTT.StateTopic = mqttStateTopicEdit.Text()
+	config.MQTT.ConfigTopic = mqttConfigTopicEdit.Text()
+	config.MQTT.Region = mqttRegionEdit.Text()
+	config.MQTT.ClientID = mqttClientIDEdit.Text()
+	extractInt(&mqttQoSEdit, &config.MQTT.QoS, 0)
+	extractInt(&mqttKeepAliveEdit, &config.MQTT.KeepAlive, 30)
+	config.MQTT.CleanSession = mqttCleanSessionBox.Value
+	config.MQTT.CACert = mqttCACertEdit.Text()
+	config.MQTT.TLSCert = mqttTLSCertEdit.Text()
+	config.MQTT.TLSKey = mqttTLSKeyEdit.Text()
+	config.MQTT.InsecureSkipVerify = mqttInsecureBox.Value
+	config.MQTT.WillTopic = mqttWillTopicEdit.Text()
+	config.MQTT.WillPayload = mqttWillPayloadEdit.Text()
+	config.MQTT.WillRetained = mqttWillRetainedBox.Value
 
 	for mqttConnectButton.Clicked() {
 		connectClient()
 	}
 
 	for mqttDisconnectButton.Clicked() {
-		mqttClient.Disconnect(200)
+		disconnectClients()
 	}
 
 	widgets := []l.FlexChild{
@@ -71,8 +115,35 @@ func mqttForm(th *material.Theme) l.FlexChild {
 		matx.RigidEditor(th, "MQTT User:", "<username>", &mqttUserEdit),
 		matx.RigidEditor(th, "MQTT Password:", "<password>", &mqttPasswordEdit),
 		matx.RigidEditor(th, "Gateway MAC:", "DEADBEEFDEADBEEF", &mqttMACEdit),
-		matx.RigidEditor(th, "Downlink Topic:", "gateway/%s/command/down", &mqttDownlinkEdit),
-		matx.RigidEditor(th, "Uplink Topic:", "gateway/%s/event/up", &mqttUplinkEdit)}
+		matx.RigidEditor(th, "Downlink Topic:", "{region}/gateway/{id}/command/{type}", &mqttDownlinkEdit),
+		matx.RigidEditor(th, "Uplink Topic:", "{region}/gateway/{id}/event/{type}", &mqttUplinkEdit),
+		matx.RigidEditor(th, "State Topic:", "{region}/gateway/{id}/state/{type}", &mqttStateTopicEdit),
+		matx.RigidEditor(th, "Config Topic:", "{region}/gateway/{id}/command/{type}", &mqttConfigTopicEdit),
+		matx.RigidEditor(th, "Region:", "eu868", &mqttRegionEdit),
+		l.Rigid(func(gtx l.Context) l.Dimensions {
+			return l.Flex{Axis: l.Horizontal}.Layout(gtx,
+				matx.RigidEditor(th, "Client ID:", "<random>", &mqttClientIDEdit),
+				matx.RigidEditor(th, "QoS:", "0", &mqttQoSEdit),
+				matx.RigidEditor(th, "Keepalive (s):", "30", &mqttKeepAliveEdit),
+				matx.RigidCheckBox(th, "Clean session", &mqttCleanSessionBox),
+			)
+		}),
+		matx.RigidEditor(th, "CA cert:", "<path to CA PEM>", &mqttCACertEdit),
+		l.Rigid(func(gtx l.Context) l.Dimensions {
+			return l.Flex{Axis: l.Horizontal}.Layout(gtx,
+				matx.RigidEditor(th, "Client cert:", "<path to PEM>", &mqttTLSCertEdit),
+				matx.RigidEditor(th, "Client key:", "<path to PEM>", &mqttTLSKeyEdit),
+				matx.RigidCheckBox(th, "Skip verify", &mqttInsecureBox),
+			)
+		}),
+		l.Rigid(func(gtx l.Context) l.Dimensions {
+			return l.Flex{Axis: l.Horizontal}.Layout(gtx,
+				matx.RigidEditor(th, "Will topic:", "<none>", &mqttWillTopicEdit),
+				matx.RigidEditor(th, "Will payload:", "", &mqttWillPayloadEdit),
+				matx.RigidCheckBox(th, "Retained", &mqttWillRetainedBox),
+			)
+		}),
+	}
 
 	if !cNSClient.IsConnected() {
 		widgets = append(widgets, matx.RigidButton(th, "Connect", &mqttConnectButton))
@@ -84,6 +155,17 @@ func mqttForm(th *material.Theme) l.FlexChild {
 		widgets = append(widgets, matx.RigidButton(th, "Disconnect", &mqttDisconnectButton))
 	}
 
+	mqttStatus.Lock()
+	names := make([]string, 0, len(mqttStatus.events))
+	for name := range mqttStatus.events {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		widgets = append(widgets, matx.RigidLabel(th, fmt.Sprintf("%s: %s", name, mqttStatus.events[name])))
+	}
+	mqttStatus.Unlock()
+
 	inset := l.Inset{Left: unit.Dp(30)}
 	return l.Rigid(func(gtx l.Context) l.Dimensions {
 		return inset.Layout(gtx, func(gtx l.Context) l.Dimensions {
@@ -92,24 +174,96 @@ func mqttForm(th *material.Theme) l.FlexChild {
 	})
 }
 
-func connectClient() error {
-	//Connect to the broker
-	opts := paho.NewClientOptions()
-	opts.AddBroker(config.MQTT.Server)
-	opts.SetUsername(config.MQTT.User)
-	opts.SetPassword(config.MQTT.Password)
-	opts.SetAutoReconnect(true)
-	opts.SetClientID(fmt.Sprintf("lds-%d", time.Now().UnixNano()))
-
-	mqttClient = paho.NewClient(opts)
-	log.Infoln("MQTT connecting...")
-	if token := mqttClient.Connect(); token.Wait() && token.Error() != nil {
-		log.Errorf("connection error: %s", token.Error())
-		return token.Error()
+// setMQTTStatus records and logs a connection event of the named client.
+func setMQTTStatus(name, event string) {
+	mqttStatus.Lock()
+	mqttStatus.events[name] = fmt.Sprintf("%s (%s)", event, time.Now().Format("15:04:05"))
+	mqttStatus.Unlock()
+	lds.DefaultTelemetry.SetConnected("mqtt", name, event == "connected")
+	log.Infof("MQTT %s: %s", name, event)
+}
+
+// onGatewayConfiguration handles a configuration command received by a gateway.
+func onGatewayConfiguration(mac string, gwConf *gw.GatewayConfiguration) {
+	log.Infof("gateway %s: received configuration version %q with %d channels", mac, gwConf.GetVersion(), len(gwConf.GetChannels()))
+	channelPlan(mac).Apply(gwConf)
+}
+
+// newMQTTClient connects a client that subscribes to the commands of the given gateways and
+// publishes them online on every (re)connection.
+func newMQTTClient(name string, o *lds.MQTTOptions, gateways []*conf.Gateway) (paho.Client, error) {
+	opts, err := o.ClientOptions()
+	if err != nil {
+		return nil, err
 	}
-	log.Infoln("connection established")
-	mqttClient.Subscribe(fmt.Sprintf(config.MQTT.DownlinkTopic, config.GW.MAC), 1, func(c paho.Client, msg paho.Message) {
-		onIncomingDownlink(msg.Payload())
+
+	opts.SetOnConnectHandler(func(c paho.Client) {
+		setMQTTStatus(name, "connected")
+		for _, g := range gateways {
+			config.Subscribe(c, g, onIncomingDownlink, onGatewayConfiguration)
+		}
+		config.PublishConnState(c, gateways, true)
+	})
+	opts.SetConnectionLostHandler(func(c paho.Client, err error) {
+		setMQTTStatus(name, fmt.Sprintf("connection lost: %s, reconnecting", err))
 	})
+
+	client := paho.NewClient(opts)
+	setMQTTStatus(name, "connecting")
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		setMQTTStatus(name, fmt.Sprintf("connection error: %s", token.Error()))
+		return nil, token.Error()
+	}
+	return client, nil
+}
+
+func connectClient() error {
+	resetChannelPlans()
+
+	opts, err := config.MainMQTTOptions()
+	if err != nil {
+		log.Errorf("connection error: %s", err)
+		return err
+	}
+	client, err := newMQTTClient("broker", opts, config.SharedGateways())
+	if err != nil {
+		log.Errorf("connection error: %s", err)
+		return err
+	}
+	mqttClient = client
+
+	//Gateways with their own certificate get their own connection.
+	for _, g := range config.Gateways {
+		if g.TLSCert == "" {
+			continue
+		}
+		if _, ok := gwMQTTClients[g.MAC]; ok {
+			continue
+		}
+		opts, err := config.GatewayMQTTOptions(g)
+		if err == nil {
+			gwMQTTClients[g.MAC], err = newMQTTClient(fmt.Sprintf("gateway %s", g.MAC), opts, []*conf.Gateway{g})
+		}
+		if err != nil {
+			delete(gwMQTTClients, g.MAC)
+			log.Errorf("gateway %s: connection error: %s", g.MAC, err)
+		}
+	}
+
 	return nil
 }
+
+// disconnectClients publishes the gateways offline and closes the main and per-gateway MQTT connections.
+func disconnectClients() {
+	if mqttClient != nil {
+		config.PublishConnState(mqttClient, config.SharedGateways(), false)
+		mqttClient.Disconnect(200)
+		setMQTTStatus("broker", "disconnected")
+	}
+	for mac, client := range gwMQTTClients {
+		config.PublishConnState(client, []*conf.Gateway{{MAC: mac}}, false)
+		client.Disconnect(200)
+		setMQTTStatus(fmt.Sprintf("gateway %s", mac), "disconnected")
+		delete(gwMQTTClients, mac)
+	}
+}
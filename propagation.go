@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strconv"
+
+	l "gioui.org/layout"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+	"github.com/iegomez/lds/conf"
+	"github.com/iegomez/lds/lds"
+	"github.com/scartill/giox"
+	xmat "github.com/scartill/giox/material"
+)
+
+var (
+	propagationModelCombo giox.Combo
+	hataEnvironmentCombo  giox.Combo
+	txPowerEdit           widget.Editor
+	txAntennaGainEdit     widget.Editor
+	shadowFadingEdit      widget.Editor
+	noiseFigureEdit       widget.Editor
+	pathLossExponentEdit  widget.Editor
+	referenceDistanceEdit widget.Editor
+	referenceLossEdit     widget.Editor
+	baseHeightEdit        widget.Editor
+	mobileHeightEdit      widget.Editor
+)
+
+func createPropagationForm() {
+	propagationModelCombo = giox.MakeCombo([]string{conf.NoModel, conf.FreeSpaceModel, conf.LogDistanceModel, conf.OkumuraHataModel}, "<select model>")
+	hataEnvironmentCombo = giox.MakeCombo([]string{lds.HataUrban, lds.HataSuburban, lds.HataOpen}, "<select environment>")
+}
+
+func propagationResetGuiValues() {
+	p := &config.Propagation
+	if p.Model == "" {
+		propagationModelCombo.SelectItem(conf.NoModel)
+	} else {
+		propagationModelCombo.SelectItem(p.Model)
+	}
+	hataEnvironmentCombo.SelectItem(p.Environment)
+	txPowerEdit.SetText(strconv.FormatFloat(p.TXPower, 'f', -1, 64))
+	txAntennaGainEdit.SetText(strconv.FormatFloat(p.TXAntennaGain, 'f', -1, 64))
+	shadowFadingEdit.SetText(strconv.FormatFloat(p.ShadowFading, 'f', -1, 64))
+	noiseFigureEdit.SetText(strconv.FormatFloat(p.NoiseFigure, 'f', -1, 64))
+	pathLossExponentEdit.SetText(strconv.FormatFloat(p.PathLossExponent, 'f', -1, 64))
+	referenceDistanceEdit.SetText(strconv.FormatFloat(p.ReferenceDistance, 'f', -1, 64))
+	referenceLossEdit.SetText(strconv.FormatFloat(p.ReferenceLoss, 'f', -1, 64))
+	baseHeightEdit.SetText(strconv.FormatFloat(p.BaseHeight, 'f', -1, 64))
+	mobileHeightEdit.SetText(strconv.FormatFloat(p.MobileHeight, 'f', -1, 64))
+}
+
+// propagationWidgets reads the propagation editors into config and returns them for the gateways tab.
+func propagationWidgets(th *material.Theme) []l.FlexChild {
+	p := &config.Propagation
+	p.Model = ""
+	if propagationModelCombo.HasSelected() && propagationModelCombo.SelectedText() != conf.NoModel {
+		p.Model = propagationModelCombo.SelectedText()
+	}
+	if hataEnvironmentCombo.HasSelected() {
+		p.Environment = hataEnvironmentCombo.SelectedText()
+	}
+	extractFloat(&txPowerEdit, &p.TXPower, 14)
+	extractFloat(&txAntennaGainEdit, &p.TXAntennaGain, 0)
+	extractFloat(&shadowFadingEdit, &p.ShadowFading, 0)
+	extractFloat(&noiseFigureEdit, &p.NoiseFigure, 6)
+	extractFloat(&pathLossExponentEdit, &p.PathLossExponent, 2.7)
+	extractFloat(&referenceDistanceEdit, &p.ReferenceDistance, 1)
+	extractFloat(&referenceLossEdit, &p.ReferenceLoss, 0)
+	extractFloat(&baseHeightEdit, &p.BaseHeight, 30)
+	extractFloat(&mobileHeightEdit, &p.MobileHeight, 1.5)
+
+	widgets := []l.FlexChild{
+		xmat.RigidLabel(th, "Radio propagation (overrides RSSI/SNR and drops frames below the SF demodulation floor)"),
+	}
+
+	if hataEnvironmentCombo.IsExpanded() {
+		return append(widgets, labelCombo(th, "Environment", &hataEnvironmentCombo))
+	}
+
+	widgets = append(widgets, labelCombo(th, "Path loss model", &propagationModelCombo))
+	if propagationModelCombo.IsExpanded() {
+		return widgets
+	}
+
+	widgets = append(widgets, l.Rigid(func(gtx l.Context) l.Dimensions {
+		return l.Flex{Axis: l.Horizontal}.Layout(gtx,
+			xmat.RigidEditor(th, "TX power (dBm)", "14", &txPowerEdit),
+			xmat.RigidEditor(th, "TX gain (dBi)", "0", &txAntennaGainEdit),
+			xmat.RigidEditor(th, "Shadowing σ (dB)", "0", &shadowFadingEdit),
+			xmat.RigidEditor(th, "Noise figure (dB)", "6", &noiseFigureEdit),
+		)
+	}))
+
+	switch p.Model {
+	case conf.LogDistanceModel:
+		widgets = append(widgets, l.Rigid(func(gtx l.Context) l.Dimensions {
+			return l.Flex{Axis: l.Horizontal}.Layout(gtx,
+				xmat.RigidEditor(th, "Exponent", "2.7", &pathLossExponentEdit),
+				xmat.RigidEditor(th, "Ref. distance (m)", "1", &referenceDistanceEdit),
+				xmat.RigidEditor(th, "Ref. loss (dB)", "0", &referenceLossEdit),
+			)
+		}))
+	case conf.OkumuraHataModel:
+		widgets = append(widgets,
+			l.Rigid(func(gtx l.Context) l.Dimensions {
+				return l.Flex{Axis: l.Horizontal}.Layout(gtx,
+					xmat.RigidEditor(th, "Gateway height (m)", "30", &baseHeightEdit),
+					xmat.RigidEditor(th, "Device height (m)", "1.5", &mobileHeightEdit),
+				)
+			}),
+			labelCombo(th, "Environment", &hataEnvironmentCombo),
+		)
+	}
+
+	return widgets
+}
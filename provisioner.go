@@ -9,15 +9,6 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-type provisioner struct {
-	Hostname string `toml:"hostname"`
-	Username string `toml:"username"`
-	Password string `toml:"password"`
-	Path     string `toml:"path"`
-	Token    string
-	Devices  []*lsp.Device
-}
-
 var openProvisioner bool
 
 // Widgets
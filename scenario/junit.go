@@ -0,0 +1,94 @@
+package scenario
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"time"
+)
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Skipped  int             `xml:"skipped,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *struct{}     `xml:"skipped,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// Report is the results of a scenario run.
+type Report struct {
+	Scenario *Scenario
+	Results  []Result
+}
+
+// Passed tells whether every step passed.
+func (r Report) Passed() bool {
+	for _, result := range r.Results {
+		if !result.Passed {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteJUnit writes the reports as a JUnit XML file, one test suite per scenario and one test case per step.
+func WriteJUnit(w io.Writer, reports []Report) error {
+	suites := junitTestSuites{}
+	for _, report := range reports {
+		suite := junitTestSuite{Name: report.Scenario.Name, Tests: len(report.Results)}
+		var total time.Duration
+		for i, result := range report.Results {
+			tc := junitTestCase{
+				Name:      fmt.Sprintf("%02d %s", i+1, result.Step.Name),
+				ClassName: report.Scenario.Name,
+				Time:      seconds(result.Duration),
+			}
+			switch {
+			case result.Skipped:
+				tc.Skipped = &struct{}{}
+				suite.Skipped++
+			case !result.Passed:
+				tc.Failure = &junitFailure{Message: result.Err.Error(), Text: result.Err.Error()}
+				suite.Failures++
+			}
+			total += result.Duration
+			suite.Cases = append(suite.Cases, tc)
+		}
+		suite.Time = seconds(total)
+		suites.Suites = append(suites.Suites, suite)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suites); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
@@ -0,0 +1,238 @@
+package scenario
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iegomez/lds/lds"
+)
+
+// Uplink is an uplink requested by a step. A nil Payload asks for the configured payload and
+// a nil FPort for the configured port.
+type Uplink struct {
+	FPort     *int
+	Payload   []byte
+	Confirmed bool
+	ADR       bool
+}
+
+// Driver executes steps on a simulated device. It must pass the device downlinks and
+// join-accepts to the runner with Downlink and JoinAccepted.
+type Driver interface {
+	Join() error
+	Uplink(u Uplink) error
+	SetDataRate(spreadFactor, bandwidth int)
+	Reset() error
+}
+
+// Result is the outcome of a step. Skipped steps weren't run because a previous one failed.
+type Result struct {
+	Step     *Step
+	Passed   bool
+	Skipped  bool
+	Err      error
+	Duration time.Duration
+}
+
+// Runner runs scenarios on a driver, collecting the downlinks and join-accepts expected by steps.
+type Runner struct {
+	driver    Driver
+	downlinks chan *lds.Downlink
+	joins     chan struct{}
+}
+
+// NewRunner returns a runner for the given driver.
+func NewRunner(driver Driver) *Runner {
+	return &Runner{
+		driver:    driver,
+		downlinks: make(chan *lds.Downlink, 100),
+		joins:     make(chan struct{}, 1),
+	}
+}
+
+// Downlink passes a downlink received by the device to the runner.
+func (r *Runner) Downlink(dl *lds.Downlink) {
+	select {
+	case r.downlinks <- dl:
+	default:
+		log.Warnln("scenario: too many downlinks pending, dropping one")
+	}
+}
+
+// JoinAccepted tells the runner the device processed a join-accept.
+func (r *Runner) JoinAccepted() {
+	select {
+	case r.joins <- struct{}{}:
+	default:
+	}
+}
+
+// Run runs the scenario steps in order. Once a step fails the remaining ones are skipped.
+// Downlinks and join-accepts left over by previous scenarios are discarded.
+func (r *Runner) Run(s *Scenario) []Result {
+	r.drain()
+
+	results := make([]Result, 0, len(s.Steps))
+	failed := false
+	for i, step := range s.Steps {
+		if failed {
+			results = append(results, Result{Step: step, Skipped: true})
+			continue
+		}
+
+		start := time.Now()
+		err := r.run(step)
+		result := Result{Step: step, Passed: err == nil, Err: err, Duration: time.Since(start)}
+		results = append(results, result)
+
+		if err != nil {
+			failed = true
+			log.Errorf("scenario %s: step %d (%s) failed: %s", s.Name, i+1, step.Name, err)
+		} else {
+			log.Infof("scenario %s: step %d (%s) passed", s.Name, i+1, step.Name)
+		}
+	}
+	return results
+}
+
+func (r *Runner) drain() {
+	for {
+		select {
+		case <-r.downlinks:
+		case <-r.joins:
+		default:
+			return
+		}
+	}
+}
+
+func (r *Runner) run(step *Step) error {
+	timeout := step.Timeout.Duration
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+
+	switch step.Action {
+	case ActionJoin:
+		//Forget join-accepts of previous joins.
+		select {
+		case <-r.joins:
+		default:
+		}
+		return r.driver.Join()
+	case ActionExpectJoin:
+		select {
+		case <-r.joins:
+			return nil
+		case <-time.After(timeout):
+			return errors.Errorf("no join-accept after %s", timeout)
+		}
+	case ActionUplink:
+		return r.uplink(step)
+	case ActionExpectDownlink:
+		return r.expectDownlink(step, timeout)
+	case ActionSetDR:
+		r.driver.SetDataRate(step.SpreadFactor, step.Bandwidth)
+		return nil
+	case ActionReset:
+		return r.driver.Reset()
+	case ActionWait:
+		time.Sleep(step.Duration.Duration)
+		return nil
+	}
+	return errors.Errorf("unknown action %q", step.Action)
+}
+
+func (r *Runner) uplink(step *Step) error {
+	u := Uplink{FPort: step.FPort, Confirmed: step.Confirmed, ADR: step.ADR}
+	if step.Payload != "" {
+		payload, err := hex.DecodeString(step.Payload)
+		if err != nil {
+			return errors.Wrap(err, "couldn't decode hex payload")
+		}
+		u.Payload = payload
+	}
+
+	count := step.Count
+	if count == 0 {
+		count = 1
+	}
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			time.Sleep(step.Interval.Duration)
+		}
+		if err := r.driver.Uplink(u); err != nil {
+			return errors.Wrapf(err, "uplink %d of %d", i+1, count)
+		}
+	}
+	return nil
+}
+
+// expectDownlink waits for a downlink matching the step, discarding the ones that don't.
+func (r *Runner) expectDownlink(step *Step, timeout time.Duration) error {
+	var payload []byte
+	if step.Payload != "" {
+		var err error
+		payload, err = hex.DecodeString(step.Payload)
+		if err != nil {
+			return errors.Wrap(err, "couldn't decode hex payload")
+		}
+	}
+
+	deadline := time.After(timeout)
+	var mismatch error
+	for {
+		select {
+		case dl := <-r.downlinks:
+			if mismatch = match(step, payload, dl); mismatch == nil {
+				return nil
+			}
+			log.Debugf("scenario: downlink discarded: %s", mismatch)
+		case <-deadline:
+			if mismatch != nil {
+				return errors.Errorf("no matching downlink after %s, last one: %s", timeout, mismatch)
+			}
+			return errors.Errorf("no downlink after %s", timeout)
+		}
+	}
+}
+
+func match(step *Step, payload []byte, dl *lds.Downlink) error {
+	if step.FPort != nil {
+		if dl.FPort == nil {
+			return errors.Errorf("expected FPort %d, got none", *step.FPort)
+		}
+		if int(*dl.FPort) != *step.FPort {
+			return errors.Errorf("expected FPort %d, got %d", *step.FPort, *dl.FPort)
+		}
+	}
+	if payload != nil && !bytes.Equal(payload, dl.Payload) {
+		return errors.Errorf("expected payload %x, got %x", payload, dl.Payload)
+	}
+	if step.MACCommand != "" && !dl.HasMACCommand(step.MACCommand) {
+		return errors.Errorf("expected MAC command %s, got %s", step.MACCommand, macCommands(dl))
+	}
+	if step.ACK != nil && *step.ACK != dl.ACK {
+		return errors.Errorf("expected ACK %t, got %t", *step.ACK, dl.ACK)
+	}
+	return nil
+}
+
+func macCommands(dl *lds.Downlink) string {
+	if len(dl.MACCommands) == 0 {
+		return "none"
+	}
+	s := ""
+	for i, cmd := range dl.MACCommands {
+		if i > 0 {
+			s += ", "
+		}
+		s += cmd.CID.String()
+	}
+	return fmt.Sprintf("[%s]", s)
+}
@@ -0,0 +1,122 @@
+// Package scenario runs declarative test scenarios, ordered steps such as joining, sending
+// uplinks and expecting downlinks, against a simulated device and reports their results.
+package scenario
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// Step actions.
+const (
+	ActionJoin           = "join"            //Send a join request.
+	ActionExpectJoin     = "expect_join"     //Wait for the join-accept.
+	ActionUplink         = "uplink"          //Send count uplinks.
+	ActionExpectDownlink = "expect_downlink" //Wait for a matching downlink.
+	ActionSetDR          = "set_dr"          //Change the uplink data rate.
+	ActionReset          = "reset"           //Clear the device session.
+	ActionWait           = "wait"            //Sleep for a duration.
+)
+
+// defaultTimeout bounds expectations without a timeout.
+const defaultTimeout = 10 * time.Second
+
+// Duration is a time.Duration read from strings such as "10s" or "1m30s".
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// Scenario is an ordered list of steps.
+type Scenario struct {
+	Name  string  `toml:"name" yaml:"name"`
+	Steps []*Step `toml:"step" yaml:"steps"`
+}
+
+// Step is a scenario step. Fields other than name, action and timeout apply to some actions only.
+type Step struct {
+	Name    string   `toml:"name" yaml:"name"`
+	Action  string   `toml:"action" yaml:"action"`
+	Timeout Duration `toml:"timeout" yaml:"timeout"` //expect_join and expect_downlink, 10s by default.
+
+	//uplink: payload is hex encoded, the configured one is used when empty, and fport defaults to the configured one.
+	Count     int      `toml:"count" yaml:"count"`
+	Interval  Duration `toml:"interval" yaml:"interval"`
+	FPort     *int     `toml:"fport" yaml:"fport"` //Also matched by expect_downlink.
+	Payload   string   `toml:"payload" yaml:"payload"`
+	Confirmed bool     `toml:"confirmed" yaml:"confirmed"`
+	ADR       bool     `toml:"adr" yaml:"adr"`
+
+	//expect_downlink: only the given conditions are checked.
+	MACCommand string `toml:"mac_command" yaml:"mac_command"` //Name (e.g. "LinkADRReq") or CID.
+	ACK        *bool  `toml:"ack" yaml:"ack"`
+
+	//set_dr.
+	SpreadFactor int `toml:"spread_factor" yaml:"spread_factor"`
+	Bandwidth    int `toml:"bandwidth" yaml:"bandwidth"`
+
+	//wait.
+	Duration Duration `toml:"duration" yaml:"duration"`
+}
+
+// Load reads a scenario file, YAML when its extension is .yaml or .yml and TOML otherwise.
+func Load(filename string) (*Scenario, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Scenario{}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, s)
+	default:
+		err = toml.Unmarshal(b, s)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't read scenario %s", filename)
+	}
+
+	if s.Name == "" {
+		s.Name = strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	}
+	if err := s.validate(); err != nil {
+		return nil, errors.Wrapf(err, "scenario %s", filename)
+	}
+	return s, nil
+}
+
+func (s *Scenario) validate() error {
+	for i, step := range s.Steps {
+		switch step.Action {
+		case ActionJoin, ActionExpectJoin, ActionUplink, ActionExpectDownlink, ActionReset, ActionWait:
+		case ActionSetDR:
+			if step.SpreadFactor == 0 && step.Bandwidth == 0 {
+				return errors.Errorf("step %d: set_dr needs spread_factor or bandwidth", i+1)
+			}
+		default:
+			return errors.Errorf("step %d: unknown action %q", i+1, step.Action)
+		}
+		if step.Name == "" {
+			step.Name = step.Action
+		}
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"gioui.org/app"
+	l "gioui.org/layout"
+	"gioui.org/op"
+	"gioui.org/unit"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+	"github.com/brocaar/lorawan"
+	"github.com/iegomez/lds/lds"
+	xmat "github.com/scartill/giox/material"
+)
+
+// window is redrawn when the watched device session changes.
+var window *app.Window
+
+// Session panel state, updated from the session events of the current device.
+var (
+	sessionMu        sync.Mutex
+	sessionState     lds.SessionState
+	sessionDevice    *lds.Device
+	sessionCancel    func()
+	showKeysCheckbox widget.Bool
+)
+
+// watchSession follows the session events of the current device, replacing the previous one.
+func watchSession() {
+	if cDevice == sessionDevice {
+		return
+	}
+	if sessionCancel != nil {
+		sessionCancel()
+		sessionCancel = nil
+	}
+	sessionDevice = cDevice
+	if cDevice == nil {
+		return
+	}
+
+	events, cancel := cDevice.Subscribe()
+	sessionCancel = cancel
+	setSessionState(cDevice.State())
+	go func() {
+		for ev := range events {
+			setSessionState(ev.State)
+			if window != nil {
+				window.Invalidate()
+			}
+		}
+	}()
+}
+
+func setSessionState(s lds.SessionState) {
+	sessionMu.Lock()
+	sessionState = s
+	sessionMu.Unlock()
+}
+
+// maskKey shows the first and last bytes of a key only, unless keys are shown.
+func maskKey(key lorawan.AES128Key) string {
+	text := lds.KeyToHex(key)
+	if showKeysCheckbox.Value {
+		return text
+	}
+	return text[:4] + strings.Repeat("*", len(text)-8) + text[len(text)-4:]
+}
+
+// orDefault formats a setting the network server may not have set.
+func orDefault(v int, format string) string {
+	if v < 0 {
+		return "default"
+	}
+	return fmt.Sprintf(format, v)
+}
+
+// sessionLines describes the session state line by line.
+func sessionLines(s lds.SessionState, now time.Time) []string {
+	lines := []string{
+		fmt.Sprintf("DevAddr:          %s (joined %t)", s.DevAddr, s.Joined),
+		fmt.Sprintf("NwkSEncKey:       %s", maskKey(s.NwkSEncKey)),
+		fmt.Sprintf("SNwkSIntKey:      %s", maskKey(s.SNwkSIntKey)),
+		fmt.Sprintf("FNwkSIntKey:      %s", maskKey(s.FNwkSIntKey)),
+		fmt.Sprintf("AppSKey:          %s", maskKey(s.AppSKey)),
+		fmt.Sprintf("FCnt up/down:     %d/%d", s.UlFcnt, s.DlFcnt),
+		fmt.Sprintf("DR / TX power / NbTrans: %s / %s / %s", orDefault(s.DataRate, "DR%d"), orDefault(s.TXPower, "index %d"), orDefault(s.NbTrans, "%d")),
+		fmt.Sprintf("Enabled channels: %s", s.EnabledChannels()),
+	}
+	for _, ch := range s.Channels {
+		if ch.Frequency == 0 {
+			lines = append(lines, fmt.Sprintf("Channel %d:        removed", ch.Index))
+			continue
+		}
+		drs := ""
+		if ch.MinDR >= 0 {
+			drs = fmt.Sprintf(", DR%d-DR%d", ch.MinDR, ch.MaxDR)
+		}
+		lines = append(lines, fmt.Sprintf("Channel %d:        %.3f MHz%s", ch.Index, float64(ch.Frequency)/1000000, drs))
+	}
+
+	rx2Freq := "default"
+	if s.RX2Frequency != 0 {
+		rx2Freq = fmt.Sprintf("%.3f MHz", float64(s.RX2Frequency)/1000000)
+	}
+	lines = append(lines,
+		fmt.Sprintf("RX1:              DR offset %s, delay %s", orDefault(s.RX1DROffset, "%d"), orDefault(s.RXDelay, "%ds")),
+		fmt.Sprintf("RX2:              %s, %s", orDefault(s.RX2DataRate, "DR%d"), rx2Freq),
+	)
+
+	pending := "none"
+	if len(s.PendingAnswers) > 0 {
+		var names []string
+		for _, cid := range s.PendingAnswers {
+			names = append(names, lds.AnswerName(cid))
+		}
+		pending = strings.Join(names, ", ")
+	}
+	lines = append(lines, fmt.Sprintf("Pending answers:  %s", pending))
+
+	if ja := s.JoinAccept; ja != nil {
+		lines = append(lines,
+			fmt.Sprintf("Join-accept:      %s ago, JoinNonce %d, HomeNetID %s, DevAddr %s", now.Sub(s.JoinedAt).Truncate(time.Second), ja.JoinNonce, ja.HomeNetID, ja.DevAddr),
+			fmt.Sprintf("                  OptNeg %t, RX1 DR offset %d, RX2 DR%d, RX delay %d, CFList %t", ja.DLSettings.OptNeg, ja.DLSettings.RX1DROffset, ja.DLSettings.RX2DataRate, ja.RXDelay, ja.CFList != nil),
+		)
+	} else {
+		lines = append(lines, "Join-accept:      none")
+	}
+
+	lastDownlink := "never"
+	if !s.LastDownlink.IsZero() {
+		lastDownlink = fmt.Sprintf("%s ago", now.Sub(s.LastDownlink).Truncate(time.Second))
+	}
+	return append(lines, fmt.Sprintf("Last downlink:    %s", lastDownlink))
+}
+
+func sessionForm(th *material.Theme) l.FlexChild {
+	sessionMu.Lock()
+	s := sessionState
+	sessionMu.Unlock()
+
+	widgets := []l.FlexChild{
+		xmat.RigidSection(th, "Session"),
+		xmat.RigidCheckBox(th, "Show keys", &showKeysCheckbox),
+	}
+	if cDevice == nil {
+		widgets = append(widgets, xmat.RigidLabel(th, "set the device first"))
+	} else {
+		for _, line := range sessionLines(s, time.Now()) {
+			widgets = append(widgets, xmat.RigidLabel(th, line))
+		}
+	}
+
+	inset := l.Inset{Top: unit.Dp(10), Left: unit.Dp(10)}
+	return l.Rigid(func(gtx l.Context) l.Dimensions {
+		//Redraw every second so that elapsed times keep up.
+		op.InvalidateOp{At: gtx.Now.Add(time.Second)}.Add(gtx.Ops)
+		return inset.Layout(gtx, func(gtx l.Context) l.Dimensions {
+			return l.Flex{Axis: l.Vertical}.Layout(gtx, widgets...)
+		})
+	})
+}